@@ -2,9 +2,12 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/jeffgrover/payment-api/internal/api"
+	"github.com/jeffgrover/payment-api/internal/apikeys"
 	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/vault"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -14,6 +17,15 @@ func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
+	// Refuse to start without persistent card vault keys: throwaway keys
+	// would make every stored card unreadable, and every fingerprint
+	// unmatchable, after the next restart
+	keys := os.Getenv("VAULT_KEYS")
+	if keys == "" && os.Getenv("ALLOW_EPHEMERAL_VAULT") != "true" {
+		log.Fatal().Msg("VAULT_KEYS is not set; set it (and VAULT_FINGERPRINT_KEY) to persistent keys, or set ALLOW_EPHEMERAL_VAULT=true to use throwaway keys for local development")
+		os.Exit(1)
+	}
+
 	// Connect to database
 	database, err := db.New("payments.db")
 	if err != nil {
@@ -21,12 +33,76 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Optionally enforce one active customer per email address
+	if err := database.SetUniqueCustomerEmails(os.Getenv("UNIQUE_CUSTOMER_EMAILS") == "true"); err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure unique customer emails")
+		os.Exit(1)
+	}
+
+	// Create test mode keys for the default account on first run so the API
+	// can be called at all
+	account, err := database.DefaultAccount()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to get default account")
+		os.Exit(1)
+	}
+	count, err := database.CountAPIKeys()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to count API keys")
+		os.Exit(1)
+	}
+	if count == 0 {
+		for _, keyType := range []string{apikeys.TypeSecret, apikeys.TypePublishable} {
+			_, secret, err := database.ForAccount(account.ID).CreateAPIKey(keyType, false, nil)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to create API key")
+				os.Exit(1)
+			}
+			log.Warn().Str("account", account.ID).Str("type", keyType).Str("key", secret).Msg("Created API key; store it now, it will not be shown again")
+		}
+	}
+
 	// Create API server
 	apiConfig := api.Config{
 		Title:       "Payments API",
 		Version:     "1.0.0",
 		Description: "A lightweight payment processing API built with Go, Huma, and SQLite, inspired by Stripe and Square but with a more focused feature set.",
 	}
+	if window := os.Getenv("AUTHORIZATION_WINDOW"); window != "" {
+		duration, err := time.ParseDuration(window)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid AUTHORIZATION_WINDOW")
+			os.Exit(1)
+		}
+		apiConfig.AuthorizationWindow = duration
+	}
+	apiConfig.RejectDuplicateCards = os.Getenv("REJECT_DUPLICATE_CARDS") == "true"
+	apiConfig.AdminKey = os.Getenv("ADMIN_API_KEY")
+	apiConfig.SimulateLivePayments = os.Getenv("SIMULATE_LIVE_PAYMENTS") == "true"
+	apiConfig.AllowPrivateWebhookURLs = os.Getenv("ALLOW_PRIVATE_WEBHOOK_URLS") == "true"
+	if keys != "" {
+		keyring, err := vault.ParseKeyring(keys, os.Getenv("VAULT_FINGERPRINT_KEY"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid VAULT_KEYS or VAULT_FINGERPRINT_KEY")
+			os.Exit(1)
+		}
+		cardVault, err := vault.New(database.DB, keyring)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open card vault")
+			os.Exit(1)
+		}
+
+		// Re-encrypt cards under the primary key so old keys can be retired
+		rotated, err := cardVault.Rotate()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to rotate card vault keys")
+			os.Exit(1)
+		}
+		if rotated > 0 {
+			log.Info().Int("count", rotated).Str("key", keyring.Primary()).Msg("Re-encrypted stored cards")
+		}
+		apiConfig.Vault = cardVault
+	}
 	server := api.New(database, apiConfig)
 
 	// Start server
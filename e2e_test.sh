@@ -10,6 +10,7 @@
 
 # Set variables
 API_URL="http://localhost:8080"
+API_KEY="${API_KEY:-}"
 CUSTOMER_ID=""
 PAYMENT_METHOD_ID=""
 PAYMENT_ID=""
@@ -32,31 +33,23 @@ print_header() {
     echo -e "\n${BLUE}==== $1 ====${NC}\n"
 }
 
-# Setup function - reset the database
+# Setup function - check that the server is running and a key is set
 setup() {
-    print_header "Setup - Resetting Database"
-    
-    echo "Stopping the server if it's running..."
-    pkill -f "go run cmd/server/main.go" || true
-    
-    echo "Removing the database file..."
-    rm -f payments.db
-    
-    echo "Starting the server again..."
-    # Run the server in a separate terminal window for better visibility
-    osascript -e 'tell app "Terminal" to do script "cd \"'$(pwd)'\" && ./run.sh server"' > /dev/null 2>&1
-    
-    # Wait for the server to start
-    echo "Waiting for the server to start..."
-    sleep 5
-    
-    # Check if the server is running
+    print_header "Setup - Checking the Server"
+
+    # The server prints its test mode keys once, on first run; the tests use
+    # the secret one, which cannot be recovered by resetting the database
+    if [[ "$API_KEY" != sk_test_* ]]; then
+        echo -e "${RED}Set API_KEY to a sk_test_ key of the server under test${NC}"
+        exit 1
+    fi
+
     response=$(curl -s -o /dev/null -w "%{http_code}" $API_URL/health)
     if [ "$response" == "200" ]; then
         echo -e "${GREEN}Server is running${NC}"
     else
-        echo -e "${RED}Failed to start the server. Response code: $response${NC}"
-        echo -e "${RED}Please start the server manually with './run.sh server' in another terminal and try again.${NC}"
+        echo -e "${RED}Server is not reachable at $API_URL. Response code: $response${NC}"
+        echo -e "${RED}Please start the server with './run.sh server' in another terminal and try again.${NC}"
         exit 1
     fi
 }
@@ -64,10 +57,9 @@ setup() {
 # Teardown function - clean up after the test
 teardown() {
     print_header "Teardown - Cleaning Up"
-    
-    echo "Note: The server is still running in a separate terminal."
-    echo "You can close it manually when you're done."
-    
+
+    echo "Note: The test data is left in the database, under unique email addresses."
+
     echo -e "${GREEN}Cleanup complete${NC}"
 }
 
@@ -78,7 +70,7 @@ create_customer() {
     echo "Sending request to create a customer with email '$TEST_EMAIL' and name '$TEST_NAME'"
     
     # Use -i flag to include headers in the output
-    response_headers=$(curl -i -s -X POST $API_URL/v1/customers \
+    response_headers=$(curl -i -s -X POST -H "Authorization: Bearer $API_KEY" $API_URL/v1/customers \
         -H "Content-Type: application/json" \
         -d "{\"email\":\"$TEST_EMAIL\",\"name\":\"$TEST_NAME\"}")
     
@@ -102,7 +94,7 @@ verify_customer() {
     
     echo "Sending request to get customer with ID: $CUSTOMER_ID"
     
-    response=$(curl -s -X GET $API_URL/v1/customers/$CUSTOMER_ID)
+    response=$(curl -s -X GET -H "Authorization: Bearer $API_KEY" $API_URL/v1/customers/$CUSTOMER_ID)
     
     echo "Response: $response"
     
@@ -117,7 +109,7 @@ verify_customer() {
     # Also test listing customers
     echo -e "\nListing all customers:"
     
-    response=$(curl -s -X GET $API_URL/v1/customers)
+    response=$(curl -s -X GET -H "Authorization: Bearer $API_KEY" $API_URL/v1/customers)
     
     echo "Response: $response"
     
@@ -137,14 +129,14 @@ create_payment_method() {
     echo "Sending request to create a payment method for customer ID: $CUSTOMER_ID"
     
     # Use -i flag to include headers in the output
-    response_headers=$(curl -i -s -X POST $API_URL/v1/payment_methods \
+    response_headers=$(curl -i -s -X POST -H "Authorization: Bearer $API_KEY" $API_URL/v1/payment_methods \
         -H "Content-Type: application/json" \
         -d "{
             \"customer_id\":\"$CUSTOMER_ID\",
             \"type\":\"card\",
             \"card_number\":\"4242424242424242\",
             \"exp_month\":12,
-            \"exp_year\":2025,
+            \"exp_year\":2030,
             \"cvc\":\"123\"
         }")
     
@@ -167,7 +159,7 @@ verify_payment_method() {
     
     echo "Sending request to get payment method with ID: $PAYMENT_METHOD_ID"
     
-    response=$(curl -s -X GET $API_URL/v1/payment_methods/$PAYMENT_METHOD_ID)
+    response=$(curl -s -X GET -H "Authorization: Bearer $API_KEY" $API_URL/v1/payment_methods/$PAYMENT_METHOD_ID)
     
     echo "Response: $response"
     
@@ -187,7 +179,7 @@ create_payment() {
     echo "Sending request to create a payment for customer ID: $CUSTOMER_ID with payment method ID: $PAYMENT_METHOD_ID"
     
     # Use -i flag to include headers in the output
-    response_headers=$(curl -i -s -X POST $API_URL/v1/payments \
+    response_headers=$(curl -i -s -X POST -H "Authorization: Bearer $API_KEY" $API_URL/v1/payments \
         -H "Content-Type: application/json" \
         -d "{
             \"amount\":2000,
@@ -216,7 +208,7 @@ verify_payment() {
     
     echo "Sending request to get payment with ID: $PAYMENT_ID"
     
-    response=$(curl -s -X GET $API_URL/v1/payments/$PAYMENT_ID)
+    response=$(curl -s -X GET -H "Authorization: Bearer $API_KEY" $API_URL/v1/payments/$PAYMENT_ID)
     
     echo "Response: $response"
     
@@ -231,7 +223,7 @@ verify_payment() {
     # Also test listing payments
     echo -e "\nListing all payments:"
     
-    response=$(curl -s -X GET $API_URL/v1/payments)
+    response=$(curl -s -X GET -H "Authorization: Bearer $API_KEY" $API_URL/v1/payments)
     
     echo "Response: $response"
     
@@ -251,7 +243,7 @@ create_refund() {
     echo "Sending request to create a refund for payment ID: $PAYMENT_ID"
     
     # Use -i flag to include headers in the output
-    response_headers=$(curl -i -s -X POST $API_URL/v1/refunds \
+    response_headers=$(curl -i -s -X POST -H "Authorization: Bearer $API_KEY" $API_URL/v1/refunds \
         -H "Content-Type: application/json" \
         -d "{
             \"payment_id\":\"$PAYMENT_ID\",
@@ -278,7 +270,7 @@ verify_refund() {
     
     echo "Sending request to get refund with ID: $REFUND_ID"
     
-    response=$(curl -s -X GET $API_URL/v1/refunds/$REFUND_ID)
+    response=$(curl -s -X GET -H "Authorization: Bearer $API_KEY" $API_URL/v1/refunds/$REFUND_ID)
     
     echo "Response: $response"
     
@@ -293,7 +285,7 @@ verify_refund() {
     # Also test listing refunds
     echo -e "\nListing all refunds:"
     
-    response=$(curl -s -X GET $API_URL/v1/refunds)
+    response=$(curl -s -X GET -H "Authorization: Bearer $API_KEY" $API_URL/v1/refunds)
     
     echo "Response: $response"
     
@@ -325,9 +317,6 @@ run_tests() {
 
 # Run the entire test suite with setup and teardown
 print_header "E2E Test Suite"
-echo -e "This test will reset the database and restart the server."
-echo -e "Press Enter to continue or Ctrl+C to cancel..."
-read
 
 # Run setup, tests, and teardown
 setup
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/apikeys"
+	"github.com/jeffgrover/payment-api/internal/contact"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/ids"
+	"github.com/jeffgrover/payment-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// adminSecurity is the security requirement of the admin API
+var adminSecurity = []map[string][]string{{adminSecurityScheme: {}}}
+
+// CreateAccountParams represents the parameters for creating an account
+type CreateAccountParams struct {
+	Body models.CreateAccountRequest
+}
+
+// CreateAccountAPIKeyParams represents the parameters for creating an API key
+// for an account with the admin key
+type CreateAccountAPIKeyParams struct {
+	ID   string `path:"id" description:"Account ID" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a"`
+	Body models.CreateAPIKeyRequest
+}
+
+// CreatedAccountResponse wraps a newly created account with its HTTP status
+type CreatedAccountResponse struct {
+	Status int
+	Body   *models.CreatedAccount
+}
+
+// registerAccountRoutes registers the admin routes that manage accounts
+func (a *API) registerAccountRoutes() {
+	// Create an account
+	huma.Register(a.API, huma.Operation{
+		OperationID:   "createAccount",
+		Summary:       "Create a new account",
+		Description:   "Creates an account for a merchant along with its first test mode secret and publishable keys. Requires the admin key.",
+		Method:        http.MethodPost,
+		Path:          "/v1/accounts",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"Accounts"},
+		Security:      adminSecurity,
+	}, a.createAccount)
+
+	// List accounts
+	huma.Register(a.API, huma.Operation{
+		OperationID: "listAccounts",
+		Summary:     "List accounts",
+		Description: "Requires the admin key.",
+		Method:      http.MethodGet,
+		Path:        "/v1/accounts",
+		Tags:        []string{"Accounts"},
+		Security:    adminSecurity,
+	}, a.listAccounts)
+
+	// Create an API key for an account
+	huma.Register(a.API, huma.Operation{
+		OperationID:   "createAccountAPIKey",
+		Summary:       "Create a new API key for an account",
+		Description:   "Creates a key of either mode, so this is how an account gets its first live mode key. The key is only returned in the response to this request. Requires the admin key.",
+		Method:        http.MethodPost,
+		Path:          "/v1/accounts/{id}/api_keys",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"Accounts"},
+		Security:      adminSecurity,
+	}, a.createAccountAPIKey)
+}
+
+// createAccount creates a new account and its first API keys
+func (a *API) createAccount(ctx context.Context, params *CreateAccountParams) (*CreatedAccountResponse, error) {
+	req := &params.Body
+	if req.Name == "" {
+		return nil, huma.Error400BadRequest("Name is required")
+	}
+	account := &models.Account{ID: ids.New(ids.Account), Name: req.Name}
+	if req.Email != "" {
+		email, err := contact.NormalizeEmail(req.Email)
+		if err != nil {
+			return nil, contactError(err)
+		}
+		account.Email = email
+	}
+
+	if err := a.DB.CreateAccount(account); err != nil {
+		return nil, huma.Error500InternalServerError("Failed to create account", err)
+	}
+
+	created := &models.CreatedAccount{Account: account}
+	for _, keyType := range []string{apikeys.TypeSecret, apikeys.TypePublishable} {
+		key, secret, err := a.DB.ForAccount(account.ID).CreateAPIKey(keyType, false, nil)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("Failed to create API key", err)
+		}
+		created.APIKeys = append(created.APIKeys, models.CreatedAPIKey{APIKey: key, Secret: secret})
+	}
+
+	return &CreatedAccountResponse{Status: 201, Body: created}, nil
+}
+
+// createAccountAPIKey creates an API key for an account. Unlike createAPIKey
+// it may create live mode keys, since the admin key is not tied to a mode.
+func (a *API) createAccountAPIKey(ctx context.Context, params *CreateAccountAPIKeyParams) (*CreatedAPIKeyResponse, error) {
+	req := &params.Body
+	if err := validateAPIKeyRequest(req); err != nil {
+		return nil, err
+	}
+	account, err := a.DB.GetAccount(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Account not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve account", err)
+	}
+
+	key, secret, err := a.DB.ForAccount(account.ID).CreateAPIKey(req.Type, req.Livemode, req.Permissions)
+	if err != nil {
+		return nil, huma.Error500InternalServerError("Failed to create API key", err)
+	}
+
+	return &CreatedAPIKeyResponse{Status: 201, Body: &models.CreatedAPIKey{APIKey: key, Secret: secret}}, nil
+}
+
+// listAccounts retrieves a list of accounts
+func (a *API) listAccounts(ctx context.Context, params *ListParams) (*ListResponse[models.Account], error) {
+	accounts, err := a.DB.ListAccounts(params.page())
+	if err != nil {
+		return nil, listError("accounts", err)
+	}
+
+	return newListResponse("/v1/accounts", accounts), nil
+}
+
+// accountDB returns the database scoped to the account and mode of the API
+// key that authenticated a request, so that it can only see that account's
+// test or live data
+func (a *API) accountDB(ctx context.Context) *db.DB {
+	if key := apiKeyFromContext(ctx); key != nil {
+		return a.DB.ForAccount(key.AccountID).ForMode(key.Livemode)
+	}
+	return a.DB
+}
+
+// apiKeyDB returns the database scoped to the account of the API key that
+// authenticated a request. API keys of both modes are visible, since a key's
+// mode is part of the key rather than a scope.
+func (a *API) apiKeyDB(ctx context.Context) *db.DB {
+	if key := apiKeyFromContext(ctx); key != nil {
+		return a.DB.ForAccount(key.AccountID)
+	}
+	return a.DB
+}
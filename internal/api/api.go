@@ -3,20 +3,46 @@ package api
 import (
 	"context"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/adapters/humachi"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/processor"
+	"github.com/jeffgrover/payment-api/internal/vault"
+	"github.com/jeffgrover/payment-api/internal/webhooks"
 	"github.com/rs/zerolog/log"
 )
 
+// DefaultAuthorizationWindow is how long an uncaptured authorization is held
+// before it expires when Config.AuthorizationWindow is not set
+const DefaultAuthorizationWindow = 7 * 24 * time.Hour
+
 // API represents the API server
 type API struct {
-	Router *chi.Mux
-	DB     *db.DB
-	API    huma.API
+	Router    *chi.Mux
+	DB        *db.DB
+	API       huma.API
+	Processor processor.Processor
+	Vault     *vault.Vault
+	config    Config
+
+	// simulator processes test mode payments and refunds
+	simulator processor.Processor
+
+	// sender POSTs events to webhook endpoints
+	sender *webhooks.Sender
+
+	// webhookSlots limits how many endpoints are sent to at once
+	webhookSlots chan struct{}
+
+	// delivering holds the endpoints being sent to, which are skipped by
+	// runs of the dispatcher that start in the meantime
+	deliveringMu sync.Mutex
+	delivering   map[string]bool
 }
 
 // Config represents the API configuration
@@ -24,21 +50,75 @@ type Config struct {
 	Title       string
 	Version     string
 	Description string
+
+	// AuthorizationWindow is how long a manual-capture payment can remain
+	// uncaptured before it is canceled automatically
+	AuthorizationWindow time.Duration
+
+	// Processor moves money for live mode payments and refunds. Without one,
+	// live mode payments fail unless SimulateLivePayments is set. Test mode
+	// always uses the simulated gateway.
+	Processor processor.Processor
+
+	// SimulateLivePayments sends live mode payments to the simulated gateway
+	// when no Processor is set, for demos
+	SimulateLivePayments bool
+
+	// Vault stores card numbers encrypted at rest. Defaults to a vault with
+	// randomly generated keys, whose cards are unreadable and fingerprints
+	// unmatchable after a restart; only tests and local development should
+	// rely on that.
+	Vault *vault.Vault
+
+	// RejectDuplicateCards refuses to attach a card to a customer that
+	// already has a payment method with the same fingerprint
+	RejectDuplicateCards bool
+
+	// AdminKey authenticates requests to the admin API that manages
+	// accounts. The admin API is disabled when it is empty.
+	AdminKey string
+
+	// AllowPrivateWebhookURLs lets webhook endpoints point at loopback,
+	// private and link-local addresses, for local development. Otherwise
+	// they are refused so that endpoints cannot reach internal services.
+	AllowPrivateWebhookURLs bool
+}
+
+// Health represents the health check response body
+type Health struct {
+	Message string `json:"message" example:"ok" description:"Status message"`
 }
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status  int    `json:"status" example:"200" description:"HTTP status code"`
-	Message string `json:"message" example:"ok" description:"Status message"`
+	Status int
+	Body   *Health
 }
 
 // New creates a new API server
 func New(database *db.DB, config Config) *API {
+	if config.AuthorizationWindow == 0 {
+		config.AuthorizationWindow = DefaultAuthorizationWindow
+	}
+	if config.Vault == nil {
+		config.Vault = newEphemeralVault(database)
+	}
+	simulator := processor.NewSimulator(config.Vault)
+	if config.Processor == nil {
+		if config.SimulateLivePayments {
+			config.Processor = simulator
+		} else {
+			config.Processor = processor.Unconfigured{}
+		}
+	}
+
 	// Create router with middleware
 	router := chi.NewRouter()
 	router.Use(middleware.Logger)
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.RealIP)
+	router.Use(authenticate(database))
+	router.Use(idempotency(database))
 
 	// Create Huma API
 	humaConfig := huma.DefaultConfig(config.Title, config.Version)
@@ -54,27 +134,70 @@ func New(database *db.DB, config Config) *API {
 		URL:  "https://opensource.org/licenses/MIT",
 	}
 
+	// Every operation requires an API key unless it opts out
+	humaConfig.Components.SecuritySchemes = map[string]*huma.SecurityScheme{
+		securityScheme: {
+			Type:         "http",
+			Scheme:       "bearer",
+			BearerFormat: "API key",
+			Description:  "A secret key (sk_test_... or sk_live_...), a restricted key (rk_test_... or rk_live_...), or a publishable key (pk_test_... or pk_live_...) for creating payment methods",
+		},
+		adminSecurityScheme: {
+			Type:        "http",
+			Scheme:      "bearer",
+			Description: "The admin key set with ADMIN_API_KEY, for managing accounts",
+		},
+	}
+	humaConfig.Security = []map[string][]string{{securityScheme: {}}}
+
 	// Create Huma adapter
 	api := humachi.New(router, humaConfig)
 
 	// Create API server
 	server := &API{
-		Router: router,
-		DB:     database,
-		API:    api,
+		Router:    router,
+		DB:        database,
+		API:       api,
+		Processor: config.Processor,
+		Vault:     config.Vault,
+		config:    config,
+		simulator: simulator,
+		sender:    webhooks.NewSender(config.AllowPrivateWebhookURLs),
+
+		webhookSlots: make(chan struct{}, webhookConcurrency),
+		delivering:   make(map[string]bool),
 	}
 
+	// Check API keys, then reject malformed IDs before they reach the handlers
+	api.UseMiddleware(authorize(api, config.AdminKey))
+	api.UseMiddleware(validateIDs(api))
+
 	// Register routes
 	server.registerRoutes()
 
 	return server
 }
 
+// newEphemeralVault creates a vault with randomly generated keys for when none
+// is configured
+func newEphemeralVault(database *db.DB) *vault.Vault {
+	log.Warn().Msg("!!! NO VAULT KEYS CONFIGURED: using throwaway keys. Every card stored by this process will be unreadable, and its fingerprint unmatchable, after a restart. Never run like this in production. !!!")
+	keys, err := vault.GenerateKeyring()
+	if err == nil {
+		var v *vault.Vault
+		if v, err = vault.New(database.DB, keys); err == nil {
+			return v
+		}
+	}
+	log.Fatal().Err(err).Msg("Failed to create card vault")
+	return nil
+}
+
 // healthCheck is a simple health check handler
 func (a *API) healthCheck(ctx context.Context, input *struct{}) (*HealthResponse, error) {
 	return &HealthResponse{
-		Status:  200,
-		Message: "ok",
+		Status: 200,
+		Body:   &Health{Message: "ok"},
 	}, nil
 }
 
@@ -87,6 +210,7 @@ func (a *API) registerRoutes() {
 		Method:      http.MethodGet,
 		Path:        "/health",
 		Tags:        []string{"System"},
+		Security:    []map[string][]string{{}},
 	}, a.healthCheck)
 
 	// Register customer routes
@@ -100,11 +224,78 @@ func (a *API) registerRoutes() {
 
 	// Register refund routes
 	a.registerRefundRoutes()
+
+	// Register API key routes
+	a.registerAPIKeyRoutes()
+
+	// Register webhook endpoint routes
+	a.registerWebhookRoutes()
+
+	// Register test data routes
+	a.registerTestDataRoutes()
+
+	// Register admin account routes
+	a.registerAccountRoutes()
 }
 
 // Start starts the API server
 func (a *API) Start(addr string) error {
 	log.Info().Str("addr", addr).Msg("Starting API server")
 	log.Info().Str("docs", "http://localhost"+addr+"/docs").Msg("API documentation available at")
+
+	// Cancel expired authorizations in the background
+	go a.expireAuthorizations(time.Minute)
+
+	// Forget idempotency keys once they can no longer be replayed
+	go a.deleteExpiredIdempotencyKeys(time.Hour)
+
+	// Send webhook events and retry failed deliveries
+	go a.dispatchWebhooks(5 * time.Second)
+
 	return http.ListenAndServe(addr, a.Router)
 }
+
+// expireAuthorizations periodically cancels uncaptured payments whose
+// authorization window has passed
+func (a *API) expireAuthorizations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := a.expireDueAuthorizations(time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to expire authorizations")
+			continue
+		}
+		if expired > 0 {
+			log.Info().Int64("count", expired).Msg("Expired uncaptured authorizations")
+		}
+	}
+}
+
+// deleteExpiredIdempotencyKeys periodically removes idempotency keys older
+// than db.IdempotencyKeyTTL
+func (a *API) deleteExpiredIdempotencyKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := a.DB.DeleteExpiredIdempotencyKeys(time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to delete expired idempotency keys")
+			continue
+		}
+		if deleted > 0 {
+			log.Info().Int64("count", deleted).Msg("Deleted expired idempotency keys")
+		}
+	}
+}
+
+// processorFor returns the processor for live or test mode payments. Test
+// mode always uses the simulated gateway so test keys cannot move real money.
+func (a *API) processorFor(livemode bool) processor.Processor {
+	if livemode {
+		return a.Processor
+	}
+	return a.simulator
+}
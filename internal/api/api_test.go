@@ -1,12 +1,27 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/apikeys"
+	"github.com/jeffgrover/payment-api/internal/contact"
 	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/ids"
+	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/jeffgrover/payment-api/internal/processor"
+	"github.com/jeffgrover/payment-api/internal/webhooks"
 )
 
 // Setup test API
@@ -22,6 +37,9 @@ func setupTestAPI(t *testing.T) (*API, func()) {
 		Title:       "Test API",
 		Version:     "1.0.0",
 		Description: "Test API for unit tests",
+
+		// Test webhook receivers listen on the loopback interface
+		AllowPrivateWebhookURLs: true,
 	}
 
 	// Create API
@@ -33,6 +51,33 @@ func setupTestAPI(t *testing.T) (*API, func()) {
 	}
 }
 
+// newTestClient returns an HTTP client that authenticates with a new secret
+// key. The key belongs to no account, like the data handlers create when
+// called directly without one.
+func newTestClient(t *testing.T, api *API, livemode bool) *http.Client {
+	t.Helper()
+
+	_, secret, err := api.DB.CreateAPIKey(apikeys.TypeSecret, livemode, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	return &http.Client{Transport: bearerTransport(secret)}
+}
+
+// keyContext returns a context authenticated with an API key, as requests are
+func keyContext(key *models.APIKey) context.Context {
+	return context.WithValue(context.Background(), authContextKey{}, &authentication{key: key})
+}
+
+// bearerTransport adds an API key to every request it sends
+type bearerTransport string
+
+func (key bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+string(key))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 func TestNew(t *testing.T) {
 	// Create an in-memory database for testing
 	database, err := db.New(":memory:")
@@ -85,8 +130,8 @@ func TestHealthCheck(t *testing.T) {
 	if response.Status != 200 {
 		t.Errorf("Expected status to be 200, got %d", response.Status)
 	}
-	if response.Message != "ok" {
-		t.Errorf("Expected message to be 'ok', got '%s'", response.Message)
+	if response.Body.Message != "ok" {
+		t.Errorf("Expected message to be 'ok', got '%s'", response.Body.Message)
 	}
 }
 
@@ -99,14 +144,2482 @@ func TestStart(t *testing.T) {
 	defer server.Close()
 
 	// Make a request to the health endpoint
-	resp, err := http.Get(server.URL + "/health")
+	var health Health
+	if status := doJSON(t, http.DefaultClient, http.MethodGet, server.URL+"/health", nil, &health); status != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, status)
+	}
+	if health.Message != "ok" {
+		t.Errorf("Expected message to be 'ok', got '%s'", health.Message)
+	}
+}
+
+// doJSON sends a request with a JSON body, if one is given, decodes the JSON
+// response into out and returns the status code
+func doJSON(t *testing.T, client *http.Client, method, url string, body, out any) int {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Failed to encode request body: %v", err)
+		}
+		reader = strings.NewReader(string(b))
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		t.Fatalf("Failed to make request: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// Check the response status
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: failed to decode %d response: %v", method, url, resp.StatusCode, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestListEnvelope(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+
+	// Create a customer to list
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/customers", map[string]string{"email": "test@example.com", "name": "Test User"}, nil); status != http.StatusCreated {
+		t.Fatalf("Failed to create customer: %d", status)
+	}
+
+	// List customers and check the envelope
+	var customers struct {
+		Object  string            `json:"object"`
+		Data    []models.Customer `json:"data"`
+		HasMore *bool             `json:"has_more"`
+		URL     string            `json:"url"`
+	}
+	if status := doJSON(t, client, http.MethodGet, server.URL+"/v1/customers?limit=10", nil, &customers); status != http.StatusOK {
+		t.Fatalf("Failed to list customers: %d", status)
+	}
+	if customers.Object != "list" {
+		t.Errorf("Expected object to be 'list', got '%s'", customers.Object)
+	}
+	if customers.URL != "/v1/customers" {
+		t.Errorf("Expected url to be '/v1/customers', got '%s'", customers.URL)
+	}
+	if len(customers.Data) != 1 || customers.HasMore == nil || *customers.HasMore {
+		t.Errorf("Expected 1 customer and no more, got %d (has_more=%v)", len(customers.Data), customers.HasMore)
+	}
+	if customers.Data[0].Email != "test@example.com" {
+		t.Errorf("Expected the created customer, got %+v", customers.Data[0])
+	}
+
+	// Empty lists should serialize as an empty array rather than null
+	var refunds map[string]json.RawMessage
+	if status := doJSON(t, client, http.MethodGet, server.URL+"/v1/refunds", nil, &refunds); status != http.StatusOK {
+		t.Fatalf("Failed to list refunds: %d", status)
+	}
+	if string(refunds["data"]) != "[]" {
+		t.Errorf("Expected empty refund list, got %s", refunds["data"])
+	}
+
+	// Malformed cursors are rejected
+	if status := doJSON(t, client, http.MethodGet, server.URL+"/v1/payments?starting_after=bogus", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for malformed cursor, got %d", status)
+	}
+}
+
+// TestJSONBodies checks that requests and responses go through the JSON
+// bodies rather than only the handlers
+func TestJSONBodies(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+
+	var customer models.Customer
+	status := doJSON(t, client, http.MethodPost, server.URL+"/v1/customers", map[string]any{
+		"email":    "Jane@Example.com",
+		"name":     "Jane Doe",
+		"metadata": map[string]string{"order_id": "123"},
+	}, &customer)
+	if status != http.StatusCreated || !strings.HasPrefix(customer.ID, "cus_") || customer.Email != "jane@example.com" || customer.Metadata["order_id"] != "123" {
+		t.Fatalf("Expected 201 with the created customer, got %d %+v", status, customer)
+	}
+
+	// Missing required fields are rejected before reaching the handler
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/customers", map[string]string{"name": "No Email"}, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a customer without an email, got %d", status)
+	}
+
+	var method models.PaymentMethod
+	status = doJSON(t, client, http.MethodPost, server.URL+"/v1/payment_methods", map[string]any{
+		"customer_id":     customer.ID,
+		"type":            "card",
+		"card_number":     "4242424242424242",
+		"exp_month":       12,
+		"exp_year":        time.Now().Year() + 1,
+		"billing_details": map[string]string{"name": "Jane Doe"},
+	}, &method)
+	if status != http.StatusCreated || method.Last4 != "4242" || method.BillingDetails.Name != "Jane Doe" {
+		t.Fatalf("Expected 201 with the created payment method, got %d %+v", status, method)
+	}
+
+	var payment models.Payment
+	status = doJSON(t, client, http.MethodPost, server.URL+"/v1/payments", map[string]any{
+		"amount":            2000,
+		"currency":          "usd",
+		"customer_id":       customer.ID,
+		"payment_method_id": method.ID,
+	}, &payment)
+	if status != http.StatusCreated || payment.Amount != 2000 || payment.Status != models.PaymentStatusSucceeded {
+		t.Fatalf("Expected 201 with a succeeded payment, got %d %+v", status, payment)
+	}
+
+	var refund models.Refund
+	status = doJSON(t, client, http.MethodPost, server.URL+"/v1/refunds", map[string]any{"payment_id": payment.ID, "amount": 500}, &refund)
+	if status != http.StatusCreated || refund.Amount != 500 || refund.PaymentID != payment.ID {
+		t.Fatalf("Expected 201 with the created refund, got %d %+v", status, refund)
+	}
+
+	// Retrieved payments embed their refunds
+	var retrieved struct {
+		models.Payment
+		Refunds struct {
+			Data []models.Refund `json:"data"`
+		} `json:"refunds"`
+	}
+	if status := doJSON(t, client, http.MethodGet, server.URL+"/v1/payments/"+payment.ID, nil, &retrieved); status != http.StatusOK {
+		t.Fatalf("Failed to get payment: %d", status)
+	}
+	if retrieved.AmountRefunded != 500 || len(retrieved.Refunds.Data) != 1 || retrieved.Refunds.Data[0].ID != refund.ID {
+		t.Errorf("Expected the payment with its refund, got %+v", retrieved)
+	}
+
+	var deleted models.DeletedCustomer
+	if status := doJSON(t, client, http.MethodDelete, server.URL+"/v1/customers/"+customer.ID, nil, &deleted); status != http.StatusOK || !deleted.Deleted || deleted.ID != customer.ID {
+		t.Errorf("Expected the customer deleted, got %d %+v", status, deleted)
+	}
+}
+
+// createTestPaymentMethod creates a customer with a card payment method and returns both IDs
+func createTestPaymentMethod(t *testing.T, api *API) (string, string) {
+	t.Helper()
+
+	customer, err := api.createCustomer(context.Background(), &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "test@example.com", Name: "Test User"}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	method, err := api.createPaymentMethod(context.Background(), &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{
+		CustomerID: customer.Body.ID,
+		Type:       "card",
+		CardNumber: "4242424242424242",
+		ExpMonth:   12,
+		ExpYear:    time.Now().Year() + 1,
+		Cvc:        "123",
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+	return customer.Body.ID, method.Body.ID
+}
+
+func TestManualCapture(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	// Create an authorization hold
+	payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{
+		Amount:          2000,
+		Currency:        "usd",
+		CustomerID:      customerID,
+		PaymentMethodID: methodID,
+		CaptureMethod:   models.CaptureMethodManual,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if payment.Body.Status != models.PaymentStatusRequiresCapture {
+		t.Fatalf("Expected status to be 'requires_capture', got '%s'", payment.Body.Status)
+	}
+	if payment.Body.CaptureBefore == nil || payment.Body.AmountCaptured != 0 {
+		t.Errorf("Expected an uncaptured authorization with capture_before set")
+	}
+
+	// Capturing more than was authorized fails
+	_, err = api.capturePayment(context.Background(), &CapturePaymentParams{ID: payment.Body.ID, Body: &models.CapturePaymentRequest{AmountToCapture: 2500}})
+	if err == nil {
+		t.Error("Expected error when capturing more than the authorized amount")
+	}
+
+	// Capture part of the authorization
+	captured, err := api.capturePayment(context.Background(), &CapturePaymentParams{ID: payment.Body.ID, Body: &models.CapturePaymentRequest{AmountToCapture: 1500}})
+	if err != nil {
+		t.Fatalf("Failed to capture payment: %v", err)
+	}
+	if captured.Body.Status != models.PaymentStatusSucceeded || captured.Body.AmountCaptured != 1500 {
+		t.Errorf("Expected succeeded payment with 1500 captured, got '%s' with %d", captured.Body.Status, captured.Body.AmountCaptured)
+	}
+
+	// A captured payment cannot be captured again
+	if _, err := api.capturePayment(context.Background(), &CapturePaymentParams{ID: payment.Body.ID}); err == nil {
+		t.Error("Expected error when capturing an already captured payment")
+	}
+
+	// The authorization and capture are both recorded in the history
+	history, err := api.getPaymentHistory(context.Background(), &PaymentParams{ID: payment.Body.ID})
+	if err != nil {
+		t.Fatalf("Failed to get payment history: %v", err)
+	}
+	if len(history.Body.Data) != 2 || history.Body.Data[1].ToStatus != models.PaymentStatusSucceeded {
+		t.Errorf("Expected 2 transitions ending in 'succeeded', got %+v", history.Body.Data)
+	}
+}
+
+func TestCancelPayment(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	// Cancel an uncaptured authorization
+	payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{
+		Amount:          2000,
+		Currency:        "usd",
+		CustomerID:      customerID,
+		PaymentMethodID: methodID,
+		CaptureMethod:   models.CaptureMethodManual,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	canceled, err := api.cancelPayment(context.Background(), &CancelPaymentParams{
+		ID:   payment.Body.ID,
+		Body: &models.CancelPaymentRequest{CancellationReason: models.CancellationReasonRequestedByCustomer},
+	})
+	if err != nil {
+		t.Fatalf("Failed to cancel payment: %v", err)
+	}
+	if canceled.Body.Status != models.PaymentStatusCanceled {
+		t.Errorf("Expected status to be 'canceled', got '%s'", canceled.Body.Status)
+	}
+	if canceled.Body.CanceledAt == nil || canceled.Body.CancellationReason != models.CancellationReasonRequestedByCustomer {
+		t.Errorf("Expected canceled_at and cancellation_reason to be set")
+	}
+
+	// Succeeded payments cannot be canceled
+	payment, err = api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{
+		Amount:          2000,
+		Currency:        "usd",
+		CustomerID:      customerID,
+		PaymentMethodID: methodID,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	_, err = api.cancelPayment(context.Background(), &CancelPaymentParams{ID: payment.Body.ID})
+	var coded *CodedError
+	if !errors.As(err, &coded) || coded.Code != CodePaymentAlreadySucceeded {
+		t.Errorf("Expected '%s' error, got %v", CodePaymentAlreadySucceeded, err)
+	}
+}
+
+// voidingProcessor is a simulated gateway that records the authorizations it
+// is asked to void, and fails to void them while unavailable is set
+type voidingProcessor struct {
+	*processor.Simulator
+	voids       []string
+	unavailable bool
+}
+
+func (p *voidingProcessor) Void(ctx context.Context, reference string) error {
+	if p.unavailable {
+		return errors.New("gateway unavailable")
+	}
+	p.voids = append(p.voids, reference)
+	return p.Simulator.Void(ctx, reference)
+}
+
+func TestCaptureExpiredAuthorization(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	customerID, methodID := createTestPaymentMethod(t, api)
+	gateway := &voidingProcessor{Simulator: processor.NewSimulator(api.Vault)}
+	api.simulator = gateway
+
+	// Two authorizations whose window has passed
+	var payments []*models.Payment
+	for range 2 {
+		payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{
+			Amount: 2000, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID, CaptureMethod: models.CaptureMethodManual,
+		}})
+		if err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+		payments = append(payments, payment.Body.Payment)
+	}
+	if err := api.DB.Model(&models.Payment{}).Where("id IN ?", []string{payments[0].ID, payments[1].ID}).Update("capture_before", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatalf("Failed to backdate authorizations: %v", err)
+	}
+	checkStatuses := func(want ...string) {
+		t.Helper()
+		for i := range payments {
+			payment, err := api.DB.GetPayment(payments[i].ID)
+			if err != nil {
+				t.Fatalf("Failed to get payment: %v", err)
+			}
+			if payment.Status != want[i] {
+				t.Errorf("Payment %d: expected status '%s', got '%s'", i, want[i], payment.Status)
+			}
+		}
+	}
+
+	// Capturing one voids and expires it but leaves the other to the background job
+	_, err := api.capturePayment(context.Background(), &CapturePaymentParams{ID: payments[0].ID})
+	var coded *CodedError
+	if !errors.As(err, &coded) || coded.Code != CodeAuthorizationExpired {
+		t.Fatalf("Expected '%s' error, got %v", CodeAuthorizationExpired, err)
+	}
+	checkStatuses(models.PaymentStatusCanceled, models.PaymentStatusRequiresCapture)
+	if len(gateway.voids) != 1 || gateway.voids[0] != payments[0].ProcessorReference {
+		t.Errorf("Expected the first authorization to be voided, got %v", gateway.voids)
+	}
+
+	// The background job leaves authorizations it cannot void for its next run
+	gateway.unavailable = true
+	expired, err := api.expireDueAuthorizations(time.Now())
+	if err != nil || expired != 0 {
+		t.Fatalf("Expected nothing expired while the gateway is unavailable, got %d, %v", expired, err)
+	}
+	checkStatuses(models.PaymentStatusCanceled, models.PaymentStatusRequiresCapture)
+
+	gateway.unavailable = false
+	expired, err = api.expireDueAuthorizations(time.Now())
+	if err != nil || expired != 1 {
+		t.Fatalf("Expected 1 expired authorization, got %d, %v", expired, err)
+	}
+	checkStatuses(models.PaymentStatusCanceled, models.PaymentStatusCanceled)
+	if len(gateway.voids) != 2 || gateway.voids[1] != payments[1].ProcessorReference {
+		t.Errorf("Expected the second authorization to be voided, got %v", gateway.voids)
+	}
+}
+
+// cancelingProcessor is a simulated gateway that cancels a payment in the
+// database while capturing it, as a concurrent request would, and counts the
+// refunds it is asked for
+type cancelingProcessor struct {
+	*processor.Simulator
+	db      *db.DB
+	payment string
+	refunds []int64
+}
+
+func (p *cancelingProcessor) Capture(ctx context.Context, reference string, amount int64) (*processor.Result, error) {
+	payment, err := p.db.GetPayment(p.payment)
+	if err != nil {
+		return nil, err
+	}
+	payment.Status = models.PaymentStatusCanceled
+	if err := p.db.UpdatePayment(payment, models.ActorAPI); err != nil {
+		return nil, err
+	}
+	return p.Simulator.Capture(ctx, reference, amount)
+}
+
+func (p *cancelingProcessor) Refund(ctx context.Context, reference string, amount int64) (*processor.Result, error) {
+	p.refunds = append(p.refunds, amount)
+	return p.Simulator.Refund(ctx, reference, amount)
+}
+
+func TestCaptureCanceledConcurrently(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{
+		Amount: 2000, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID, CaptureMethod: models.CaptureMethodManual,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	gateway := &cancelingProcessor{Simulator: processor.NewSimulator(api.Vault), db: api.DB, payment: payment.Body.ID}
+	api.simulator = gateway
+
+	// The capture loses the race, so the captured money is given back
+	_, err = api.capturePayment(context.Background(), &CapturePaymentParams{ID: payment.Body.ID, Body: &models.CapturePaymentRequest{AmountToCapture: 1500}})
+	var coded *CodedError
+	if !errors.As(err, &coded) || coded.Code != CodePaymentUnexpectedState {
+		t.Fatalf("Expected '%s' error, got %v", CodePaymentUnexpectedState, err)
+	}
+	if len(gateway.refunds) != 1 || gateway.refunds[0] != 1500 {
+		t.Errorf("Expected the 1500 captured to be refunded, got %v", gateway.refunds)
+	}
+	stored, err := api.DB.GetPayment(payment.Body.ID)
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if stored.Status != models.PaymentStatusCanceled || stored.AmountCaptured != 0 {
+		t.Errorf("Expected the payment to stay canceled, got '%s' with %d captured", stored.Status, stored.AmountCaptured)
+	}
+}
+
+func TestPaymentAmountValidation(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	for _, amount := range []int64{0, -2000} {
+		req := models.CreatePaymentRequest{Amount: amount, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID}
+		if _, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: req}); err == nil {
+			t.Errorf("Expected error for amount %d", amount)
+		}
+		if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/payments", req, nil); status != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for amount %d, got %d", amount, status)
+		}
+	}
+}
+
+func TestRefundAmountValidation(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	var payment models.Payment
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/payments", map[string]any{
+		"amount": 2000, "currency": "usd", "customer_id": customerID, "payment_method_id": methodID,
+	}, &payment); status != http.StatusCreated {
+		t.Fatalf("Failed to create payment: %d", status)
+	}
+
+	for _, amount := range []int64{0, -2000} {
+		req := models.CreateRefundRequest{PaymentID: payment.ID, Amount: amount}
+		if _, err := api.createRefund(context.Background(), &CreateRefundParams{Body: req}); err == nil {
+			t.Errorf("Expected error for amount %d", amount)
+		}
+		if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/refunds", req, nil); status != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for amount %d, got %d", amount, status)
+		}
+	}
+
+	// The rejected refunds must not have freed up balance for a larger one
+	status := doJSON(t, client, http.MethodPost, server.URL+"/v1/refunds", models.CreateRefundRequest{PaymentID: payment.ID, Amount: 4000}, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for refund larger than the payment, got %d", status)
+	}
+
+	// The refundable amount reported leaves out pending refunds too
+	if err := api.DB.CreateRefund(&models.Refund{ID: ids.New(ids.Refund), PaymentID: payment.ID, Amount: 500}); err != nil {
+		t.Fatalf("Failed to create pending refund: %v", err)
+	}
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/refunds", models.CreateRefundRequest{PaymentID: payment.ID, Amount: 1000}, nil); status != http.StatusCreated {
+		t.Fatalf("Expected 201 for a refund within the balance, got %d", status)
+	}
+	var exceeded CodedError
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/refunds", models.CreateRefundRequest{PaymentID: payment.ID, Amount: 1000}, &exceeded); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a refund over the balance, got %d", status)
+	}
+	if exceeded.Code != CodeRefundExceedsBalance || !strings.HasSuffix(exceeded.Detail, "amount of 500") {
+		t.Errorf("Expected the 500 not reserved to be reported, got %s %q", exceeded.Code, exceeded.Detail)
+	}
+}
+
+// unsavableRefundProcessor is a simulated gateway that fails refunds in the
+// database while processing them, so that their outcome cannot be saved
+type unsavableRefundProcessor struct {
+	*processor.Simulator
+	db      *db.DB
+	refunds int
+}
+
+func (p *unsavableRefundProcessor) Refund(ctx context.Context, reference string, amount int64) (*processor.Result, error) {
+	p.refunds++
+	if err := p.db.Model(&models.Refund{}).Where("status = ?", models.RefundStatusPending).Update("status", models.RefundStatusFailed).Error; err != nil {
+		return nil, err
+	}
+	return p.Simulator.Refund(ctx, reference, amount)
+}
+
+func TestRefundSaveFailure(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 2000, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	gateway := &unsavableRefundProcessor{Simulator: processor.NewSimulator(api.Vault), db: api.DB}
+	api.simulator = gateway
+
+	// The money has moved, so the refund is returned as pending rather than
+	// as an error that would invite a second refund
+	refund, err := api.createRefund(context.Background(), &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 500}})
+	if err != nil {
+		t.Fatalf("Expected the processed refund to be returned, got %v", err)
+	}
+	if refund.Status != http.StatusAccepted || refund.Body.Status != models.RefundStatusPending {
+		t.Errorf("Expected 202 with a pending refund, got %d '%s'", refund.Status, refund.Body.Status)
+	}
+	if gateway.refunds != 1 {
+		t.Errorf("Expected the refund to be processed once, got %d", gateway.refunds)
+	}
+}
+
+// TestActionBodies checks that capture, cancel and update requests read
+// their JSON bodies
+func TestActionBodies(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	authorize := func() models.Payment {
+		t.Helper()
+		var payment models.Payment
+		if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/payments", map[string]any{
+			"amount": 2000, "currency": "usd", "customer_id": customerID, "payment_method_id": methodID, "capture_method": "manual",
+		}, &payment); status != http.StatusCreated {
+			t.Fatalf("Failed to create payment: %d", status)
+		}
+		return payment
+	}
+
+	// Partial capture
+	payment := authorize()
+	var captured models.Payment
+	status := doJSON(t, client, http.MethodPost, server.URL+"/v1/payments/"+payment.ID+"/capture", map[string]any{"amount_to_capture": 1500}, &captured)
+	if status != http.StatusOK || captured.AmountCaptured != 1500 {
+		t.Errorf("Expected 1500 captured, got %d %+v", status, captured)
+	}
+
+	// Capturing without a body captures the full amount
+	payment = authorize()
+	status = doJSON(t, client, http.MethodPost, server.URL+"/v1/payments/"+payment.ID+"/capture", nil, &captured)
+	if status != http.StatusOK || captured.AmountCaptured != 2000 {
+		t.Errorf("Expected 2000 captured, got %d %+v", status, captured)
+	}
+
+	// Cancellation with a reason
+	payment = authorize()
+	var canceled models.Payment
+	status = doJSON(t, client, http.MethodPost, server.URL+"/v1/payments/"+payment.ID+"/cancel", map[string]any{"cancellation_reason": "duplicate"}, &canceled)
+	if status != http.StatusOK || canceled.CancellationReason != models.CancellationReasonDuplicate {
+		t.Errorf("Expected a payment canceled as a duplicate, got %d %+v", status, canceled)
+	}
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/payments/"+authorize().ID+"/cancel", map[string]any{"cancellation_reason": "bored"}, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown cancellation reason, got %d", status)
+	}
+
+	// Updates
+	var customer models.Customer
+	status = doJSON(t, client, http.MethodPatch, server.URL+"/v1/customers/"+customerID, map[string]any{"name": "Jane Roe"}, &customer)
+	if status != http.StatusOK || customer.Name != "Jane Roe" || customer.Email != "test@example.com" {
+		t.Errorf("Expected the customer renamed, got %d %+v", status, customer)
+	}
+	var updated models.Payment
+	status = doJSON(t, client, http.MethodPatch, server.URL+"/v1/payments/"+payment.ID, map[string]any{"description": "Order #1"}, &updated)
+	if status != http.StatusOK || updated.Description != "Order #1" {
+		t.Errorf("Expected the payment described, got %d %+v", status, updated)
+	}
+	var method models.PaymentMethod
+	status = doJSON(t, client, http.MethodPatch, server.URL+"/v1/payment_methods/"+methodID, map[string]any{"exp_month": 6}, &method)
+	if status != http.StatusOK || method.ExpMonth != 6 {
+		t.Errorf("Expected the expiry month changed, got %d %+v", status, method)
+	}
+	var refund models.Refund
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/refunds", map[string]any{"payment_id": captured.ID, "amount": 100}, &refund); status != http.StatusCreated {
+		t.Fatalf("Failed to create refund: %d", status)
+	}
+	status = doJSON(t, client, http.MethodPatch, server.URL+"/v1/refunds/"+refund.ID, map[string]any{"metadata": map[string]string{"ticket": "T-1"}}, &refund)
+	if status != http.StatusOK || refund.Metadata["ticket"] != "T-1" {
+		t.Errorf("Expected the refund's metadata set, got %d %+v", status, refund)
+	}
+}
+
+func TestDeclinedPayment(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	customerID, _ := createTestPaymentMethod(t, api)
+
+	// Add a card the simulator declines for insufficient funds
+	method, err := api.createPaymentMethod(context.Background(), &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{
+		CustomerID: customerID,
+		Type:       "card",
+		CardNumber: "4000000000009995",
+		ExpMonth:   12,
+		ExpYear:    time.Now().Year() + 1,
+		Cvc:        "123",
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+
+	// The payment is rejected with the decline code
+	_, err = api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{
+		Amount:          2000,
+		Currency:        "usd",
+		CustomerID:      customerID,
+		PaymentMethodID: method.Body.ID,
+	}})
+	var coded *CodedError
+	if !errors.As(err, &coded) {
+		t.Fatalf("Expected CodedError, got %v", err)
+	}
+	if coded.Status != http.StatusPaymentRequired || coded.Code != "insufficient_funds" {
+		t.Errorf("Expected 402 'insufficient_funds', got %d '%s'", coded.Status, coded.Code)
+	}
+
+	// The failed payment is still recorded
+	payment, err := api.DB.GetPayment(coded.PaymentID)
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if payment.Status != models.PaymentStatusFailed || payment.FailureCode != "insufficient_funds" {
+		t.Errorf("Expected failed payment with 'insufficient_funds', got '%s' with '%s'", payment.Status, payment.FailureCode)
+	}
+}
+
+func TestCumulativeRefunds(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{
+		Amount:          2000,
+		Currency:        "usd",
+		CustomerID:      customerID,
+		PaymentMethodID: methodID,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	// A partial refund leaves the payment partially refunded
+	if _, err := api.createRefund(context.Background(), &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 1500}}); err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+	retrieved, err := api.DB.GetPayment(payment.Body.ID)
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if retrieved.Status != models.PaymentStatusPartiallyRefunded || retrieved.AmountRefunded != 1500 || retrieved.Refunded {
+		t.Errorf("Expected partially refunded payment with 1500 refunded, got '%s' with %d", retrieved.Status, retrieved.AmountRefunded)
+	}
+
+	// Refunds beyond the remaining balance are rejected
+	_, err = api.createRefund(context.Background(), &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 600}})
+	var coded *CodedError
+	if !errors.As(err, &coded) || coded.Code != CodeRefundExceedsBalance {
+		t.Errorf("Expected '%s' error, got %v", CodeRefundExceedsBalance, err)
+	}
+
+	// Refunding the remainder fully refunds the payment
+	if _, err := api.createRefund(context.Background(), &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 500}}); err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+	retrieved, err = api.DB.GetPayment(payment.Body.ID)
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if retrieved.Status != models.PaymentStatusRefunded || retrieved.AmountRefunded != 2000 || !retrieved.Refunded {
+		t.Errorf("Expected refunded payment with 2000 refunded, got '%s' with %d", retrieved.Status, retrieved.AmountRefunded)
+	}
+
+	// Fully refunded payments cannot be refunded again
+	if _, err := api.createRefund(context.Background(), &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 1}}); err == nil {
+		t.Error("Expected error when refunding a fully refunded payment")
+	}
+	// Retrieving the payment includes its refunds
+	response, err := api.getPayment(context.Background(), &PaymentParams{ID: payment.Body.ID})
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if response.Body.Refunds == nil || len(response.Body.Refunds.Data) != 2 {
+		t.Fatalf("Expected 2 embedded refunds, got %+v", response.Body.Refunds)
+	}
+	if response.Body.Refunds.URL != "/v1/refunds?payment_id="+payment.Body.ID {
+		t.Errorf("Expected refunds url to filter by payment, got %s", response.Body.Refunds.URL)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+
+	// Cancel an authorization, which only succeeds the first time it runs
+	customerID, methodID := createTestPaymentMethod(t, api)
+	payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID, CaptureMethod: models.CaptureMethodManual}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	post := func(key, body string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/payments/"+payment.Body.ID+"/cancel", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, key)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return resp, respBody
+	}
+
+	// The first request is processed
+	first, firstBody := post("key-1", `{"cancellation_reason":"duplicate"}`)
+	if first.StatusCode >= 300 {
+		t.Fatalf("Expected success, got %d", first.StatusCode)
+	}
+	var canceled models.Payment
+	if err := json.Unmarshal(firstBody, &canceled); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if canceled.Status != models.PaymentStatusCanceled || canceled.CancellationReason != "duplicate" {
+		t.Errorf("Expected payment canceled as duplicate, got '%s' '%s'", canceled.Status, canceled.CancellationReason)
+	}
+	if first.Header.Get(IdempotentReplayedHeader) != "" {
+		t.Error("Expected first response not to be a replay")
+	}
+
+	// An identical retry replays the stored response without canceling again
+	retry, retryBody := post("key-1", `{"cancellation_reason":"duplicate"}`)
+	if retry.StatusCode != first.StatusCode {
+		t.Errorf("Expected replayed status %d, got %d", first.StatusCode, retry.StatusCode)
+	}
+	if !bytes.Equal(retryBody, firstBody) {
+		t.Errorf("Expected replayed body %s, got %s", firstBody, retryBody)
+	}
+	if retry.Header.Get(IdempotentReplayedHeader) != "true" {
+		t.Error("Expected retry to be a replay")
+	}
+	history, err := api.DB.GetPaymentHistory(payment.Body.ID)
+	if err != nil {
+		t.Fatalf("Failed to get payment history: %v", err)
+	}
+	if len(history) != 2 {
+		t.Errorf("Expected 2 status transitions, got %d", len(history))
+	}
+
+	// Reusing the key for a different request is a conflict
+	if resp, _ := post("key-1", `{"cancellation_reason":"abandoned"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status %d for reused key, got %d", http.StatusConflict, resp.StatusCode)
+	}
+
+	// Bodies too large to fingerprint are rejected rather than truncated
+	large := `{"cancellation_reason":"` + strings.Repeat("x", maxIdempotentBodySize) + `"}`
+	if resp, _ := post("key-3", large); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for oversized body, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+
+	// A duplicate of a request still in flight is a conflict
+	if _, err := api.DB.BeginIdempotentRequest("key-2", "fingerprint", time.Now()); err != nil {
+		t.Fatalf("Failed to begin idempotent request: %v", err)
+	}
+	if _, err := api.DB.BeginIdempotentRequest("key-2", "fingerprint", time.Now()); err != db.ErrIdempotencyKeyInProgress {
+		t.Errorf("Expected ErrIdempotencyKeyInProgress, got %v", err)
+	}
+
+	// A request the API key may not make does not use up the key for the
+	// account's other keys
+	_, publishable, err := api.DB.CreateAPIKey(apikeys.TypePublishable, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	createCustomer := func(client *http.Client) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/customers", strings.NewReader(`{"email":"jane@example.com","name":"Jane"}`))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, "key-4")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := createCustomer(&http.Client{Transport: bearerTransport(publishable)}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status %d for a publishable key, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if resp := createCustomer(client); resp.StatusCode != http.StatusCreated || resp.Header.Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("Expected the secret key's request to be processed, got %d replayed %q", resp.StatusCode, resp.Header.Get(IdempotentReplayedHeader))
+	}
+
+	// Expired keys are forgotten
+	deleted, err := api.DB.DeleteExpiredIdempotencyKeys(time.Now().Add(db.IdempotencyKeyTTL + time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to delete expired keys: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("Expected 3 expired keys, got %d", deleted)
+	}
+}
+
+func TestCreatePaymentMethodValidation(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	customer, err := api.createCustomer(context.Background(), &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "test@example.com", Name: "Test User"}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+
+	// Amex cards have 15 digits and a 4-digit security code
+	method, err := api.createPaymentMethod(context.Background(), &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{
+		CustomerID: customer.Body.ID,
+		Type:       "card",
+		CardNumber: "378282246310005",
+		ExpMonth:   12,
+		ExpYear:    time.Now().Year() + 1,
+		Cvc:        "1234",
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create amex payment method: %v", err)
+	}
+	if method.Body.Brand != "amex" || method.Body.Funding != "credit" || method.Body.Last4 != "0005" {
+		t.Errorf("Expected amex credit card ending 0005, got %s %s card ending %s", method.Body.Brand, method.Body.Funding, method.Body.Last4)
+	}
+
+	// Invalid cards are rejected with a machine-readable code
+	tests := []struct {
+		name string
+		req  models.CreatePaymentMethodRequest
+		code string
+	}{
+		{"bad checksum", models.CreatePaymentMethodRequest{CardNumber: "4242424242424241", ExpMonth: 12, ExpYear: time.Now().Year() + 1}, "invalid_number"},
+		{"expired", models.CreatePaymentMethodRequest{CardNumber: "4242424242424242", ExpMonth: 12, ExpYear: time.Now().Year() - 1}, "expired_card"},
+		{"wrong cvc length", models.CreatePaymentMethodRequest{CardNumber: "4242424242424242", ExpMonth: 12, ExpYear: time.Now().Year() + 1, Cvc: "1234"}, "invalid_cvc"},
+	}
+	for _, tt := range tests {
+		tt.req.CustomerID = customer.Body.ID
+		tt.req.Type = "card"
+		_, err := api.createPaymentMethod(context.Background(), &CreatePaymentMethodParams{Body: tt.req})
+		var coded *CodedError
+		if !errors.As(err, &coded) {
+			t.Errorf("%s: expected coded error, got %v", tt.name, err)
+			continue
+		}
+		if coded.Status != http.StatusBadRequest || coded.Code != tt.code {
+			t.Errorf("%s: expected 400 %s, got %d %s", tt.name, tt.code, coded.Status, coded.Code)
+		}
+	}
+}
+
+func TestCreateBankAccountPaymentMethod(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	customer, err := api.createCustomer(context.Background(), &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "test@example.com", Name: "Test User"}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+
+	// Bank accounts store the last 4 digits, bank name and routing number
+	method, err := api.createPaymentMethod(context.Background(), &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{
+		CustomerID:        customer.Body.ID,
+		Type:              "bank_account",
+		RoutingNumber:     "110000000",
+		AccountNumber:     "000123456789",
+		AccountHolderType: "company",
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create bank account: %v", err)
+	}
+	if method.Body.Last4 != "6789" || method.Body.BankName != "STRIPE TEST BANK" || method.Body.RoutingNumber != "110000000" {
+		t.Errorf("Unexpected bank account details: %+v", method.Body)
+	}
+	if method.Body.AccountHolderType != "company" || method.Body.AccountType != "checking" {
+		t.Errorf("Expected company checking account, got %s %s", method.Body.AccountHolderType, method.Body.AccountType)
+	}
+
+	// Bank accounts can be charged
+	payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{
+		Amount:          1000,
+		Currency:        "usd",
+		CustomerID:      customer.Body.ID,
+		PaymentMethodID: method.Body.ID,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if payment.Body.Status != models.PaymentStatusSucceeded {
+		t.Errorf("Expected payment to succeed, got %s", payment.Body.Status)
+	}
+
+	// Incomplete inputs are rejected instead of crashing
+	tests := []struct {
+		name string
+		req  models.CreatePaymentMethodRequest
+		code string
+	}{
+		{"card without number", models.CreatePaymentMethodRequest{Type: "card"}, "invalid_number"},
+		{"bank account without details", models.CreatePaymentMethodRequest{Type: "bank_account"}, "routing_number_invalid"},
+		{"bad routing checksum", models.CreatePaymentMethodRequest{Type: "bank_account", RoutingNumber: "110000001", AccountNumber: "000123456789"}, "routing_number_invalid"},
+		{"bank account without account number", models.CreatePaymentMethodRequest{Type: "bank_account", RoutingNumber: "110000000"}, "account_number_invalid"},
+	}
+	for _, tt := range tests {
+		tt.req.CustomerID = customer.Body.ID
+		_, err := api.createPaymentMethod(context.Background(), &CreatePaymentMethodParams{Body: tt.req})
+		var coded *CodedError
+		if !errors.As(err, &coded) {
+			t.Errorf("%s: expected coded error, got %v", tt.name, err)
+			continue
+		}
+		if coded.Status != http.StatusBadRequest || coded.Code != tt.code {
+			t.Errorf("%s: expected 400 %s, got %d %s", tt.name, tt.code, coded.Status, coded.Code)
+		}
+	}
+
+	// Unknown types are rejected
+	if _, err := api.createPaymentMethod(context.Background(), &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{CustomerID: customer.Body.ID, Type: "wallet"}}); err == nil {
+		t.Error("Expected error for unknown payment method type")
+	}
+}
+
+func TestCardVault(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	_, methodID := createTestPaymentMethod(t, api)
+	method, err := api.DB.GetPaymentMethod(methodID)
+	if err != nil {
+		t.Fatalf("Failed to get payment method: %v", err)
+	}
+
+	// The card number is kept in the vault and can be recovered by token
+	if method.VaultToken == "" {
+		t.Fatal("Expected payment method to have a vault token")
+	}
+	number, err := api.Vault.Reveal(method.VaultToken)
+	if err != nil {
+		t.Fatalf("Failed to reveal card: %v", err)
+	}
+	if number != "4242424242424242" {
+		t.Errorf("Expected vaulted card number, got %s", number)
+	}
+
+	// Neither the token nor the card number is exposed to clients
+	body, err := json.Marshal(method)
+	if err != nil {
+		t.Fatalf("Failed to marshal payment method: %v", err)
+	}
+	if strings.Contains(string(body), method.VaultToken) || strings.Contains(string(body), "4242424242424242") {
+		t.Errorf("Expected vault details to be hidden, got %s", body)
+	}
+}
+
+func TestCardFingerprint(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	customerID, methodID := createTestPaymentMethod(t, api)
+	first, err := api.getPaymentMethod(context.Background(), &PaymentMethodParams{ID: methodID})
+	if err != nil {
+		t.Fatalf("Failed to get payment method: %v", err)
+	}
+	if first.Body.Fingerprint == "" {
+		t.Fatal("Expected card to have a fingerprint")
+	}
+
+	// The same card gets the same fingerprint, even when formatted differently
+	req := &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{
+		CustomerID: customerID,
+		Type:       "card",
+		CardNumber: "4242 4242 4242 4242",
+		ExpMonth:   12,
+		ExpYear:    time.Now().Year() + 2,
+	}}
+	second, err := api.createPaymentMethod(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+	if second.Body.Fingerprint != first.Body.Fingerprint {
+		t.Errorf("Expected matching fingerprints, got %s and %s", first.Body.Fingerprint, second.Body.Fingerprint)
+	}
+
+	// A different card gets a different fingerprint
+	other, err := api.createPaymentMethod(context.Background(), &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{
+		CustomerID: customerID,
+		Type:       "card",
+		CardNumber: "5555555555554444",
+		ExpMonth:   12,
+		ExpYear:    time.Now().Year() + 1,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+	if other.Body.Fingerprint == first.Body.Fingerprint {
+		t.Error("Expected different cards to have different fingerprints")
+	}
+
+	// Payment methods can be looked up by fingerprint
+	list, err := api.listPaymentMethods(context.Background(), &ListPaymentMethodsParams{Fingerprint: first.Body.Fingerprint})
+	if err != nil {
+		t.Fatalf("Failed to list payment methods: %v", err)
+	}
+	if len(list.Body.Data) != 2 {
+		t.Errorf("Expected 2 payment methods with the fingerprint, got %d", len(list.Body.Data))
+	}
+
+	// Duplicates can be rejected
+	api.config.RejectDuplicateCards = true
+	_, err = api.createPaymentMethod(context.Background(), req)
+	var coded *CodedError
+	if !errors.As(err, &coded) || coded.Status != http.StatusConflict || coded.Code != CodeDuplicatePaymentMethod {
+		t.Fatalf("Expected 409 duplicate_payment_method, got %v", err)
+	}
+	if coded.PaymentMethodID == "" {
+		t.Error("Expected error to name the existing payment method")
+	}
+}
+
+func TestPublishablePaymentMethods(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	api.config.RejectDuplicateCards = true
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+	_, publishable, err := api.DB.CreateAPIKey(apikeys.TypePublishable, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	public := &http.Client{Transport: bearerTransport(publishable)}
+	customerID, existingID := createTestPaymentMethod(t, api)
+	card := map[string]any{"type": "card", "card_number": "4242424242424242", "exp_month": 12, "exp_year": time.Now().Year() + 1}
+
+	// Publishable keys cannot name a customer, so they can neither add cards
+	// to one nor learn which payment methods it has
+	var coded CodedError
+	status := doJSON(t, public, http.MethodPost, server.URL+"/v1/payment_methods", map[string]any{
+		"customer_id": customerID, "type": "card", "card_number": "4242424242424242", "exp_month": 12, "exp_year": time.Now().Year() + 1,
+	}, &coded)
+	if status != http.StatusForbidden || coded.Code != CodePermissionDenied || coded.PaymentMethodID != "" {
+		t.Errorf("Expected 403 permission_denied without a payment method ID, got %d %+v", status, coded)
+	}
+
+	// They create unattached payment methods instead
+	var method models.PaymentMethod
+	if status := doJSON(t, public, http.MethodPost, server.URL+"/v1/payment_methods", card, &method); status != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", status)
+	}
+	if method.CustomerID != "" {
+		t.Errorf("Expected an unattached payment method, got customer %s", method.CustomerID)
+	}
+	if methods, err := api.DB.ListPaymentMethods(db.PaymentMethodFilter{CustomerID: customerID}); err != nil || len(methods.Data) != 1 {
+		t.Errorf("Expected the customer to keep only its own payment method, got %v", err)
+	}
+
+	// which only a secret key can attach, subject to the duplicate check
+	if status := doJSON(t, public, http.MethodPost, server.URL+"/v1/payment_methods/"+method.ID+"/attach", map[string]any{"customer_id": customerID}, nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403 attaching with a publishable key, got %d", status)
+	}
+	coded = CodedError{}
+	status = doJSON(t, client, http.MethodPost, server.URL+"/v1/payment_methods/"+method.ID+"/attach", map[string]any{"customer_id": customerID}, &coded)
+	if status != http.StatusConflict || coded.Code != CodeDuplicatePaymentMethod || coded.PaymentMethodID != existingID {
+		t.Errorf("Expected 409 naming %s, got %d %+v", existingID, status, coded)
+	}
+	other, err := api.createCustomer(context.Background(), &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "other@example.com"}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	otherID := other.Body.ID
+	var attached models.PaymentMethod
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/payment_methods/"+method.ID+"/attach", map[string]any{"customer_id": otherID}, &attached); status != http.StatusOK {
+		t.Fatalf("Expected 200 attaching, got %d", status)
+	}
+	if attached.CustomerID != otherID {
+		t.Errorf("Expected payment method attached to %s, got %s", otherID, attached.CustomerID)
+	}
+
+	// Attached payment methods cannot be moved to another customer
+	coded = CodedError{}
+	status = doJSON(t, client, http.MethodPost, server.URL+"/v1/payment_methods/"+method.ID+"/attach", map[string]any{"customer_id": customerID}, &coded)
+	if status != http.StatusBadRequest || coded.Code != CodePaymentMethodAttached {
+		t.Errorf("Expected 400 payment_method_attached, got %d %+v", status, coded)
+	}
+}
+
+func TestListPaymentMethodsQuery(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+
+	// The type filter is optional but must be a known type when given
+	for query, want := range map[string]int{
+		"":                   http.StatusOK,
+		"?type=card":         http.StatusOK,
+		"?type=bank_account": http.StatusOK,
+		"?type=wallet":       http.StatusUnprocessableEntity,
+	} {
+		resp, err := client.Get(server.URL + "/v1/payment_methods" + query)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET /v1/payment_methods%s: expected status %d, got %d", query, want, resp.StatusCode)
+		}
+	}
+}
+
+func TestPaymentMethodLifecycle(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	customerID, methodID := createTestPaymentMethod(t, api)
+
+	// Update the expiry date and billing details
+	month, year := 6, time.Now().Year()+3
+	updated, err := api.updatePaymentMethod(ctx, &UpdatePaymentMethodParams{
+		ID: methodID,
+		Body: models.UpdatePaymentMethodRequest{
+			ExpMonth: &month,
+			ExpYear:  &year,
+			BillingDetails: &models.BillingDetails{
+				Name:    "Test User",
+				Address: models.Address{Line1: "510 Townsend St", City: "San Francisco", PostalCode: "94103", Country: "US"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to update payment method: %v", err)
+	}
+	method, err := api.DB.GetPaymentMethod(methodID)
+	if err != nil {
+		t.Fatalf("Failed to get payment method: %v", err)
+	}
+	if method.ExpMonth != month || method.ExpYear != year || method.BillingDetails.Address.City != "San Francisco" {
+		t.Errorf("Expected update to be saved, got %+v", method)
+	}
+	if updated.Body.Brand != "visa" {
+		t.Errorf("Expected other fields to be preserved, got brand %q", updated.Body.Brand)
+	}
+
+	// An expiry date in the past is rejected
+	past := time.Now().Year() - 1
+	if _, err := api.updatePaymentMethod(ctx, &UpdatePaymentMethodParams{ID: methodID, Body: models.UpdatePaymentMethodRequest{ExpYear: &past}}); err == nil {
+		t.Error("Expected error for expired date")
+	}
+
+	// Without a default, payments must name a payment method
+	if _, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customerID}}); err == nil {
+		t.Error("Expected error when no payment method is given or defaulted")
+	}
+
+	// Set the default and pay with it
+	customer, err := api.updateCustomer(ctx, &UpdateCustomerParams{ID: customerID, Body: models.UpdateCustomerRequest{DefaultPaymentMethodID: &methodID}})
+	if err != nil {
+		t.Fatalf("Failed to set default payment method: %v", err)
+	}
+	if customer.Body.DefaultPaymentMethodID != methodID {
+		t.Errorf("Expected default payment method %s, got %s", methodID, customer.Body.DefaultPaymentMethodID)
+	}
+	payment, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customerID}})
+	if err != nil {
+		t.Fatalf("Failed to create payment with default payment method: %v", err)
+	}
+	if payment.Body.PaymentMethodID != methodID {
+		t.Errorf("Expected payment to use %s, got %s", methodID, payment.Body.PaymentMethodID)
+	}
+
+	// Detaching removes the card from the vault and clears the default
+	detached, err := api.detachPaymentMethod(ctx, &PaymentMethodParams{ID: methodID})
+	if err != nil {
+		t.Fatalf("Failed to detach payment method: %v", err)
+	}
+	if detached.Body.DetachedAt == nil {
+		t.Error("Expected detached_at to be set")
+	}
+	if _, err := api.Vault.Reveal(method.VaultToken); err == nil {
+		t.Error("Expected card to be removed from the vault")
+	}
+	reloaded, err := api.DB.GetCustomer(customerID)
+	if err != nil {
+		t.Fatalf("Failed to get customer: %v", err)
+	}
+	if reloaded.DefaultPaymentMethodID != "" {
+		t.Errorf("Expected default payment method to be cleared, got %s", reloaded.DefaultPaymentMethodID)
+	}
+
+	// Detached payment methods cannot be charged, updated, defaulted or detached again
+	var coded *CodedError
+	if _, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID}}); !errors.As(err, &coded) || coded.Code != CodePaymentMethodDetached {
+		t.Errorf("Expected payment_method_detached when charging, got %v", err)
+	}
+	if _, err := api.updatePaymentMethod(ctx, &UpdatePaymentMethodParams{ID: methodID, Body: models.UpdatePaymentMethodRequest{ExpMonth: &month}}); !errors.As(err, &coded) || coded.Code != CodePaymentMethodDetached {
+		t.Errorf("Expected payment_method_detached when updating, got %v", err)
+	}
+	if _, err := api.updateCustomer(ctx, &UpdateCustomerParams{ID: customerID, Body: models.UpdateCustomerRequest{DefaultPaymentMethodID: &methodID}}); !errors.As(err, &coded) || coded.Code != CodePaymentMethodDetached {
+		t.Errorf("Expected payment_method_detached when setting default, got %v", err)
+	}
+	if _, err := api.detachPaymentMethod(ctx, &PaymentMethodParams{ID: methodID}); !errors.As(err, &coded) || coded.Code != CodePaymentMethodDetached {
+		t.Errorf("Expected payment_method_detached when detaching again, got %v", err)
+	}
+
+	// Detached payment methods are no longer listed
+	list, err := api.listPaymentMethods(ctx, &ListPaymentMethodsParams{CustomerID: customerID})
+	if err != nil {
+		t.Fatalf("Failed to list payment methods: %v", err)
+	}
+	if len(list.Body.Data) != 0 {
+		t.Errorf("Expected no attached payment methods, got %d", len(list.Body.Data))
+	}
+}
+
+func TestUpdateAndDeleteCustomer(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	customerID, methodID := createTestPaymentMethod(t, api)
+	payment, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if _, err := api.createRefund(ctx, &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 100}}); err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+
+	// Update contact details and merge metadata
+	before, err := api.DB.GetCustomer(customerID)
+	if err != nil {
+		t.Fatalf("Failed to get customer: %v", err)
+	}
+	email, phone := "new@example.com", "+14155550123"
+	if _, err := api.updateCustomer(ctx, &UpdateCustomerParams{ID: customerID, Body: models.UpdateCustomerRequest{
+		Email:    &email,
+		Phone:    &phone,
+		Address:  &models.Address{Line1: "510 Townsend St", City: "San Francisco", Country: "US"},
+		Metadata: models.Metadata{"order_id": "123", "tier": "gold"},
+	}}); err != nil {
+		t.Fatalf("Failed to update customer: %v", err)
+	}
+	updated, err := api.updateCustomer(ctx, &UpdateCustomerParams{ID: customerID, Body: models.UpdateCustomerRequest{
+		Metadata: models.Metadata{"tier": ""},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to update customer: %v", err)
+	}
+	customer, err := api.DB.GetCustomer(customerID)
+	if err != nil {
+		t.Fatalf("Failed to get customer: %v", err)
+	}
+	if customer.Email != email || customer.Phone != phone || customer.Address.City != "San Francisco" || customer.Name != "Test User" {
+		t.Errorf("Expected update to be saved, got %+v", customer)
+	}
+	if len(customer.Metadata) != 1 || customer.Metadata["order_id"] != "123" {
+		t.Errorf("Expected metadata {order_id: 123}, got %v", customer.Metadata)
+	}
+	if !updated.Body.UpdatedAt.After(before.UpdatedAt) {
+		t.Error("Expected updated_at to advance")
+	}
+
+	// Delete the customer
+	deleted, err := api.deleteCustomer(ctx, &CustomerParams{ID: customerID})
+	if err != nil {
+		t.Fatalf("Failed to delete customer: %v", err)
+	}
+	if !deleted.Body.Deleted || deleted.Body.ID != customerID {
+		t.Errorf("Expected deleted customer %s, got %+v", customerID, deleted.Body)
+	}
+
+	// The customer is gone and can no longer pay
+	if _, err := api.getCustomer(ctx, &CustomerParams{ID: customerID}); err == nil {
+		t.Error("Expected deleted customer to be not found")
+	}
+	if _, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID}}); err == nil {
+		t.Error("Expected payment for a deleted customer to fail")
+	}
+
+	// Their payment methods are detached
+	method, err := api.DB.GetPaymentMethod(methodID)
+	if err != nil {
+		t.Fatalf("Failed to get payment method: %v", err)
+	}
+	if method.DetachedAt == nil || method.VaultToken != "" {
+		t.Error("Expected payment method to be detached and removed from the vault")
+	}
+
+	// Their payments and refunds are preserved
+	if _, err := api.getPayment(ctx, &PaymentParams{ID: payment.Body.ID}); err != nil {
+		t.Errorf("Expected payment to be preserved, got %v", err)
+	}
+	refunds, err := api.listRefunds(ctx, &ListRefundsParams{PaymentID: payment.Body.ID})
+	if err != nil {
+		t.Fatalf("Failed to list refunds: %v", err)
+	}
+	if len(refunds.Body.Data) != 1 {
+		t.Errorf("Expected refund to be preserved, got %d", len(refunds.Body.Data))
+	}
+
+	// Deleting again is a 404
+	if _, err := api.deleteCustomer(ctx, &CustomerParams{ID: customerID}); err == nil {
+		t.Error("Expected error deleting a deleted customer")
+	}
+}
+
+func TestSearchEndpoints(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+
+	// Search routes must not be captured by the /{id} routes
+	tests := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{`/v1/customers/search?query=email:"jane@"`, http.StatusOK, ""},
+		{`/v1/customers/search?query=name:"smith"`, http.StatusOK, ""},
+		{`/v1/customers/search?query=email:"jane`, http.StatusBadRequest, CodeInvalidSearchQuery},
+		{`/v1/customers/search?query=amount>100`, http.StatusBadRequest, CodeInvalidSearchQuery},
+		{`/v1/customers/search`, http.StatusUnprocessableEntity, ""},
+		{`/v1/payments/search?query=amount>100`, http.StatusOK, ""},
+		{`/v1/payments/search?query=amount>lots`, http.StatusBadRequest, CodeInvalidSearchQuery},
+	}
+	for _, tt := range tests {
+		path, query, _ := strings.Cut(tt.path, "?")
+		if query != "" {
+			query = "?query=" + url.QueryEscape(strings.TrimPrefix(query, "query="))
+		}
+		resp, err := client.Get(server.URL + path + query)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		var body struct {
+			Code string `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s: expected status %d, got %d", tt.path, tt.status, resp.StatusCode)
+			continue
+		}
+		if body.Code != tt.code {
+			t.Errorf("GET %s: expected code %q, got %q", tt.path, tt.code, body.Code)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Metadata is accepted on create
+	customer, err := api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "test@example.com", Name: "Test User", Metadata: models.Metadata{"order_id": "123"}}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	if customer.Body.Metadata["order_id"] != "123" {
+		t.Errorf("Expected metadata to be saved, got %v", customer.Body.Metadata)
+	}
+
+	// Limits are enforced on create and on the merged result of an update
+	tooMany := models.Metadata{}
+	for i := 0; i < models.MaxMetadataKeys; i++ {
+		tooMany[fmt.Sprintf("key_%d", i)] = "value"
+	}
+	invalid := []struct {
+		name     string
+		metadata models.Metadata
+	}{
+		{"long key", models.Metadata{strings.Repeat("k", models.MaxMetadataKeyLength+1): "value"}},
+		{"long value", models.Metadata{"key": strings.Repeat("v", models.MaxMetadataValueLength+1)}},
+		{"bracketed key", models.Metadata{"a[b]": "value"}},
+		{"too many keys after merge", tooMany},
+	}
+	for _, tt := range invalid {
+		_, err := api.updateCustomer(ctx, &UpdateCustomerParams{ID: customer.Body.ID, Body: models.UpdateCustomerRequest{Metadata: tt.metadata}})
+		var coded *CodedError
+		if !errors.As(err, &coded) || coded.Status != http.StatusBadRequest || coded.Code != CodeInvalidMetadata {
+			t.Errorf("%s: expected 400 %s, got %v", tt.name, CodeInvalidMetadata, err)
+		}
+	}
+	if _, err := api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "test@example.com", Name: "Test User", Metadata: models.Metadata{"": "value"}}}); err == nil {
+		t.Error("Expected an empty metadata key to be rejected")
+	}
+
+	// Payments and refunds can have their metadata updated after creation
+	method, err := api.createPaymentMethod(ctx, &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{
+		CustomerID: customer.Body.ID,
+		Type:       "card",
+		CardNumber: "4242424242424242",
+		ExpMonth:   12,
+		ExpYear:    time.Now().Year() + 1,
+		Cvc:        "123",
+		Metadata:   models.Metadata{"source": "checkout"},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+	payment, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customer.Body.ID, PaymentMethodID: method.Body.ID, Metadata: models.Metadata{"order_id": "123"}}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	description := "Order 123"
+	updated, err := api.updatePayment(ctx, &UpdatePaymentParams{ID: payment.Body.ID, Body: models.UpdatePaymentRequest{
+		Description: &description,
+		Metadata:    models.Metadata{"order_id": "", "shipment": "S-1"},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to update payment: %v", err)
+	}
+	if updated.Body.Description != description || len(updated.Body.Metadata) != 1 || updated.Body.Metadata["shipment"] != "S-1" || updated.Body.Status != models.PaymentStatusSucceeded {
+		t.Errorf("Expected description and metadata to be updated, got %+v", updated.Body.Payment)
+	}
+
+	refund, err := api.createRefund(ctx, &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 100, Metadata: models.Metadata{"ticket": "T-1"}}})
+	if err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+	if _, err := api.updateRefund(ctx, &UpdateRefundParams{ID: refund.Body.ID, Body: models.UpdateRefundRequest{Metadata: models.Metadata{"agent": "jo"}}}); err != nil {
+		t.Fatalf("Failed to update refund: %v", err)
+	}
+
+	// Lists can be filtered by metadata
+	refunds, err := api.listRefunds(ctx, &ListRefundsParams{Metadata: map[string]string{"ticket": "T-1", "agent": "jo"}})
+	if err != nil {
+		t.Fatalf("Failed to list refunds: %v", err)
+	}
+	if len(refunds.Body.Data) != 1 || refunds.Body.Data[0].Status != models.RefundStatusSucceeded {
+		t.Errorf("Expected the refund, got %+v", refunds.Body.Data)
+	}
+	payments, err := api.listPayments(ctx, &ListPaymentsParams{Metadata: map[string]string{"order_id": "123"}})
+	if err != nil {
+		t.Fatalf("Failed to list payments: %v", err)
+	}
+	if len(payments.Body.Data) != 0 {
+		t.Errorf("Expected removed metadata not to match, got %d payments", len(payments.Body.Data))
+	}
+	customers, err := api.listCustomers(ctx, &ListCustomersParams{Metadata: map[string]string{"order_id": "123"}})
+	if err != nil {
+		t.Fatalf("Failed to list customers: %v", err)
+	}
+	if len(customers.Body.Data) != 1 {
+		t.Errorf("Expected 1 customer, got %d", len(customers.Body.Data))
+	}
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+	resp, err := client.Get(server.URL + "/v1/payment_methods?metadata[source]=checkout")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for a metadata filter, got %d", resp.StatusCode)
+	}
+}
+
+func TestCustomerContactDetails(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Contact details are normalized on create
+	customer, err := api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{
+		Email:    "  Jane.Doe@Example.COM ",
+		Name:     "Jane Doe",
+		Phone:    "+1 (415) 555-0123",
+		Address:  &models.Address{Line1: "510 Townsend St", City: "San Francisco", Country: "us"},
+		Shipping: &models.Shipping{Name: "Jane Doe", Phone: "+44 20 7946 0958", Address: models.Address{Line1: "1 Main St", Country: "gb"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	if customer.Body.Email != "jane.doe@example.com" || customer.Body.Phone != "+14155550123" || customer.Body.Address.Country != "US" {
+		t.Errorf("Expected normalized contact details, got %+v", customer.Body)
+	}
+	if customer.Body.Shipping.Phone != "+442079460958" || customer.Body.Shipping.Address.Country != "GB" || customer.Body.Shipping.Address.Line1 != "1 Main St" {
+		t.Errorf("Expected normalized shipping details, got %+v", customer.Body.Shipping)
+	}
+
+	// Invalid details are rejected with their code
+	badEmail, badPhone := "jane@", "415-555-0123"
+	invalid := []struct {
+		name string
+		req  models.UpdateCustomerRequest
+		code string
+	}{
+		{"email", models.UpdateCustomerRequest{Email: &badEmail}, contact.CodeEmailInvalid},
+		{"phone", models.UpdateCustomerRequest{Phone: &badPhone}, contact.CodePhoneInvalid},
+		{"country", models.UpdateCustomerRequest{Address: &models.Address{Country: "USA"}}, contact.CodeCountryInvalid},
+		{"shipping phone", models.UpdateCustomerRequest{Shipping: &models.Shipping{Phone: "+0123"}}, contact.CodePhoneInvalid},
+	}
+	for _, tt := range invalid {
+		_, err := api.updateCustomer(ctx, &UpdateCustomerParams{ID: customer.Body.ID, Body: tt.req})
+		var coded *CodedError
+		if !errors.As(err, &coded) || coded.Status != http.StatusBadRequest || coded.Code != tt.code {
+			t.Errorf("%s: expected 400 %s, got %v", tt.name, tt.code, err)
+		}
+	}
+
+	// Duplicate emails are allowed unless enforced
+	other, err := api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "JANE.DOE@example.com", Name: "Other"}})
+	if err != nil {
+		t.Fatalf("Expected duplicate email to be allowed, got %v", err)
+	}
+	if _, err := api.deleteCustomer(ctx, &CustomerParams{ID: other.Body.ID}); err != nil {
+		t.Fatalf("Failed to delete customer: %v", err)
+	}
+	if err := api.DB.SetUniqueCustomerEmails(true); err != nil {
+		t.Fatalf("Failed to enforce unique emails: %v", err)
+	}
+
+	// Once enforced, a duplicate is a conflict pointing at the existing customer
+	_, err = api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "Jane.Doe@example.com ", Name: "Duplicate"}})
+	var coded *CodedError
+	if !errors.As(err, &coded) || coded.Status != http.StatusConflict || coded.Code != CodeDuplicateCustomerEmail || coded.CustomerID != customer.Body.ID {
+		t.Errorf("Expected 409 %s for %s, got %v", CodeDuplicateCustomerEmail, customer.Body.ID, err)
+	}
+	second, err := api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "john@example.com", Name: "John"}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	duplicate := "jane.doe@example.com"
+	_, err = api.updateCustomer(ctx, &UpdateCustomerParams{ID: second.Body.ID, Body: models.UpdateCustomerRequest{Email: &duplicate}})
+	if !errors.As(err, &coded) || coded.Status != http.StatusConflict || coded.CustomerID != customer.Body.ID {
+		t.Errorf("Expected 409 on update, got %v", err)
+	}
+}
+
+func TestMalformedIDs(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	customerID, methodID := createTestPaymentMethod(t, api)
+	if !ids.Valid(ids.Customer, customerID) || !ids.Valid(ids.PaymentMethod, methodID) {
+		t.Fatalf("Expected generated IDs, got %s and %s", customerID, methodID)
+	}
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+
+	get := func(path string) int {
+		t.Helper()
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/v1/customers/" + customerID, http.StatusOK},
+		{"/v1/customers/" + ids.New(ids.Customer), http.StatusNotFound},
+		{"/v1/customers/cus_123abc", http.StatusNotFound},
+		{"/v1/customers/" + methodID, http.StatusNotFound},
+		{"/v1/payments/" + customerID, http.StatusNotFound},
+		{"/v1/payments/" + customerID + "/history", http.StatusNotFound},
+		{"/v1/refunds/ref_", http.StatusNotFound},
+		{"/v1/customers/search?query=name:x", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if status := get(tt.path); status != tt.status {
+			t.Errorf("GET %s: expected status %d, got %d", tt.path, tt.status, status)
+		}
+	}
+
+	// Malformed IDs are rejected without a database lookup
+	if err := api.DB.Migrator().DropTable(&models.PaymentMethod{}); err != nil {
+		t.Fatalf("Failed to drop payment methods table: %v", err)
+	}
+	if status := get("/v1/payment_methods/pm_malformed"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a malformed ID with the table dropped, got %d", status)
+	}
+	if status := get("/v1/payment_methods/" + methodID); status != http.StatusInternalServerError {
+		t.Errorf("Expected a well-formed ID to reach the database, got %d", status)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+
+	// request returns the response to a request and the error code it carries
+	request := func(method, path, key string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Code string `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body.Code
+	}
+	expectCode := func(resp *http.Response, code string, status int, wantCode string) {
+		t.Helper()
+		if resp.StatusCode != status || code != wantCode {
+			t.Errorf("%s %s: expected %d %q, got %d %q", resp.Request.Method, resp.Request.URL.Path, status, wantCode, resp.StatusCode, code)
+		}
+	}
+
+	_, secret, err := api.DB.CreateAPIKey(apikeys.TypeSecret, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	_, publishable, err := api.DB.CreateAPIKey(apikeys.TypePublishable, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+
+	// The health check is public; everything else needs a valid key
+	resp, code := request(http.MethodGet, "/health", "")
+	expectCode(resp, code, http.StatusOK, "")
+	resp, code = request(http.MethodGet, "/v1/customers", "")
+	expectCode(resp, code, http.StatusUnauthorized, CodeAuthenticationRequired)
+	if resp.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("Expected WWW-Authenticate: Bearer, got %q", resp.Header.Get("WWW-Authenticate"))
+	}
+	resp, code = request(http.MethodGet, "/v1/customers", "Bearer sk_test_unknown")
+	expectCode(resp, code, http.StatusUnauthorized, CodeAPIKeyInvalid)
+	resp, code = request(http.MethodGet, "/v1/customers", "Basic "+secret)
+	expectCode(resp, code, http.StatusUnauthorized, CodeAPIKeyInvalid)
+	resp, code = request(http.MethodGet, "/v1/customers", "Bearer "+secret)
+	expectCode(resp, code, http.StatusOK, "")
+	resp, code = request(http.MethodGet, "/v1/customers", "bearer "+secret)
+	expectCode(resp, code, http.StatusOK, "")
+
+	// Publishable keys can only create payment methods; the empty body then fails validation
+	resp, code = request(http.MethodGet, "/v1/customers", "Bearer "+publishable)
+	expectCode(resp, code, http.StatusForbidden, CodePermissionDenied)
+	resp, code = request(http.MethodPost, "/v1/payments", "Bearer "+publishable)
+	expectCode(resp, code, http.StatusForbidden, CodePermissionDenied)
+	resp, code = request(http.MethodPost, "/v1/payment_methods", "Bearer "+publishable)
+	expectCode(resp, code, http.StatusUnprocessableEntity, "")
+
+	// Rolled keys keep working until the overlap ends
+	keys, err := api.listAPIKeys(context.Background(), &ListParams{Limit: 10})
+	if err != nil {
+		t.Fatalf("Failed to list API keys: %v", err)
+	}
+	var secretKey *models.APIKey
+	for i, key := range keys.Body.Data {
+		if key.Type == apikeys.TypeSecret {
+			secretKey = &keys.Body.Data[i]
+		}
+	}
+	if secretKey == nil || !strings.HasPrefix(secretKey.Redacted, "sk_test_...") {
+		t.Fatalf("Expected redacted secret key in list, got %+v", keys.Body.Data)
+	}
+	rolled, err := api.rollAPIKey(context.Background(), &RollAPIKeyParams{ID: secretKey.ID})
+	if err != nil {
+		t.Fatalf("Failed to roll API key: %v", err)
+	}
+	resp, code = request(http.MethodGet, "/v1/customers", "Bearer "+secret)
+	expectCode(resp, code, http.StatusOK, "")
+	resp, code = request(http.MethodGet, "/v1/customers", "Bearer "+rolled.Body.Secret)
+	expectCode(resp, code, http.StatusOK, "")
+
+	zero := int64(0)
+	if _, err := api.rollAPIKey(context.Background(), &RollAPIKeyParams{ID: rolled.Body.ID, Body: &models.RollAPIKeyRequest{ExpiresIn: &zero}}); err != nil {
+		t.Fatalf("Failed to roll API key: %v", err)
+	}
+	resp, code = request(http.MethodGet, "/v1/customers", "Bearer "+rolled.Body.Secret)
+	expectCode(resp, code, http.StatusUnauthorized, CodeAPIKeyExpired)
+
+	// Test mode keys cannot create live mode keys
+	var coded *CodedError
+	ctx := keyContext(secretKey)
+	if _, err := api.createAPIKey(ctx, &CreateAPIKeyParams{Body: models.CreateAPIKeyRequest{Type: apikeys.TypeSecret, Livemode: true}}); !errors.As(err, &coded) || coded.Code != CodePermissionDenied {
+		t.Errorf("Expected %s, got %v", CodePermissionDenied, err)
+	}
+
+	// The OpenAPI document describes the scheme
+	scheme := api.API.OpenAPI().Components.SecuritySchemes[securityScheme]
+	if scheme == nil || scheme.Scheme != "bearer" {
+		t.Errorf("Expected a bearer security scheme, got %+v", scheme)
+	}
+}
+
+func TestRestrictedKeys(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+
+	// A warehouse key that can only read payments and a support key that can
+	// only create refunds
+	_, warehouse, err := api.DB.CreateAPIKey(apikeys.TypeRestricted, false, models.Permissions{models.ResourcePayments: models.AccessRead})
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	_, support, err := api.DB.CreateAPIKey(apikeys.TypeRestricted, false, models.Permissions{models.ResourceRefunds: models.AccessWrite})
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if !strings.HasPrefix(warehouse, "rk_test_") {
+		t.Fatalf("Expected a rk_test_ key, got %q", warehouse)
+	}
+
+	tests := []struct {
+		key        string
+		method     string
+		path       string
+		status     int
+		permission string
+	}{
+		{warehouse, http.MethodGet, "/v1/payments", http.StatusOK, ""},
+		{warehouse, http.MethodGet, "/v1/payments/search?query=amount>1", http.StatusOK, ""},
+		{warehouse, http.MethodPost, "/v1/payments", http.StatusForbidden, "payments:write"},
+		{warehouse, http.MethodGet, "/v1/customers", http.StatusForbidden, "customers:read"},
+		{warehouse, http.MethodGet, "/v1/api_keys", http.StatusForbidden, ""},
+		{support, http.MethodGet, "/v1/refunds", http.StatusOK, ""},
+		{support, http.MethodPost, "/v1/refunds", http.StatusUnprocessableEntity, ""},
+		{support, http.MethodGet, "/v1/payments", http.StatusForbidden, "payments:read"},
+		{support, http.MethodPost, "/v1/payment_methods", http.StatusForbidden, "payment_methods:write"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tt.key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		var body struct {
+			Code       string `json:"code"`
+			Permission string `json:"permission"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status || body.Permission != tt.permission {
+			t.Errorf("%s %s: expected %d missing %q, got %d missing %q", tt.method, tt.path, tt.status, tt.permission, resp.StatusCode, body.Permission)
+		}
+		if tt.status == http.StatusForbidden && body.Code != CodePermissionDenied {
+			t.Errorf("%s %s: expected code %s, got %q", tt.method, tt.path, CodePermissionDenied, body.Code)
+		}
+	}
+
+	// Payments only include their refunds for keys that can read refunds
+	customerID, methodID := createTestPaymentMethod(t, api)
+	payment, err := api.createPayment(context.Background(), &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 2000, Currency: "usd", CustomerID: customerID, PaymentMethodID: methodID}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if _, err := api.createRefund(context.Background(), &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 500}}); err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+	_, auditor, err := api.DB.CreateAPIKey(apikeys.TypeRestricted, false, models.Permissions{models.ResourcePayments: models.AccessRead, models.ResourceRefunds: models.AccessRead})
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	for key, want := range map[string]int{warehouse: -1, auditor: 1} {
+		var body map[string]json.RawMessage
+		if status := doJSON(t, &http.Client{Transport: bearerTransport(key)}, http.MethodGet, server.URL+"/v1/payments/"+payment.Body.ID, nil, &body); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		raw, ok := body["refunds"]
+		if want < 0 {
+			if ok {
+				t.Errorf("Expected no refunds for a key without refunds:read, got %s", raw)
+			}
+			continue
+		}
+		var refunds List[models.Refund]
+		if err := json.Unmarshal(raw, &refunds); err != nil || len(refunds.Data) != want {
+			t.Errorf("Expected %d refund, got %s", want, raw)
+		}
+	}
+
+	// Webhook endpoints only receive the events of resources the key can read
+	_, integrator, err := api.DB.CreateAPIKey(apikeys.TypeRestricted, false, models.Permissions{models.ResourceWebhookEndpoints: models.AccessWrite, models.ResourcePayments: models.AccessRead})
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	for _, tt := range []struct {
+		events     []string
+		status     int
+		permission string
+	}{
+		{[]string{models.EventPaymentSucceeded, models.EventPaymentRefunded}, http.StatusCreated, ""},
+		{[]string{models.EventPaymentSucceeded, models.EventCustomerCreated}, http.StatusForbidden, "customers:read"},
+		{[]string{models.EventRefundSucceeded}, http.StatusForbidden, "refunds:read"},
+		{[]string{models.EventAll}, http.StatusForbidden, "customers:read"},
+	} {
+		var body struct {
+			Permission string `json:"permission"`
+		}
+		status := doJSON(t, &http.Client{Transport: bearerTransport(integrator)}, http.MethodPost, server.URL+"/v1/webhook_endpoints", map[string]any{"url": "https://example.com/hooks", "enabled_events": tt.events}, &body)
+		if status != tt.status || body.Permission != tt.permission {
+			t.Errorf("%v: expected %d missing %q, got %d missing %q", tt.events, tt.status, tt.permission, status, body.Permission)
+		}
+	}
+
+	// Permissions must name known resources and access levels
+	for _, permissions := range []models.Permissions{nil, {"charges": "read"}, {models.ResourcePayments: "admin"}} {
+		req := &CreateAPIKeyParams{Body: models.CreateAPIKeyRequest{Type: apikeys.TypeRestricted, Permissions: permissions}}
+		if _, err := api.createAPIKey(context.Background(), req); err == nil {
+			t.Errorf("%v: expected an error for invalid permissions", permissions)
+		}
+	}
+	req := &CreateAPIKeyParams{Body: models.CreateAPIKeyRequest{Type: apikeys.TypeSecret, Permissions: models.Permissions{models.ResourcePayments: models.AccessRead}}}
+	if _, err := api.createAPIKey(context.Background(), req); err == nil {
+		t.Error("Expected an error for a secret key with permissions")
+	}
+
+	// Rolled keys keep their permissions
+	created, err := api.createAPIKey(context.Background(), &CreateAPIKeyParams{Body: models.CreateAPIKeyRequest{Type: apikeys.TypeRestricted, Permissions: models.Permissions{models.ResourceCustomers: models.AccessWrite}}})
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	rolled, err := api.rollAPIKey(context.Background(), &RollAPIKeyParams{ID: created.Body.ID})
+	if err != nil {
+		t.Fatalf("Failed to roll API key: %v", err)
+	}
+	if !strings.HasPrefix(rolled.Body.Secret, "rk_test_") || !rolled.Body.Permissions.Allows(models.ResourceCustomers, models.AccessRead) {
+		t.Errorf("Expected rolled key to keep its permissions, got %+v", rolled.Body.APIKey)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	api := New(database, Config{Title: "Test API", Version: "1.0.0", AdminKey: "admin_secret"})
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+
+	get := func(path, key string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Each account is created with its own keys
+	var keys []models.CreatedAPIKey
+	for _, name := range []string{"Acme", "Globex"} {
+		created, err := api.createAccount(context.Background(), &CreateAccountParams{Body: models.CreateAccountRequest{Name: name, Email: " Billing@Example.com"}})
+		if err != nil {
+			t.Fatalf("Failed to create account: %v", err)
+		}
+		if created.Body.Email != "billing@example.com" || len(created.Body.APIKeys) != 2 || created.Body.APIKeys[0].AccountID != created.Body.ID {
+			t.Fatalf("Unexpected account %+v", created.Body)
+		}
+		keys = append(keys, created.Body.APIKeys[0])
+	}
+	acme, globex := keys[0], keys[1]
+
+	// Only the admin key can use the admin API
+	if status := get("/v1/accounts", "admin_secret"); status != http.StatusOK {
+		t.Errorf("Expected admin key to list accounts, got %d", status)
+	}
+	if status := get("/v1/accounts", acme.Secret); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 listing accounts with an account key, got %d", status)
+	}
+	if status := get("/v1/customers", "admin_secret"); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 using the admin key on the account API, got %d", status)
+	}
+	accounts, err := api.listAccounts(context.Background(), &ListParams{Limit: 10})
+	if err != nil {
+		t.Fatalf("Failed to list accounts: %v", err)
+	}
+	if len(accounts.Body.Data) != 3 {
+		t.Errorf("Expected the default account and 2 new ones, got %d", len(accounts.Body.Data))
+	}
+
+	// Accounts are created over HTTP from a JSON body, and their keys work
+	admin := &http.Client{Transport: bearerTransport("admin_secret")}
+	var created models.CreatedAccount
+	status := doJSON(t, admin, http.MethodPost, server.URL+"/v1/accounts", map[string]any{"name": "Initech", "email": "billing@initech.example"}, &created)
+	if status != http.StatusCreated || created.Name != "Initech" || created.Email != "billing@initech.example" || len(created.APIKeys) != 2 {
+		t.Fatalf("Expected 201 with the account and its keys, got %d %+v", status, created)
+	}
+	if status := get("/v1/customers", created.APIKeys[0].Secret); status != http.StatusOK {
+		t.Errorf("Expected the new account's secret key to work, got %d", status)
+	}
+	if status := doJSON(t, admin, http.MethodPost, server.URL+"/v1/accounts", map[string]any{"email": "billing@initech.example"}, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 without a name, got %d", status)
+	}
+	if status := doJSON(t, &http.Client{Transport: bearerTransport(acme.Secret)}, http.MethodPost, server.URL+"/v1/accounts", map[string]any{"name": "Initech"}, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 creating an account with an account key, got %d", status)
+	}
+
+	// Create data in one account
+	ctx := keyContext(acme.APIKey)
+	customer, err := api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "jane@example.com", Name: "Jane"}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	method, err := api.createPaymentMethod(ctx, &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{CustomerID: customer.Body.ID, Type: "card", CardNumber: "4242424242424242", ExpMonth: 12, ExpYear: time.Now().Year() + 1, Cvc: "123"}})
+	if err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+	payment, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customer.Body.ID, PaymentMethodID: method.Body.ID}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	refund, err := api.createRefund(ctx, &CreateRefundParams{Body: models.CreateRefundRequest{PaymentID: payment.Body.ID, Amount: 500}})
+	if err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+
+	// The other account cannot read any of it
+	for _, path := range []string{
+		"/v1/customers/" + customer.Body.ID,
+		"/v1/payment_methods/" + method.Body.ID,
+		"/v1/payments/" + payment.Body.ID,
+		"/v1/payments/" + payment.Body.ID + "/history",
+		"/v1/refunds/" + refund.Body.ID,
+	} {
+		if status := get(path, acme.Secret); status != http.StatusOK {
+			t.Errorf("GET %s: expected 200 for the owning account, got %d", path, status)
+		}
+		if status := get(path, globex.Secret); status != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404 for another account, got %d", path, status)
+		}
+	}
+	list, err := api.listCustomers(keyContext(globex.APIKey), &ListCustomersParams{ListParams: ListParams{Limit: 10}})
+	if err != nil {
+		t.Fatalf("Failed to list customers: %v", err)
+	}
+	if len(list.Body.Data) != 0 {
+		t.Errorf("Expected no customers for another account, got %d", len(list.Body.Data))
+	}
+
+	// Nor use it to make payments
+	var statusErr huma.StatusError
+	_, err = api.createPayment(keyContext(globex.APIKey), &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customer.Body.ID, PaymentMethodID: method.Body.ID}})
+	if !errors.As(err, &statusErr) || statusErr.GetStatus() != http.StatusBadRequest {
+		t.Errorf("Expected customer not found paying with another account's customer, got %v", err)
+	}
+}
+
+// countingProcessor is a simulated gateway that counts authorizations
+type countingProcessor struct {
+	*processor.Simulator
+	authorizations int
+}
+
+func (p *countingProcessor) Authorize(ctx context.Context, req processor.AuthorizeRequest) (*processor.Result, error) {
+	p.authorizations++
+	return p.Simulator.Authorize(ctx, req)
+}
+
+func TestAccountLiveKeys(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	live := &countingProcessor{Simulator: processor.NewSimulator(nil)}
+	api := New(database, Config{Title: "Test API", Version: "1.0.0", AdminKey: "admin_secret", Processor: live})
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+
+	// Create an account; it only comes with test mode keys
+	admin := &http.Client{Transport: bearerTransport("admin_secret")}
+	var account models.CreatedAccount
+	if status := doJSON(t, admin, http.MethodPost, server.URL+"/v1/accounts", map[string]any{"name": "Acme"}, &account); status != http.StatusCreated {
+		t.Fatalf("Expected 201 creating an account, got %d", status)
+	}
+	test := &http.Client{Transport: bearerTransport(account.APIKeys[0].Secret)}
+
+	// A test mode key cannot create a live mode key, but the admin key can
+	if status := doJSON(t, test, http.MethodPost, server.URL+"/v1/api_keys", map[string]any{"type": "secret", "livemode": true}, nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403 creating a live key with a test key, got %d", status)
+	}
+	if status := doJSON(t, test, http.MethodPost, server.URL+"/v1/accounts/"+account.ID+"/api_keys", map[string]any{"type": "secret", "livemode": true}, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 using the admin API with an account key, got %d", status)
+	}
+	if status := doJSON(t, admin, http.MethodPost, server.URL+"/v1/accounts/acct_missing/api_keys", map[string]any{"type": "secret", "livemode": true}, nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown account, got %d", status)
+	}
+	if status := doJSON(t, admin, http.MethodPost, server.URL+"/v1/accounts/"+account.ID+"/api_keys", map[string]any{"type": "publishable", "permissions": map[string]string{"payments": "read"}}, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a publishable key with permissions, got %d", status)
+	}
+	var key models.CreatedAPIKey
+	if status := doJSON(t, admin, http.MethodPost, server.URL+"/v1/accounts/"+account.ID+"/api_keys", map[string]any{"type": "secret", "livemode": true}, &key); status != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a live key with the admin key, got %d", status)
+	}
+	if !key.Livemode || key.AccountID != account.ID || !strings.HasPrefix(key.Secret, "sk_live_") {
+		t.Fatalf("Expected a live secret key for the account, got %+v", key)
+	}
+
+	// The live key takes live payments through the live processor
+	client := &http.Client{Transport: bearerTransport(key.Secret)}
+	var customer models.Customer
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/customers", map[string]any{"email": "jane@example.com", "name": "Jane"}, &customer); status != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a customer, got %d", status)
+	}
+	var method models.PaymentMethod
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/payment_methods", map[string]any{"customer_id": customer.ID, "type": "card", "card_number": "4242424242424242", "exp_month": 12, "exp_year": time.Now().Year() + 1, "cvc": "123"}, &method); status != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a payment method, got %d", status)
+	}
+	var payment models.Payment
+	if status := doJSON(t, client, http.MethodPost, server.URL+"/v1/payments", map[string]any{"amount": 1000, "currency": "usd", "customer_id": customer.ID, "payment_method_id": method.ID}, &payment); status != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a payment, got %d", status)
+	}
+	if !payment.Livemode || payment.AccountID != account.ID {
+		t.Errorf("Expected a live payment for the account, got %+v", payment)
+	}
+	if live.authorizations != 1 {
+		t.Errorf("Expected the live processor to authorize the payment, got %d authorizations", live.authorizations)
+	}
+}
+
+func TestLivemode(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	live := &countingProcessor{Simulator: processor.NewSimulator(nil)}
+	api := New(database, Config{Title: "Test API", Version: "1.0.0", Processor: live})
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+
+	account, err := database.DefaultAccount()
+	if err != nil {
+		t.Fatalf("Failed to get default account: %v", err)
+	}
+	keys := map[bool]*models.APIKey{}
+	secrets := map[bool]string{}
+	for _, livemode := range []bool{false, true} {
+		key, secret, err := database.ForAccount(account.ID).CreateAPIKey(apikeys.TypeSecret, livemode, nil)
+		if err != nil {
+			t.Fatalf("Failed to create API key: %v", err)
+		}
+		keys[livemode], secrets[livemode] = key, secret
+	}
+	do := func(method, path, secret string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Create a payment in each mode; only live mode uses the live processor
+	payments := map[bool]*PaymentResponse{}
+	for _, livemode := range []bool{false, true} {
+		ctx := keyContext(keys[livemode])
+		customer, err := api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "jane@example.com", Name: "Jane"}})
+		if err != nil {
+			t.Fatalf("Failed to create customer: %v", err)
+		}
+		if customer.Body.Livemode != livemode {
+			t.Errorf("Expected customer livemode %v, got %v", livemode, customer.Body.Livemode)
+		}
+		method, err := api.createPaymentMethod(ctx, &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{CustomerID: customer.Body.ID, Type: "card", CardNumber: "4242424242424242", ExpMonth: 12, ExpYear: time.Now().Year() + 1, Cvc: "123"}})
+		if err != nil {
+			t.Fatalf("Failed to create payment method: %v", err)
+		}
+		payment, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customer.Body.ID, PaymentMethodID: method.Body.ID}})
+		if err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+		if payment.Body.Livemode != livemode {
+			t.Errorf("Expected payment livemode %v, got %v", livemode, payment.Body.Livemode)
+		}
+		payments[livemode] = payment
+	}
+	if live.authorizations != 1 {
+		t.Errorf("Expected only the live mode payment to use the live processor, got %d authorizations", live.authorizations)
+	}
+
+	// Each mode's keys only see that mode's data
+	if status := do(http.MethodGet, "/v1/payments/"+payments[false].Body.ID, secrets[true]); status != http.StatusNotFound {
+		t.Errorf("Expected 404 reading a test payment with a live key, got %d", status)
+	}
+	if status := do(http.MethodGet, "/v1/payments/"+payments[true].Body.ID, secrets[false]); status != http.StatusNotFound {
+		t.Errorf("Expected 404 reading a live payment with a test key, got %d", status)
+	}
+
+	// Deleting test data leaves live data alone
+	deleted, err := api.deleteTestData(keyContext(keys[true]), &struct{}{})
+	if err != nil {
+		t.Fatalf("Failed to delete test data: %v", err)
+	}
+	if deleted.Body.Customers != 1 || deleted.Body.PaymentMethods != 1 || deleted.Body.Payments != 1 {
+		t.Errorf("Expected the test customer, payment method and payment deleted, got %+v", deleted.Body)
+	}
+	if status := do(http.MethodGet, "/v1/payments/"+payments[false].Body.ID, secrets[false]); status != http.StatusNotFound {
+		t.Errorf("Expected test payment to be deleted, got %d", status)
+	}
+	if status := do(http.MethodGet, "/v1/payments/"+payments[true].Body.ID, secrets[true]); status != http.StatusOK {
+		t.Errorf("Expected live payment to survive, got %d", status)
+	}
+
+	// Deleting test data requires a secret key
+	_, restricted, err := database.ForAccount(account.ID).CreateAPIKey(apikeys.TypeRestricted, false, models.Permissions{models.ResourcePayments: models.AccessWrite})
+	if err != nil {
+		t.Fatalf("Failed to create restricted key: %v", err)
+	}
+	if status := do(http.MethodDelete, "/v1/test_data", restricted); status != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting test data with a restricted key, got %d", status)
+	}
+}
+
+func TestLivemodeWithoutProcessor(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	// Live mode payments are refused rather than sent to the simulator
+	key, _, err := api.DB.CreateAPIKey(apikeys.TypeSecret, true, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	ctx := keyContext(key)
+	customer, err := api.createCustomer(ctx, &CreateCustomerParams{Body: models.CreateCustomerRequest{Email: "jane@example.com", Name: "Jane"}})
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	method, err := api.createPaymentMethod(ctx, &CreatePaymentMethodParams{Body: models.CreatePaymentMethodRequest{CustomerID: customer.Body.ID, Type: "card", CardNumber: "4242424242424242", ExpMonth: 12, ExpYear: time.Now().Year() + 1, Cvc: "123"}})
+	if err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+	_, err = api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customer.Body.ID, PaymentMethodID: method.Body.ID}})
+	var statusErr huma.StatusError
+	if !errors.As(err, &statusErr) || statusErr.GetStatus() != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 error, got %v", err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	// A receiver that fails the first event it gets
+	var received []models.Event
+	var signatures []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event models.Event
+		json.Unmarshal(body, &event)
+		received = append(received, event)
+		signatures = append(signatures, r.Header.Get(webhooks.SignatureHeader))
+		if len(received) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer receiver.Close()
+
+	ctx := context.Background()
+	response, err := api.createWebhookEndpoint(ctx, &CreateWebhookEndpointParams{Body: models.CreateWebhookEndpointRequest{
+		URL:           receiver.URL,
+		EnabledEvents: models.EnabledEvents{models.EventPaymentSucceeded, models.EventRefundCreated},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create webhook endpoint: %v", err)
+	}
+	created := response.Body
+	if !strings.HasPrefix(created.Secret, webhooks.SecretPrefix) || !strings.HasPrefix(created.ID, ids.WebhookEndpoint+"_") {
+		t.Errorf("Unexpected webhook endpoint %+v", created)
+	}
+
+	// Subscribed events are sent, signed with the endpoint's secret
+	customerID, paymentMethodID := createTestPaymentMethod(t, api)
+	payment, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customerID, PaymentMethodID: paymentMethodID}})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if sent, err := api.deliverWebhooks(time.Now()); err != nil || sent != 1 {
+		t.Fatalf("Expected one delivery, got %d (%v)", sent, err)
+	}
+	if received[0].Type != models.EventPaymentSucceeded || !strings.Contains(string(received[0].Data), payment.Body.ID) {
+		t.Errorf("Expected a payment.succeeded event for %s, got %+v", payment.Body.ID, received[0])
+	}
+	payload, _ := json.Marshal(received[0])
+	if err := webhooks.Verify(signatures[0], created.Secret, payload, webhooks.DefaultTolerance, time.Now()); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+
+	// The failed delivery is logged and retried later
+	attempts, err := api.listWebhookAttempts(ctx, &ListWebhookAttemptsParams{ID: created.ID, ListParams: ListParams{Limit: 10}})
+	if err != nil {
+		t.Fatalf("Failed to list attempts: %v", err)
+	}
+	if len(attempts.Body.Data) != 1 || attempts.Body.Data[0].StatusCode != http.StatusServiceUnavailable || attempts.Body.Data[0].NextAttemptAt == nil {
+		t.Fatalf("Expected a failed attempt with a retry, got %+v", attempts.Body.Data)
+	}
+	if sent, err := api.deliverWebhooks(time.Now()); err != nil || sent != 0 {
+		t.Errorf("Expected no deliveries before the retry, got %d (%v)", sent, err)
+	}
+	if sent, err := api.deliverWebhooks(*attempts.Body.Data[0].NextAttemptAt); err != nil || sent != 1 {
+		t.Fatalf("Expected the retry to be sent, got %d (%v)", sent, err)
+	}
+	if len(received) != 2 || received[1].ID != received[0].ID {
+		t.Errorf("Expected the same event to be resent, got %+v", received)
+	}
+	attempts, err = api.listWebhookAttempts(ctx, &ListWebhookAttemptsParams{ID: created.ID, ListParams: ListParams{Limit: 10}})
+	if err != nil {
+		t.Fatalf("Failed to list attempts: %v", err)
+	}
+	if len(attempts.Body.Data) != 2 || !attempts.Body.Data[0].Succeeded || attempts.Body.Data[0].ResponseBody != "ok" {
+		t.Errorf("Expected a successful second attempt, got %+v", attempts.Body.Data)
+	}
+
+	// Invalid endpoints are rejected
+	for _, req := range []models.CreateWebhookEndpointRequest{
+		{URL: "not a url", EnabledEvents: models.EnabledEvents{models.EventAll}},
+		{URL: "ftp://example.com", EnabledEvents: models.EnabledEvents{models.EventAll}},
+		{URL: "https://example.com", EnabledEvents: models.EnabledEvents{"payment.exploded"}},
+		{URL: "https://example.com"},
+	} {
+		if _, err := api.createWebhookEndpoint(ctx, &CreateWebhookEndpointParams{Body: req}); err == nil {
+			t.Errorf("Expected an error creating %+v", req)
+		}
+	}
+	liveKey, _, err := api.DB.CreateAPIKey(apikeys.TypeSecret, true, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if _, err := api.createWebhookEndpoint(keyContext(liveKey), &CreateWebhookEndpointParams{Body: models.CreateWebhookEndpointRequest{URL: "http://example.com", EnabledEvents: models.EnabledEvents{models.EventAll}}}); err == nil {
+		t.Error("Expected an error creating a live mode endpoint without https")
+	}
+
+	// Deleted endpoints are gone
+	if _, err := api.deleteWebhookEndpoint(ctx, &WebhookEndpointParams{ID: created.ID}); err != nil {
+		t.Fatalf("Failed to delete webhook endpoint: %v", err)
+	}
+	if _, err := api.getWebhookEndpoint(ctx, &WebhookEndpointParams{ID: created.ID}); err == nil {
+		t.Error("Expected an error getting a deleted webhook endpoint")
+	}
+}
+
+func TestWebhookEndpointAddresses(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.Router)
+	defer server.Close()
+	client := newTestClient(t, api, false)
+
+	// Endpoints are created from a JSON body
+	var created models.CreatedWebhookEndpoint
+	status := doJSON(t, client, http.MethodPost, server.URL+"/v1/webhook_endpoints", map[string]any{
+		"url": "http://127.0.0.1:9999/webhooks", "enabled_events": []string{models.EventAll},
+	}, &created)
+	if status != http.StatusCreated || created.URL != "http://127.0.0.1:9999/webhooks" || !strings.HasPrefix(created.Secret, webhooks.SecretPrefix) {
+		t.Fatalf("Expected 201 with the endpoint and its secret, got %d %+v", status, created)
+	}
+
+	// Unless allowed, endpoints cannot point at internal services
+	api.config.AllowPrivateWebhookURLs = false
+	for _, target := range []string{
+		"http://127.0.0.1:9999/webhooks",
+		"http://localhost/webhooks",
+		"http://[::1]/webhooks",
+		"http://10.0.0.1/webhooks",
+		"http://192.168.1.1/webhooks",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/webhooks",
+		"http://100.64.0.1/webhooks",
+		"http://[::ffff:127.0.0.1]/webhooks",
+	} {
+		status := doJSON(t, client, http.MethodPost, server.URL+"/v1/webhook_endpoints", map[string]any{
+			"url": target, "enabled_events": []string{models.EventAll},
+		}, nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", target, status)
+		}
+	}
+}
+
+func TestWebhookDeliveryConcurrency(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	// A slow endpoint does not hold up deliveries to the others
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fastDone := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case fastDone <- struct{}{}:
+		default:
+		}
+	}))
+	defer fast.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	ctx := context.Background()
+	for _, receiver := range []*httptest.Server{slow, fast} {
+		if _, err := api.createWebhookEndpoint(ctx, &CreateWebhookEndpointParams{Body: models.CreateWebhookEndpointRequest{
+			URL:           receiver.URL,
+			EnabledEvents: models.EnabledEvents{models.EventPaymentSucceeded},
+		}}); err != nil {
+			t.Fatalf("Failed to create webhook endpoint: %v", err)
+		}
+	}
+	customerID, paymentMethodID := createTestPaymentMethod(t, api)
+	pay := func() {
+		t.Helper()
+		if _, err := api.createPayment(ctx, &CreatePaymentParams{Body: models.CreatePaymentRequest{Amount: 1000, Currency: "usd", CustomerID: customerID, PaymentMethodID: paymentMethodID}}); err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+	}
+	deliver := func() int {
+		t.Helper()
+		done := make(chan int, 1)
+		go func() {
+			sent, err := api.deliverWebhooks(time.Now())
+			if err != nil {
+				t.Errorf("Failed to deliver webhooks: %v", err)
+			}
+			done <- sent
+		}()
+		select {
+		case sent := <-done:
+			return sent
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the run to finish without waiting for the slow endpoint")
+			return 0
+		}
+	}
+	pay()
+
+	type result struct {
+		sent int
+		err  error
+	}
+	first := make(chan result, 1)
+	go func() {
+		sent, err := api.deliverWebhooks(time.Now())
+		first <- result{sent, err}
+	}()
+	select {
+	case <-fastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the fast endpoint to receive its event while the slow one is pending")
+	}
+
+	// A run started meanwhile skips the endpoint still being sent to
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		api.deliveringMu.Lock()
+		pending := len(api.delivering)
+		api.deliveringMu.Unlock()
+		if pending == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected only the slow endpoint to be in flight, got %d endpoints", pending)
+		}
+	}
+	pay()
+	if sent := deliver(); sent != 1 {
+		t.Errorf("Expected only the fast endpoint's delivery, got %d", sent)
+	}
+
+	close(release)
+	if r := <-first; r.err != nil || r.sent != 2 {
+		t.Errorf("Expected 2 deliveries, got %d (%v)", r.sent, r.err)
+	}
+	if sent := deliver(); sent != 1 {
+		t.Errorf("Expected the slow endpoint's second delivery, got %d", sent)
+	}
+
+	// An endpoint's deliveries stop at the first that fails
+	endpoint, err := api.createWebhookEndpoint(ctx, &CreateWebhookEndpointParams{Body: models.CreateWebhookEndpointRequest{
+		URL:           failing.URL,
+		EnabledEvents: models.EnabledEvents{models.EventPaymentSucceeded},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create webhook endpoint: %v", err)
+	}
+	pay()
+	pay()
+	if sent := deliver(); sent != 5 {
+		t.Errorf("Expected 2 deliveries each to the slow and fast endpoints and 1 to the failing one, got %d", sent)
+	}
+	attempts, err := api.listWebhookAttempts(ctx, &ListWebhookAttemptsParams{ID: endpoint.Body.ID, ListParams: ListParams{Limit: 10}})
+	if err != nil {
+		t.Fatalf("Failed to list attempts: %v", err)
+	}
+	if len(attempts.Body.Data) != 1 || attempts.Body.Data[0].Succeeded {
+		t.Errorf("Expected one failed attempt, got %+v", attempts.Body.Data)
 	}
 }
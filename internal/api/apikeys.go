@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/apikeys"
+	"github.com/jeffgrover/payment-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// defaultRollOverlap is how long a rolled key keeps working by default
+const defaultRollOverlap = 24 * time.Hour
+
+// CreateAPIKeyParams represents the parameters for creating an API key
+type CreateAPIKeyParams struct {
+	Body models.CreateAPIKeyRequest
+}
+
+// APIKeyParams represents the parameters for retrieving an API key
+type APIKeyParams struct {
+	ID string `path:"id" description:"API key ID" example:"key_01jh3z9b8c7d6e5f4g3h2j1k0m"`
+}
+
+// RollAPIKeyParams represents the parameters for rolling an API key
+type RollAPIKeyParams struct {
+	ID   string `path:"id" description:"API key ID" example:"key_01jh3z9b8c7d6e5f4g3h2j1k0m"`
+	Body *models.RollAPIKeyRequest
+}
+
+// CreatedAPIKeyResponse wraps a newly created API key with its HTTP status
+type CreatedAPIKeyResponse struct {
+	Status int
+	Body   *models.CreatedAPIKey
+}
+
+// DeleteAPIKeyResponse wraps a deleted API key with its HTTP status
+type DeleteAPIKeyResponse struct {
+	Status int
+	Body   *models.DeletedAPIKey
+}
+
+// registerAPIKeyRoutes registers all API key-related routes
+func (a *API) registerAPIKeyRoutes() {
+	// Create an API key
+	huma.Register(a.API, huma.Operation{
+		OperationID:   "createAPIKey",
+		Summary:       "Create a new API key",
+		Description:   "The key is only returned in the response to this request; store it securely.",
+		Method:        http.MethodPost,
+		Path:          "/v1/api_keys",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"API Keys"},
+	}, a.createAPIKey)
+
+	// List API keys
+	huma.Register(a.API, huma.Operation{
+		OperationID: "listAPIKeys",
+		Summary:     "List API keys that have not expired",
+		Method:      http.MethodGet,
+		Path:        "/v1/api_keys",
+		Tags:        []string{"API Keys"},
+	}, a.listAPIKeys)
+
+	// Roll an API key
+	huma.Register(a.API, huma.Operation{
+		OperationID:   "rollAPIKey",
+		Summary:       "Replace an API key with a new one",
+		Description:   "The old key keeps working for `expires_in` seconds so clients can switch over without downtime.",
+		Method:        http.MethodPost,
+		Path:          "/v1/api_keys/{id}/roll",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"API Keys"},
+	}, a.rollAPIKey)
+
+	// Delete an API key
+	huma.Register(a.API, huma.Operation{
+		OperationID: "deleteAPIKey",
+		Summary:     "Revoke an API key immediately",
+		Method:      http.MethodDelete,
+		Path:        "/v1/api_keys/{id}",
+		Tags:        []string{"API Keys"},
+	}, a.deleteAPIKey)
+}
+
+// createAPIKey creates a new API key
+func (a *API) createAPIKey(ctx context.Context, params *CreateAPIKeyParams) (*CreatedAPIKeyResponse, error) {
+	req := &params.Body
+	if err := validateAPIKeyRequest(req); err != nil {
+		return nil, err
+	}
+	if err := checkKeyMode(ctx, req.Livemode); err != nil {
+		return nil, err
+	}
+
+	key, secret, err := a.apiKeyDB(ctx).CreateAPIKey(req.Type, req.Livemode, req.Permissions)
+	if err != nil {
+		return nil, huma.Error500InternalServerError("Failed to create API key", err)
+	}
+
+	return &CreatedAPIKeyResponse{Status: 201, Body: &models.CreatedAPIKey{APIKey: key, Secret: secret}}, nil
+}
+
+// validateAPIKeyRequest checks a key's type and that only restricted keys
+// have permissions
+func validateAPIKeyRequest(req *models.CreateAPIKeyRequest) error {
+	switch req.Type {
+	case apikeys.TypeRestricted:
+		if err := req.Permissions.Validate(); err != nil {
+			return huma.Error400BadRequest("Invalid permissions: "+err.Error(), err)
+		}
+	case apikeys.TypeSecret, apikeys.TypePublishable:
+		if len(req.Permissions) > 0 {
+			return huma.Error400BadRequest("Only restricted keys have permissions")
+		}
+	default:
+		return huma.Error400BadRequest("Type must be secret, restricted or publishable")
+	}
+	return nil
+}
+
+// listAPIKeys retrieves a list of API keys
+func (a *API) listAPIKeys(ctx context.Context, params *ListParams) (*ListResponse[models.APIKey], error) {
+	keys, err := a.apiKeyDB(ctx).ListAPIKeys(params.page())
+	if err != nil {
+		return nil, listError("API keys", err)
+	}
+
+	return newListResponse("/v1/api_keys", keys), nil
+}
+
+// rollAPIKey replaces an API key with a new one, keeping the old one working
+// for an overlap period
+func (a *API) rollAPIKey(ctx context.Context, params *RollAPIKeyParams) (*CreatedAPIKeyResponse, error) {
+	overlap := defaultRollOverlap
+	if params.Body != nil && params.Body.ExpiresIn != nil {
+		expiresIn := *params.Body.ExpiresIn
+		if expiresIn < 0 || expiresIn > 7*24*60*60 {
+			return nil, huma.Error400BadRequest("expires_in must be between 0 and 604800 seconds")
+		}
+		overlap = time.Duration(expiresIn) * time.Second
+	}
+
+	key, err := a.getAPIKey(ctx, params.ID)
+	if err != nil {
+		return nil, err
+	}
+	if key.IsExpired(time.Now()) {
+		return nil, huma.Error400BadRequest("Expired API keys cannot be rolled")
+	}
+
+	rolled, secret, err := a.apiKeyDB(ctx).RollAPIKey(key, time.Now().Add(overlap))
+	if err != nil {
+		return nil, huma.Error500InternalServerError("Failed to roll API key", err)
+	}
+
+	return &CreatedAPIKeyResponse{Status: 201, Body: &models.CreatedAPIKey{APIKey: rolled, Secret: secret}}, nil
+}
+
+// deleteAPIKey revokes an API key
+func (a *API) deleteAPIKey(ctx context.Context, params *APIKeyParams) (*DeleteAPIKeyResponse, error) {
+	key, err := a.getAPIKey(ctx, params.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.apiKeyDB(ctx).DeleteAPIKey(key); err != nil {
+		return nil, huma.Error500InternalServerError("Failed to delete API key", err)
+	}
+
+	return &DeleteAPIKeyResponse{Status: 200, Body: &models.DeletedAPIKey{ID: key.ID, Deleted: true}}, nil
+}
+
+// getAPIKey retrieves an API key the caller may manage
+func (a *API) getAPIKey(ctx context.Context, id string) (*models.APIKey, error) {
+	key, err := a.apiKeyDB(ctx).GetAPIKey(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("API key not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve API key", err)
+	}
+	if err := checkKeyMode(ctx, key.Livemode); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkKeyMode rejects managing keys of the other mode, so that a leaked test
+// key cannot be used to mint live keys
+func checkKeyMode(ctx context.Context, livemode bool) error {
+	caller := apiKeyFromContext(ctx)
+	if caller != nil && livemode && !caller.Livemode {
+		return newCodedError(http.StatusForbidden, CodePermissionDenied, "Test mode keys cannot manage live mode keys")
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/apikeys"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/models"
+)
+
+// Names of the security schemes in the OpenAPI document
+const (
+	securityScheme      = "apiKey"
+	adminSecurityScheme = "adminKey"
+)
+
+// Error codes returned when a request is not authenticated or not allowed
+const (
+	CodeAuthenticationRequired = "authentication_required"
+	CodeAPIKeyInvalid          = "api_key_invalid"
+	CodeAPIKeyExpired          = "api_key_expired"
+	CodePermissionDenied       = "permission_denied"
+)
+
+// publishableOperations are the operations publishable keys may call. They
+// are meant to be embedded in client-side code, so they can only collect
+// payment details.
+var publishableOperations = map[string]bool{
+	"createPaymentMethod": true,
+}
+
+// tagResources maps operation tags to the resources restricted keys are
+// given permissions on. Operations without one of these tags, such as API key
+// management, cannot be called with restricted keys.
+var tagResources = map[string]string{
+	"Customers":         models.ResourceCustomers,
+	"Payment Methods":   models.ResourcePaymentMethods,
+	"Payments":          models.ResourcePayments,
+	"Refunds":           models.ResourceRefunds,
+	"Webhook Endpoints": models.ResourceWebhookEndpoints,
+}
+
+// authContextKey is the context key under which the authentication result is stored
+type authContextKey struct{}
+
+// authentication is the result of checking a request's API key
+type authentication struct {
+	token string
+	key   *models.APIKey
+	err   error
+}
+
+// authenticate returns middleware that checks the API key in a request's
+// Authorization: Bearer header and stores the result in the request context.
+// Requests are rejected later, by authorize, once their operation is known.
+func authenticate(database *db.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			auth := &authentication{err: db.ErrInvalidAPIKey}
+			if scheme, token, ok := strings.Cut(header, " "); ok && strings.EqualFold(scheme, "Bearer") {
+				auth.token = strings.TrimSpace(token)
+				auth.key, auth.err = database.AuthenticateAPIKey(auth.token, time.Now())
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth)))
+		})
+	}
+}
+
+// authorize returns Huma middleware that rejects requests to operations
+// requiring an API key unless they carry a valid one that may call the
+// operation, and requests to the admin API unless they carry the admin key
+func authorize(api huma.API, adminKey string) func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		if public(api, ctx.Operation()) {
+			next(ctx)
+			return
+		}
+
+		auth, _ := ctx.Context().Value(authContextKey{}).(*authentication)
+		if requires(ctx.Operation(), adminSecurityScheme) {
+			switch {
+			case adminKey == "":
+				writeContextError(ctx, newCodedError(http.StatusForbidden, CodePermissionDenied, "The admin API is disabled; set ADMIN_API_KEY to enable it"))
+			case auth == nil:
+				ctx.SetHeader("WWW-Authenticate", "Bearer")
+				writeContextError(ctx, newCodedError(http.StatusUnauthorized, CodeAuthenticationRequired, "Provide the admin key in the Authorization header as Bearer <key>"))
+			case subtle.ConstantTimeCompare([]byte(auth.token), []byte(adminKey)) != 1:
+				ctx.SetHeader("WWW-Authenticate", "Bearer")
+				writeContextError(ctx, newCodedError(http.StatusUnauthorized, CodeAPIKeyInvalid, "Invalid admin key"))
+			default:
+				next(ctx)
+			}
+			return
+		}
+
+		switch {
+		case auth == nil:
+			ctx.SetHeader("WWW-Authenticate", "Bearer")
+			writeContextError(ctx, newCodedError(http.StatusUnauthorized, CodeAuthenticationRequired, "Provide an API key in the Authorization header as Bearer sk_test_..."))
+		case auth.err == db.ErrInvalidAPIKey:
+			ctx.SetHeader("WWW-Authenticate", "Bearer")
+			writeContextError(ctx, newCodedError(http.StatusUnauthorized, CodeAPIKeyInvalid, "Invalid API key"))
+		case auth.err == db.ErrAPIKeyExpired:
+			ctx.SetHeader("WWW-Authenticate", "Bearer")
+			writeContextError(ctx, newCodedError(http.StatusUnauthorized, CodeAPIKeyExpired, "API key has expired; use the key it was rolled to"))
+		case auth.err != nil:
+			writeContextError(ctx, huma.Error500InternalServerError("Failed to check API key", auth.err))
+		case auth.key.Type == apikeys.TypePublishable && !publishableOperations[ctx.Operation().OperationID]:
+			writeContextError(ctx, newCodedError(http.StatusForbidden, CodePermissionDenied, "Publishable keys can only create payment methods; use a secret key"))
+		case auth.key.Type == apikeys.TypeRestricted:
+			if err := checkPermission(auth.key, ctx.Operation()); err != nil {
+				writeContextError(ctx, err)
+				return
+			}
+			next(ctx)
+		default:
+			next(ctx)
+		}
+	}
+}
+
+// checkPermission returns a 403 error naming the permission a restricted key
+// is missing to call an operation, or nil if it has it
+func checkPermission(key *models.APIKey, op *huma.Operation) *CodedError {
+	resource, access, ok := requiredPermission(op)
+	if !ok {
+		return newCodedError(http.StatusForbidden, CodePermissionDenied, "Restricted keys cannot call "+op.OperationID+"; use a secret key")
+	}
+	if key.Permissions.Allows(resource, access) {
+		return nil
+	}
+	coded := newCodedError(http.StatusForbidden, CodePermissionDenied, "This API key needs the "+resource+":"+access+" permission to call "+op.OperationID)
+	coded.Permission = resource + ":" + access
+	return coded
+}
+
+// requiredPermission returns the resource and access level an operation
+// needs: the resource from its tag, and read access for GET requests or
+// write access otherwise
+func requiredPermission(op *huma.Operation) (resource, access string, ok bool) {
+	for _, tag := range op.Tags {
+		if resource, ok = tagResources[tag]; ok {
+			break
+		}
+	}
+	if !ok {
+		return "", "", false
+	}
+	if op.Method == http.MethodGet {
+		return resource, models.AccessRead, true
+	}
+	return resource, models.AccessWrite, true
+}
+
+// public reports whether an operation can be called without an API key: its
+// security requirements, or the API's if it has none, include an empty one
+func public(api huma.API, op *huma.Operation) bool {
+	security := op.Security
+	if security == nil {
+		security = api.OpenAPI().Security
+	}
+	for _, requirement := range security {
+		if len(requirement) == 0 {
+			return true
+		}
+	}
+	return len(security) == 0
+}
+
+// requires reports whether an operation's own security requirements name a scheme
+func requires(op *huma.Operation, scheme string) bool {
+	for _, requirement := range op.Security {
+		if _, ok := requirement[scheme]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyFromContext returns the API key that authenticated a request, or nil
+func apiKeyFromContext(ctx context.Context) *models.APIKey {
+	if auth, ok := ctx.Value(authContextKey{}).(*authentication); ok && auth.err == nil {
+		return auth.key
+	}
+	return nil
+}
+
+// allowedFromContext reports whether a request's API key has an access level
+// on a resource. Only restricted keys are limited; the operations other keys
+// cannot call at all are rejected by authorize.
+func allowedFromContext(ctx context.Context, resource, access string) bool {
+	key := apiKeyFromContext(ctx)
+	return key == nil || key.Type != apikeys.TypeRestricted || key.Permissions.Allows(resource, access)
+}
+
+// livemodeFromContext reports whether a request was made with a live mode key
+func livemodeFromContext(ctx context.Context) bool {
+	key := apiKeyFromContext(ctx)
+	return key != nil && key.Livemode
+}
+
+// writeContextError writes an error response from Huma middleware
+func writeContextError(ctx huma.Context, err huma.StatusError) {
+	ctx.SetHeader("Content-Type", "application/problem+json")
+	ctx.SetStatus(err.GetStatus())
+	json.NewEncoder(ctx.BodyWriter()).Encode(err)
+}
@@ -2,46 +2,62 @@ package api
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/contact"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/ids"
 	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
+// CreateCustomerParams represents the parameters for creating a customer
+type CreateCustomerParams struct {
+	Body models.CreateCustomerRequest
+}
+
 // CustomerParams represents the parameters for retrieving a customer
 type CustomerParams struct {
-	ID string `path:"id" description:"Customer ID" example:"cus_123456789"`
+	ID string `path:"id" description:"Customer ID" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t"`
+}
+
+// UpdateCustomerParams represents the parameters for updating a customer
+type UpdateCustomerParams struct {
+	ID   string `path:"id" description:"Customer ID" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t"`
+	Body models.UpdateCustomerRequest
 }
 
 // ListCustomersParams represents the parameters for listing customers
 type ListCustomersParams struct {
-	Limit int `query:"limit" description:"Maximum number of customers to return" default:"10" example:"10"`
+	Metadata map[string]string `query:"metadata,deepObject" description:"Filter by metadata, e.g. metadata[order_id]=123"`
+	ListParams
 }
 
-// ListCustomersResponse represents the response for listing customers
-type ListCustomersResponse struct {
-	Data   []models.Customer `json:"data" description:"List of customers"`
-	Status int               `json:"status" example:"200" description:"HTTP status code"`
+// CustomerResponse wraps a customer with its HTTP status
+type CustomerResponse struct {
+	Status int
+	Body   *models.Customer
 }
 
-// CustomerResponse wraps a customer with a status field
-type CustomerResponse struct {
-	*models.Customer
-	Status int `json:"status" example:"200" description:"HTTP status code"`
+// DeleteCustomerResponse wraps a deleted customer with its HTTP status
+type DeleteCustomerResponse struct {
+	Status int
+	Body   *models.DeletedCustomer
 }
 
 // registerCustomerRoutes registers all customer-related routes
 func (a *API) registerCustomerRoutes() {
 	// Create a customer
 	huma.Register(a.API, huma.Operation{
-		OperationID: "createCustomer",
-		Summary:     "Create a new customer",
-		Method:      http.MethodPost,
-		Path:        "/v1/customers",
-		Tags:        []string{"Customers"},
+		OperationID:   "createCustomer",
+		Summary:       "Create a new customer",
+		Method:        http.MethodPost,
+		Path:          "/v1/customers",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"Customers"},
 	}, a.createCustomer)
 
 	// Get a customer by ID
@@ -53,6 +69,24 @@ func (a *API) registerCustomerRoutes() {
 		Tags:        []string{"Customers"},
 	}, a.getCustomer)
 
+	// Update a customer
+	huma.Register(a.API, huma.Operation{
+		OperationID: "updateCustomer",
+		Summary:     "Update a customer",
+		Method:      http.MethodPatch,
+		Path:        "/v1/customers/{id}",
+		Tags:        []string{"Customers"},
+	}, a.updateCustomer)
+
+	// Delete a customer
+	huma.Register(a.API, huma.Operation{
+		OperationID: "deleteCustomer",
+		Summary:     "Delete a customer",
+		Method:      http.MethodDelete,
+		Path:        "/v1/customers/{id}",
+		Tags:        []string{"Customers"},
+	}, a.deleteCustomer)
+
 	// List customers
 	huma.Register(a.API, huma.Operation{
 		OperationID: "listCustomers",
@@ -61,31 +95,189 @@ func (a *API) registerCustomerRoutes() {
 		Path:        "/v1/customers",
 		Tags:        []string{"Customers"},
 	}, a.listCustomers)
+
+	// Search customers
+	huma.Register(a.API, huma.Operation{
+		OperationID: "searchCustomers",
+		Summary:     "Search customers",
+		Description: "Search customers by `email`, `name` or `phone` (substring), `created` and `metadata[\"key\"]`.",
+		Method:      http.MethodGet,
+		Path:        "/v1/customers/search",
+		Tags:        []string{"Customers"},
+	}, a.searchCustomers)
 }
 
 // createCustomer creates a new customer
-func (a *API) createCustomer(ctx context.Context, req *models.CreateCustomerRequest) (*CustomerResponse, error) {
+func (a *API) createCustomer(ctx context.Context, params *CreateCustomerParams) (*CustomerResponse, error) {
+	req := &params.Body
+
+	// Normalize the contact details so equal ones compare equal
+	email, err := contact.NormalizeEmail(req.Email)
+	if err != nil {
+		return nil, contactError(err)
+	}
+	phone, err := contact.NormalizePhone(req.Phone)
+	if err != nil {
+		return nil, contactError(err)
+	}
+	var address models.Address
+	if req.Address != nil {
+		if address, err = normalizeAddress(*req.Address); err != nil {
+			return nil, err
+		}
+	}
+	var shipping models.Shipping
+	if req.Shipping != nil {
+		if shipping, err = normalizeShipping(*req.Shipping); err != nil {
+			return nil, err
+		}
+	}
+	metadata, err := mergeMetadata(nil, req.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new customer
 	customer := &models.Customer{
-		ID:        fmt.Sprintf("cus_%d", time.Now().UnixNano()),
-		Email:     req.Email,
+		ID:        ids.New(ids.Customer),
+		Email:     email,
 		Name:      req.Name,
+		Phone:     phone,
+		Address:   address,
+		Shipping:  shipping,
+		Metadata:  metadata,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 
 	// Save to database
-	if err := a.DB.CreateCustomer(customer); err != nil {
-		return nil, huma.Error400BadRequest("Failed to create customer", err)
+	if err := a.accountDB(ctx).CreateCustomer(customer); err != nil {
+		if err == db.ErrDuplicateEmail {
+			return nil, a.duplicateEmailError(ctx, customer.Email, err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to create customer", err)
 	}
 
-	return &CustomerResponse{Customer: customer, Status: 201}, nil
+	return &CustomerResponse{Status: 201, Body: customer}, nil
 }
 
 // getCustomer retrieves a customer by ID
 func (a *API) getCustomer(ctx context.Context, params *CustomerParams) (*CustomerResponse, error) {
 	// Get customer from database
-	customer, err := a.DB.GetCustomer(params.ID)
+	customer, err := a.accountDB(ctx).GetCustomer(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Customer not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve customer", err)
+	}
+
+	return &CustomerResponse{Status: 200, Body: customer}, nil
+}
+
+// updateCustomer updates a customer
+func (a *API) updateCustomer(ctx context.Context, params *UpdateCustomerParams) (*CustomerResponse, error) {
+	customer, err := a.accountDB(ctx).GetCustomer(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Customer not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve customer", err)
+	}
+
+	if params.Body.Email != nil {
+		if customer.Email, err = contact.NormalizeEmail(*params.Body.Email); err != nil {
+			return nil, contactError(err)
+		}
+	}
+	if params.Body.Name != nil {
+		customer.Name = *params.Body.Name
+	}
+	if params.Body.Phone != nil {
+		if customer.Phone, err = contact.NormalizePhone(*params.Body.Phone); err != nil {
+			return nil, contactError(err)
+		}
+	}
+	if params.Body.Address != nil {
+		if customer.Address, err = normalizeAddress(*params.Body.Address); err != nil {
+			return nil, err
+		}
+	}
+	if params.Body.Shipping != nil {
+		if customer.Shipping, err = normalizeShipping(*params.Body.Shipping); err != nil {
+			return nil, err
+		}
+	}
+	if params.Body.Metadata != nil {
+		if customer.Metadata, err = mergeMetadata(customer.Metadata, params.Body.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	// The default payment method must be attached to this customer
+	if params.Body.DefaultPaymentMethodID != nil {
+		if id := *params.Body.DefaultPaymentMethodID; id != "" {
+			method, err := a.accountDB(ctx).GetPaymentMethodByCustomer(id, customer.ID)
+			if err != nil {
+				if err == gorm.ErrRecordNotFound {
+					return nil, huma.Error400BadRequest("Payment method not found or doesn't belong to customer", err)
+				}
+				return nil, huma.Error500InternalServerError("Failed to verify payment method", err)
+			}
+			if method.DetachedAt != nil {
+				return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodDetached, "Detached payment methods cannot be the default")
+			}
+		}
+		customer.DefaultPaymentMethodID = *params.Body.DefaultPaymentMethodID
+	}
+
+	if err := a.accountDB(ctx).UpdateCustomer(customer); err != nil {
+		if err == db.ErrDuplicateEmail {
+			return nil, a.duplicateEmailError(ctx, customer.Email, err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to update customer", err)
+	}
+
+	return &CustomerResponse{Status: 200, Body: customer}, nil
+}
+
+// duplicateEmailError builds the 409 error returned when another customer
+// already has an email, pointing at that customer
+func (a *API) duplicateEmailError(ctx context.Context, email string, err error) error {
+	existing, findErr := a.accountDB(ctx).FindCustomerByEmail(email)
+	if findErr != nil {
+		return huma.Error500InternalServerError("Failed to save customer", err, findErr)
+	}
+	coded := newCodedError(http.StatusConflict, CodeDuplicateCustomerEmail, "A customer with this email already exists as "+existing.ID, err)
+	coded.CustomerID = existing.ID
+	return coded
+}
+
+// normalizeAddress validates and upper-cases an address's country code
+func normalizeAddress(address models.Address) (models.Address, error) {
+	country, err := contact.NormalizeCountry(address.Country)
+	if err != nil {
+		return address, contactError(err)
+	}
+	address.Country = country
+	return address, nil
+}
+
+// normalizeShipping validates shipping details' phone number and address
+func normalizeShipping(shipping models.Shipping) (models.Shipping, error) {
+	phone, err := contact.NormalizePhone(shipping.Phone)
+	if err != nil {
+		return shipping, contactError(err)
+	}
+	shipping.Phone = phone
+	shipping.Address, err = normalizeAddress(shipping.Address)
+	return shipping, err
+}
+
+// deleteCustomer soft-deletes a customer, detaching their payment methods so
+// no new payments can be made while keeping their payment history
+func (a *API) deleteCustomer(ctx context.Context, params *CustomerParams) (*DeleteCustomerResponse, error) {
+	customer, err := a.accountDB(ctx).GetCustomer(params.ID)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, huma.Error404NotFound("Customer not found", err)
@@ -93,19 +285,39 @@ func (a *API) getCustomer(ctx context.Context, params *CustomerParams) (*Custome
 		return nil, huma.Error500InternalServerError("Failed to retrieve customer", err)
 	}
 
-	return &CustomerResponse{Customer: customer, Status: 200}, nil
+	tokens, err := a.accountDB(ctx).DeleteCustomer(customer)
+	if err != nil {
+		return nil, huma.Error500InternalServerError("Failed to delete customer", err)
+	}
+	for _, token := range tokens {
+		if err := a.Vault.Delete(token); err != nil {
+			log.Error().Err(err).Str("customer", customer.ID).Msg("Failed to delete detached card from vault")
+		}
+	}
+
+	return &DeleteCustomerResponse{Status: 200, Body: &models.DeletedCustomer{ID: customer.ID, Deleted: true}}, nil
 }
 
 // listCustomers retrieves a list of customers
-func (a *API) listCustomers(ctx context.Context, params *ListCustomersParams) (*ListCustomersResponse, error) {
+func (a *API) listCustomers(ctx context.Context, params *ListCustomersParams) (*ListResponse[models.Customer], error) {
 	// Get customers from database
-	customers, err := a.DB.ListCustomers(params.Limit)
+	customers, err := a.accountDB(ctx).ListCustomers(db.CustomerFilter{
+		Metadata: params.Metadata,
+		Page:     params.page(),
+	})
+	if err != nil {
+		return nil, listError("customers", err)
+	}
+
+	return newListResponse("/v1/customers", customers), nil
+}
+
+// searchCustomers retrieves the customers matching a search query
+func (a *API) searchCustomers(ctx context.Context, params *SearchParams) (*ListResponse[models.Customer], error) {
+	customers, err := a.accountDB(ctx).SearchCustomers(params.Query, params.page())
 	if err != nil {
-		return nil, huma.Error500InternalServerError("Failed to list customers", err)
+		return nil, listError("customers", err)
 	}
 
-	return &ListCustomersResponse{
-		Data:   customers,
-		Status: 200,
-	}, nil
+	return newListResponse("/v1/customers/search", customers), nil
 }
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/bank"
+	"github.com/jeffgrover/payment-api/internal/cards"
+	"github.com/jeffgrover/payment-api/internal/contact"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/processor"
+	"github.com/jeffgrover/payment-api/internal/statemachine"
+)
+
+// Error codes returned in the code field of error responses
+const (
+	CodePaymentAlreadySucceeded = "payment_already_succeeded"
+	CodePaymentUnexpectedState  = "payment_unexpected_state"
+	CodeAuthorizationExpired    = "authorization_expired"
+	CodeConcurrentUpdate        = "concurrent_update"
+	CodeRefundExceedsBalance    = "refund_exceeds_balance"
+	CodeDuplicatePaymentMethod  = "duplicate_payment_method"
+	CodePaymentMethodDetached   = "payment_method_detached"
+	CodePaymentMethodAttached   = "payment_method_attached"
+	CodeInvalidSearchQuery      = "invalid_search_query"
+	CodeInvalidMetadata         = "invalid_metadata"
+	CodeDuplicateCustomerEmail  = "duplicate_customer_email"
+)
+
+// CodedError is an error response with a machine-readable code so that
+// clients can branch on the failure without parsing the message
+type CodedError struct {
+	*huma.ErrorModel
+	Code            string `json:"code" example:"payment_already_succeeded" description:"Machine-readable error code"`
+	CustomerID      string `json:"customer_id,omitempty" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t" description:"ID of the customer the error relates to, if any"`
+	PaymentID       string `json:"payment_id,omitempty" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k" description:"ID of the payment the error relates to, if any"`
+	PaymentMethodID string `json:"payment_method_id,omitempty" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g" description:"ID of the payment method the error relates to, if any"`
+	Permission      string `json:"permission,omitempty" example:"payments:write" description:"Permission the API key is missing, if any"`
+}
+
+// newCodedError creates an error response with the given status and code
+func newCodedError(status int, code, msg string, errs ...error) *CodedError {
+	model, ok := huma.NewError(status, msg, errs...).(*huma.ErrorModel)
+	if !ok {
+		model = &huma.ErrorModel{Status: status, Title: http.StatusText(status), Detail: msg}
+	}
+	return &CodedError{ErrorModel: model, Code: code}
+}
+
+// paymentUpdateError maps a failed payment update to an API error
+func paymentUpdateError(action string, err error) error {
+	var transition *statemachine.TransitionError
+	if errors.As(err, &transition) {
+		return newCodedError(http.StatusBadRequest, CodePaymentUnexpectedState, transition.Error(), err)
+	}
+	if err == db.ErrConcurrentUpdate {
+		return newCodedError(http.StatusConflict, CodeConcurrentUpdate, "Payment was modified by another request; retry", err)
+	}
+	return huma.Error500InternalServerError("Failed to "+action+" payment", err)
+}
+
+// processorError maps a processor failure to an API error. Declines are
+// returned as 402 errors carrying the processor's decline code.
+func processorError(err error, paymentID string) error {
+	var decline *processor.DeclineError
+	if errors.As(err, &decline) {
+		coded := newCodedError(http.StatusPaymentRequired, decline.Code, decline.Message, err)
+		coded.PaymentID = paymentID
+		return coded
+	}
+	if errors.Is(err, processor.ErrNotConfigured) {
+		return huma.Error503ServiceUnavailable("Live mode payments are unavailable: no payment processor is configured", err)
+	}
+	return huma.Error502BadGateway("Payment processor request failed", err)
+}
+
+// paymentMethodError maps a card or bank account validation failure to a 400
+// error carrying the validation code
+func paymentMethodError(err error) error {
+	var card *cards.Error
+	if errors.As(err, &card) {
+		return newCodedError(http.StatusBadRequest, card.Code, card.Message, err)
+	}
+	var account *bank.Error
+	if errors.As(err, &account) {
+		return newCodedError(http.StatusBadRequest, account.Code, account.Message, err)
+	}
+	return huma.Error400BadRequest("Invalid payment method", err)
+}
+
+// contactError maps an email, phone or country validation failure to a 400
+// error carrying the validation code
+func contactError(err error) error {
+	var invalid *contact.Error
+	if errors.As(err, &invalid) {
+		return newCodedError(http.StatusBadRequest, invalid.Code, invalid.Message, err)
+	}
+	return huma.Error400BadRequest("Invalid contact details", err)
+}
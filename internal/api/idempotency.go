@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header carrying a client-chosen key
+	// that makes a POST request safe to retry
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader is set on responses replayed from a stored
+	// idempotent request
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLength bounds the size of client-chosen keys
+	maxIdempotencyKeyLength = 255
+
+	// maxIdempotentBodySize bounds the request body read for fingerprinting
+	maxIdempotentBodySize = 1 << 20
+)
+
+// Error codes returned by the idempotency middleware
+const (
+	CodeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	CodeIdempotencyKeyMismatch   = "idempotency_key_mismatch"
+	CodeIdempotencyKeyInvalid    = "idempotency_key_invalid"
+)
+
+// idempotency returns middleware that makes POST requests carrying an
+// Idempotency-Key header safe to retry. The first request with a key is
+// processed and its response stored; identical retries replay the stored
+// response, while reusing the key for a different request or while the first
+// is still in flight returns 409. Keys are scoped to the account and mode of
+// the API key, and requests without a valid API key are passed through to be
+// rejected. Responses with a 5xx, 401 or 403 status are not stored.
+func idempotency(database *db.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientKey := r.Header.Get(IdempotencyKeyHeader)
+			apiKey := apiKeyFromContext(r.Context())
+			if r.Method != http.MethodPost || clientKey == "" || apiKey == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(clientKey) > maxIdempotencyKeyLength {
+				writeError(w, newCodedError(http.StatusBadRequest, CodeIdempotencyKeyInvalid, "Idempotency key must be at most 255 characters"))
+				return
+			}
+			key := db.IdempotencyScope(apiKey.AccountID, apiKey.Livemode) + clientKey
+
+			// Read the body so it can be fingerprinted and then handed on;
+			// reading one byte past the limit detects bodies that would
+			// otherwise be silently truncated
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+			if err != nil {
+				writeError(w, huma.Error400BadRequest("Failed to read request body", err))
+				return
+			}
+			if len(body) > maxIdempotentBodySize {
+				writeError(w, huma.NewError(http.StatusRequestEntityTooLarge, "Request body must be at most 1 MB"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			stored, err := database.BeginIdempotentRequest(key, fingerprint(r, body), time.Now())
+			switch {
+			case err == db.ErrIdempotencyKeyInProgress:
+				writeError(w, newCodedError(http.StatusConflict, CodeIdempotencyKeyInProgress, "A request with this idempotency key is still being processed; retry later", err))
+				return
+			case err == db.ErrIdempotencyKeyMismatch:
+				writeError(w, newCodedError(http.StatusConflict, CodeIdempotencyKeyMismatch, "Idempotency key was already used for a different request", err))
+				return
+			case err != nil:
+				writeError(w, huma.Error500InternalServerError("Failed to check idempotency key", err))
+				return
+			case stored != nil:
+				replay(w, stored.StatusCode, stored.ResponseHeaders, stored.ResponseBody)
+				return
+			}
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				// Server errors are not stored so that the request can be
+				// retried, and neither are requests the API key was not
+				// allowed to make, so that e.g. a publishable key cannot use
+				// up a key its account's secret key goes on to send
+				if p := recover(); p != nil {
+					release(database, key)
+					panic(p)
+				}
+				if rec.status >= http.StatusInternalServerError || rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden {
+					release(database, key)
+					return
+				}
+				headers, err := json.Marshal(rec.Header())
+				if err == nil {
+					err = database.CompleteIdempotentRequest(key, rec.status, string(headers), rec.body.Bytes())
+				}
+				if err != nil {
+					log.Error().Err(err).Str("key", key).Msg("Failed to store idempotent response")
+					release(database, key)
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// fingerprint identifies a request by its method, path and body
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replay writes a stored response
+func replay(w http.ResponseWriter, status int, headers string, body []byte) {
+	var header http.Header
+	if err := json.Unmarshal([]byte(headers), &header); err == nil {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// release forgets an idempotency key, logging any failure
+func release(database *db.DB, key string) {
+	if err := database.ReleaseIdempotencyKey(key); err != nil {
+		log.Error().Err(err).Str("key", key).Msg("Failed to release idempotency key")
+	}
+}
+
+// writeError writes an error response outside of a Huma handler
+func writeError(w http.ResponseWriter, err huma.StatusError) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(err.GetStatus())
+	json.NewEncoder(w).Encode(err)
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/ids"
+)
+
+// idResource describes the objects addressed by a /v1/{resource}/{id} path
+type idResource struct {
+	prefix string
+	name   string
+}
+
+// idResources maps each collection to the prefix of its IDs
+var idResources = map[string]idResource{
+	"customers":         {ids.Customer, "Customer"},
+	"payment_methods":   {ids.PaymentMethod, "Payment method"},
+	"payments":          {ids.Payment, "Payment"},
+	"refunds":           {ids.Refund, "Refund"},
+	"api_keys":          {ids.APIKey, "API key"},
+	"webhook_endpoints": {ids.WebhookEndpoint, "Webhook endpoint"},
+}
+
+// validateIDs rejects requests whose {id} path parameter is not a well-formed
+// ID for the collection with a 404, without looking it up in the database
+func validateIDs(api huma.API) func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		// Paths look like /v1/{collection}/{id}/...
+		segments := strings.Split(ctx.Operation().Path, "/")
+		if len(segments) > 3 && segments[3] == "{id}" {
+			if resource, ok := idResources[segments[2]]; ok && !ids.Valid(resource.prefix, ctx.Param("id")) {
+				huma.WriteErr(api, ctx, http.StatusNotFound, resource.name+" not found")
+				return
+			}
+		}
+		next(ctx)
+	}
+}
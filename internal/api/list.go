@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/search"
+)
+
+// ListParams represents the pagination parameters shared by all list endpoints
+type ListParams struct {
+	Limit         int    `query:"limit" description:"Maximum number of objects to return" default:"10" minimum:"1" maximum:"100" example:"10"`
+	StartingAfter string `query:"starting_after" description:"Cursor from a previous response's next_cursor; returns the page that follows it"`
+	EndingBefore  string `query:"ending_before" description:"Cursor from a previous response's previous_cursor; returns the page that precedes it"`
+}
+
+// SearchParams represents the parameters shared by all search endpoints
+type SearchParams struct {
+	Query string `query:"query" required:"true" description:"Search query, e.g. email:\"jane@\" AND created>2025-01-01" example:"email:\"jane@\""`
+	ListParams
+}
+
+// page converts the list parameters to database pagination options
+func (p ListParams) page() db.Page {
+	return db.Page{
+		Limit:         p.Limit,
+		StartingAfter: p.StartingAfter,
+		EndingBefore:  p.EndingBefore,
+	}
+}
+
+// List represents a page of objects in a Stripe-style list envelope
+type List[T any] struct {
+	Object         string `json:"object" example:"list" description:"Always 'list'"`
+	Data           []T    `json:"data" description:"Objects on this page, newest first"`
+	HasMore        bool   `json:"has_more" example:"false" description:"Whether more objects are available beyond this page"`
+	URL            string `json:"url" example:"/v1/customers" description:"URL for accessing this list"`
+	NextCursor     string `json:"next_cursor,omitempty" description:"Cursor to pass as starting_after for the next page"`
+	PreviousCursor string `json:"previous_cursor,omitempty" description:"Cursor to pass as ending_before for the previous page"`
+}
+
+// ListResponse wraps a list envelope with its HTTP status
+type ListResponse[T any] struct {
+	Status int
+	Body   *List[T]
+}
+
+// newList wraps a page of database records in a list envelope
+func newList[T any](url string, list *db.List[T]) *List[T] {
+	data := list.Data
+	if data == nil {
+		data = []T{}
+	}
+	return &List[T]{
+		Object:         "list",
+		Data:           data,
+		HasMore:        list.HasMore,
+		URL:            url,
+		NextCursor:     list.NextCursor,
+		PreviousCursor: list.PreviousCursor,
+	}
+}
+
+// newListResponse responds with a page of database records in a list envelope
+func newListResponse[T any](url string, list *db.List[T]) *ListResponse[T] {
+	return &ListResponse[T]{Status: 200, Body: newList(url, list)}
+}
+
+// listError maps a failed list or search query to an API error
+func listError(resource string, err error) error {
+	if err == db.ErrInvalidCursor {
+		return huma.Error400BadRequest("Invalid pagination cursor", err)
+	}
+	var invalid *search.Error
+	if errors.As(err, &invalid) {
+		return newCodedError(http.StatusBadRequest, CodeInvalidSearchQuery, invalid.Error(), err)
+	}
+	return huma.Error500InternalServerError("Failed to list "+resource, err)
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+)
+
+// mergeMetadata applies metadata from a create or update request to an
+// object's current metadata, returning a 400 error if the updates or the
+// result break the metadata limits
+func mergeMetadata(current, updates models.Metadata) (models.Metadata, error) {
+	if err := updates.Validate(); err != nil {
+		return nil, newCodedError(http.StatusBadRequest, CodeInvalidMetadata, err.Error(), err)
+	}
+	merged := current.Merge(updates)
+	if err := merged.Validate(); err != nil {
+		return nil, newCodedError(http.StatusBadRequest, CodeInvalidMetadata, err.Error(), err)
+	}
+	return merged, nil
+}
@@ -2,47 +2,69 @@ package api
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/apikeys"
+	"github.com/jeffgrover/payment-api/internal/bank"
+	"github.com/jeffgrover/payment-api/internal/cards"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/ids"
 	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
+// CreatePaymentMethodParams represents the parameters for creating a payment method
+type CreatePaymentMethodParams struct {
+	Body models.CreatePaymentMethodRequest
+}
+
 // PaymentMethodParams represents the parameters for retrieving a payment method
 type PaymentMethodParams struct {
-	ID string `path:"id" description:"Payment Method ID" example:"pm_123456789"`
+	ID string `path:"id" description:"Payment Method ID" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g"`
 }
 
-// ListPaymentMethodsParams represents the parameters for listing payment methods
-type ListPaymentMethodsParams struct {
-	CustomerID string `query:"customer_id" description:"Filter by customer ID" example:"cus_123456789"`
-	Limit      int    `query:"limit" description:"Maximum number of payment methods to return" default:"10" example:"10"`
+// UpdatePaymentMethodParams represents the parameters for updating a payment method
+type UpdatePaymentMethodParams struct {
+	ID   string `path:"id" description:"Payment Method ID" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g"`
+	Body models.UpdatePaymentMethodRequest
 }
 
-// ListPaymentMethodsResponse represents the response for listing payment methods
-type ListPaymentMethodsResponse struct {
-	Data   []models.PaymentMethod `json:"data" description:"List of payment methods"`
-	Status int                    `json:"status" example:"200" description:"HTTP status code"`
+// AttachPaymentMethodParams represents the parameters for attaching a payment method to a customer
+type AttachPaymentMethodParams struct {
+	ID   string `path:"id" description:"Payment Method ID" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g"`
+	Body models.AttachPaymentMethodRequest
+}
+
+// ListPaymentMethodsParams represents the parameters for listing payment methods
+type ListPaymentMethodsParams struct {
+	CustomerID  string            `query:"customer_id" description:"Filter by customer ID" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t"`
+	Type        string            `query:"type" enum:"card,bank_account" description:"Filter by payment method type" example:"card"`
+	Brand       string            `query:"brand" description:"Filter by card brand" example:"visa"`
+	Fingerprint string            `query:"fingerprint" description:"Filter by card fingerprint" example:"3f1c0b7e9a5d2c4e8b6a1f0d9c7e5b3a"`
+	Metadata    map[string]string `query:"metadata,deepObject" description:"Filter by metadata, e.g. metadata[order_id]=123"`
+	ListParams
 }
 
-// PaymentMethodResponse wraps a payment method with a status field
+// PaymentMethodResponse wraps a payment method with its HTTP status
 type PaymentMethodResponse struct {
-	*models.PaymentMethod
-	Status int `json:"status" example:"200" description:"HTTP status code"`
+	Status int
+	Body   *models.PaymentMethod
 }
 
 // registerPaymentMethodRoutes registers all payment method-related routes
 func (a *API) registerPaymentMethodRoutes() {
 	// Create a payment method
 	huma.Register(a.API, huma.Operation{
-		OperationID: "createPaymentMethod",
-		Summary:     "Create a new payment method",
-		Method:      http.MethodPost,
-		Path:        "/v1/payment_methods",
-		Tags:        []string{"Payment Methods"},
+		OperationID:   "createPaymentMethod",
+		Summary:       "Create a new payment method",
+		Description:   "Publishable keys can only create payment methods without a customer, which are then attached to one with a secret key.",
+		Method:        http.MethodPost,
+		Path:          "/v1/payment_methods",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"Payment Methods"},
 	}, a.createPaymentMethod)
 
 	// Get a payment method by ID
@@ -54,6 +76,33 @@ func (a *API) registerPaymentMethodRoutes() {
 		Tags:        []string{"Payment Methods"},
 	}, a.getPaymentMethod)
 
+	// Update a payment method
+	huma.Register(a.API, huma.Operation{
+		OperationID: "updatePaymentMethod",
+		Summary:     "Update a payment method's expiry date or billing details",
+		Method:      http.MethodPatch,
+		Path:        "/v1/payment_methods/{id}",
+		Tags:        []string{"Payment Methods"},
+	}, a.updatePaymentMethod)
+
+	// Attach a payment method to a customer
+	huma.Register(a.API, huma.Operation{
+		OperationID: "attachPaymentMethod",
+		Summary:     "Attach a payment method created without a customer to one",
+		Method:      http.MethodPost,
+		Path:        "/v1/payment_methods/{id}/attach",
+		Tags:        []string{"Payment Methods"},
+	}, a.attachPaymentMethod)
+
+	// Detach a payment method from its customer
+	huma.Register(a.API, huma.Operation{
+		OperationID: "detachPaymentMethod",
+		Summary:     "Detach a payment method from its customer",
+		Method:      http.MethodPost,
+		Path:        "/v1/payment_methods/{id}/detach",
+		Tags:        []string{"Payment Methods"},
+	}, a.detachPaymentMethod)
+
 	// List payment methods
 	huma.Register(a.API, huma.Operation{
 		OperationID: "listPaymentMethods",
@@ -65,57 +114,271 @@ func (a *API) registerPaymentMethodRoutes() {
 }
 
 // createPaymentMethod creates a new payment method
-func (a *API) createPaymentMethod(ctx context.Context, req *models.CreatePaymentMethodRequest) (*PaymentMethodResponse, error) {
+func (a *API) createPaymentMethod(ctx context.Context, params *CreatePaymentMethodParams) (*PaymentMethodResponse, error) {
+	req := &params.Body
+
+	// Publishable keys are public, so they cannot add cards to, or probe,
+	// customers; their payment methods are attached later with a secret key
+	if key := apiKeyFromContext(ctx); key != nil && key.Type == apikeys.TypePublishable && req.CustomerID != "" {
+		return nil, newCodedError(http.StatusForbidden, CodePermissionDenied,
+			"Publishable keys cannot set customer_id; create the payment method without it and attach it with a secret key")
+	}
+
 	// Verify customer exists
-	_, err := a.DB.GetCustomer(req.CustomerID)
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, huma.Error400BadRequest("Customer not found", err)
+	if req.CustomerID != "" {
+		if err := a.verifyCustomer(ctx, req.CustomerID); err != nil {
+			return nil, err
 		}
-		return nil, huma.Error500InternalServerError("Failed to verify customer", err)
+	}
+	metadata, err := mergeMetadata(nil, req.Metadata)
+	if err != nil {
+		return nil, err
 	}
 
-	// In a real app, you'd validate and process card details securely
-	// This is a simplified version
 	paymentMethod := &models.PaymentMethod{
-		ID:         fmt.Sprintf("pm_%d", time.Now().UnixNano()),
-		CustomerID: req.CustomerID,
-		Type:       req.Type,
-		Last4:      req.CardNumber[len(req.CardNumber)-4:],
-		ExpMonth:   req.ExpMonth,
-		ExpYear:    req.ExpYear,
-		Brand:      "visa", // Simplified - would be detected from card number
-		CreatedAt:  time.Now(),
+		ID:             ids.New(ids.PaymentMethod),
+		CustomerID:     req.CustomerID,
+		Type:           req.Type,
+		BillingDetails: req.BillingDetails,
+		Metadata:       metadata,
+		CreatedAt:      time.Now(),
+	}
+
+	switch req.Type {
+	case models.PaymentMethodTypeCard:
+		// Validate the card and identify its brand
+		details, err := cards.Validate(cards.Card{
+			Number:   req.CardNumber,
+			CVC:      req.Cvc,
+			ExpMonth: req.ExpMonth,
+			ExpYear:  req.ExpYear,
+		}, time.Now())
+		if err != nil {
+			return nil, paymentMethodError(err)
+		}
+		paymentMethod.Last4 = details.Last4
+		paymentMethod.ExpMonth = req.ExpMonth
+		paymentMethod.ExpYear = req.ExpYear
+		paymentMethod.Brand = details.Brand
+		paymentMethod.Funding = details.Funding
+
+		// Optionally refuse to attach the same card to a customer twice
+		number := cards.Normalize(req.CardNumber)
+		if req.CustomerID != "" {
+			if err := a.checkDuplicateCard(ctx, req.CustomerID, a.Vault.Fingerprint(number)); err != nil {
+				return nil, err
+			}
+		}
+
+		// Encrypt the card number; the security code is never stored
+		card, err := a.Vault.Store(number)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("Failed to store card", err)
+		}
+		paymentMethod.Fingerprint = card.Fingerprint
+		paymentMethod.VaultToken = card.Token
+	case models.PaymentMethodTypeBankAccount:
+		// Validate the routing and account numbers
+		details, err := bank.Validate(bank.Account{
+			RoutingNumber:     req.RoutingNumber,
+			AccountNumber:     req.AccountNumber,
+			AccountHolderType: req.AccountHolderType,
+			AccountType:       req.AccountType,
+		})
+		if err != nil {
+			return nil, paymentMethodError(err)
+		}
+		paymentMethod.Last4 = details.Last4
+		paymentMethod.BankName = details.BankName
+		paymentMethod.RoutingNumber = details.RoutingNumber
+		paymentMethod.AccountHolderType = details.AccountHolderType
+		paymentMethod.AccountType = details.AccountType
+	default:
+		return nil, huma.Error400BadRequest("Type must be card or bank_account")
 	}
 
 	// Save to database
-	if err := a.DB.CreatePaymentMethod(paymentMethod); err != nil {
+	if err := a.accountDB(ctx).CreatePaymentMethod(paymentMethod); err != nil {
+		if paymentMethod.VaultToken != "" {
+			a.Vault.Delete(paymentMethod.VaultToken)
+		}
 		return nil, huma.Error500InternalServerError("Failed to create payment method", err)
 	}
 
-	return &PaymentMethodResponse{PaymentMethod: paymentMethod, Status: 201}, nil
+	return &PaymentMethodResponse{Status: 201, Body: paymentMethod}, nil
 }
 
 // getPaymentMethod retrieves a payment method by ID
 func (a *API) getPaymentMethod(ctx context.Context, params *PaymentMethodParams) (*PaymentMethodResponse, error) {
 	// Get payment method from database
-	method, err := a.DB.GetPaymentMethod(params.ID)
+	method, err := a.accountDB(ctx).GetPaymentMethod(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Payment method not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve payment method", err)
+	}
+
+	return &PaymentMethodResponse{Status: 200, Body: method}, nil
+}
+
+// updatePaymentMethod updates a payment method's expiry date, billing details or metadata
+func (a *API) updatePaymentMethod(ctx context.Context, params *UpdatePaymentMethodParams) (*PaymentMethodResponse, error) {
+	method, err := a.accountDB(ctx).GetPaymentMethod(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Payment method not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve payment method", err)
+	}
+	if method.DetachedAt != nil {
+		return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodDetached, "Detached payment methods cannot be updated")
+	}
+
+	// Only cards have an expiry date, and the new one must not have passed
+	if params.Body.ExpMonth != nil || params.Body.ExpYear != nil {
+		if method.Type != models.PaymentMethodTypeCard {
+			return nil, huma.Error400BadRequest("Only cards have an expiry date")
+		}
+		if params.Body.ExpMonth != nil {
+			method.ExpMonth = *params.Body.ExpMonth
+		}
+		if params.Body.ExpYear != nil {
+			method.ExpYear = *params.Body.ExpYear
+		}
+		if err := cards.ValidateExpiry(method.ExpMonth, method.ExpYear, time.Now()); err != nil {
+			return nil, paymentMethodError(err)
+		}
+	}
+	if params.Body.BillingDetails != nil {
+		method.BillingDetails = *params.Body.BillingDetails
+	}
+	if params.Body.Metadata != nil {
+		if method.Metadata, err = mergeMetadata(method.Metadata, params.Body.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.accountDB(ctx).UpdatePaymentMethod(method); err != nil {
+		if err == db.ErrPaymentMethodDetached {
+			return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodDetached, "Detached payment methods cannot be updated", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to update payment method", err)
+	}
+	method.Expired = method.IsExpired(time.Now())
+
+	return &PaymentMethodResponse{Status: 200, Body: method}, nil
+}
+
+// attachPaymentMethod attaches a payment method created without a customer,
+// such as with a publishable key, to one
+func (a *API) attachPaymentMethod(ctx context.Context, params *AttachPaymentMethodParams) (*PaymentMethodResponse, error) {
+	method, err := a.accountDB(ctx).GetPaymentMethod(params.ID)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, huma.Error404NotFound("Payment method not found", err)
 		}
 		return nil, huma.Error500InternalServerError("Failed to retrieve payment method", err)
 	}
+	if method.DetachedAt != nil {
+		return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodDetached, "Detached payment methods cannot be attached")
+	}
+	if method.CustomerID != "" {
+		return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodAttached, "Payment method is already attached to a customer")
+	}
+	if err := a.verifyCustomer(ctx, params.Body.CustomerID); err != nil {
+		return nil, err
+	}
+	if method.Fingerprint != "" {
+		if err := a.checkDuplicateCard(ctx, params.Body.CustomerID, method.Fingerprint); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.accountDB(ctx).AttachPaymentMethod(method, params.Body.CustomerID); err != nil {
+		switch err {
+		case db.ErrPaymentMethodDetached:
+			return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodDetached, "Detached payment methods cannot be attached", err)
+		case db.ErrPaymentMethodAttached:
+			return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodAttached, "Payment method is already attached to a customer", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to attach payment method", err)
+	}
 
-	return &PaymentMethodResponse{PaymentMethod: method, Status: 200}, nil
+	return &PaymentMethodResponse{Status: 200, Body: method}, nil
+}
+
+// verifyCustomer checks that a customer a payment method is attached to
+// exists in the caller's account and mode
+func (a *API) verifyCustomer(ctx context.Context, customerID string) error {
+	if _, err := a.accountDB(ctx).GetCustomer(customerID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return huma.Error400BadRequest("Customer not found", err)
+		}
+		return huma.Error500InternalServerError("Failed to verify customer", err)
+	}
+	return nil
+}
+
+// checkDuplicateCard returns a 409 naming the customer's existing payment
+// method for a card when duplicate cards are rejected and it has one
+func (a *API) checkDuplicateCard(ctx context.Context, customerID, fingerprint string) error {
+	if !a.config.RejectDuplicateCards {
+		return nil
+	}
+	existing, err := a.accountDB(ctx).FindPaymentMethodByFingerprint(customerID, fingerprint)
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return huma.Error500InternalServerError("Failed to check for duplicate card", err)
+	}
+	coded := newCodedError(http.StatusConflict, CodeDuplicatePaymentMethod, "This card is already attached to the customer as "+existing.ID)
+	coded.PaymentMethodID = existing.ID
+	return coded
+}
+
+// detachPaymentMethod detaches a payment method from its customer and removes
+// its card number from the vault
+func (a *API) detachPaymentMethod(ctx context.Context, params *PaymentMethodParams) (*PaymentMethodResponse, error) {
+	method, err := a.accountDB(ctx).GetPaymentMethod(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Payment method not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve payment method", err)
+	}
+
+	token := method.VaultToken
+	if err := a.accountDB(ctx).DetachPaymentMethod(method); err != nil {
+		if err == db.ErrPaymentMethodDetached {
+			return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodDetached, "Payment method is already detached", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to detach payment method", err)
+	}
+	if token != "" {
+		if err := a.Vault.Delete(token); err != nil {
+			log.Error().Err(err).Str("payment_method", method.ID).Msg("Failed to delete detached card from vault")
+		}
+	}
+
+	return &PaymentMethodResponse{Status: 200, Body: method}, nil
 }
 
 // listPaymentMethods retrieves a list of payment methods
-func (a *API) listPaymentMethods(ctx context.Context, params *ListPaymentMethodsParams) (*ListPaymentMethodsResponse, error) {
-	// This would typically filter by customer ID and apply limits
-	// For simplicity, we'll just return an empty list for now
-	return &ListPaymentMethodsResponse{
-		Data:   []models.PaymentMethod{},
-		Status: 200,
-	}, nil
+func (a *API) listPaymentMethods(ctx context.Context, params *ListPaymentMethodsParams) (*ListResponse[models.PaymentMethod], error) {
+	// Get payment methods from database
+	methods, err := a.accountDB(ctx).ListPaymentMethods(db.PaymentMethodFilter{
+		CustomerID:  params.CustomerID,
+		Type:        params.Type,
+		Brand:       params.Brand,
+		Fingerprint: params.Fingerprint,
+		Metadata:    params.Metadata,
+		Page:        params.page(),
+	})
+	if err != nil {
+		return nil, listError("payment methods", err)
+	}
+
+	return newListResponse("/v1/payment_methods", methods), nil
 }
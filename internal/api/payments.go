@@ -2,41 +2,69 @@ package api
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/ids"
 	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/jeffgrover/payment-api/internal/processor"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
+// CreatePaymentParams represents the parameters for creating a payment
+type CreatePaymentParams struct {
+	Body models.CreatePaymentRequest
+}
+
 // PaymentParams represents the parameters for retrieving a payment
 type PaymentParams struct {
-	ID string `path:"id" description:"Payment ID" example:"pay_123456789"`
+	ID string `path:"id" description:"Payment ID" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k"`
 }
 
-// ListPaymentsParams represents the parameters for listing payments
-type ListPaymentsParams struct {
-	CustomerID string `query:"customer_id" description:"Filter by customer ID" example:"cus_123456789"`
-	Limit      int    `query:"limit" description:"Maximum number of payments to return" default:"10" example:"10"`
+// UpdatePaymentParams represents the parameters for updating a payment
+type UpdatePaymentParams struct {
+	ID   string `path:"id" description:"Payment ID" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k"`
+	Body models.UpdatePaymentRequest
+}
+
+// CapturePaymentParams represents the parameters for capturing a payment
+type CapturePaymentParams struct {
+	ID   string `path:"id" description:"Payment ID" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k"`
+	Body *models.CapturePaymentRequest
+}
+
+// CancelPaymentParams represents the parameters for canceling a payment
+type CancelPaymentParams struct {
+	ID   string `path:"id" description:"Payment ID" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k"`
+	Body *models.CancelPaymentRequest
 }
 
-// ListPaymentsResponse represents the response for listing payments
-type ListPaymentsResponse struct {
-	Data   []models.Payment `json:"data" description:"List of payments"`
-	Status int              `json:"status" example:"200" description:"HTTP status code"`
+// ListPaymentsParams represents the parameters for listing payments
+type ListPaymentsParams struct {
+	CustomerID string            `query:"customer_id" description:"Filter by customer ID" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t"`
+	Status     string            `query:"status" description:"Filter by payment status" example:"succeeded"`
+	Currency   string            `query:"currency" description:"Filter by three-letter ISO currency code" example:"usd"`
+	Created    db.Range          `query:"created,deepObject" description:"Filter by creation time as Unix timestamps, e.g. created[gte]=1672531200"`
+	Amount     db.Range          `query:"amount,deepObject" description:"Filter by amount in cents, e.g. amount[lt]=5000"`
+	Metadata   map[string]string `query:"metadata,deepObject" description:"Filter by metadata, e.g. metadata[order_id]=123"`
+	ListParams
 }
 
 // registerPaymentRoutes registers all payment-related routes
 func (a *API) registerPaymentRoutes() {
 	// Create a payment
 	huma.Register(a.API, huma.Operation{
-		OperationID: "createPayment",
-		Summary:     "Create a new payment",
-		Method:      http.MethodPost,
-		Path:        "/v1/payments",
-		Tags:        []string{"Payments"},
+		OperationID:   "createPayment",
+		Summary:       "Create a new payment",
+		Method:        http.MethodPost,
+		Path:          "/v1/payments",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"Payments"},
 	}, a.createPayment)
 
 	// Get a payment by ID
@@ -48,6 +76,42 @@ func (a *API) registerPaymentRoutes() {
 		Tags:        []string{"Payments"},
 	}, a.getPayment)
 
+	// Update a payment
+	huma.Register(a.API, huma.Operation{
+		OperationID: "updatePayment",
+		Summary:     "Update a payment's description or metadata",
+		Method:      http.MethodPatch,
+		Path:        "/v1/payments/{id}",
+		Tags:        []string{"Payments"},
+	}, a.updatePayment)
+
+	// Capture an authorized payment
+	huma.Register(a.API, huma.Operation{
+		OperationID: "capturePayment",
+		Summary:     "Capture an authorized payment",
+		Method:      http.MethodPost,
+		Path:        "/v1/payments/{id}/capture",
+		Tags:        []string{"Payments"},
+	}, a.capturePayment)
+
+	// Cancel a payment
+	huma.Register(a.API, huma.Operation{
+		OperationID: "cancelPayment",
+		Summary:     "Cancel a pending or uncaptured payment",
+		Method:      http.MethodPost,
+		Path:        "/v1/payments/{id}/cancel",
+		Tags:        []string{"Payments"},
+	}, a.cancelPayment)
+
+	// Get a payment's status history
+	huma.Register(a.API, huma.Operation{
+		OperationID: "getPaymentHistory",
+		Summary:     "List a payment's status transitions",
+		Method:      http.MethodGet,
+		Path:        "/v1/payments/{id}/history",
+		Tags:        []string{"Payments"},
+	}, a.getPaymentHistory)
+
 	// List payments
 	huma.Register(a.API, huma.Operation{
 		OperationID: "listPayments",
@@ -56,60 +120,164 @@ func (a *API) registerPaymentRoutes() {
 		Path:        "/v1/payments",
 		Tags:        []string{"Payments"},
 	}, a.listPayments)
+
+	// Search payments
+	huma.Register(a.API, huma.Operation{
+		OperationID: "searchPayments",
+		Summary:     "Search payments",
+		Description: "Search payments by `amount`, `status`, `currency`, `customer`, `description` (substring), `created` and `metadata`.",
+		Method:      http.MethodGet,
+		Path:        "/v1/payments/search",
+		Tags:        []string{"Payments"},
+	}, a.searchPayments)
 }
 
-// PaymentResponse wraps a payment with a status field
-type PaymentResponse struct {
+// PaymentBody represents a payment as returned by the API
+type PaymentBody struct {
 	*models.Payment
-	Status int `json:"status" example:"200" description:"HTTP status code"`
+	Refunds *List[models.Refund] `json:"refunds,omitempty" description:"The payment's most recent refunds (retrieve only, and omitted for restricted keys without refunds:read)"`
+}
+
+// PaymentResponse wraps a payment with its HTTP status
+type PaymentResponse struct {
+	Status int
+	Body   *PaymentBody
 }
 
 // createPayment creates a new payment
-func (a *API) createPayment(ctx context.Context, req *models.CreatePaymentRequest) (*PaymentResponse, error) {
+func (a *API) createPayment(ctx context.Context, params *CreatePaymentParams) (*PaymentResponse, error) {
+	req := &params.Body
+	if req.Amount < 1 {
+		return nil, huma.Error400BadRequest("amount must be at least 1")
+	}
+
 	// Verify customer exists
-	_, err := a.DB.GetCustomer(req.CustomerID)
+	customer, err := a.accountDB(ctx).GetCustomer(req.CustomerID)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, huma.Error400BadRequest("Customer not found", err)
 		}
 		return nil, huma.Error500InternalServerError("Failed to verify customer", err)
 	}
+	metadata, err := mergeMetadata(nil, req.Metadata)
+	if err != nil {
+		return nil, err
+	}
 
-	// Verify payment method exists and belongs to customer
-	_, err = a.DB.GetPaymentMethodByCustomer(req.PaymentMethodID, req.CustomerID)
+	// Fall back to the customer's default payment method
+	methodID := req.PaymentMethodID
+	if methodID == "" {
+		methodID = customer.DefaultPaymentMethodID
+	}
+	if methodID == "" {
+		return nil, huma.Error400BadRequest("payment_method_id is required when the customer has no default payment method")
+	}
+
+	// Verify payment method exists, belongs to customer and is still attached
+	method, err := a.accountDB(ctx).GetPaymentMethodByCustomer(methodID, req.CustomerID)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, huma.Error400BadRequest("Payment method not found or doesn't belong to customer", err)
 		}
 		return nil, huma.Error500InternalServerError("Failed to verify payment method", err)
 	}
+	if method.DetachedAt != nil {
+		return nil, newCodedError(http.StatusBadRequest, CodePaymentMethodDetached, "Detached payment methods cannot be charged")
+	}
+
+	captureMethod := req.CaptureMethod
+	if captureMethod == "" {
+		captureMethod = models.CaptureMethodAutomatic
+	}
+	if captureMethod != models.CaptureMethodAutomatic && captureMethod != models.CaptureMethodManual {
+		return nil, huma.Error400BadRequest("capture_method must be automatic or manual")
+	}
 
-	// In a real app, you'd process the payment through a payment processor
-	// This is a simplified version that always succeeds
+	now := time.Now()
 	payment := &models.Payment{
-		ID:              fmt.Sprintf("pay_%d", time.Now().UnixNano()),
+		ID:              ids.New(ids.Payment),
 		Amount:          req.Amount,
 		Currency:        req.Currency,
 		CustomerID:      req.CustomerID,
-		PaymentMethodID: req.PaymentMethodID,
-		Status:          "succeeded",
+		PaymentMethodID: methodID,
+		CaptureMethod:   captureMethod,
 		Description:     req.Description,
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		Metadata:        metadata,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+
+	// Process the payment; manual capture only places an authorization hold
+	result, err := a.processorFor(livemodeFromContext(ctx)).Authorize(ctx, processor.AuthorizeRequest{
+		Amount:        req.Amount,
+		Currency:      req.Currency,
+		PaymentMethod: method,
+		Capture:       captureMethod == models.CaptureMethodAutomatic,
+	})
+	var decline *processor.DeclineError
+	switch {
+	case errors.As(err, &decline):
+		payment.Status = models.PaymentStatusFailed
+		payment.FailureCode = decline.Code
+		payment.FailureMessage = decline.Message
+	case err != nil:
+		return nil, processorError(err, "")
+	case captureMethod == models.CaptureMethodManual:
+		captureBefore := now.Add(a.config.AuthorizationWindow)
+		payment.Status = models.PaymentStatusRequiresCapture
+		payment.CaptureBefore = &captureBefore
+		payment.ProcessorReference = result.Reference
+	default:
+		payment.Status = models.PaymentStatusSucceeded
+		payment.AmountCaptured = req.Amount
+		payment.CapturedAt = &now
+		payment.ProcessorReference = result.Reference
 	}
 
 	// Save to database
-	if err := a.DB.CreatePayment(payment); err != nil {
+	if err := a.accountDB(ctx).CreatePayment(payment, models.ActorAPI); err != nil {
 		return nil, huma.Error500InternalServerError("Failed to create payment", err)
 	}
 
-	return &PaymentResponse{Payment: payment, Status: 201}, nil
+	// Declined payments are kept for the record but reported as errors
+	if decline != nil {
+		return nil, processorError(decline, payment.ID)
+	}
+
+	return &PaymentResponse{Status: 201, Body: &PaymentBody{Payment: payment}}, nil
 }
 
 // getPayment retrieves a payment by ID
 func (a *API) getPayment(ctx context.Context, params *PaymentParams) (*PaymentResponse, error) {
 	// Get payment from database
-	payment, err := a.DB.GetPayment(params.ID)
+	payment, err := a.accountDB(ctx).GetPayment(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Payment not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve payment", err)
+	}
+
+	// Include the payment's refunds so they can be seen alongside the
+	// charge, unless the key is not allowed to read refunds
+	body := &PaymentBody{Payment: payment}
+	if allowedFromContext(ctx, models.ResourceRefunds, models.AccessRead) {
+		refunds, err := a.accountDB(ctx).ListRefunds(db.RefundFilter{
+			PaymentID: payment.ID,
+			Page:      db.Page{Limit: db.MaxLimit},
+		})
+		if err != nil {
+			return nil, huma.Error500InternalServerError("Failed to retrieve refunds", err)
+		}
+		body.Refunds = newList("/v1/refunds?payment_id="+url.QueryEscape(payment.ID), refunds)
+	}
+
+	return &PaymentResponse{Status: 200, Body: body}, nil
+}
+
+// updatePayment updates a payment's description or metadata
+func (a *API) updatePayment(ctx context.Context, params *UpdatePaymentParams) (*PaymentResponse, error) {
+	payment, err := a.accountDB(ctx).GetPayment(params.ID)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, huma.Error404NotFound("Payment not found", err)
@@ -117,15 +285,211 @@ func (a *API) getPayment(ctx context.Context, params *PaymentParams) (*PaymentRe
 		return nil, huma.Error500InternalServerError("Failed to retrieve payment", err)
 	}
 
-	return &PaymentResponse{Payment: payment, Status: 200}, nil
+	if params.Body.Description != nil {
+		payment.Description = *params.Body.Description
+	}
+	if params.Body.Metadata != nil {
+		if payment.Metadata, err = mergeMetadata(payment.Metadata, params.Body.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.accountDB(ctx).UpdatePaymentDetails(payment); err != nil {
+		return nil, huma.Error500InternalServerError("Failed to update payment", err)
+	}
+
+	return &PaymentResponse{Status: 200, Body: &PaymentBody{Payment: payment}}, nil
+}
+
+// capturePayment captures all or part of an authorized payment
+func (a *API) capturePayment(ctx context.Context, params *CapturePaymentParams) (*PaymentResponse, error) {
+	// Get payment from database
+	payment, err := a.accountDB(ctx).GetPayment(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Payment not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve payment", err)
+	}
+
+	// Verify payment is awaiting capture
+	if payment.Status != models.PaymentStatusRequiresCapture {
+		return nil, newCodedError(http.StatusBadRequest, CodePaymentUnexpectedState, "Payment is "+payment.Status+" and cannot be captured")
+	}
+
+	now := time.Now()
+	if payment.CaptureBefore != nil && now.After(*payment.CaptureBefore) {
+		// If this fails the background job tries again
+		if err := a.expireAuthorization(ctx, payment, now); err != nil && err != db.ErrConcurrentUpdate {
+			log.Error().Err(err).Str("payment", payment.ID).Msg("Failed to expire authorization")
+		}
+		return nil, newCodedError(http.StatusBadRequest, CodeAuthorizationExpired, "Authorization has expired")
+	}
+
+	// Verify capture amount is valid
+	var amount int64
+	if params.Body != nil {
+		amount = params.Body.AmountToCapture
+	}
+	if amount == 0 {
+		amount = payment.Amount
+	}
+	if amount < 0 || amount > payment.Amount {
+		return nil, huma.Error400BadRequest("amount_to_capture must be between 1 and the authorized amount")
+	}
+
+	// Capture through the processor; any uncaptured remainder is released
+	if _, err := a.processorFor(payment.Livemode).Capture(ctx, payment.ProcessorReference, amount); err != nil {
+		return nil, processorError(err, payment.ID)
+	}
+	payment.Status = models.PaymentStatusSucceeded
+	payment.AmountCaptured = amount
+	payment.CapturedAt = &now
+
+	// Save to database. If that fails, e.g. because the payment was canceled
+	// while it was being captured, give the money back so the processor
+	// agrees with the stored status.
+	if err := a.accountDB(ctx).UpdatePayment(payment, models.ActorAPI); err != nil {
+		if _, refundErr := a.processorFor(payment.Livemode).Refund(context.WithoutCancel(ctx), payment.ProcessorReference, amount); refundErr != nil {
+			log.Error().Err(refundErr).Str("payment", payment.ID).Int64("amount", amount).Msg("Failed to reverse capture of a payment that could not be saved")
+		}
+		return nil, paymentUpdateError("capture", err)
+	}
+
+	return &PaymentResponse{Status: 200, Body: &PaymentBody{Payment: payment}}, nil
+}
+
+// cancelPayment voids a payment that has not been captured yet
+func (a *API) cancelPayment(ctx context.Context, params *CancelPaymentParams) (*PaymentResponse, error) {
+	// Get payment from database
+	payment, err := a.accountDB(ctx).GetPayment(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Payment not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve payment", err)
+	}
+
+	// Verify payment can be canceled
+	switch payment.Status {
+	case models.PaymentStatusPending, models.PaymentStatusRequiresCapture:
+	case models.PaymentStatusSucceeded:
+		return nil, newCodedError(http.StatusBadRequest, CodePaymentAlreadySucceeded, "Payment has already succeeded; create a refund instead")
+	default:
+		return nil, newCodedError(http.StatusBadRequest, CodePaymentUnexpectedState, "Payment is "+payment.Status+" and cannot be canceled")
+	}
+
+	// Verify cancellation reason is valid
+	var reason string
+	if params.Body != nil {
+		reason = params.Body.CancellationReason
+	}
+	switch reason {
+	case "", models.CancellationReasonDuplicate, models.CancellationReasonFraudulent,
+		models.CancellationReasonRequestedByCustomer, models.CancellationReasonAbandoned:
+	default:
+		return nil, huma.Error400BadRequest("cancellation_reason must be one of duplicate, fraudulent, requested_by_customer or abandoned")
+	}
+
+	// Release the authorization hold at the processor
+	if payment.ProcessorReference != "" {
+		if err := a.processorFor(payment.Livemode).Void(ctx, payment.ProcessorReference); err != nil {
+			return nil, processorError(err, payment.ID)
+		}
+	}
+	now := time.Now()
+	payment.Status = models.PaymentStatusCanceled
+	payment.CancellationReason = reason
+	payment.CanceledAt = &now
+
+	// Save to database
+	if err := a.accountDB(ctx).UpdatePayment(payment, models.ActorAPI); err != nil {
+		return nil, paymentUpdateError("cancel", err)
+	}
+
+	return &PaymentResponse{Status: 200, Body: &PaymentBody{Payment: payment}}, nil
+}
+
+// expireAuthorization voids an authorization whose window has passed at the
+// processor, then cancels its payment. The hold is released first, like
+// cancelPayment does, so a payment is never canceled while its money is
+// still held.
+func (a *API) expireAuthorization(ctx context.Context, payment *models.Payment, now time.Time) error {
+	if payment.ProcessorReference != "" {
+		if err := a.processorFor(payment.Livemode).Void(ctx, payment.ProcessorReference); err != nil {
+			return err
+		}
+	}
+	return a.accountDB(ctx).ExpireAuthorization(payment, now)
+}
+
+// expireDueAuthorizations expires every uncaptured payment whose
+// authorization window ended before the given time and returns the number
+// expired. Payments that cannot be voided are left for the next run.
+func (a *API) expireDueAuthorizations(now time.Time) (int64, error) {
+	payments, err := a.DB.ExpiredAuthorizations(now)
+	if err != nil {
+		return 0, err
+	}
+
+	var expired int64
+	for i := range payments {
+		if err := a.expireAuthorization(context.Background(), &payments[i], now); err != nil {
+			// Captured or canceled since it was read
+			if err != db.ErrConcurrentUpdate {
+				log.Warn().Err(err).Str("payment", payments[i].ID).Msg("Failed to expire authorization; will retry")
+			}
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// getPaymentHistory retrieves every status transition of a payment, oldest first
+func (a *API) getPaymentHistory(ctx context.Context, params *PaymentParams) (*ListResponse[models.PaymentStatusTransition], error) {
+	// Verify payment exists
+	if _, err := a.accountDB(ctx).GetPayment(params.ID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Payment not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve payment", err)
+	}
+
+	// Get history from database
+	history, err := a.accountDB(ctx).GetPaymentHistory(params.ID)
+	if err != nil {
+		return nil, huma.Error500InternalServerError("Failed to retrieve payment history", err)
+	}
+
+	return newListResponse("/v1/payments/"+params.ID+"/history", &db.List[models.PaymentStatusTransition]{Data: history}), nil
 }
 
 // listPayments retrieves a list of payments
-func (a *API) listPayments(ctx context.Context, params *ListPaymentsParams) (*ListPaymentsResponse, error) {
-	// This would typically filter by customer ID and apply limits
-	// For simplicity, we'll just return an empty list for now
-	return &ListPaymentsResponse{
-		Data:   []models.Payment{},
-		Status: 200,
-	}, nil
+func (a *API) listPayments(ctx context.Context, params *ListPaymentsParams) (*ListResponse[models.Payment], error) {
+	// Get payments from database
+	payments, err := a.accountDB(ctx).ListPayments(db.PaymentFilter{
+		CustomerID: params.CustomerID,
+		Status:     params.Status,
+		Currency:   params.Currency,
+		Created:    params.Created,
+		Amount:     params.Amount,
+		Metadata:   params.Metadata,
+		Page:       params.page(),
+	})
+	if err != nil {
+		return nil, listError("payments", err)
+	}
+
+	return newListResponse("/v1/payments", payments), nil
+}
+
+// searchPayments retrieves the payments matching a search query
+func (a *API) searchPayments(ctx context.Context, params *SearchParams) (*ListResponse[models.Payment], error) {
+	payments, err := a.accountDB(ctx).SearchPayments(params.Query, params.page())
+	if err != nil {
+		return nil, listError("payments", err)
+	}
+
+	return newListResponse("/v1/payments/search", payments), nil
 }
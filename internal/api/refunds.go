@@ -2,47 +2,67 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/ids"
 	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/jeffgrover/payment-api/internal/processor"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
+// refundSaveAttempts is how many times the outcome of a processed refund is
+// saved before giving up
+const refundSaveAttempts = 3
+
+// CreateRefundParams represents the parameters for creating a refund
+type CreateRefundParams struct {
+	Body models.CreateRefundRequest
+}
+
 // RefundParams represents the parameters for retrieving a refund
 type RefundParams struct {
-	ID string `path:"id" description:"Refund ID" example:"ref_123456789"`
+	ID string `path:"id" description:"Refund ID" example:"ref_01jh3z8m9n0p1q2r3s4t5v6w7x"`
 }
 
-// ListRefundsParams represents the parameters for listing refunds
-type ListRefundsParams struct {
-	PaymentID string `query:"payment_id" description:"Filter by payment ID" example:"pay_123456789"`
-	Limit     int    `query:"limit" description:"Maximum number of refunds to return" default:"10" example:"10"`
+// UpdateRefundParams represents the parameters for updating a refund
+type UpdateRefundParams struct {
+	ID   string `path:"id" description:"Refund ID" example:"ref_01jh3z8m9n0p1q2r3s4t5v6w7x"`
+	Body models.UpdateRefundRequest
 }
 
-// ListRefundsResponse represents the response for listing refunds
-type ListRefundsResponse struct {
-	Data   []models.Refund `json:"data" description:"List of refunds"`
-	Status int             `json:"status" example:"200" description:"HTTP status code"`
+// ListRefundsParams represents the parameters for listing refunds
+type ListRefundsParams struct {
+	PaymentID string            `query:"payment_id" description:"Filter by payment ID" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k"`
+	Status    string            `query:"status" enum:"pending,succeeded,failed" description:"Filter by refund status" example:"succeeded"`
+	Reason    string            `query:"reason" description:"Filter by refund reason" example:"requested_by_customer"`
+	Created   db.Range          `query:"created,deepObject" description:"Filter by creation time as Unix timestamps, e.g. created[gte]=1672531200"`
+	Metadata  map[string]string `query:"metadata,deepObject" description:"Filter by metadata, e.g. metadata[order_id]=123"`
+	ListParams
 }
 
-// RefundResponse wraps a refund with a status field
+// RefundResponse wraps a refund with its HTTP status
 type RefundResponse struct {
-	*models.Refund
-	Status int `json:"status" example:"200" description:"HTTP status code"`
+	Status int
+	Body   *models.Refund
 }
 
 // registerRefundRoutes registers all refund-related routes
 func (a *API) registerRefundRoutes() {
 	// Create a refund
 	huma.Register(a.API, huma.Operation{
-		OperationID: "createRefund",
-		Summary:     "Create a new refund",
-		Method:      http.MethodPost,
-		Path:        "/v1/refunds",
-		Tags:        []string{"Refunds"},
+		OperationID:   "createRefund",
+		Summary:       "Create a new refund",
+		Description:   "Returns `202` with the refund still `pending` if the processor refunded the money but the outcome could not be saved.",
+		Method:        http.MethodPost,
+		Path:          "/v1/refunds",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"Refunds"},
 	}, a.createRefund)
 
 	// Get a refund by ID
@@ -54,6 +74,15 @@ func (a *API) registerRefundRoutes() {
 		Tags:        []string{"Refunds"},
 	}, a.getRefund)
 
+	// Update a refund
+	huma.Register(a.API, huma.Operation{
+		OperationID: "updateRefund",
+		Summary:     "Update a refund's metadata",
+		Method:      http.MethodPatch,
+		Path:        "/v1/refunds/{id}",
+		Tags:        []string{"Refunds"},
+	}, a.updateRefund)
+
 	// List refunds
 	huma.Register(a.API, huma.Operation{
 		OperationID: "listRefunds",
@@ -65,50 +94,117 @@ func (a *API) registerRefundRoutes() {
 }
 
 // createRefund creates a new refund
-func (a *API) createRefund(ctx context.Context, req *models.CreateRefundRequest) (*RefundResponse, error) {
+func (a *API) createRefund(ctx context.Context, params *CreateRefundParams) (*RefundResponse, error) {
+	req := &params.Body
+	if req.Amount < 1 {
+		return nil, huma.Error400BadRequest("amount must be at least 1")
+	}
+
 	// Verify payment exists
-	payment, err := a.DB.GetPayment(req.PaymentID)
+	payment, err := a.accountDB(ctx).GetPayment(req.PaymentID)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, huma.Error400BadRequest("Payment not found", err)
 		}
 		return nil, huma.Error500InternalServerError("Failed to verify payment", err)
 	}
-
-	// Verify payment can be refunded
-	if payment.Status != "succeeded" {
-		return nil, huma.Error400BadRequest("Payment cannot be refunded", nil)
+	metadata, err := mergeMetadata(nil, req.Metadata)
+	if err != nil {
+		return nil, err
 	}
 
-	// Verify refund amount is valid
-	if req.Amount > payment.Amount {
-		return nil, huma.Error400BadRequest("Refund amount exceeds payment amount", nil)
+	// Verify payment can be refunded
+	if payment.Status != models.PaymentStatusSucceeded && payment.Status != models.PaymentStatusPartiallyRefunded {
+		return nil, newCodedError(http.StatusBadRequest, CodePaymentUnexpectedState, "Payment is "+payment.Status+" and cannot be refunded")
 	}
 
-	// In a real app, you'd process the refund through the payment processor
-	// This is a simplified version that always succeeds
+	// Reserve the refund amount against the payment's remaining balance
 	refund := &models.Refund{
-		ID:        fmt.Sprintf("ref_%d", time.Now().UnixNano()),
+		ID:        ids.New(ids.Refund),
 		PaymentID: req.PaymentID,
 		Amount:    req.Amount,
-		Status:    "succeeded",
 		Reason:    req.Reason,
+		Metadata:  metadata,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
-
-	// Save to database
-	if err := a.DB.CreateRefund(refund); err != nil {
+	if err := a.accountDB(ctx).CreateRefund(refund); err != nil {
+		if err == db.ErrRefundExceedsBalance {
+			refundable, refundableErr := a.accountDB(ctx).RefundableAmount(payment)
+			if refundableErr != nil {
+				return nil, huma.Error500InternalServerError("Failed to create refund", refundableErr)
+			}
+			return nil, newCodedError(http.StatusBadRequest, CodeRefundExceedsBalance,
+				fmt.Sprintf("Refund exceeds the remaining refundable amount of %d", refundable), err)
+		}
 		return nil, huma.Error500InternalServerError("Failed to create refund", err)
 	}
 
-	return &RefundResponse{Refund: refund, Status: 201}, nil
+	// Process the refund; processor failures are recorded on a failed refund
+	status := models.RefundStatusSucceeded
+	result, err := a.processorFor(payment.Livemode).Refund(ctx, payment.ProcessorReference, req.Amount)
+	var decline *processor.DeclineError
+	switch {
+	case errors.As(err, &decline):
+		status = models.RefundStatusFailed
+		refund.FailureReason = decline.Code
+	case err != nil:
+		status = models.RefundStatusFailed
+		refund.FailureReason = processor.CodeProcessingError
+	default:
+		refund.ProcessorReference = result.Reference
+	}
+
+	// Save the outcome and apply it to the payment. The money has already
+	// moved, so a refund that cannot be saved is retried and then logged for
+	// reconciliation; a successful one is returned as still pending rather
+	// than as an error the client might retry.
+	if err := a.completeRefund(ctx, refund, status); err != nil {
+		log.Error().Err(err).Str("refund", refund.ID).Str("payment", payment.ID).Int64("amount", refund.Amount).
+			Str("status", status).Str("processor_reference", refund.ProcessorReference).
+			Msg("Refund was processed but could not be saved; it needs reconciliation")
+		if status != models.RefundStatusSucceeded {
+			return nil, huma.Error500InternalServerError("Failed to complete refund", err)
+		}
+		refund.Status = models.RefundStatusPending
+		return &RefundResponse{Status: http.StatusAccepted, Body: refund}, nil
+	}
+
+	return &RefundResponse{Status: 201, Body: refund}, nil
+}
+
+// completeRefund saves the outcome of a processed refund, trying again a few
+// times if that fails
+func (a *API) completeRefund(ctx context.Context, refund *models.Refund, status string) error {
+	var err error
+	for attempt := range refundSaveAttempts {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		if err = a.accountDB(ctx).CompleteRefund(refund, status, models.ActorAPI); err == nil {
+			return nil
+		}
+	}
+	return err
 }
 
 // getRefund retrieves a refund by ID
 func (a *API) getRefund(ctx context.Context, params *RefundParams) (*RefundResponse, error) {
 	// Get refund from database
-	refund, err := a.DB.GetRefund(params.ID)
+	refund, err := a.accountDB(ctx).GetRefund(params.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Refund not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve refund", err)
+	}
+
+	return &RefundResponse{Status: 200, Body: refund}, nil
+}
+
+// updateRefund updates a refund's metadata
+func (a *API) updateRefund(ctx context.Context, params *UpdateRefundParams) (*RefundResponse, error) {
+	refund, err := a.accountDB(ctx).GetRefund(params.ID)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, huma.Error404NotFound("Refund not found", err)
@@ -116,15 +212,33 @@ func (a *API) getRefund(ctx context.Context, params *RefundParams) (*RefundRespo
 		return nil, huma.Error500InternalServerError("Failed to retrieve refund", err)
 	}
 
-	return &RefundResponse{Refund: refund, Status: 200}, nil
+	if params.Body.Metadata != nil {
+		if refund.Metadata, err = mergeMetadata(refund.Metadata, params.Body.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.accountDB(ctx).UpdateRefundMetadata(refund); err != nil {
+		return nil, huma.Error500InternalServerError("Failed to update refund", err)
+	}
+
+	return &RefundResponse{Status: 200, Body: refund}, nil
 }
 
 // listRefunds retrieves a list of refunds
-func (a *API) listRefunds(ctx context.Context, params *ListRefundsParams) (*ListRefundsResponse, error) {
-	// This would typically filter by payment ID and apply limits
-	// For simplicity, we'll just return an empty list for now
-	return &ListRefundsResponse{
-		Data:   []models.Refund{},
-		Status: 200,
-	}, nil
+func (a *API) listRefunds(ctx context.Context, params *ListRefundsParams) (*ListResponse[models.Refund], error) {
+	// Get refunds from database
+	refunds, err := a.accountDB(ctx).ListRefunds(db.RefundFilter{
+		PaymentID: params.PaymentID,
+		Status:    params.Status,
+		Reason:    params.Reason,
+		Created:   params.Created,
+		Metadata:  params.Metadata,
+		Page:      params.page(),
+	})
+	if err != nil {
+		return nil, listError("refunds", err)
+	}
+
+	return newListResponse("/v1/refunds", refunds), nil
 }
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// DeletedTestDataResponse wraps the counts of deleted test mode data with its HTTP status
+type DeletedTestDataResponse struct {
+	Status int
+	Body   *models.DeletedTestData
+}
+
+// registerTestDataRoutes registers the routes that manage test mode data
+func (a *API) registerTestDataRoutes() {
+	// Delete all test mode data
+	huma.Register(a.API, huma.Operation{
+		OperationID: "deleteTestData",
+		Summary:     "Delete all test mode data",
+		Description: "Permanently deletes the account's test mode customers, payment methods, payments, refunds, webhook endpoints and events. Live mode data is not affected. Requires a secret key.",
+		Method:      http.MethodDelete,
+		Path:        "/v1/test_data",
+		Tags:        []string{"Test Data"},
+	}, a.deleteTestData)
+}
+
+// deleteTestData permanently deletes the caller's account's test mode data
+func (a *API) deleteTestData(ctx context.Context, input *struct{}) (*DeletedTestDataResponse, error) {
+	key := apiKeyFromContext(ctx)
+	if key == nil {
+		return nil, newCodedError(http.StatusUnauthorized, CodeAuthenticationRequired, "Provide an API key in the Authorization header as Bearer sk_test_...")
+	}
+
+	deleted, tokens, err := a.DB.DeleteTestData(key.AccountID)
+	if err != nil {
+		return nil, huma.Error500InternalServerError("Failed to delete test data", err)
+	}
+	for _, token := range tokens {
+		if err := a.Vault.Delete(token); err != nil {
+			log.Error().Err(err).Str("account", key.AccountID).Msg("Failed to delete test card from vault")
+		}
+	}
+
+	return &DeletedTestDataResponse{Status: 200, Body: deleted}, nil
+}
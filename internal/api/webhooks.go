@@ -0,0 +1,363 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jeffgrover/payment-api/internal/db"
+	"github.com/jeffgrover/payment-api/internal/ids"
+	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/jeffgrover/payment-api/internal/webhooks"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	// webhookBatchSize is the most deliveries sent per run of the dispatcher
+	webhookBatchSize = 100
+
+	// webhookEndpointBatchSize is the most deliveries to one endpoint sent per
+	// run, so that one endpoint's backlog cannot fill a batch
+	webhookEndpointBatchSize = 10
+
+	// webhookConcurrency is the most endpoints sent to at once. Each
+	// endpoint's deliveries are sent one at a time and stop at the first
+	// that fails, so a slow or unreachable endpoint holds one of these slots
+	// for at most webhookEndpointBatchSize sender timeouts.
+	webhookConcurrency = 10
+)
+
+// CreateWebhookEndpointParams represents the parameters for creating a webhook endpoint
+type CreateWebhookEndpointParams struct {
+	Body models.CreateWebhookEndpointRequest
+}
+
+// WebhookEndpointParams represents the parameters for retrieving a webhook endpoint
+type WebhookEndpointParams struct {
+	ID string `path:"id" description:"Webhook endpoint ID" example:"we_01jh3zb2c3d4e5f6g7h8j9k0m1"`
+}
+
+// ListWebhookAttemptsParams represents the parameters for listing the
+// delivery attempts of a webhook endpoint
+type ListWebhookAttemptsParams struct {
+	ID string `path:"id" description:"Webhook endpoint ID" example:"we_01jh3zb2c3d4e5f6g7h8j9k0m1"`
+	ListParams
+}
+
+// WebhookEndpointResponse wraps a webhook endpoint with its HTTP status
+type WebhookEndpointResponse struct {
+	Status int
+	Body   *models.WebhookEndpoint
+}
+
+// CreatedWebhookEndpointResponse wraps a newly created webhook endpoint with its HTTP status
+type CreatedWebhookEndpointResponse struct {
+	Status int
+	Body   *models.CreatedWebhookEndpoint
+}
+
+// DeleteWebhookEndpointResponse wraps a deleted webhook endpoint with its HTTP status
+type DeleteWebhookEndpointResponse struct {
+	Status int
+	Body   *models.DeletedWebhookEndpoint
+}
+
+// registerWebhookRoutes registers all webhook endpoint-related routes
+func (a *API) registerWebhookRoutes() {
+	// Create a webhook endpoint
+	huma.Register(a.API, huma.Operation{
+		OperationID:   "createWebhookEndpoint",
+		Summary:       "Create a new webhook endpoint",
+		Description:   "Events of the enabled types are POSTed to the URL, signed with the secret in the `Signature` header. The secret is only returned in the response to this request. URLs that resolve to private, loopback or link-local addresses are refused.",
+		Method:        http.MethodPost,
+		Path:          "/v1/webhook_endpoints",
+		DefaultStatus: http.StatusCreated,
+		Tags:          []string{"Webhook Endpoints"},
+	}, a.createWebhookEndpoint)
+
+	// List webhook endpoints
+	huma.Register(a.API, huma.Operation{
+		OperationID: "listWebhookEndpoints",
+		Summary:     "List webhook endpoints",
+		Method:      http.MethodGet,
+		Path:        "/v1/webhook_endpoints",
+		Tags:        []string{"Webhook Endpoints"},
+	}, a.listWebhookEndpoints)
+
+	// Get a webhook endpoint by ID
+	huma.Register(a.API, huma.Operation{
+		OperationID: "getWebhookEndpoint",
+		Summary:     "Get a webhook endpoint by ID",
+		Method:      http.MethodGet,
+		Path:        "/v1/webhook_endpoints/{id}",
+		Tags:        []string{"Webhook Endpoints"},
+	}, a.getWebhookEndpoint)
+
+	// Delete a webhook endpoint
+	huma.Register(a.API, huma.Operation{
+		OperationID: "deleteWebhookEndpoint",
+		Summary:     "Delete a webhook endpoint",
+		Description: "Events that have not been delivered to the endpoint yet are dropped.",
+		Method:      http.MethodDelete,
+		Path:        "/v1/webhook_endpoints/{id}",
+		Tags:        []string{"Webhook Endpoints"},
+	}, a.deleteWebhookEndpoint)
+
+	// List a webhook endpoint's delivery attempts
+	huma.Register(a.API, huma.Operation{
+		OperationID: "listWebhookAttempts",
+		Summary:     "List the attempts to deliver events to a webhook endpoint",
+		Description: "Returns the most recent attempts first, with the endpoint's response or the error that prevented one.",
+		Method:      http.MethodGet,
+		Path:        "/v1/webhook_endpoints/{id}/attempts",
+		Tags:        []string{"Webhook Endpoints"},
+	}, a.listWebhookAttempts)
+}
+
+// createWebhookEndpoint creates a new webhook endpoint
+func (a *API) createWebhookEndpoint(ctx context.Context, params *CreateWebhookEndpointParams) (*CreatedWebhookEndpointResponse, error) {
+	req := &params.Body
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+		return nil, huma.Error400BadRequest("url must be an absolute http or https URL")
+	}
+	if target.Scheme != "https" && livemodeFromContext(ctx) {
+		return nil, huma.Error400BadRequest("Live mode webhook endpoints must use https")
+	}
+	if err := req.EnabledEvents.Validate(); err != nil {
+		return nil, huma.Error400BadRequest("Invalid enabled_events: "+err.Error(), err)
+	}
+	// Events carry full objects, so a restricted key can only subscribe to
+	// the events of resources it can read
+	for _, resource := range req.EnabledEvents.Resources() {
+		if !allowedFromContext(ctx, resource, models.AccessRead) {
+			coded := newCodedError(http.StatusForbidden, CodePermissionDenied, "This API key needs the "+resource+":read permission to subscribe to "+resource+" events")
+			coded.Permission = resource + ":" + models.AccessRead
+			return nil, coded
+		}
+	}
+	if !a.config.AllowPrivateWebhookURLs {
+		if err := webhooks.CheckHost(ctx, target.Hostname()); err == webhooks.ErrPrivateAddress {
+			return nil, huma.Error400BadRequest("url must not point at a private, loopback or link-local address", err)
+		} else if err != nil {
+			return nil, huma.Error400BadRequest("url host could not be resolved", err)
+		}
+	}
+
+	secret, err := webhooks.NewSecret()
+	if err != nil {
+		return nil, huma.Error500InternalServerError("Failed to generate signing secret", err)
+	}
+	endpoint := &models.WebhookEndpoint{
+		ID:            ids.New(ids.WebhookEndpoint),
+		URL:           target.String(),
+		Description:   req.Description,
+		EnabledEvents: req.EnabledEvents,
+		Secret:        secret,
+	}
+	if err := a.accountDB(ctx).CreateWebhookEndpoint(endpoint); err != nil {
+		return nil, huma.Error500InternalServerError("Failed to create webhook endpoint", err)
+	}
+
+	return &CreatedWebhookEndpointResponse{
+		Status: 201,
+		Body:   &models.CreatedWebhookEndpoint{WebhookEndpoint: endpoint, Secret: secret},
+	}, nil
+}
+
+// listWebhookEndpoints retrieves a list of webhook endpoints
+func (a *API) listWebhookEndpoints(ctx context.Context, params *ListParams) (*ListResponse[models.WebhookEndpoint], error) {
+	endpoints, err := a.accountDB(ctx).ListWebhookEndpoints(params.page())
+	if err != nil {
+		return nil, listError("webhook endpoints", err)
+	}
+
+	return newListResponse("/v1/webhook_endpoints", endpoints), nil
+}
+
+// getWebhookEndpoint retrieves a webhook endpoint by ID
+func (a *API) getWebhookEndpoint(ctx context.Context, params *WebhookEndpointParams) (*WebhookEndpointResponse, error) {
+	endpoint, err := a.findWebhookEndpoint(ctx, params.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookEndpointResponse{Status: 200, Body: endpoint}, nil
+}
+
+// deleteWebhookEndpoint deletes a webhook endpoint
+func (a *API) deleteWebhookEndpoint(ctx context.Context, params *WebhookEndpointParams) (*DeleteWebhookEndpointResponse, error) {
+	endpoint, err := a.findWebhookEndpoint(ctx, params.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.accountDB(ctx).DeleteWebhookEndpoint(endpoint); err != nil {
+		return nil, huma.Error500InternalServerError("Failed to delete webhook endpoint", err)
+	}
+
+	return &DeleteWebhookEndpointResponse{Status: 200, Body: &models.DeletedWebhookEndpoint{ID: endpoint.ID, Deleted: true}}, nil
+}
+
+// listWebhookAttempts retrieves a list of a webhook endpoint's delivery attempts
+func (a *API) listWebhookAttempts(ctx context.Context, params *ListWebhookAttemptsParams) (*ListResponse[models.WebhookAttempt], error) {
+	if _, err := a.findWebhookEndpoint(ctx, params.ID); err != nil {
+		return nil, err
+	}
+
+	attempts, err := a.accountDB(ctx).ListWebhookAttempts(params.ID, params.page())
+	if err != nil {
+		return nil, listError("webhook attempts", err)
+	}
+
+	return newListResponse("/v1/webhook_endpoints/"+params.ID+"/attempts", attempts), nil
+}
+
+// findWebhookEndpoint retrieves a webhook endpoint of the caller's account and mode
+func (a *API) findWebhookEndpoint(ctx context.Context, id string) (*models.WebhookEndpoint, error) {
+	endpoint, err := a.accountDB(ctx).GetWebhookEndpoint(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("Webhook endpoint not found", err)
+		}
+		return nil, huma.Error500InternalServerError("Failed to retrieve webhook endpoint", err)
+	}
+	return endpoint, nil
+}
+
+// dispatchWebhooks periodically sends the webhook deliveries that are due.
+// Each run is started without waiting for the previous one, whose endpoints
+// it skips, so a slow endpoint does not hold up the others' next deliveries.
+func (a *API) dispatchWebhooks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		go func() {
+			if _, err := a.deliverWebhooks(now); err != nil {
+				log.Error().Err(err).Msg("Failed to deliver webhooks")
+			}
+		}()
+	}
+}
+
+// deliverWebhooks sends the webhook deliveries due at the given time, logs an
+// attempt for each and schedules retries of the failed ones. Endpoints that
+// an earlier run is still sending to are skipped. Up to webhookConcurrency
+// endpoints are sent to at once, each of them one delivery at a time until
+// one fails; the rest stay due for a later run. It returns the number of
+// attempts recorded, and the first error that stopped an endpoint's
+// deliveries from being recorded.
+func (a *API) deliverWebhooks(now time.Time) (int, error) {
+	a.deliveringMu.Lock()
+	busy := make([]string, 0, len(a.delivering))
+	for endpointID := range a.delivering {
+		busy = append(busy, endpointID)
+	}
+	a.deliveringMu.Unlock()
+
+	due, err := a.DB.DueWebhookDeliveries(now, webhookBatchSize, webhookEndpointBatchSize, busy)
+	if err != nil {
+		return 0, err
+	}
+
+	// Group the deliveries by endpoint, keeping each group oldest first
+	var groups [][]db.DueDelivery
+	groupOf := make(map[string]int)
+	for _, delivery := range due {
+		i, ok := groupOf[delivery.EndpointID]
+		if !ok {
+			i = len(groups)
+			groupOf[delivery.EndpointID] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], delivery)
+	}
+
+	// Claim the endpoints, in case another run started sending to one of
+	// them since they were read
+	a.deliveringMu.Lock()
+	claimed := groups[:0]
+	for _, deliveries := range groups {
+		if endpointID := deliveries[0].EndpointID; !a.delivering[endpointID] {
+			a.delivering[endpointID] = true
+			claimed = append(claimed, deliveries)
+		}
+	}
+	a.deliveringMu.Unlock()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		sent     int
+		firstErr error
+	)
+	for _, deliveries := range claimed {
+		wg.Add(1)
+		go func() {
+			defer func() {
+				a.deliveringMu.Lock()
+				delete(a.delivering, deliveries[0].EndpointID)
+				a.deliveringMu.Unlock()
+				wg.Done()
+			}()
+			a.webhookSlots <- struct{}{}
+			defer func() { <-a.webhookSlots }()
+
+			for _, delivery := range deliveries {
+				succeeded, err := a.deliverWebhook(delivery)
+				mu.Lock()
+				if err == nil {
+					sent++
+				} else if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				if err != nil || !succeeded {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return sent, firstErr
+}
+
+// deliverWebhook sends one delivery and records the attempt. It reports
+// whether the endpoint accepted the event, and any error recording it.
+func (a *API) deliverWebhook(delivery db.DueDelivery) (bool, error) {
+	payload, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return false, err
+	}
+
+	start := time.Now()
+	resp, err := a.sender.Send(context.Background(), delivery.Endpoint.URL, delivery.Endpoint.Secret, payload, start)
+	attempt := &models.WebhookAttempt{
+		EventType:  delivery.Event.Type,
+		DurationMS: time.Since(start).Milliseconds(),
+		CreatedAt:  start,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		attempt.StatusCode = resp.StatusCode
+		attempt.ResponseBody = resp.Body
+		attempt.Succeeded = resp.Succeeded()
+	}
+	if !attempt.Succeeded {
+		if next, ok := webhooks.NextAttempt(delivery.Event.CreatedAt, delivery.Attempts+1, start); ok {
+			attempt.NextAttemptAt = &next
+		}
+		log.Warn().Str("endpoint", delivery.Endpoint.ID).Str("event", delivery.Event.ID).
+			Int("status", attempt.StatusCode).Str("error", attempt.Error).
+			Bool("retrying", attempt.NextAttemptAt != nil).Msg("Webhook delivery failed")
+	}
+
+	return attempt.Succeeded, a.DB.RecordWebhookAttempt(&delivery.WebhookDelivery, attempt)
+}
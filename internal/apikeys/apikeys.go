@@ -0,0 +1,123 @@
+// Package apikeys generates and parses API keys. A key is a prefix naming its
+// type and mode (such as sk_test_, rk_live_ or pk_test_) followed by 32
+// random base62 characters. The first 8 of those identify the key so it can
+// be looked up; only a salted hash of the whole key is stored.
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Key types
+const (
+	TypeSecret      = "secret"
+	TypeRestricted  = "restricted"
+	TypePublishable = "publishable"
+)
+
+// types lists the key types in the order Parse tries their prefixes
+var types = []string{TypeSecret, TypeRestricted, TypePublishable}
+
+const (
+	// randomLength is the number of random characters after the prefix
+	randomLength = 32
+
+	// lookupLength is the number of leading random characters used to find
+	// the stored key
+	lookupLength = 8
+
+	// alphabet is the character set of the random part
+	alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// ErrMalformed is returned when a string is not shaped like an API key
+var ErrMalformed = errors.New("malformed API key")
+
+// Key describes a parsed API key
+type Key struct {
+	Type     string
+	Livemode bool
+	// Lookup identifies the stored key without revealing its secret part
+	Lookup string
+}
+
+// Prefix returns the prefix of keys with the given type and mode
+func Prefix(keyType string, livemode bool) string {
+	prefix := "sk_"
+	switch keyType {
+	case TypeRestricted:
+		prefix = "rk_"
+	case TypePublishable:
+		prefix = "pk_"
+	}
+	if livemode {
+		return prefix + "live_"
+	}
+	return prefix + "test_"
+}
+
+// Generate returns a new random key with the given type and mode
+func Generate(keyType string, livemode bool) (string, error) {
+	b := make([]byte, randomLength)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return Prefix(keyType, livemode) + string(b), nil
+}
+
+// Parse checks the shape of a key and returns its type, mode and lookup value
+func Parse(token string) (*Key, error) {
+	for _, keyType := range types {
+		for _, livemode := range []bool{false, true} {
+			random, ok := strings.CutPrefix(token, Prefix(keyType, livemode))
+			if !ok {
+				continue
+			}
+			if len(random) != randomLength || strings.Trim(random, alphabet) != "" {
+				return nil, ErrMalformed
+			}
+			return &Key{Type: keyType, Livemode: livemode, Lookup: random[:lookupLength]}, nil
+		}
+	}
+	return nil, ErrMalformed
+}
+
+// NewSalt returns a random salt for hashing a key
+func NewSalt() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Hash returns the salted SHA-256 hash of a key
+func Hash(token, salt string) string {
+	sum := sha256.Sum256([]byte(salt + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify reports whether a key matches a stored salted hash, in constant time
+func Verify(token, salt, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(Hash(token, salt)), []byte(hash)) == 1
+}
+
+// Redact returns a key with all but its prefix and last 4 characters hidden,
+// for display
+func Redact(token string) string {
+	if key, err := Parse(token); err == nil {
+		return Prefix(key.Type, key.Livemode) + "..." + token[len(token)-4:]
+	}
+	return "..."
+}
@@ -0,0 +1,85 @@
+package apikeys
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateAndParse(t *testing.T) {
+	tests := []struct {
+		keyType  string
+		livemode bool
+		prefix   string
+	}{
+		{TypeSecret, false, "sk_test_"},
+		{TypeSecret, true, "sk_live_"},
+		{TypeRestricted, false, "rk_test_"},
+		{TypeRestricted, true, "rk_live_"},
+		{TypePublishable, false, "pk_test_"},
+		{TypePublishable, true, "pk_live_"},
+	}
+	for _, tt := range tests {
+		token, err := Generate(tt.keyType, tt.livemode)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		if !strings.HasPrefix(token, tt.prefix) || len(token) != len(tt.prefix)+randomLength {
+			t.Errorf("Expected a %s key of %d characters, got %q", tt.prefix, len(tt.prefix)+randomLength, token)
+		}
+		key, err := Parse(token)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", token, err)
+		}
+		if key.Type != tt.keyType || key.Livemode != tt.livemode || key.Lookup != token[len(tt.prefix):len(tt.prefix)+lookupLength] {
+			t.Errorf("Unexpected parse of %q: %+v", token, key)
+		}
+		if redacted := Redact(token); redacted != tt.prefix+"..."+token[len(token)-4:] {
+			t.Errorf("Unexpected redaction %q", redacted)
+		}
+	}
+
+	other, _ := Generate(TypeSecret, false)
+	first, _ := Generate(TypeSecret, false)
+	if other == first {
+		t.Error("Expected generated keys to differ")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, token := range []string{
+		"",
+		"sk_test_",
+		"sk_test_short",
+		"sk_test_" + strings.Repeat("a", randomLength+1),
+		"sk_test_" + strings.Repeat("-", randomLength),
+		"xk_test_" + strings.Repeat("a", randomLength),
+		"sk_prod_" + strings.Repeat("a", randomLength),
+	} {
+		if _, err := Parse(token); err != ErrMalformed {
+			t.Errorf("Parse(%q): expected ErrMalformed, got %v", token, err)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	token, _ := Generate(TypeSecret, false)
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatalf("Failed to generate salt: %v", err)
+	}
+	otherSalt, _ := NewSalt()
+
+	hash := Hash(token, salt)
+	if hash == Hash(token, otherSalt) {
+		t.Error("Expected different salts to give different hashes")
+	}
+	if strings.Contains(hash, token) {
+		t.Error("Expected the hash not to contain the key")
+	}
+	if !Verify(token, salt, hash) {
+		t.Error("Expected the key to verify")
+	}
+	if Verify(token+"x", salt, hash) || Verify(token, otherSalt, hash) {
+		t.Error("Expected a different key or salt not to verify")
+	}
+}
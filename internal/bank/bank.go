@@ -0,0 +1,126 @@
+// Package bank validates US bank account details for ACH payment methods.
+package bank
+
+import (
+	"fmt"
+)
+
+// Account holder types
+const (
+	HolderTypeIndividual = "individual"
+	HolderTypeCompany    = "company"
+)
+
+// Account types
+const (
+	AccountTypeChecking = "checking"
+	AccountTypeSavings  = "savings"
+)
+
+// Validation error codes
+const (
+	CodeRoutingNumberInvalid     = "routing_number_invalid"
+	CodeAccountNumberInvalid     = "account_number_invalid"
+	CodeAccountHolderTypeInvalid = "account_holder_type_invalid"
+	CodeAccountTypeInvalid       = "account_type_invalid"
+)
+
+// Account represents the bank account details submitted by a client
+type Account struct {
+	RoutingNumber     string
+	AccountNumber     string
+	AccountHolderType string
+	AccountType       string
+}
+
+// Details describes a validated bank account
+type Details struct {
+	BankName          string
+	RoutingNumber     string
+	Last4             string
+	AccountHolderType string
+	AccountType       string
+}
+
+// Error reports why a bank account failed validation
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Banks maps routing numbers to the name of the bank they belong to. Without
+// a Federal Reserve directory only these well-known numbers are recognized.
+var Banks = map[string]string{
+	"110000000": "STRIPE TEST BANK",
+	"021000021": "JPMORGAN CHASE BANK, NA",
+	"026009593": "BANK OF AMERICA, N.A.",
+	"121000248": "WELLS FARGO BANK, NA",
+	"021000089": "CITIBANK NA",
+}
+
+// ValidRoutingNumber reports whether a routing number has nine digits and a
+// valid ABA checksum
+func ValidRoutingNumber(routingNumber string) bool {
+	if len(routingNumber) != 9 || !digits(routingNumber) {
+		return false
+	}
+	weights := [3]int{3, 7, 1}
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(routingNumber[i]-'0') * weights[i%3]
+	}
+	return sum%10 == 0
+}
+
+// Validate checks a bank account and returns its details. The account holder
+// type defaults to individual and the account type to checking. Failures are
+// reported as *Error.
+func Validate(account Account) (*Details, error) {
+	if !ValidRoutingNumber(account.RoutingNumber) {
+		return nil, &Error{Code: CodeRoutingNumberInvalid, Message: "The routing number must be 9 digits with a valid checksum."}
+	}
+	if len(account.AccountNumber) < 4 || len(account.AccountNumber) > 17 || !digits(account.AccountNumber) {
+		return nil, &Error{Code: CodeAccountNumberInvalid, Message: "The account number must be 4 to 17 digits."}
+	}
+
+	holderType := account.AccountHolderType
+	switch holderType {
+	case "":
+		holderType = HolderTypeIndividual
+	case HolderTypeIndividual, HolderTypeCompany:
+	default:
+		return nil, &Error{Code: CodeAccountHolderTypeInvalid, Message: "The account holder type must be individual or company."}
+	}
+
+	accountType := account.AccountType
+	switch accountType {
+	case "":
+		accountType = AccountTypeChecking
+	case AccountTypeChecking, AccountTypeSavings:
+	default:
+		return nil, &Error{Code: CodeAccountTypeInvalid, Message: "The account type must be checking or savings."}
+	}
+
+	return &Details{
+		BankName:          Banks[account.RoutingNumber],
+		RoutingNumber:     account.RoutingNumber,
+		Last4:             account.AccountNumber[len(account.AccountNumber)-4:],
+		AccountHolderType: holderType,
+		AccountType:       accountType,
+	}, nil
+}
+
+// digits reports whether s consists only of ASCII digits
+func digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package bank
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidRoutingNumber(t *testing.T) {
+	tests := map[string]bool{
+		"110000000":  true,
+		"021000021":  true,
+		"021000022":  false,
+		"02100002":   false,
+		"0210000210": false,
+		"02100002a":  false,
+	}
+	for routingNumber, want := range tests {
+		if got := ValidRoutingNumber(routingNumber); got != want {
+			t.Errorf("ValidRoutingNumber(%q) = %v, want %v", routingNumber, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// Valid accounts return their details with defaults applied
+	details, err := Validate(Account{RoutingNumber: "110000000", AccountNumber: "000123456789"})
+	if err != nil {
+		t.Fatalf("Expected valid account, got %v", err)
+	}
+	if details.Last4 != "6789" || details.BankName != "STRIPE TEST BANK" {
+		t.Errorf("Unexpected details: %+v", details)
+	}
+	if details.AccountHolderType != HolderTypeIndividual || details.AccountType != AccountTypeChecking {
+		t.Errorf("Expected individual checking defaults, got %s %s", details.AccountHolderType, details.AccountType)
+	}
+
+	// Invalid accounts are rejected with a code
+	tests := []struct {
+		name    string
+		account Account
+		code    string
+	}{
+		{"missing routing number", Account{AccountNumber: "000123456789"}, CodeRoutingNumberInvalid},
+		{"bad checksum", Account{RoutingNumber: "110000001", AccountNumber: "000123456789"}, CodeRoutingNumberInvalid},
+		{"missing account number", Account{RoutingNumber: "110000000"}, CodeAccountNumberInvalid},
+		{"non-digit account number", Account{RoutingNumber: "110000000", AccountNumber: "12ab5678"}, CodeAccountNumberInvalid},
+		{"bad holder type", Account{RoutingNumber: "110000000", AccountNumber: "000123456789", AccountHolderType: "trust"}, CodeAccountHolderTypeInvalid},
+		{"bad account type", Account{RoutingNumber: "110000000", AccountNumber: "000123456789", AccountType: "brokerage"}, CodeAccountTypeInvalid},
+	}
+	for _, tt := range tests {
+		_, err := Validate(tt.account)
+		var bankErr *Error
+		if !errors.As(err, &bankErr) {
+			t.Errorf("%s: expected *Error, got %v", tt.name, err)
+			continue
+		}
+		if bankErr.Code != tt.code {
+			t.Errorf("%s: expected code %q, got %q", tt.name, tt.code, bankErr.Code)
+		}
+	}
+}
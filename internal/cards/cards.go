@@ -0,0 +1,220 @@
+// Package cards validates card numbers, security codes and expiry dates and
+// identifies the card brand from the issuer identification number (IIN).
+package cards
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Card brands
+const (
+	BrandVisa       = "visa"
+	BrandMastercard = "mastercard"
+	BrandAmex       = "amex"
+	BrandDiscover   = "discover"
+	BrandJCB        = "jcb"
+	BrandDiners     = "diners"
+	BrandUnionPay   = "unionpay"
+)
+
+// Card funding types
+const (
+	FundingCredit  = "credit"
+	FundingDebit   = "debit"
+	FundingPrepaid = "prepaid"
+)
+
+// Validation error codes
+const (
+	CodeInvalidNumber      = "invalid_number"
+	CodeInvalidCVC         = "invalid_cvc"
+	CodeInvalidExpiryMonth = "invalid_expiry_month"
+	CodeInvalidExpiryYear  = "invalid_expiry_year"
+	CodeExpiredCard        = "expired_card"
+)
+
+// maxExpiryYears bounds how far in the future an expiry year may be
+const maxExpiryYears = 50
+
+// Card represents the card details submitted by a client
+type Card struct {
+	Number   string
+	CVC      string
+	ExpMonth int
+	ExpYear  int
+}
+
+// Details describes a validated card
+type Details struct {
+	Brand   string
+	Funding string
+	Last4   string
+}
+
+// Error reports why a card failed validation
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// brand describes the IIN ranges and formats of a card brand
+type brand struct {
+	name      string
+	ranges    [][2]int // Inclusive IIN prefix ranges; both ends have the same number of digits
+	lengths   []int
+	cvcLength int
+}
+
+// brands lists the supported brands. Order matters where ranges overlap:
+// earlier entries win.
+var brands = []brand{
+	{name: BrandAmex, ranges: [][2]int{{34, 34}, {37, 37}}, lengths: []int{15}, cvcLength: 4},
+	{name: BrandDiners, ranges: [][2]int{{300, 305}, {36, 36}, {38, 39}}, lengths: []int{14, 15, 16, 17, 18, 19}, cvcLength: 3},
+	{name: BrandJCB, ranges: [][2]int{{3528, 3589}}, lengths: []int{16, 17, 18, 19}, cvcLength: 3},
+	{name: BrandVisa, ranges: [][2]int{{4, 4}}, lengths: []int{13, 16, 19}, cvcLength: 3},
+	{name: BrandMastercard, ranges: [][2]int{{51, 55}, {2221, 2720}}, lengths: []int{16}, cvcLength: 3},
+	{name: BrandDiscover, ranges: [][2]int{{6011, 6011}, {644, 649}, {65, 65}}, lengths: []int{16, 17, 18, 19}, cvcLength: 3},
+	{name: BrandUnionPay, ranges: [][2]int{{62, 62}, {81, 81}}, lengths: []int{16, 17, 18, 19}, cvcLength: 3},
+}
+
+// fundingPrefixes maps BIN prefixes to a funding type other than credit.
+// Without a BIN database only these well-known test ranges are recognized.
+var fundingPrefixes = map[string]string{
+	"400005":   FundingDebit,   // Visa debit test card 4000056655665556
+	"52008282": FundingDebit,   // Mastercard debit test card 5200828282828210
+	"510510":   FundingPrepaid, // Mastercard prepaid test card 5105105105105100
+}
+
+// Normalize strips the spaces and dashes clients commonly use to group digits
+func Normalize(number string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(number)
+}
+
+// Luhn reports whether a string of digits passes the Luhn checksum
+func Luhn(number string) bool {
+	if number == "" {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// DetectBrand returns the brand of a card number, or an empty string if it
+// does not belong to a supported brand
+func DetectBrand(number string) string {
+	if b := lookup(number); b != nil {
+		return b.name
+	}
+	return ""
+}
+
+// Funding returns the funding type of a card number
+func Funding(number string) string {
+	for prefix, funding := range fundingPrefixes {
+		if strings.HasPrefix(number, prefix) {
+			return funding
+		}
+	}
+	return FundingCredit
+}
+
+// Validate checks a card's number, security code and expiry date as of now and
+// returns its details. Failures are reported as *Error.
+func Validate(card Card, now time.Time) (*Details, error) {
+	number := Normalize(card.Number)
+	if len(number) < 12 || len(number) > 19 || !Luhn(number) {
+		return nil, &Error{Code: CodeInvalidNumber, Message: "The card number is not a valid card number."}
+	}
+
+	b := lookup(number)
+	if b == nil {
+		return nil, &Error{Code: CodeInvalidNumber, Message: "The card brand is not supported."}
+	}
+	if !slices.Contains(b.lengths, len(number)) {
+		return nil, &Error{Code: CodeInvalidNumber, Message: fmt.Sprintf("The card number has an invalid length for a %s card.", b.name)}
+	}
+
+	if card.CVC != "" && (len(card.CVC) != b.cvcLength || !digits(card.CVC)) {
+		return nil, &Error{Code: CodeInvalidCVC, Message: fmt.Sprintf("The card's security code must be %d digits.", b.cvcLength)}
+	}
+
+	if err := ValidateExpiry(card.ExpMonth, card.ExpYear, now); err != nil {
+		return nil, err
+	}
+
+	return &Details{
+		Brand:   b.name,
+		Funding: Funding(number),
+		Last4:   number[len(number)-4:],
+	}, nil
+}
+
+// ValidateExpiry checks that an expiry date is well-formed and not in the past.
+// Cards are valid through the end of their expiry month.
+func ValidateExpiry(month, year int, now time.Time) error {
+	if month < 1 || month > 12 {
+		return &Error{Code: CodeInvalidExpiryMonth, Message: "The card's expiration month is invalid."}
+	}
+	if year < 1000 || year > now.Year()+maxExpiryYears {
+		return &Error{Code: CodeInvalidExpiryYear, Message: "The card's expiration year is invalid."}
+	}
+	if year < now.Year() || (year == now.Year() && month < int(now.Month())) {
+		return &Error{Code: CodeExpiredCard, Message: "The card has expired."}
+	}
+	return nil
+}
+
+// lookup returns the brand whose IIN ranges match the number
+func lookup(number string) *brand {
+	for i := range brands {
+		for _, r := range brands[i].ranges {
+			width := len(strconv.Itoa(r[0]))
+			if len(number) < width {
+				continue
+			}
+			prefix, err := strconv.Atoi(number[:width])
+			if err != nil {
+				continue
+			}
+			if prefix >= r[0] && prefix <= r[1] {
+				return &brands[i]
+			}
+		}
+	}
+	return nil
+}
+
+// digits reports whether s consists only of ASCII digits
+func digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
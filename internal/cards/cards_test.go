@@ -0,0 +1,92 @@
+package cards
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLuhn(t *testing.T) {
+	tests := map[string]bool{
+		"4242424242424242": true,
+		"4242424242424241": false,
+		"378282246310005":  true,
+		"0":                true,
+		"":                 false,
+		"4242x42424242424": false,
+	}
+	for number, want := range tests {
+		if got := Luhn(number); got != want {
+			t.Errorf("Luhn(%q) = %v, want %v", number, got, want)
+		}
+	}
+}
+
+func TestDetectBrand(t *testing.T) {
+	tests := map[string]string{
+		"4242424242424242": BrandVisa,
+		"5555555555554444": BrandMastercard,
+		"2223003122003222": BrandMastercard,
+		"378282246310005":  BrandAmex,
+		"6011111111111117": BrandDiscover,
+		"3566002020360505": BrandJCB,
+		"3056930009020004": BrandDiners,
+		"36227206271667":   BrandDiners,
+		"6200000000000005": BrandUnionPay,
+		"9999999999999995": "",
+	}
+	for number, want := range tests {
+		if got := DetectBrand(number); got != want {
+			t.Errorf("DetectBrand(%q) = %q, want %q", number, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Date(2025, time.June, 15, 0, 0, 0, 0, time.UTC)
+
+	// Valid cards return their details
+	details, err := Validate(Card{Number: "3782 822463 10005", CVC: "1234", ExpMonth: 6, ExpYear: 2025}, now)
+	if err != nil {
+		t.Fatalf("Expected valid card, got %v", err)
+	}
+	if details.Brand != BrandAmex || details.Last4 != "0005" || details.Funding != FundingCredit {
+		t.Errorf("Unexpected details: %+v", details)
+	}
+
+	details, err = Validate(Card{Number: "4000056655665556", ExpMonth: 1, ExpYear: 2030}, now)
+	if err != nil {
+		t.Fatalf("Expected valid card, got %v", err)
+	}
+	if details.Funding != FundingDebit {
+		t.Errorf("Expected debit funding, got %q", details.Funding)
+	}
+
+	// Invalid cards are rejected with a code
+	tests := []struct {
+		name string
+		card Card
+		code string
+	}{
+		{"bad checksum", Card{Number: "4242424242424241", ExpMonth: 12, ExpYear: 2030}, CodeInvalidNumber},
+		{"unknown brand", Card{Number: "9999999999999995", ExpMonth: 12, ExpYear: 2030}, CodeInvalidNumber},
+		{"wrong length", Card{Number: "55555555555544443", ExpMonth: 12, ExpYear: 2030}, CodeInvalidNumber},
+		{"amex cvc", Card{Number: "378282246310005", CVC: "123", ExpMonth: 12, ExpYear: 2030}, CodeInvalidCVC},
+		{"visa cvc", Card{Number: "4242424242424242", CVC: "12a", ExpMonth: 12, ExpYear: 2030}, CodeInvalidCVC},
+		{"bad month", Card{Number: "4242424242424242", ExpMonth: 13, ExpYear: 2030}, CodeInvalidExpiryMonth},
+		{"bad year", Card{Number: "4242424242424242", ExpMonth: 12, ExpYear: 25}, CodeInvalidExpiryYear},
+		{"expired last month", Card{Number: "4242424242424242", ExpMonth: 5, ExpYear: 2025}, CodeExpiredCard},
+		{"expired last year", Card{Number: "4242424242424242", ExpMonth: 12, ExpYear: 2024}, CodeExpiredCard},
+	}
+	for _, tt := range tests {
+		_, err := Validate(tt.card, now)
+		var cardErr *Error
+		if !errors.As(err, &cardErr) {
+			t.Errorf("%s: expected *Error, got %v", tt.name, err)
+			continue
+		}
+		if cardErr.Code != tt.code {
+			t.Errorf("%s: expected code %q, got %q", tt.name, tt.code, cardErr.Code)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Package contact validates and normalizes customer contact details.
+package contact
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Validation error codes
+const (
+	CodeEmailInvalid   = "email_invalid"
+	CodePhoneInvalid   = "phone_invalid"
+	CodeCountryInvalid = "country_invalid"
+)
+
+// Error reports why a contact detail failed validation
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NormalizeEmail trims and lower-cases an email address so that the same
+// address always compares equal, and checks that it is a bare address
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", &Error{Code: CodeEmailInvalid, Message: "The email address is not valid."}
+	}
+	return email, nil
+}
+
+// NormalizePhone removes spaces, dashes, dots and parentheses from a phone
+// number and checks that the result is in E.164 format: a plus sign followed
+// by a country code and subscriber number of at most 15 digits in total. An
+// empty phone number is left empty.
+func NormalizePhone(phone string) (string, error) {
+	phone = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, phone)
+	if phone == "" {
+		return "", nil
+	}
+
+	number, ok := strings.CutPrefix(phone, "+")
+	if !ok || len(number) < 2 || len(number) > 15 || number[0] == '0' || !digits(number) {
+		return "", &Error{Code: CodePhoneInvalid, Message: "The phone number must be in E.164 format, e.g. +14155550123."}
+	}
+	return phone, nil
+}
+
+// NormalizeCountry upper-cases a two-letter ISO country code. An empty
+// country is left empty.
+func NormalizeCountry(country string) (string, error) {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if country == "" {
+		return "", nil
+	}
+	if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+		return "", &Error{Code: CodeCountryInvalid, Message: "The country must be a two-letter ISO code, e.g. US."}
+	}
+	return country, nil
+}
+
+// digits reports whether s consists only of ASCII digits
+func digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
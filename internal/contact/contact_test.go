@@ -0,0 +1,83 @@
+package contact
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+		code  string
+	}{
+		{"user@example.com", "user@example.com", ""},
+		{"  User@Example.COM ", "user@example.com", ""},
+		{"first.last+tag@sub.example.org", "first.last+tag@sub.example.org", ""},
+		{"", "", CodeEmailInvalid},
+		{"not-an-email", "", CodeEmailInvalid},
+		{"Jane <jane@example.com>", "", CodeEmailInvalid},
+		{"a@b@example.com", "", CodeEmailInvalid},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeEmail(tt.email)
+		assertResult(t, tt.email, got, err, tt.want, tt.code)
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		want  string
+		code  string
+	}{
+		{"", "", ""},
+		{"+14155550123", "+14155550123", ""},
+		{"+1 (415) 555-0123", "+14155550123", ""},
+		{"+44 20 7946 0958", "+442079460958", ""},
+		{"4155550123", "", CodePhoneInvalid},
+		{"+04155550123", "", CodePhoneInvalid},
+		{"+1415555012345678", "", CodePhoneInvalid},
+		{"+1415abc0123", "", CodePhoneInvalid},
+		{"+", "", CodePhoneInvalid},
+	}
+	for _, tt := range tests {
+		got, err := NormalizePhone(tt.phone)
+		assertResult(t, tt.phone, got, err, tt.want, tt.code)
+	}
+}
+
+func TestNormalizeCountry(t *testing.T) {
+	tests := []struct {
+		country string
+		want    string
+		code    string
+	}{
+		{"", "", ""},
+		{"US", "US", ""},
+		{" gb ", "GB", ""},
+		{"USA", "", CodeCountryInvalid},
+		{"U1", "", CodeCountryInvalid},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeCountry(tt.country)
+		assertResult(t, tt.country, got, err, tt.want, tt.code)
+	}
+}
+
+// assertResult checks a normalized value or the code of its validation error
+func assertResult(t *testing.T, input, got string, err error, want, code string) {
+	t.Helper()
+	if code != "" {
+		var contactErr *Error
+		if !errors.As(err, &contactErr) || contactErr.Code != code {
+			t.Errorf("%q: expected error code %s, got %v", input, code, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%q: unexpected error: %v", input, err)
+	} else if got != want {
+		t.Errorf("%q: expected %q, got %q", input, want, got)
+	}
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jeffgrover/payment-api/internal/ids"
+	"github.com/jeffgrover/payment-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// adoptUnownedRows creates a default account if there is none and assigns it
+// every row created before accounts existed
+func adoptUnownedRows(db *gorm.DB) error {
+	var account models.Account
+	err := db.Order("created_at").First(&account).Error
+	if err == gorm.ErrRecordNotFound {
+		account = models.Account{ID: ids.New(ids.Account), Name: "Default account", CreatedAt: time.Now()}
+		err = db.Create(&account).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, model := range []any{&models.Customer{}, &models.PaymentMethod{}, &models.Payment{}, &models.Refund{}, &models.APIKey{}} {
+		if err := db.Model(model).Unscoped().
+			Where("account_id IS NULL OR account_id = ''").
+			UpdateColumn("account_id", account.ID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateAccount creates a new account
+func (db *DB) CreateAccount(account *models.Account) error {
+	account.CreatedAt = time.Now()
+	return db.Create(account).Error
+}
+
+// GetAccount retrieves an account by ID
+func (db *DB) GetAccount(id string) (*models.Account, error) {
+	var account models.Account
+	if err := db.First(&account, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// DefaultAccount retrieves the oldest account, which owns the data created
+// before accounts existed
+func (db *DB) DefaultAccount() (*models.Account, error) {
+	var account models.Account
+	if err := db.Order("created_at").First(&account).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// ListAccounts retrieves a page of accounts
+func (db *DB) ListAccounts(page Page) (*List[models.Account], error) {
+	return paginate(db.Model(&models.Account{}), page, func(a models.Account) (time.Time, string) {
+		return a.CreatedAt, a.ID
+	})
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jeffgrover/payment-api/internal/apikeys"
+	"github.com/jeffgrover/payment-api/internal/ids"
+	"github.com/jeffgrover/payment-api/internal/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidAPIKey is returned when a key is malformed or unknown
+	ErrInvalidAPIKey = errors.New("invalid API key")
+
+	// ErrAPIKeyExpired is returned when a key was rolled and its overlap
+	// period has ended
+	ErrAPIKeyExpired = errors.New("API key has expired")
+)
+
+// CreateAPIKey generates and stores a new API key, with permissions if it is
+// a restricted key. The key itself is returned but only its salted hash is
+// stored.
+func (db *DB) CreateAPIKey(keyType string, livemode bool, permissions models.Permissions) (*models.APIKey, string, error) {
+	var key *models.APIKey
+	var token string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		key, token, err = createAPIKey(tx, keyType, livemode, permissions)
+		return err
+	})
+	return key, token, err
+}
+
+// createAPIKey implements CreateAPIKey within a transaction
+func createAPIKey(tx *gorm.DB, keyType string, livemode bool, permissions models.Permissions) (*models.APIKey, string, error) {
+	token, err := apikeys.Generate(keyType, livemode)
+	if err != nil {
+		return nil, "", err
+	}
+	parsed, err := apikeys.Parse(token)
+	if err != nil {
+		return nil, "", err
+	}
+	salt, err := apikeys.NewSalt()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &models.APIKey{
+		ID:          ids.New(ids.APIKey),
+		Type:        keyType,
+		Livemode:    livemode,
+		Permissions: permissions,
+		Redacted:    apikeys.Redact(token),
+		Lookup:      parsed.Lookup,
+		Salt:        salt,
+		Hash:        apikeys.Hash(token, salt),
+		CreatedAt:   time.Now(),
+	}
+	if err := tx.Create(key).Error; err != nil {
+		return nil, "", err
+	}
+	return key, token, nil
+}
+
+// AuthenticateAPIKey finds the stored key matching an API key. It returns
+// ErrInvalidAPIKey if there is none and ErrAPIKeyExpired if it has expired.
+func (db *DB) AuthenticateAPIKey(token string, now time.Time) (*models.APIKey, error) {
+	parsed, err := apikeys.Parse(token)
+	if err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	var key models.APIKey
+	if err := db.First(&key, "lookup = ?", parsed.Lookup).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if !apikeys.Verify(token, key.Salt, key.Hash) || key.Type != parsed.Type || key.Livemode != parsed.Livemode {
+		return nil, ErrInvalidAPIKey
+	}
+	if key.IsExpired(now) {
+		return nil, ErrAPIKeyExpired
+	}
+	return &key, nil
+}
+
+// GetAPIKey retrieves an API key by ID
+func (db *DB) GetAPIKey(id string) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := db.First(&key, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// ListAPIKeys retrieves a page of API keys that have not expired
+func (db *DB) ListAPIKeys(page Page) (*List[models.APIKey], error) {
+	query := db.Model(&models.APIKey{}).Where("expires_at IS NULL OR expires_at > ?", time.Now())
+	return paginate(query, page, func(k models.APIKey) (time.Time, string) {
+		return k.CreatedAt, k.ID
+	})
+}
+
+// CountAPIKeys returns the number of stored API keys
+func (db *DB) CountAPIKeys() (int64, error) {
+	var count int64
+	err := db.Model(&models.APIKey{}).Count(&count).Error
+	return count, err
+}
+
+// RollAPIKey replaces an API key with a new one of the same type, mode and
+// permissions.
+// The old key keeps working until expiresAt, or its existing expiry if that
+// is sooner, so clients can switch over without downtime.
+func (db *DB) RollAPIKey(key *models.APIKey, expiresAt time.Time) (*models.APIKey, string, error) {
+	var rolled *models.APIKey
+	var token string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		rolled, token, err = createAPIKey(tx, key.Type, key.Livemode, key.Permissions)
+		if err != nil {
+			return err
+		}
+		if key.ExpiresAt == nil || expiresAt.Before(*key.ExpiresAt) {
+			key.ExpiresAt = &expiresAt
+		}
+		return tx.Model(key).Update("expires_at", key.ExpiresAt).Error
+	})
+	return rolled, token, err
+}
+
+// DeleteAPIKey revokes an API key immediately
+func (db *DB) DeleteAPIKey(key *models.APIKey) error {
+	return db.Delete(key).Error
+}
@@ -1,26 +1,67 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/jeffgrover/payment-api/internal/statemachine"
 	"github.com/rs/zerolog/log"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
+var (
+	// ErrConcurrentUpdate is returned when a record's status changed between
+	// being read and being saved
+	ErrConcurrentUpdate = errors.New("record was modified concurrently")
+
+	// ErrRefundExceedsBalance is returned when a refund is larger than the
+	// payment's captured amount less its pending and successful refunds
+	ErrRefundExceedsBalance = errors.New("refund exceeds remaining refundable amount")
+
+	// ErrInvalidRefundAmount is returned when a refund's amount is not positive
+	ErrInvalidRefundAmount = errors.New("refund amount must be positive")
+
+	// ErrPaymentMethodDetached is returned when modifying a payment method
+	// that has been detached from its customer
+	ErrPaymentMethodDetached = errors.New("payment method is detached")
+
+	// ErrPaymentMethodAttached is returned when attaching a payment method
+	// that already belongs to a customer
+	ErrPaymentMethodAttached = errors.New("payment method is already attached")
+
+	// ErrDuplicateEmail is returned when saving a customer whose email belongs
+	// to another customer while unique emails are enforced
+	ErrDuplicateEmail = errors.New("a customer with this email already exists")
+)
+
+const (
+	// uniqueEmailIndex is the name of the index enforcing unique customer
+	// emails within each account's test or live mode data
+	uniqueEmailIndex = "idx_customers_account_mode_email_unique"
+)
+
+// legacyUniqueEmailIndexes are the names of indexes that enforced unique
+// customer emails across all accounts, then across both modes of an account
+var legacyUniqueEmailIndexes = []string{"idx_customers_email_unique", "idx_customers_account_email_unique"}
+
 // DB is a wrapper around gorm.DB
 type DB struct {
 	*gorm.DB
+
+	// fullText is set when SQLite has FTS5 and search uses full-text indexes
+	fullText bool
 }
 
 // New creates a new database connection
 func New(dbPath string) (*DB, error) {
 	// Configure GORM
 	gormConfig := &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger:         logger.Default.LogMode(logger.Info),
+		TranslateError: true,
 	}
 
 	// Connect to SQLite database
@@ -29,23 +70,100 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
+	// SQLite allows a single writer, so use one connection to serialize
+	// transactions (this also keeps in-memory databases shared)
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database handle: %w", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	// Scope statements made through ForAccount and ForMode
+	if err := registerScopes(db); err != nil {
+		return nil, fmt.Errorf("failed to register scopes: %w", err)
+	}
+
 	// Run migrations
 	if err := migrate(db); err != nil {
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	// Index text fields for search when FTS5 is compiled in
+	fullText, err := setupFullText(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up full-text search: %w", err)
+	}
+	if !fullText {
+		log.Info().Msg("SQLite FTS5 not available (build with -tags sqlite_fts5); search will scan tables")
+	}
+
 	log.Info().Str("path", dbPath).Msg("Connected to SQLite database")
-	return &DB{db}, nil
+	return &DB{DB: db, fullText: fullText}, nil
 }
 
 // migrate runs database migrations
 func migrate(db *gorm.DB) error {
-	return db.AutoMigrate(
+	if err := db.AutoMigrate(
+		&models.Account{},
 		&models.Customer{},
 		&models.PaymentMethod{},
 		&models.Payment{},
 		&models.Refund{},
-	)
+		&models.PaymentStatusTransition{},
+		&models.IdempotencyKey{},
+		&models.APIKey{},
+		&models.WebhookEndpoint{},
+		&models.Event{},
+		&models.WebhookDelivery{},
+		&models.WebhookAttempt{},
+	); err != nil {
+		return err
+	}
+
+	// Customers created before emails were normalized
+	if err := db.Model(&models.Customer{}).
+		Where("email <> LOWER(TRIM(email))").
+		Update("email", gorm.Expr("LOWER(TRIM(email))")).Error; err != nil {
+		return err
+	}
+
+	// Payments created before manual capture existed were captured in full
+	if err := db.Model(&models.Payment{}).
+		Where("capture_method IS NULL OR capture_method = ''").
+		Updates(map[string]any{
+			"capture_method":  models.CaptureMethodAutomatic,
+			"amount_captured": gorm.Expr("CASE WHEN status = ? THEN amount ELSE 0 END", models.PaymentStatusSucceeded),
+		}).Error; err != nil {
+		return err
+	}
+
+	// Payments refunded before refunds were tracked on the payment
+	refunded := "(SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE refunds.payment_id = payments.id AND refunds.status = ?)"
+	if err := db.Model(&models.Payment{}).
+		Where("amount_refunded = 0 AND "+refunded+" > 0", models.RefundStatusSucceeded).
+		Updates(map[string]any{
+			"amount_refunded": gorm.Expr(refunded, models.RefundStatusSucceeded),
+			"refunded":        gorm.Expr(refunded+" >= amount_captured", models.RefundStatusSucceeded),
+		}).Error; err != nil {
+		return err
+	}
+
+	// Data created before test and live mode were separated is test data,
+	// as it was made with the simulated processor
+	for _, model := range []any{&models.Customer{}, &models.PaymentMethod{}, &models.Payment{}, &models.Refund{}} {
+		if err := db.Model(model).Unscoped().Where("livemode IS NULL").UpdateColumn("livemode", false).Error; err != nil {
+			return err
+		}
+	}
+
+	// Data created before accounts existed belongs to the default account,
+	// and emails are unique per account and mode rather than globally
+	for _, index := range legacyUniqueEmailIndexes {
+		if err := db.Exec("DROP INDEX IF EXISTS " + index).Error; err != nil {
+			return err
+		}
+	}
+	return adoptUnownedRows(db)
 }
 
 // CreateCustomer creates a new customer
@@ -55,7 +173,12 @@ func (db *DB) CreateCustomer(customer *models.Customer) error {
 	customer.UpdatedAt = time.Now()
 
 	// Create the customer
-	return db.Create(customer).Error
+	return customerError(db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(customer).Error; err != nil {
+			return err
+		}
+		return recordEvent(tx, models.EventCustomerCreated, customer.AccountID, customer.Livemode, customer)
+	}))
 }
 
 // GetCustomer retrieves a customer by ID
@@ -67,19 +190,128 @@ func (db *DB) GetCustomer(id string) (*models.Customer, error) {
 	return &customer, nil
 }
 
-// ListCustomers retrieves a list of customers
-func (db *DB) ListCustomers(limit int) ([]models.Customer, error) {
-	var customers []models.Customer
-	if err := db.Limit(limit).Find(&customers).Error; err != nil {
+// UpdateCustomer saves changes to a customer
+func (db *DB) UpdateCustomer(customer *models.Customer) error {
+	customer.UpdatedAt = time.Now()
+	return customerError(db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(customer).Select("*").Omit("created_at", "deleted_at").Updates(customer).Error; err != nil {
+			return err
+		}
+		return recordEvent(tx, models.EventCustomerUpdated, customer.AccountID, customer.Livemode, customer)
+	}))
+}
+
+// FindCustomerByEmail retrieves the customer with a normalized email address
+func (db *DB) FindCustomerByEmail(email string) (*models.Customer, error) {
+	var customer models.Customer
+	if err := db.Order("created_at").First(&customer, "email = ?", email).Error; err != nil {
 		return nil, err
 	}
-	return customers, nil
+	return &customer, nil
+}
+
+// SetUniqueCustomerEmails creates or drops the unique index on customer
+// emails within each account's test or live mode data. Deleted customers are
+// not indexed, so their emails can be reused. Creating the index fails if
+// existing customers of an account and mode share an email.
+func (db *DB) SetUniqueCustomerEmails(enabled bool) error {
+	if !enabled {
+		return db.Exec("DROP INDEX IF EXISTS " + uniqueEmailIndex).Error
+	}
+	err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + uniqueEmailIndex + " ON customers(account_id, livemode, email) WHERE deleted_at IS NULL AND email <> ''").Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return fmt.Errorf("existing customers share an email address: %w", ErrDuplicateEmail)
+	}
+	return err
+}
+
+// customerError maps a unique index violation on a customer to ErrDuplicateEmail
+func customerError(err error) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+// DeleteCustomer soft-deletes a customer and detaches their payment methods.
+// Their payments and refunds are kept. It returns the vault tokens of the
+// detached cards so the caller can remove them from the vault.
+func (db *DB) DeleteCustomer(customer *models.Customer) ([]string, error) {
+	var tokens []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		attached := tx.Model(&models.PaymentMethod{}).Where("customer_id = ? AND detached_at IS NULL", customer.ID).Session(&gorm.Session{})
+		if err := attached.Where("vault_token <> ''").Pluck("vault_token", &tokens).Error; err != nil {
+			return err
+		}
+		if err := attached.Updates(map[string]any{"detached_at": now, "vault_token": ""}).Error; err != nil {
+			return err
+		}
+
+		customer.DefaultPaymentMethodID = ""
+		if err := tx.Model(customer).Update("default_payment_method_id", "").Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(customer).Error; err != nil {
+			return err
+		}
+		return recordEvent(tx, models.EventCustomerDeleted, customer.AccountID, customer.Livemode, customer)
+	})
+	return tokens, err
+}
+
+// CustomerFilter represents the filters and pagination options for listing customers
+type CustomerFilter struct {
+	Metadata map[string]string
+	Page
+}
+
+// ListCustomers retrieves a page of customers matching the filter
+func (db *DB) ListCustomers(filter CustomerFilter) (*List[models.Customer], error) {
+	query := applyMetadata(db.Model(&models.Customer{}), "metadata", filter.Metadata)
+
+	return paginate(query, filter.Page, func(c models.Customer) (time.Time, string) {
+		return c.CreatedAt, c.ID
+	})
 }
 
-// CreatePaymentMethod creates a new payment method
+// CreatePaymentMethod creates a new payment method, attached to its customer
+// if it has one
 func (db *DB) CreatePaymentMethod(method *models.PaymentMethod) error {
 	method.CreatedAt = time.Now()
-	return db.Create(method).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(method).Error; err != nil {
+			return err
+		}
+		if method.CustomerID == "" {
+			return nil
+		}
+		return recordEvent(tx, models.EventPaymentMethodAttached, method.AccountID, method.Livemode, method)
+	})
+}
+
+// AttachPaymentMethod attaches a payment method created without a customer
+// to one. It returns ErrPaymentMethodAttached if the payment method already
+// belongs to a customer and ErrPaymentMethodDetached if it was detached.
+func (db *DB) AttachPaymentMethod(method *models.PaymentMethod, customerID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(method).Where("customer_id = '' AND detached_at IS NULL").Update("customer_id", customerID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			var current models.PaymentMethod
+			if err := tx.Select("customer_id", "detached_at").First(&current, "id = ?", method.ID).Error; err != nil {
+				return err
+			}
+			if current.DetachedAt != nil {
+				return ErrPaymentMethodDetached
+			}
+			return ErrPaymentMethodAttached
+		}
+		method.CustomerID = customerID
+		return recordEvent(tx, models.EventPaymentMethodAttached, method.AccountID, method.Livemode, method)
+	})
 }
 
 // GetPaymentMethod retrieves a payment method by ID
@@ -88,14 +320,122 @@ func (db *DB) GetPaymentMethod(id string) (*models.PaymentMethod, error) {
 	if err := db.First(&method, "id = ?", id).Error; err != nil {
 		return nil, err
 	}
+	method.Expired = method.IsExpired(time.Now())
 	return &method, nil
 }
 
-// CreatePayment creates a new payment
-func (db *DB) CreatePayment(payment *models.Payment) error {
+// UpdatePaymentMethod saves changes to an attached payment method
+func (db *DB) UpdatePaymentMethod(method *models.PaymentMethod) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(method).Where("detached_at IS NULL").Select("*").Omit("created_at").Updates(method)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrPaymentMethodDetached
+		}
+		return recordEvent(tx, models.EventPaymentMethodUpdated, method.AccountID, method.Livemode, method)
+	})
+}
+
+// DetachPaymentMethod detaches a payment method from its customer so it can no
+// longer be used, clearing it as the customer's default
+func (db *DB) DetachPaymentMethod(method *models.PaymentMethod) error {
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(method).Where("detached_at IS NULL").Updates(map[string]any{
+			"detached_at": now,
+			"vault_token": "",
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrPaymentMethodDetached
+		}
+		method.DetachedAt = &now
+		method.VaultToken = ""
+
+		if err := tx.Model(&models.Customer{}).
+			Where("id = ? AND default_payment_method_id = ?", method.CustomerID, method.ID).
+			Updates(map[string]any{"default_payment_method_id": "", "updated_at": now}).Error; err != nil {
+			return err
+		}
+		return recordEvent(tx, models.EventPaymentMethodDetached, method.AccountID, method.Livemode, method)
+	})
+}
+
+// PaymentMethodFilter represents the filters and pagination options for listing payment methods
+type PaymentMethodFilter struct {
+	CustomerID  string
+	Type        string
+	Brand       string
+	Fingerprint string
+	Metadata    map[string]string
+	Page
+}
+
+// ListPaymentMethods retrieves a page of attached payment methods matching the
+// filter, with expired cards flagged
+func (db *DB) ListPaymentMethods(filter PaymentMethodFilter) (*List[models.PaymentMethod], error) {
+	query := db.Model(&models.PaymentMethod{}).Where("detached_at IS NULL")
+	if filter.CustomerID != "" {
+		query = query.Where("customer_id = ?", filter.CustomerID)
+	}
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if filter.Brand != "" {
+		query = query.Where("brand = ?", filter.Brand)
+	}
+	if filter.Fingerprint != "" {
+		query = query.Where("fingerprint = ?", filter.Fingerprint)
+	}
+	query = applyMetadata(query, "metadata", filter.Metadata)
+
+	list, err := paginate(query, filter.Page, func(m models.PaymentMethod) (time.Time, string) {
+		return m.CreatedAt, m.ID
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range list.Data {
+		list.Data[i].Expired = list.Data[i].IsExpired(now)
+	}
+	return list, nil
+}
+
+// FindPaymentMethodByFingerprint retrieves a customer's attached payment method
+// for the card with the given fingerprint
+func (db *DB) FindPaymentMethodByFingerprint(customerID, fingerprint string) (*models.PaymentMethod, error) {
+	var method models.PaymentMethod
+	if err := db.First(&method, "customer_id = ? AND fingerprint = ? AND detached_at IS NULL", customerID, fingerprint).Error; err != nil {
+		return nil, err
+	}
+	return &method, nil
+}
+
+// CreatePayment creates a new payment and records its initial status
+func (db *DB) CreatePayment(payment *models.Payment, actor string) error {
+	if err := statemachine.Payment.Validate("", payment.Status); err != nil {
+		return err
+	}
+
 	payment.CreatedAt = time.Now()
 	payment.UpdatedAt = time.Now()
-	return db.Create(payment).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(payment).Error; err != nil {
+			return err
+		}
+		if err := recordPaymentTransition(tx, payment.ID, "", payment.Status, actor); err != nil {
+			return err
+		}
+		if err := recordEvent(tx, models.EventPaymentCreated, payment.AccountID, payment.Livemode, payment); err != nil {
+			return err
+		}
+		return recordPaymentEvent(tx, payment)
+	})
 }
 
 // GetPayment retrieves a payment by ID
@@ -107,11 +447,202 @@ func (db *DB) GetPayment(id string) (*models.Payment, error) {
 	return &payment, nil
 }
 
-// CreateRefund creates a new refund
+// UpdatePayment saves changes to an existing payment. A status change must be
+// a legal transition from the stored status and is recorded in the payment's
+// history; otherwise a *statemachine.TransitionError is returned.
+func (db *DB) UpdatePayment(payment *models.Payment, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return updatePayment(tx, payment, actor)
+	})
+}
+
+// updatePayment implements UpdatePayment within a transaction
+func updatePayment(tx *gorm.DB, payment *models.Payment, actor string) error {
+	var current models.Payment
+	if err := tx.Select("status").First(&current, "id = ?", payment.ID).Error; err != nil {
+		return err
+	}
+	if current.Status != payment.Status {
+		if err := statemachine.Payment.Validate(current.Status, payment.Status); err != nil {
+			return err
+		}
+	}
+
+	// Only save if the status is still the one the transition was validated against
+	payment.UpdatedAt = time.Now()
+	result := tx.Model(payment).Where("status = ?", current.Status).Select("*").Updates(payment)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrConcurrentUpdate
+	}
+
+	if current.Status == payment.Status {
+		return nil
+	}
+	if err := recordPaymentTransition(tx, payment.ID, current.Status, payment.Status, actor); err != nil {
+		return err
+	}
+	return recordPaymentEvent(tx, payment)
+}
+
+// UpdatePaymentDetails saves a payment's description and metadata without
+// touching its status or amounts
+func (db *DB) UpdatePaymentDetails(payment *models.Payment) error {
+	payment.UpdatedAt = time.Now()
+	return db.Model(payment).Select("description", "metadata", "updated_at").Updates(payment).Error
+}
+
+// ExpiredAuthorizations retrieves the uncaptured payments whose authorization
+// window ended before the given time
+func (db *DB) ExpiredAuthorizations(now time.Time) ([]models.Payment, error) {
+	var payments []models.Payment
+	if err := db.Where("status = ? AND capture_before < ?", models.PaymentStatusRequiresCapture, now).Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// ExpireAuthorization cancels an uncaptured payment whose authorization
+// window has passed, once it has been voided at the processor. ErrConcurrentUpdate is returned if it was captured or
+// canceled since it was read.
+func (db *DB) ExpireAuthorization(payment *models.Payment, now time.Time) error {
+	payment.Status = models.PaymentStatusCanceled
+	payment.CancellationReason = models.CancellationReasonAutomatic
+	payment.CanceledAt = &now
+	return db.UpdatePayment(payment, models.ActorSystem)
+}
+
+// PaymentFilter represents the filters and pagination options for listing payments
+type PaymentFilter struct {
+	CustomerID string
+	Status     string
+	Currency   string
+	Created    Range // Unix timestamps in seconds
+	Amount     Range // Amounts in cents
+	Metadata   map[string]string
+	Page
+}
+
+// ListPayments retrieves a page of payments matching the filter
+func (db *DB) ListPayments(filter PaymentFilter) (*List[models.Payment], error) {
+	query := db.Model(&models.Payment{})
+	if filter.CustomerID != "" {
+		query = query.Where("customer_id = ?", filter.CustomerID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.Currency != "" {
+		query = query.Where("currency = ?", filter.Currency)
+	}
+	query = applyRange(query, "created_at", filter.Created, unixSeconds)
+	query = applyRange(query, "amount", filter.Amount, cents)
+	query = applyMetadata(query, "metadata", filter.Metadata)
+
+	return paginate(query, filter.Page, func(p models.Payment) (time.Time, string) {
+		return p.CreatedAt, p.ID
+	})
+}
+
+// CreateRefund creates a new pending refund, reserving its amount against the
+// payment. It returns ErrRefundExceedsBalance if the payment's captured amount
+// less its pending and successful refunds is smaller than the refund, and
+// ErrInvalidRefundAmount if the refund's amount is not positive.
 func (db *DB) CreateRefund(refund *models.Refund) error {
+	if refund.Amount <= 0 {
+		return ErrInvalidRefundAmount
+	}
+	refund.Status = models.RefundStatusPending
 	refund.CreatedAt = time.Now()
 	refund.UpdatedAt = time.Now()
-	return db.Create(refund).Error
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var payment models.Payment
+		if err := tx.First(&payment, "id = ?", refund.PaymentID).Error; err != nil {
+			return err
+		}
+
+		reserved, err := reservedRefundAmount(tx, refund.PaymentID)
+		if err != nil {
+			return err
+		}
+		if reserved+refund.Amount > payment.AmountCaptured {
+			return ErrRefundExceedsBalance
+		}
+
+		if err := tx.Create(refund).Error; err != nil {
+			return err
+		}
+		return recordEvent(tx, models.EventRefundCreated, refund.AccountID, refund.Livemode, refund)
+	})
+}
+
+// RefundableAmount returns how much of a payment's captured amount is not
+// reserved by pending or succeeded refunds
+func (db *DB) RefundableAmount(payment *models.Payment) (int64, error) {
+	reserved, err := reservedRefundAmount(db.DB, payment.ID)
+	if err != nil {
+		return 0, err
+	}
+	return payment.AmountCaptured - reserved, nil
+}
+
+// reservedRefundAmount sums the pending and succeeded refunds of a payment
+func reservedRefundAmount(tx *gorm.DB, paymentID string) (int64, error) {
+	var reserved int64
+	err := tx.Model(&models.Refund{}).
+		Where("payment_id = ? AND status IN ?", paymentID, []string{models.RefundStatusPending, models.RefundStatusSucceeded}).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&reserved).Error
+	return reserved, err
+}
+
+// CompleteRefund moves a pending refund to succeeded or failed. A successful
+// refund is applied to its payment's refunded amount and status in the same
+// transaction.
+func (db *DB) CompleteRefund(refund *models.Refund, status string, actor string) error {
+	if err := statemachine.Refund.Validate(models.RefundStatusPending, status); err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		refund.Status = status
+		refund.UpdatedAt = time.Now()
+		result := tx.Model(refund).Where("status = ?", models.RefundStatusPending).Select("*").Updates(refund)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrConcurrentUpdate
+		}
+		if err := recordEvent(tx, refundStatusEvents[status], refund.AccountID, refund.Livemode, refund); err != nil {
+			return err
+		}
+		if status != models.RefundStatusSucceeded {
+			return nil
+		}
+
+		// Apply the refund to the payment
+		var payment models.Payment
+		if err := tx.First(&payment, "id = ?", refund.PaymentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Refund{}).
+			Where("payment_id = ? AND status = ?", refund.PaymentID, models.RefundStatusSucceeded).
+			Select("COALESCE(SUM(amount), 0)").
+			Scan(&payment.AmountRefunded).Error; err != nil {
+			return err
+		}
+		payment.Refunded = payment.AmountRefunded >= payment.AmountCaptured
+		if payment.Refunded {
+			payment.Status = models.PaymentStatusRefunded
+		} else {
+			payment.Status = models.PaymentStatusPartiallyRefunded
+		}
+		return updatePayment(tx, &payment, actor)
+	})
 }
 
 // GetRefund retrieves a refund by ID
@@ -123,6 +654,42 @@ func (db *DB) GetRefund(id string) (*models.Refund, error) {
 	return &refund, nil
 }
 
+// UpdateRefundMetadata saves a refund's metadata without touching its status
+func (db *DB) UpdateRefundMetadata(refund *models.Refund) error {
+	refund.UpdatedAt = time.Now()
+	return db.Model(refund).Select("metadata", "updated_at").Updates(refund).Error
+}
+
+// RefundFilter represents the filters and pagination options for listing refunds
+type RefundFilter struct {
+	PaymentID string
+	Status    string
+	Reason    string
+	Created   Range // Unix timestamps in seconds
+	Metadata  map[string]string
+	Page
+}
+
+// ListRefunds retrieves a page of refunds matching the filter
+func (db *DB) ListRefunds(filter RefundFilter) (*List[models.Refund], error) {
+	query := db.Model(&models.Refund{})
+	if filter.PaymentID != "" {
+		query = query.Where("payment_id = ?", filter.PaymentID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.Reason != "" {
+		query = query.Where("reason = ?", filter.Reason)
+	}
+	query = applyRange(query, "created_at", filter.Created, unixSeconds)
+	query = applyMetadata(query, "metadata", filter.Metadata)
+
+	return paginate(query, filter.Page, func(r models.Refund) (time.Time, string) {
+		return r.CreatedAt, r.ID
+	})
+}
+
 // GetPaymentMethodByCustomer retrieves a payment method by ID and customer ID
 func (db *DB) GetPaymentMethodByCustomer(id string, customerID string) (*models.PaymentMethod, error) {
 	var method models.PaymentMethod
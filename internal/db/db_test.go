@@ -1,11 +1,18 @@
 package db
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/jeffgrover/payment-api/internal/apikeys"
 	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/jeffgrover/payment-api/internal/search"
+	"github.com/jeffgrover/payment-api/internal/statemachine"
+	"gorm.io/gorm"
 )
 
 // Setup test database
@@ -85,17 +92,20 @@ func TestCustomerOperations(t *testing.T) {
 	}
 
 	// Test ListCustomers
-	customers, err := db.ListCustomers(10)
+	customers, err := db.ListCustomers(CustomerFilter{Page: Page{Limit: 10}})
 	if err != nil {
 		t.Fatalf("Failed to list customers: %v", err)
 	}
 
 	// Check that the list contains the customer
-	if len(customers) != 1 {
-		t.Errorf("Expected 1 customer, got %d", len(customers))
+	if len(customers.Data) != 1 {
+		t.Fatalf("Expected 1 customer, got %d", len(customers.Data))
 	}
-	if customers[0].ID != customer.ID {
-		t.Errorf("Expected ID to be '%s', got '%s'", customer.ID, customers[0].ID)
+	if customers.Data[0].ID != customer.ID {
+		t.Errorf("Expected ID to be '%s', got '%s'", customer.ID, customers.Data[0].ID)
+	}
+	if customers.HasMore {
+		t.Error("Expected has_more to be false")
 	}
 }
 
@@ -165,3 +175,1060 @@ func TestPaymentMethodOperations(t *testing.T) {
 		t.Errorf("Expected ID to be '%s', got '%s'", paymentMethod.ID, retrievedMethodByCustomer.ID)
 	}
 }
+
+func TestAttachPaymentMethod(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	customer := &models.Customer{ID: "cus_test123", Email: "test@example.com"}
+	if err := db.CreateCustomer(customer); err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	method := &models.PaymentMethod{ID: "pm_test123", Type: "card", Last4: "4242"}
+	if err := db.CreatePaymentMethod(method); err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+
+	if err := db.AttachPaymentMethod(method, customer.ID); err != nil {
+		t.Fatalf("Failed to attach payment method: %v", err)
+	}
+	if _, err := db.GetPaymentMethodByCustomer(method.ID, customer.ID); err != nil {
+		t.Errorf("Expected payment method to belong to the customer, got %v", err)
+	}
+
+	// Attached payment methods cannot be attached again, even from a stale copy
+	stale := &models.PaymentMethod{ID: method.ID}
+	if err := db.AttachPaymentMethod(stale, "cus_other"); err != ErrPaymentMethodAttached {
+		t.Errorf("Expected ErrPaymentMethodAttached, got %v", err)
+	}
+	if err := db.DetachPaymentMethod(method); err != nil {
+		t.Fatalf("Failed to detach payment method: %v", err)
+	}
+	if err := db.AttachPaymentMethod(stale, "cus_other"); err != ErrPaymentMethodDetached {
+		t.Errorf("Expected ErrPaymentMethodDetached, got %v", err)
+	}
+}
+
+func TestListPaymentMethods(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	detachedAt := now
+	methods := []*models.PaymentMethod{
+		{ID: "pm_visa", CustomerID: "cus_1", Type: "card", Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: now.Year() + 1},
+		{ID: "pm_expired", CustomerID: "cus_1", Type: "card", Brand: "visa", Last4: "1111", ExpMonth: 1, ExpYear: now.Year() - 1},
+		{ID: "pm_mastercard", CustomerID: "cus_1", Type: "card", Brand: "mastercard", Last4: "4444", ExpMonth: 12, ExpYear: now.Year() + 1},
+		{ID: "pm_bank", CustomerID: "cus_1", Type: "bank_account", Last4: "6789"},
+		{ID: "pm_detached", CustomerID: "cus_1", Type: "card", Brand: "visa", Last4: "0005", ExpMonth: 12, ExpYear: now.Year() + 1, DetachedAt: &detachedAt},
+		{ID: "pm_other", CustomerID: "cus_2", Type: "card", Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: now.Year() + 1},
+	}
+	for i, method := range methods {
+		method.CreatedAt = now.Add(time.Duration(i) * time.Second)
+		if err := db.CreatePaymentMethod(method); err != nil {
+			t.Fatalf("Failed to create payment method: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter PaymentMethodFilter
+		want   int
+	}{
+		{"customer", PaymentMethodFilter{CustomerID: "cus_1"}, 4},
+		{"type", PaymentMethodFilter{CustomerID: "cus_1", Type: "card"}, 3},
+		{"brand", PaymentMethodFilter{CustomerID: "cus_1", Brand: "visa"}, 2},
+		{"all customers", PaymentMethodFilter{}, 5},
+	}
+	for _, tt := range tests {
+		list, err := db.ListPaymentMethods(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: failed to list payment methods: %v", tt.name, err)
+		}
+		if len(list.Data) != tt.want {
+			t.Errorf("%s: expected %d payment methods, got %d", tt.name, tt.want, len(list.Data))
+		}
+		for _, method := range list.Data {
+			if method.ID == "pm_detached" {
+				t.Errorf("%s: expected detached payment method to be excluded", tt.name)
+			}
+			if method.Expired != (method.ID == "pm_expired") {
+				t.Errorf("%s: unexpected expired flag %v on %s", tt.name, method.Expired, method.ID)
+			}
+		}
+	}
+
+	// Expired cards are flagged when retrieved directly too
+	method, err := db.GetPaymentMethod("pm_expired")
+	if err != nil {
+		t.Fatalf("Failed to get payment method: %v", err)
+	}
+	if !method.Expired {
+		t.Error("Expected card to be flagged as expired")
+	}
+}
+
+func TestListPayments(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Create test payments across two customers and currencies
+	payments := []*models.Payment{
+		{ID: "pay_test1", Amount: 1000, Currency: "usd", CustomerID: "cus_a", Status: "succeeded"},
+		{ID: "pay_test2", Amount: 2000, Currency: "usd", CustomerID: "cus_a", Status: "failed"},
+		{ID: "pay_test3", Amount: 3000, Currency: "eur", CustomerID: "cus_b", Status: "succeeded"},
+		{ID: "pay_test4", Amount: 4000, Currency: "usd", CustomerID: "cus_a", Status: "succeeded"},
+	}
+	for _, payment := range payments {
+		if err := db.CreatePayment(payment, models.ActorAPI); err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+	}
+
+	// Test filtering by customer, status and currency
+	result, err := db.ListPayments(PaymentFilter{CustomerID: "cus_a", Status: "succeeded", Currency: "usd"})
+	if err != nil {
+		t.Fatalf("Failed to list payments: %v", err)
+	}
+	if len(result.Data) != 2 || result.HasMore {
+		t.Fatalf("Expected 2 payments and no more, got %d (has_more=%v)", len(result.Data), result.HasMore)
+	}
+	if result.Data[0].ID != "pay_test4" || result.Data[1].ID != "pay_test1" {
+		t.Errorf("Expected newest first, got '%s', '%s'", result.Data[0].ID, result.Data[1].ID)
+	}
+
+	// Test filtering by amount range
+	result, err = db.ListPayments(PaymentFilter{Amount: Range{GT: 1000, LTE: 3000}})
+	if err != nil {
+		t.Fatalf("Failed to list payments: %v", err)
+	}
+	if len(result.Data) != 2 {
+		t.Errorf("Expected 2 payments in amount range, got %d", len(result.Data))
+	}
+
+	// Test filtering by created range
+	result, err = db.ListPayments(PaymentFilter{Created: Range{LT: time.Now().Add(-time.Hour).Unix()}})
+	if err != nil {
+		t.Fatalf("Failed to list payments: %v", err)
+	}
+	if len(result.Data) != 0 {
+		t.Errorf("Expected no payments created over an hour ago, got %d", len(result.Data))
+	}
+}
+
+func TestPagination(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Create five customers, oldest first
+	for _, id := range []string{"cus_1", "cus_2", "cus_3", "cus_4", "cus_5"} {
+		if err := db.CreateCustomer(&models.Customer{ID: id, Email: id + "@example.com", Name: id}); err != nil {
+			t.Fatalf("Failed to create customer: %v", err)
+		}
+	}
+
+	// Test paging forward with starting_after
+	page, err := db.ListCustomers(CustomerFilter{Page: Page{Limit: 2}})
+	if err != nil {
+		t.Fatalf("Failed to list customers: %v", err)
+	}
+	if len(page.Data) != 2 || !page.HasMore || page.Data[0].ID != "cus_5" || page.Data[1].ID != "cus_4" {
+		t.Fatalf("Expected 'cus_5', 'cus_4' with more available, got %v (has_more=%v)", page.Data, page.HasMore)
+	}
+	page, err = db.ListCustomers(CustomerFilter{Page: Page{Limit: 2, StartingAfter: page.NextCursor}})
+	if err != nil {
+		t.Fatalf("Failed to list customers: %v", err)
+	}
+	if len(page.Data) != 2 || !page.HasMore || page.Data[0].ID != "cus_3" || page.Data[1].ID != "cus_2" {
+		t.Fatalf("Expected 'cus_3', 'cus_2' with more available, got %v (has_more=%v)", page.Data, page.HasMore)
+	}
+	last, err := db.ListCustomers(CustomerFilter{Page: Page{Limit: 2, StartingAfter: page.NextCursor}})
+	if err != nil {
+		t.Fatalf("Failed to list customers: %v", err)
+	}
+	if len(last.Data) != 1 || last.HasMore || last.Data[0].ID != "cus_1" {
+		t.Errorf("Expected final page with 'cus_1', got %v (has_more=%v)", last.Data, last.HasMore)
+	}
+
+	// Test paging backward with ending_before
+	previous, err := db.ListCustomers(CustomerFilter{Page: Page{Limit: 2, EndingBefore: page.PreviousCursor}})
+	if err != nil {
+		t.Fatalf("Failed to list customers: %v", err)
+	}
+	if len(previous.Data) != 2 || previous.HasMore || previous.Data[0].ID != "cus_5" || previous.Data[1].ID != "cus_4" {
+		t.Errorf("Expected 'cus_5', 'cus_4' with no more available, got %v (has_more=%v)", previous.Data, previous.HasMore)
+	}
+
+	// Test malformed and conflicting cursors
+	if _, err := db.ListCustomers(CustomerFilter{Page: Page{StartingAfter: "not-a-cursor"}}); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+	if _, err := db.ListCustomers(CustomerFilter{Page: Page{StartingAfter: page.NextCursor, EndingBefore: page.PreviousCursor}}); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestExpireAuthorizations(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Create one expired and one live authorization
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	for _, payment := range []*models.Payment{
+		{ID: "pay_expired", Amount: 1000, Currency: "usd", Status: models.PaymentStatusRequiresCapture, CaptureMethod: models.CaptureMethodManual, CaptureBefore: &past},
+		{ID: "pay_live", Amount: 1000, Currency: "usd", Status: models.PaymentStatusRequiresCapture, CaptureMethod: models.CaptureMethodManual, CaptureBefore: &future},
+	} {
+		if err := db.CreatePayment(payment, models.ActorAPI); err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+	}
+
+	// Test ExpiredAuthorizations and ExpireAuthorization
+	expired, err := db.ExpiredAuthorizations(time.Now())
+	if err != nil {
+		t.Fatalf("Failed to list expired authorizations: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ID != "pay_expired" {
+		t.Fatalf("Expected 1 expired authorization, got %d", len(expired))
+	}
+	if err := db.ExpireAuthorization(&expired[0], time.Now()); err != nil {
+		t.Fatalf("Failed to expire authorization: %v", err)
+	}
+
+	// Check the statuses
+	payment, err := db.GetPayment("pay_expired")
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if payment.Status != models.PaymentStatusCanceled {
+		t.Errorf("Expected status to be 'canceled', got '%s'", payment.Status)
+	}
+	payment, err = db.GetPayment("pay_live")
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if payment.Status != models.PaymentStatusRequiresCapture {
+		t.Errorf("Expected status to be 'requires_capture', got '%s'", payment.Status)
+	}
+}
+
+func TestPaymentStatusTransitions(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Payments cannot be created in a terminal status
+	if err := db.CreatePayment(&models.Payment{ID: "pay_bad", Status: models.PaymentStatusRefunded}, models.ActorAPI); err == nil {
+		t.Error("Expected error when creating a payment with status 'refunded'")
+	}
+
+	// Create an authorization and capture it
+	payment := &models.Payment{ID: "pay_test123", Amount: 1000, Currency: "usd", Status: models.PaymentStatusRequiresCapture}
+	if err := db.CreatePayment(payment, models.ActorAPI); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	payment.Status = models.PaymentStatusSucceeded
+	if err := db.UpdatePayment(payment, "key_test"); err != nil {
+		t.Fatalf("Failed to update payment: %v", err)
+	}
+
+	// Illegal transitions are rejected and leave the payment unchanged
+	payment.Status = models.PaymentStatusCanceled
+	var transitionErr *statemachine.TransitionError
+	if err := db.UpdatePayment(payment, models.ActorAPI); !errors.As(err, &transitionErr) {
+		t.Errorf("Expected TransitionError, got %v", err)
+	}
+	retrieved, err := db.GetPayment(payment.ID)
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if retrieved.Status != models.PaymentStatusSucceeded {
+		t.Errorf("Expected status to be 'succeeded', got '%s'", retrieved.Status)
+	}
+
+	// Test GetPaymentHistory
+	history, err := db.GetPaymentHistory(payment.ID)
+	if err != nil {
+		t.Fatalf("Failed to get payment history: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 transitions, got %d", len(history))
+	}
+	if history[0].FromStatus != "" || history[0].ToStatus != models.PaymentStatusRequiresCapture || history[0].Actor != models.ActorAPI {
+		t.Errorf("Unexpected creation transition: %+v", history[0])
+	}
+	if history[1].FromStatus != models.PaymentStatusRequiresCapture || history[1].ToStatus != models.PaymentStatusSucceeded || history[1].Actor != "key_test" {
+		t.Errorf("Unexpected capture transition: %+v", history[1])
+	}
+}
+
+func TestRefundBalance(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	payment := &models.Payment{ID: "pay_test123", Amount: 1000, AmountCaptured: 1000, Currency: "usd", Status: models.PaymentStatusSucceeded}
+	if err := db.CreatePayment(payment, models.ActorAPI); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	// Pending refunds reserve their amount
+	pending := &models.Refund{ID: "ref_pending", PaymentID: payment.ID, Amount: 700}
+	if err := db.CreateRefund(pending); err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+	if err := db.CreateRefund(&models.Refund{ID: "ref_over", PaymentID: payment.ID, Amount: 400}); err != ErrRefundExceedsBalance {
+		t.Errorf("Expected ErrRefundExceedsBalance, got %v", err)
+	}
+
+	// Refunds that are not positive cannot offset the reservation
+	for _, amount := range []int64{0, -2000} {
+		if err := db.CreateRefund(&models.Refund{ID: fmt.Sprintf("ref_%d", amount), PaymentID: payment.ID, Amount: amount}); err != ErrInvalidRefundAmount {
+			t.Errorf("Expected ErrInvalidRefundAmount for amount %d, got %v", amount, err)
+		}
+	}
+
+	// Failed refunds release their reservation without touching the payment
+	if err := db.CompleteRefund(pending, models.RefundStatusFailed, models.ActorAPI); err != nil {
+		t.Fatalf("Failed to complete refund: %v", err)
+	}
+	refund := &models.Refund{ID: "ref_ok", PaymentID: payment.ID, Amount: 400}
+	if err := db.CreateRefund(refund); err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+	if err := db.CompleteRefund(refund, models.RefundStatusSucceeded, models.ActorAPI); err != nil {
+		t.Fatalf("Failed to complete refund: %v", err)
+	}
+
+	// Completed refunds cannot be completed again
+	if err := db.CompleteRefund(refund, models.RefundStatusSucceeded, models.ActorAPI); err != ErrConcurrentUpdate {
+		t.Errorf("Expected ErrConcurrentUpdate, got %v", err)
+	}
+
+	retrieved, err := db.GetPayment(payment.ID)
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if retrieved.AmountRefunded != 400 || retrieved.Status != models.PaymentStatusPartiallyRefunded {
+		t.Errorf("Expected 400 refunded and 'partially_refunded', got %d and '%s'", retrieved.AmountRefunded, retrieved.Status)
+	}
+}
+
+func TestListRefunds(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, id := range []string{"pay_1", "pay_2"} {
+		payment := &models.Payment{ID: id, Amount: 1000, AmountCaptured: 1000, Currency: "usd", Status: models.PaymentStatusSucceeded}
+		if err := db.CreatePayment(payment, models.ActorAPI); err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+	}
+
+	refunds := []struct {
+		refund *models.Refund
+		status string
+		age    time.Duration
+	}{
+		{&models.Refund{ID: "ref_1", PaymentID: "pay_1", Amount: 100, Reason: "duplicate"}, models.RefundStatusSucceeded, 48 * time.Hour},
+		{&models.Refund{ID: "ref_2", PaymentID: "pay_1", Amount: 100, Reason: "requested_by_customer"}, models.RefundStatusFailed, time.Hour},
+		{&models.Refund{ID: "ref_3", PaymentID: "pay_2", Amount: 100, Reason: "requested_by_customer"}, models.RefundStatusSucceeded, time.Hour},
+	}
+	for _, r := range refunds {
+		if err := db.CreateRefund(r.refund); err != nil {
+			t.Fatalf("Failed to create refund: %v", err)
+		}
+		if err := db.CompleteRefund(r.refund, r.status, models.ActorAPI); err != nil {
+			t.Fatalf("Failed to complete refund: %v", err)
+		}
+		if err := db.Model(r.refund).Update("created_at", time.Now().Add(-r.age)).Error; err != nil {
+			t.Fatalf("Failed to backdate refund: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter RefundFilter
+		want   int
+	}{
+		{"payment", RefundFilter{PaymentID: "pay_1"}, 2},
+		{"status", RefundFilter{Status: models.RefundStatusSucceeded}, 2},
+		{"reason", RefundFilter{Reason: "requested_by_customer"}, 2},
+		{"created", RefundFilter{Created: Range{GTE: time.Now().Add(-24 * time.Hour).Unix()}}, 2},
+		{"combined", RefundFilter{PaymentID: "pay_1", Status: models.RefundStatusSucceeded, Reason: "duplicate"}, 1},
+	}
+	for _, tt := range tests {
+		list, err := db.ListRefunds(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: failed to list refunds: %v", tt.name, err)
+		}
+		if len(list.Data) != tt.want {
+			t.Errorf("%s: expected %d refunds, got %d", tt.name, tt.want, len(list.Data))
+		}
+	}
+}
+
+func TestUniqueCustomerEmails(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Duplicates are allowed until the index is created
+	first := &models.Customer{ID: "cus_1", Email: "jane@example.com"}
+	second := &models.Customer{ID: "cus_2", Email: "jane@example.com"}
+	for _, customer := range []*models.Customer{first, second} {
+		if err := db.CreateCustomer(customer); err != nil {
+			t.Fatalf("Failed to create customer: %v", err)
+		}
+	}
+	if err := db.SetUniqueCustomerEmails(true); !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("Expected ErrDuplicateEmail while duplicates exist, got %v", err)
+	}
+
+	// Once the duplicate is gone the index can be created and is enforced
+	if _, err := db.DeleteCustomer(second); err != nil {
+		t.Fatalf("Failed to delete customer: %v", err)
+	}
+	if err := db.SetUniqueCustomerEmails(true); err != nil {
+		t.Fatalf("Failed to enforce unique emails: %v", err)
+	}
+	if err := db.CreateCustomer(&models.Customer{ID: "cus_3", Email: "jane@example.com"}); err != ErrDuplicateEmail {
+		t.Errorf("Expected ErrDuplicateEmail on create, got %v", err)
+	}
+	other := &models.Customer{ID: "cus_4", Email: "john@example.com"}
+	if err := db.CreateCustomer(other); err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	other.Email = "jane@example.com"
+	if err := db.UpdateCustomer(other); err != ErrDuplicateEmail {
+		t.Errorf("Expected ErrDuplicateEmail on update, got %v", err)
+	}
+
+	existing, err := db.FindCustomerByEmail("jane@example.com")
+	if err != nil {
+		t.Fatalf("Failed to find customer: %v", err)
+	}
+	if existing.ID != first.ID {
+		t.Errorf("Expected %s, got %s", first.ID, existing.ID)
+	}
+
+	// Dropping the index allows duplicates again
+	if err := db.SetUniqueCustomerEmails(false); err != nil {
+		t.Fatalf("Failed to stop enforcing unique emails: %v", err)
+	}
+	if err := db.UpdateCustomer(other); err != nil {
+		t.Errorf("Expected duplicate to be allowed, got %v", err)
+	}
+}
+
+func TestAccountScope(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// A default account is created for data that predates accounts
+	defaultAccount, err := db.DefaultAccount()
+	if err != nil {
+		t.Fatalf("Failed to get default account: %v", err)
+	}
+	other := &models.Account{ID: "acct_2", Name: "Other"}
+	if err := db.CreateAccount(other); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+	mine, theirs := db.ForAccount(defaultAccount.ID), db.ForAccount(other.ID)
+
+	// Created rows are assigned to the scoped account
+	customer := &models.Customer{ID: "cus_1", Email: "jane@example.com"}
+	if err := mine.CreateCustomer(customer); err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	if customer.AccountID != defaultAccount.ID {
+		t.Errorf("Expected account %s, got %q", defaultAccount.ID, customer.AccountID)
+	}
+	payment := &models.Payment{ID: "pay_1", CustomerID: customer.ID, Amount: 1000, AmountCaptured: 1000, Currency: "usd", Status: models.PaymentStatusSucceeded}
+	if err := mine.CreatePayment(payment, models.ActorAPI); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	// Other accounts can neither read, list, update nor refund them
+	if _, err := theirs.GetCustomer(customer.ID); err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected ErrRecordNotFound reading another account's customer, got %v", err)
+	}
+	if _, err := theirs.GetPayment(payment.ID); err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected ErrRecordNotFound reading another account's payment, got %v", err)
+	}
+	if list, err := theirs.ListCustomers(CustomerFilter{}); err != nil || len(list.Data) != 0 {
+		t.Errorf("Expected no customers for another account, got %v (%v)", list, err)
+	}
+	if list, err := theirs.SearchCustomers(`email:"jane"`, Page{}); err != nil || len(list.Data) != 0 {
+		t.Errorf("Expected no search results for another account, got %v (%v)", list, err)
+	}
+	if err := theirs.UpdatePaymentDetails(&models.Payment{ID: payment.ID, Description: "stolen"}); err != nil {
+		t.Fatalf("Failed to run update: %v", err)
+	}
+	if err := theirs.CreateRefund(&models.Refund{ID: "ref_1", PaymentID: payment.ID, Amount: 100}); err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected ErrRecordNotFound refunding another account's payment, got %v", err)
+	}
+	got, err := mine.GetPayment(payment.ID)
+	if err != nil {
+		t.Fatalf("Failed to get payment: %v", err)
+	}
+	if got.Description != "" {
+		t.Errorf("Expected another account's update to have no effect, got description %q", got.Description)
+	}
+
+	// Unique emails are enforced within each account only
+	if err := db.SetUniqueCustomerEmails(true); err != nil {
+		t.Fatalf("Failed to enforce unique emails: %v", err)
+	}
+	if err := theirs.CreateCustomer(&models.Customer{ID: "cus_2", Email: customer.Email}); err != nil {
+		t.Errorf("Expected another account to reuse the email, got %v", err)
+	}
+	if err := mine.CreateCustomer(&models.Customer{ID: "cus_3", Email: customer.Email}); err != ErrDuplicateEmail {
+		t.Errorf("Expected ErrDuplicateEmail within the account, got %v", err)
+	}
+}
+
+func TestModeScope(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	account, err := db.DefaultAccount()
+	if err != nil {
+		t.Fatalf("Failed to get default account: %v", err)
+	}
+	test, live := db.ForAccount(account.ID).ForMode(false), db.ForAccount(account.ID).ForMode(true)
+
+	// Created rows are assigned to the scoped mode
+	for _, scoped := range []*DB{test, live} {
+		mode := "test"
+		if scoped == live {
+			mode = "live"
+		}
+		endpoint := &models.WebhookEndpoint{ID: "we_" + mode, URL: "https://example.com/" + mode, EnabledEvents: models.EnabledEvents{models.EventAll}, Secret: "whsec_" + mode}
+		if err := scoped.CreateWebhookEndpoint(endpoint); err != nil {
+			t.Fatalf("Failed to create %s webhook endpoint: %v", mode, err)
+		}
+		customer := &models.Customer{ID: "cus_" + mode, Email: "jane@example.com"}
+		if err := scoped.CreateCustomer(customer); err != nil {
+			t.Fatalf("Failed to create %s customer: %v", mode, err)
+		}
+		if customer.Livemode != (scoped == live) {
+			t.Errorf("Expected %s customer to have livemode %v", mode, scoped == live)
+		}
+		method := &models.PaymentMethod{ID: "pm_" + mode, Type: models.PaymentMethodTypeCard, CustomerID: customer.ID, VaultToken: "tok_" + mode}
+		if err := scoped.CreatePaymentMethod(method); err != nil {
+			t.Fatalf("Failed to create %s payment method: %v", mode, err)
+		}
+		payment := &models.Payment{ID: "pay_" + mode, CustomerID: customer.ID, PaymentMethodID: method.ID, Amount: 1000, AmountCaptured: 1000, Currency: "usd", Status: models.PaymentStatusSucceeded}
+		if err := scoped.CreatePayment(payment, models.ActorAPI); err != nil {
+			t.Fatalf("Failed to create %s payment: %v", mode, err)
+		}
+		refund := &models.Refund{ID: "ref_" + mode, PaymentID: payment.ID, Amount: 100}
+		if err := scoped.CreateRefund(refund); err != nil {
+			t.Fatalf("Failed to create %s refund: %v", mode, err)
+		}
+	}
+
+	// Each mode only sees its own rows
+	if _, err := live.GetCustomer("cus_test"); err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected ErrRecordNotFound reading a test customer in live mode, got %v", err)
+	}
+	if _, err := test.GetPayment("pay_live"); err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected ErrRecordNotFound reading a live payment in test mode, got %v", err)
+	}
+	if list, err := test.ListCustomers(CustomerFilter{}); err != nil || len(list.Data) != 1 || list.Data[0].ID != "cus_test" {
+		t.Errorf("Expected only the test customer in test mode, got %v (%v)", list, err)
+	}
+
+	// Attempt to send every event
+	due, err := db.DueWebhookDeliveries(time.Now(), 100, 100, nil)
+	if err != nil {
+		t.Fatalf("Failed to get due deliveries: %v", err)
+	}
+	var testEvents int64
+	for i := range due {
+		if !due[i].Event.Livemode {
+			testEvents++
+		}
+		if err := db.RecordWebhookAttempt(&due[i].WebhookDelivery, &models.WebhookAttempt{EventType: due[i].Event.Type, StatusCode: 200, Succeeded: true, CreatedAt: time.Now()}); err != nil {
+			t.Fatalf("Failed to record attempt: %v", err)
+		}
+	}
+
+	// Deleting test data removes only test mode rows
+	deleted, tokens, err := db.DeleteTestData(account.ID)
+	if err != nil {
+		t.Fatalf("Failed to delete test data: %v", err)
+	}
+	if deleted.Customers != 1 || deleted.PaymentMethods != 1 || deleted.Payments != 1 || deleted.Refunds != 1 || deleted.WebhookEndpoints != 1 {
+		t.Errorf("Expected one of each test object deleted, got %+v", deleted)
+	}
+	if testEvents == 0 || deleted.Events != testEvents || deleted.WebhookAttempts != testEvents {
+		t.Errorf("Expected %d test events and attempts deleted, got %+v", testEvents, deleted)
+	}
+	var deliveries, attempts int64
+	db.Model(&models.WebhookDelivery{}).Count(&deliveries)
+	db.Model(&models.WebhookAttempt{}).Count(&attempts)
+	if kept := int64(len(due)) - testEvents; deliveries != kept || attempts != kept {
+		t.Errorf("Expected only the %d live deliveries and attempts to survive, got %d and %d", kept, deliveries, attempts)
+	}
+	if _, err := live.GetWebhookEndpoint("we_live"); err != nil {
+		t.Errorf("Expected live webhook endpoint to survive, got %v", err)
+	}
+	if len(tokens) != 1 || tokens[0] != "tok_test" {
+		t.Errorf("Expected the test card's vault token, got %v", tokens)
+	}
+	if _, err := test.GetCustomer("cus_test"); err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected test customer to be deleted, got %v", err)
+	}
+	if history, err := db.GetPaymentHistory("pay_test"); err != nil || len(history) != 0 {
+		t.Errorf("Expected test payment history to be deleted, got %v (%v)", history, err)
+	}
+	if _, err := live.GetPayment("pay_live"); err != nil {
+		t.Errorf("Expected live payment to survive, got %v", err)
+	}
+	if history, err := db.GetPaymentHistory("pay_live"); err != nil || len(history) == 0 {
+		t.Errorf("Expected live payment history to survive, got %v (%v)", history, err)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	account, err := db.DefaultAccount()
+	if err != nil {
+		t.Fatalf("Failed to get default account: %v", err)
+	}
+	test, live := db.ForAccount(account.ID).ForMode(false), db.ForAccount(account.ID).ForMode(true)
+
+	// Endpoints are created in the scoped account and mode
+	payments := &models.WebhookEndpoint{ID: "we_1", URL: "https://example.com/payments", EnabledEvents: models.EnabledEvents{models.EventPaymentSucceeded}, Secret: "whsec_1"}
+	everything := &models.WebhookEndpoint{ID: "we_2", URL: "https://example.com/all", EnabledEvents: models.EnabledEvents{models.EventAll}, Secret: "whsec_2"}
+	if err := test.CreateWebhookEndpoint(payments); err != nil {
+		t.Fatalf("Failed to create webhook endpoint: %v", err)
+	}
+	if err := live.CreateWebhookEndpoint(everything); err != nil {
+		t.Fatalf("Failed to create webhook endpoint: %v", err)
+	}
+	if payments.AccountID != account.ID || payments.Livemode {
+		t.Errorf("Expected a test mode endpoint of %s, got %+v", account.ID, payments)
+	}
+	if _, err := live.GetWebhookEndpoint(payments.ID); err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected ErrRecordNotFound reading a test endpoint in live mode, got %v", err)
+	}
+
+	// Only subscribed events of the endpoint's mode are delivered
+	customer := &models.Customer{ID: "cus_1", Email: "jane@example.com"}
+	if err := test.CreateCustomer(customer); err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	payment := &models.Payment{ID: "pay_1", CustomerID: customer.ID, Amount: 1000, AmountCaptured: 1000, Currency: "usd", Status: models.PaymentStatusSucceeded}
+	if err := test.CreatePayment(payment, models.ActorAPI); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	now := time.Now()
+	due, err := db.DueWebhookDeliveries(now, 10, 10, nil)
+	if err != nil {
+		t.Fatalf("Failed to get due deliveries: %v", err)
+	}
+	if len(due) != 1 || due[0].Endpoint.ID != payments.ID || due[0].Event.Type != models.EventPaymentSucceeded {
+		t.Fatalf("Expected one payment.succeeded delivery to %s, got %+v", payments.ID, due)
+	}
+	if due[0].Event.AccountID != account.ID || due[0].Event.Livemode {
+		t.Errorf("Expected a test mode event of %s, got %+v", account.ID, due[0].Event)
+	}
+	var data struct {
+		Object models.Payment `json:"object"`
+	}
+	if err := json.Unmarshal(due[0].Event.Data, &data); err != nil || data.Object.ID != payment.ID || data.Object.Status != models.PaymentStatusSucceeded {
+		t.Errorf("Expected the payment in the event data, got %s (%v)", due[0].Event.Data, err)
+	}
+
+	// A failed attempt is retried later
+	delivery := &due[0].WebhookDelivery
+	retry := now.Add(time.Minute)
+	if err := db.RecordWebhookAttempt(delivery, &models.WebhookAttempt{EventType: due[0].Event.Type, StatusCode: 500, NextAttemptAt: &retry, CreatedAt: now}); err != nil {
+		t.Fatalf("Failed to record attempt: %v", err)
+	}
+	if due, err := db.DueWebhookDeliveries(now, 10, 10, nil); err != nil || len(due) != 0 {
+		t.Errorf("Expected no deliveries due before the retry, got %v (%v)", due, err)
+	}
+	due, err = db.DueWebhookDeliveries(retry, 10, 10, nil)
+	if err != nil || len(due) != 1 || due[0].Attempts != 1 {
+		t.Fatalf("Expected the delivery due again after one attempt, got %+v (%v)", due, err)
+	}
+
+	// A successful attempt completes it
+	if err := db.RecordWebhookAttempt(&due[0].WebhookDelivery, &models.WebhookAttempt{EventType: due[0].Event.Type, StatusCode: 200, Succeeded: true, CreatedAt: retry}); err != nil {
+		t.Fatalf("Failed to record attempt: %v", err)
+	}
+	if due, err := db.DueWebhookDeliveries(retry.Add(time.Hour), 10, 10, nil); err != nil || len(due) != 0 {
+		t.Errorf("Expected no deliveries due after success, got %v (%v)", due, err)
+	}
+	attempts, err := test.ListWebhookAttempts(payments.ID, Page{})
+	if err != nil {
+		t.Fatalf("Failed to list attempts: %v", err)
+	}
+	if len(attempts.Data) != 2 || attempts.Data[0].Attempt != 2 || !attempts.Data[0].Succeeded || attempts.Data[1].StatusCode != 500 {
+		t.Errorf("Expected the successful attempt after the failed one, got %+v", attempts.Data)
+	}
+
+	// Deleting an endpoint drops its deliveries and attempts
+	if err := test.DeleteWebhookEndpoint(payments); err != nil {
+		t.Fatalf("Failed to delete webhook endpoint: %v", err)
+	}
+	if _, err := test.GetWebhookEndpoint(payments.ID); err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected endpoint to be deleted, got %v", err)
+	}
+	if attempts, err := test.ListWebhookAttempts(payments.ID, Page{}); err != nil || len(attempts.Data) != 0 {
+		t.Errorf("Expected attempts to be deleted, got %v (%v)", attempts, err)
+	}
+
+	// Each endpoint contributes at most perEndpoint deliveries, and skipped
+	// endpoints none
+	customers := &models.WebhookEndpoint{ID: "we_3", URL: "https://example.com/customers", EnabledEvents: models.EnabledEvents{models.EventCustomerCreated}, Secret: "whsec_3"}
+	if err := test.CreateWebhookEndpoint(customers); err != nil {
+		t.Fatalf("Failed to create webhook endpoint: %v", err)
+	}
+	for _, id := range []string{"cus_2", "cus_3", "cus_4"} {
+		if err := test.CreateCustomer(&models.Customer{ID: id, Email: id + "@example.com"}); err != nil {
+			t.Fatalf("Failed to create customer: %v", err)
+		}
+	}
+	later := time.Now()
+	if due, err := db.DueWebhookDeliveries(later, 10, 2, nil); err != nil || len(due) != 2 || due[0].Endpoint.ID != customers.ID {
+		t.Errorf("Expected 2 of the 3 deliveries to %s, got %d (%v)", customers.ID, len(due), err)
+	}
+	if due, err := db.DueWebhookDeliveries(later, 10, 10, []string{customers.ID}); err != nil || len(due) != 0 {
+		t.Errorf("Expected no deliveries to a skipped endpoint, got %d (%v)", len(due), err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	key, secret, err := db.CreateAPIKey(apikeys.TypeSecret, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if key.Hash == "" || key.Hash == secret || key.Salt == "" {
+		t.Errorf("Expected only a salted hash of the key to be stored")
+	}
+
+	// The key authenticates; altered or unknown keys do not
+	now := time.Now()
+	if found, err := db.AuthenticateAPIKey(secret, now); err != nil || found.ID != key.ID {
+		t.Fatalf("Expected key %s to authenticate, got %v", key.ID, err)
+	}
+	altered := secret[:len(secret)-1] + "x"
+	if altered == secret {
+		altered = secret[:len(secret)-1] + "y"
+	}
+	for _, token := range []string{altered, "sk_live_" + secret[len("sk_test_"):], "not a key"} {
+		if _, err := db.AuthenticateAPIKey(token, now); err != ErrInvalidAPIKey {
+			t.Errorf("%q: expected ErrInvalidAPIKey, got %v", token, err)
+		}
+	}
+
+	// Rolling keeps the old key working until the overlap ends
+	rolled, rolledSecret, err := db.RollAPIKey(key, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to roll API key: %v", err)
+	}
+	if rolled.Type != key.Type || rolled.Livemode != key.Livemode {
+		t.Errorf("Expected rolled key to keep type and mode, got %s livemode=%v", rolled.Type, rolled.Livemode)
+	}
+	if _, err := db.AuthenticateAPIKey(secret, now); err != nil {
+		t.Errorf("Expected old key to work during the overlap, got %v", err)
+	}
+	if _, err := db.AuthenticateAPIKey(secret, now.Add(2*time.Hour)); err != ErrAPIKeyExpired {
+		t.Errorf("Expected ErrAPIKeyExpired after the overlap, got %v", err)
+	}
+	if _, err := db.AuthenticateAPIKey(rolledSecret, now.Add(2*time.Hour)); err != nil {
+		t.Errorf("Expected rolled key to work, got %v", err)
+	}
+
+	// Rolling again cannot extend the old key's overlap
+	if _, _, err := db.RollAPIKey(key, now.Add(48*time.Hour)); err != nil {
+		t.Fatalf("Failed to roll API key: %v", err)
+	}
+	if !key.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected expiry to stay at %v, got %v", now.Add(time.Hour), key.ExpiresAt)
+	}
+
+	// Deleted keys stop working immediately
+	if err := db.DeleteAPIKey(rolled); err != nil {
+		t.Fatalf("Failed to delete API key: %v", err)
+	}
+	if _, err := db.AuthenticateAPIKey(rolledSecret, now); err != ErrInvalidAPIKey {
+		t.Errorf("Expected ErrInvalidAPIKey for a deleted key, got %v", err)
+	}
+}
+
+func TestListByMetadata(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	customers := []*models.Customer{
+		{ID: "cus_1", Email: "a@example.com", Metadata: models.Metadata{"order_id": "123", "tier": "gold"}},
+		{ID: "cus_2", Email: "b@example.com", Metadata: models.Metadata{"order_id": "456", `say "hi"`: "yes"}},
+		{ID: "cus_3", Email: "c@example.com"},
+	}
+	for _, customer := range customers {
+		if err := db.CreateCustomer(customer); err != nil {
+			t.Fatalf("Failed to create customer: %v", err)
+		}
+	}
+
+	customerTests := []struct {
+		name     string
+		metadata map[string]string
+		want     int
+	}{
+		{"none", nil, 3},
+		{"one key", map[string]string{"order_id": "123"}, 1},
+		{"all keys must match", map[string]string{"order_id": "123", "tier": "silver"}, 0},
+		{"quoted key", map[string]string{`say "hi"`: "yes"}, 1},
+		{"missing key", map[string]string{"unknown": "123"}, 0},
+	}
+	for _, tt := range customerTests {
+		list, err := db.ListCustomers(CustomerFilter{Metadata: tt.metadata})
+		if err != nil {
+			t.Fatalf("%s: failed to list customers: %v", tt.name, err)
+		}
+		if len(list.Data) != tt.want {
+			t.Errorf("%s: expected %d customers, got %d", tt.name, tt.want, len(list.Data))
+		}
+	}
+
+	method := &models.PaymentMethod{ID: "pm_1", CustomerID: "cus_1", Type: models.PaymentMethodTypeCard, Metadata: models.Metadata{"source": "checkout"}}
+	if err := db.CreatePaymentMethod(method); err != nil {
+		t.Fatalf("Failed to create payment method: %v", err)
+	}
+	methods, err := db.ListPaymentMethods(PaymentMethodFilter{Metadata: map[string]string{"source": "checkout"}})
+	if err != nil {
+		t.Fatalf("Failed to list payment methods: %v", err)
+	}
+	if len(methods.Data) != 1 || methods.Data[0].Metadata["source"] != "checkout" {
+		t.Errorf("Expected the payment method with its metadata, got %+v", methods.Data)
+	}
+
+	payment := &models.Payment{ID: "pay_1", Amount: 1000, AmountCaptured: 1000, Currency: "usd", Status: models.PaymentStatusSucceeded}
+	if err := db.CreatePayment(payment, models.ActorAPI); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	// Updating the details leaves the status and amounts alone
+	payment.Metadata = models.Metadata{"order_id": "123"}
+	payment.Description = "Order 123"
+	payment.Status = models.PaymentStatusFailed
+	if err := db.UpdatePaymentDetails(payment); err != nil {
+		t.Fatalf("Failed to update payment: %v", err)
+	}
+	payments, err := db.ListPayments(PaymentFilter{Metadata: map[string]string{"order_id": "123"}})
+	if err != nil {
+		t.Fatalf("Failed to list payments: %v", err)
+	}
+	if len(payments.Data) != 1 || payments.Data[0].Description != "Order 123" || payments.Data[0].Status != models.PaymentStatusSucceeded {
+		t.Errorf("Expected the updated payment with its status unchanged, got %+v", payments.Data)
+	}
+
+	refund := &models.Refund{ID: "ref_1", PaymentID: "pay_1", Amount: 100}
+	if err := db.CreateRefund(refund); err != nil {
+		t.Fatalf("Failed to create refund: %v", err)
+	}
+	refund.Metadata = models.Metadata{"ticket": "T-1"}
+	if err := db.UpdateRefundMetadata(refund); err != nil {
+		t.Fatalf("Failed to update refund: %v", err)
+	}
+	refunds, err := db.ListRefunds(RefundFilter{Metadata: map[string]string{"ticket": "T-1"}})
+	if err != nil {
+		t.Fatalf("Failed to list refunds: %v", err)
+	}
+	if len(refunds.Data) != 1 || refunds.Data[0].Status != models.RefundStatusPending {
+		t.Errorf("Expected the pending refund, got %+v", refunds.Data)
+	}
+
+	// Payments can also be searched by metadata
+	found, err := db.SearchPayments(`metadata["order_id"]:"123"`, Page{})
+	if err != nil {
+		t.Fatalf("Failed to search payments: %v", err)
+	}
+	if len(found.Data) != 1 {
+		t.Errorf("Expected 1 payment, got %d", len(found.Data))
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	customers := []*models.Customer{
+		{ID: "cus_jane", Email: "jane@example.com", Name: "Jane Doe", Metadata: models.Metadata{"order_id": "123"}},
+		{ID: "cus_john", Email: "john@example.org", Name: "John Smith", Phone: "+14155550123"},
+		{ID: "cus_100", Email: "100%_off@example.com", Name: "Bargain Hunter"},
+	}
+	for _, customer := range customers {
+		if err := db.CreateCustomer(customer); err != nil {
+			t.Fatalf("Failed to create customer: %v", err)
+		}
+	}
+	// Backdate one customer so date filters have something to exclude
+	if err := db.Model(&models.Customer{}).Where("id = ?", "cus_john").Update("created_at", time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)).Error; err != nil {
+		t.Fatalf("Failed to backdate customer: %v", err)
+	}
+
+	customerTests := []struct {
+		query string
+		want  []string
+	}{
+		{`email:"jane@"`, []string{"cus_jane"}},
+		{`email:"EXAMPLE"`, []string{"cus_jane", "cus_john", "cus_100"}},
+		{`name:"do"`, []string{"cus_jane"}},
+		{`email:"%_"`, []string{"cus_100"}},
+		{`email:"jane@example.com" OR name:"smith"`, []string{"cus_jane", "cus_john"}},
+		{`email:"example" AND -name:"john"`, []string{"cus_jane", "cus_100"}},
+		{`email:"example" created>2025-01-01`, []string{"cus_jane", "cus_100"}},
+		{`created:2024-06-01`, []string{"cus_john"}},
+		{`phone:"555"`, []string{"cus_john"}},
+		{`metadata["order_id"]:"123"`, []string{"cus_jane"}},
+		{`-metadata["order_id"]:"123"`, []string{"cus_john", "cus_100"}},
+	}
+	for _, tt := range customerTests {
+		list, err := db.SearchCustomers(tt.query, Page{})
+		if err != nil {
+			t.Fatalf("%s: failed to search customers: %v", tt.query, err)
+		}
+		assertIDs(t, tt.query, list.Data, func(c models.Customer) string { return c.ID }, tt.want)
+	}
+
+	// Updated and deleted customers are reflected in search
+	customers[0].Email = "janet@example.net"
+	if err := db.UpdateCustomer(customers[0]); err != nil {
+		t.Fatalf("Failed to update customer: %v", err)
+	}
+	if _, err := db.DeleteCustomer(customers[1]); err != nil {
+		t.Fatalf("Failed to delete customer: %v", err)
+	}
+	list, err := db.SearchCustomers(`email:"example.net" OR email:"john"`, Page{})
+	if err != nil {
+		t.Fatalf("Failed to search customers: %v", err)
+	}
+	assertIDs(t, "after update", list.Data, func(c models.Customer) string { return c.ID }, []string{"cus_jane"})
+
+	payments := []*models.Payment{
+		{ID: "pay_1", Amount: 500, Currency: "usd", CustomerID: "cus_jane", Status: models.PaymentStatusSucceeded, Description: "Order #1234"},
+		{ID: "pay_2", Amount: 2500, Currency: "eur", CustomerID: "cus_jane", Status: models.PaymentStatusFailed, Description: "Subscription renewal"},
+		{ID: "pay_3", Amount: 1000, Currency: "usd", CustomerID: "cus_100", Status: models.PaymentStatusSucceeded},
+	}
+	for _, payment := range payments {
+		if err := db.CreatePayment(payment, models.ActorAPI); err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+	}
+
+	paymentTests := []struct {
+		query string
+		want  []string
+	}{
+		{`amount>=1000`, []string{"pay_2", "pay_3"}},
+		{`status:"succeeded" currency:"usd" amount<1000`, []string{"pay_1"}},
+		{`customer:"cus_jane" -status:"failed"`, []string{"pay_1"}},
+		{`description:"order"`, []string{"pay_1"}},
+		{`description:"#1"`, []string{"pay_1"}},
+		{`currency:"eur" OR amount=1000`, []string{"pay_2", "pay_3"}},
+	}
+	for _, tt := range paymentTests {
+		list, err := db.SearchPayments(tt.query, Page{})
+		if err != nil {
+			t.Fatalf("%s: failed to search payments: %v", tt.query, err)
+		}
+		assertIDs(t, tt.query, list.Data, func(p models.Payment) string { return p.ID }, tt.want)
+	}
+
+	// Malformed queries are reported with their position
+	var searchErr *search.Error
+	if _, err := db.SearchPayments(`amount>lots`, Page{}); !errors.As(err, &searchErr) {
+		t.Errorf("Expected *search.Error, got %v", err)
+	}
+	if _, err := db.SearchPayments(`email:"jane"`, Page{}); !errors.As(err, &searchErr) {
+		t.Errorf("Expected *search.Error for a customer field, got %v", err)
+	}
+}
+
+func TestFullTextRebuild(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test-payments-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := New(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if !db.fullText {
+		t.Skip("SQLite built without FTS5")
+	}
+	if err := db.CreateCustomer(&models.Customer{ID: "cus_jane", Email: "jane@example.com", Name: "Jane Doe"}); err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	// A row only in the index shows whether it was rebuilt from the table
+	if err := db.Exec("INSERT INTO customers_fts (id, email, name, phone) VALUES ('cus_stray', '', '', '')").Error; err != nil {
+		t.Fatalf("Failed to insert index row: %v", err)
+	}
+	indexed := func(db *DB) int64 {
+		t.Helper()
+		var count int64
+		if err := db.Raw("SELECT COUNT(*) FROM customers_fts").Scan(&count).Error; err != nil {
+			t.Fatalf("Failed to count index rows: %v", err)
+		}
+		return count
+	}
+
+	// Reopening an up to date index leaves it alone
+	db, err = New(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if count := indexed(db); count != 2 {
+		t.Errorf("Expected the index to be kept with 2 rows, got %d", count)
+	}
+
+	// A missing trigger means writes went unindexed, so the index is rebuilt
+	if err := db.Exec("DROP TRIGGER customers_fts_insert").Error; err != nil {
+		t.Fatalf("Failed to drop trigger: %v", err)
+	}
+	db, err = New(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if count := indexed(db); count != 1 {
+		t.Errorf("Expected the index to be rebuilt with 1 row, got %d", count)
+	}
+	list, err := db.SearchCustomers(`name:"jane"`, Page{})
+	if err != nil {
+		t.Fatalf("Failed to search customers: %v", err)
+	}
+	assertIDs(t, "rebuilt index", list.Data, func(c models.Customer) string { return c.ID }, []string{"cus_jane"})
+}
+
+// assertIDs checks that records have exactly the expected IDs in any order
+func assertIDs[T any](t *testing.T, name string, records []T, id func(T) string, want []string) {
+	t.Helper()
+	got := make(map[string]bool, len(records))
+	for _, r := range records {
+		got[id(r)] = true
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s: expected %v, got %v", name, want, got)
+		return
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+			return
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// recordPaymentTransition appends a status change to a payment's history
+func recordPaymentTransition(tx *gorm.DB, paymentID, from, to, actor string) error {
+	return tx.Create(&models.PaymentStatusTransition{
+		PaymentID:  paymentID,
+		FromStatus: from,
+		ToStatus:   to,
+		Actor:      actor,
+		CreatedAt:  time.Now(),
+	}).Error
+}
+
+// GetPaymentHistory retrieves every status transition of a payment, oldest first
+func (db *DB) GetPaymentHistory(paymentID string) ([]models.PaymentStatusTransition, error) {
+	var history []models.PaymentStatusTransition
+	if err := db.Where("payment_id = ?", paymentID).Order("created_at ASC, id ASC").Find(&history).Error; err != nil {
+		return nil, err
+	}
+	return history, nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// IdempotencyKeyTTL is how long a completed request can be replayed
+	IdempotencyKeyTTL = 24 * time.Hour
+
+	// idempotencyLockTimeout is how long an in-flight request holds its key
+	// before it is assumed to have crashed and another request may take over
+	idempotencyLockTimeout = time.Minute
+)
+
+var (
+	// ErrIdempotencyKeyInProgress is returned when another request with the
+	// same idempotency key is still being processed
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is in progress")
+
+	// ErrIdempotencyKeyMismatch is returned when an idempotency key is reused
+	// with a different request
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key was used with a different request")
+)
+
+// BeginIdempotentRequest claims an idempotency key for a request. It returns
+// the stored key if the request has already completed and should be replayed,
+// or nil if the caller now holds the key and must process the request and then
+// call CompleteIdempotentRequest or ReleaseIdempotencyKey.
+func (db *DB) BeginIdempotentRequest(key, fingerprint string, now time.Time) (*models.IdempotencyKey, error) {
+	var completed *models.IdempotencyKey
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var existing models.IdempotencyKey
+		err := tx.First(&existing, "key = ?", key).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+		case err != nil:
+			return err
+		case existing.ExpiresAt.Before(now):
+			if err := tx.Delete(&existing).Error; err != nil {
+				return err
+			}
+		case existing.Fingerprint != fingerprint:
+			return ErrIdempotencyKeyMismatch
+		case existing.LockedAt == nil:
+			completed = &existing
+			return nil
+		case now.Sub(*existing.LockedAt) < idempotencyLockTimeout:
+			return ErrIdempotencyKeyInProgress
+		default:
+			// The original request never finished; take over its key
+			return tx.Model(&existing).Update("locked_at", now).Error
+		}
+
+		return tx.Create(&models.IdempotencyKey{
+			Key:         key,
+			Fingerprint: fingerprint,
+			LockedAt:    &now,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(IdempotencyKeyTTL),
+		}).Error
+	})
+	return completed, err
+}
+
+// CompleteIdempotentRequest stores the response to a request holding an
+// idempotency key and releases its lock
+func (db *DB) CompleteIdempotentRequest(key string, statusCode int, headers string, body []byte) error {
+	return db.Model(&models.IdempotencyKey{}).Where("key = ?", key).Updates(map[string]any{
+		"locked_at":        nil,
+		"status_code":      statusCode,
+		"response_headers": headers,
+		"response_body":    body,
+	}).Error
+}
+
+// ReleaseIdempotencyKey forgets an idempotency key so the request can be retried
+func (db *DB) ReleaseIdempotencyKey(key string) error {
+	return db.Delete(&models.IdempotencyKey{}, "key = ?", key).Error
+}
+
+// DeleteExpiredIdempotencyKeys removes idempotency keys that can no longer be
+// replayed and returns the number removed
+func (db *DB) DeleteExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	result := db.Where("expires_at < ?", now).Delete(&models.IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
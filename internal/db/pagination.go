@@ -0,0 +1,179 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor is malformed or both
+// directions are requested at once
+var ErrInvalidCursor = errors.New("invalid pagination cursor")
+
+// Page size bounds
+const (
+	DefaultLimit = 10
+	MaxLimit     = 100
+)
+
+// Page represents the pagination options for a list query. Results are
+// ordered newest first by (created_at, id).
+type Page struct {
+	Limit         int
+	StartingAfter string // Cursor; returns records older than it
+	EndingBefore  string // Cursor; returns records newer than it
+}
+
+// List represents one page of records
+type List[T any] struct {
+	Data    []T
+	HasMore bool
+	// NextCursor points at the last record and can be passed as StartingAfter
+	NextCursor string
+	// PreviousCursor points at the first record and can be passed as EndingBefore
+	PreviousCursor string
+}
+
+// Range represents a numeric range filter. Zero-valued bounds are ignored.
+type Range struct {
+	GT  int64 `json:"gt,omitempty" description:"Greater than"`
+	GTE int64 `json:"gte,omitempty" description:"Greater than or equal to"`
+	LT  int64 `json:"lt,omitempty" description:"Less than"`
+	LTE int64 `json:"lte,omitempty" description:"Less than or equal to"`
+}
+
+// EncodeCursor builds an opaque cursor for a record's position in the list order
+func EncodeCursor(createdAt time.Time, id string) string {
+	raw := strconv.FormatInt(createdAt.UnixNano(), 10) + ":" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor parses a cursor built by EncodeCursor
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return time.Unix(0, n), id, nil
+}
+
+// paginate runs a list query one page at a time using keyset pagination on
+// (created_at, id). The key function returns the same pair for a record so
+// that cursors can be built for the returned page.
+func paginate[T any](query *gorm.DB, page Page, key func(T) (time.Time, string)) (*List[T], error) {
+	if page.StartingAfter != "" && page.EndingBefore != "" {
+		return nil, ErrInvalidCursor
+	}
+
+	order := "created_at DESC, id DESC"
+	reverse := false
+	if page.StartingAfter != "" {
+		createdAt, id, err := decodeCursor(page.StartingAfter)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("created_at < ? OR (created_at = ? AND id < ?)", createdAt, createdAt, id)
+	} else if page.EndingBefore != "" {
+		createdAt, id, err := decodeCursor(page.EndingBefore)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("created_at > ? OR (created_at = ? AND id > ?)", createdAt, createdAt, id)
+		order = "created_at ASC, id ASC"
+		reverse = true
+	}
+
+	// Fetch one extra record to find out whether there is another page
+	limit := normalizeLimit(page.Limit)
+	var records []T
+	if err := query.Order(order).Limit(limit + 1).Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	list := &List[T]{Data: records, HasMore: len(records) > limit}
+	if list.HasMore {
+		list.Data = records[:limit]
+	}
+	if reverse {
+		for i, j := 0, len(list.Data)-1; i < j; i, j = i+1, j-1 {
+			list.Data[i], list.Data[j] = list.Data[j], list.Data[i]
+		}
+	}
+	if len(list.Data) > 0 {
+		list.PreviousCursor = EncodeCursor(key(list.Data[0]))
+		list.NextCursor = EncodeCursor(key(list.Data[len(list.Data)-1]))
+	}
+	return list, nil
+}
+
+// applyRange adds the bounds of a range filter on the given column to a query
+func applyRange(query *gorm.DB, column string, r Range, convert func(int64) any) *gorm.DB {
+	if r.GT != 0 {
+		query = query.Where(column+" > ?", convert(r.GT))
+	}
+	if r.GTE != 0 {
+		query = query.Where(column+" >= ?", convert(r.GTE))
+	}
+	if r.LT != 0 {
+		query = query.Where(column+" < ?", convert(r.LT))
+	}
+	if r.LTE != 0 {
+		query = query.Where(column+" <= ?", convert(r.LTE))
+	}
+	return query
+}
+
+// applyMetadata restricts a query to records whose metadata column has every
+// key set to the given value
+func applyMetadata(query *gorm.DB, column string, metadata map[string]string) *gorm.DB {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		query = query.Where(metadataCondition(column), key, metadata[key])
+	}
+	return query
+}
+
+// metadataCondition matches records whose metadata column has a key (the
+// first argument) set to a value (the second argument). json_each is used
+// rather than a JSON path so that keys need no escaping.
+func metadataCondition(column string) string {
+	return "EXISTS (SELECT 1 FROM json_each(" + column + ") WHERE json_each.key = ? AND json_each.value = ?)"
+}
+
+// normalizeLimit clamps a page size to between 1 and 100, defaulting to 10
+func normalizeLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultLimit
+	}
+	if limit > MaxLimit {
+		return MaxLimit
+	}
+	return limit
+}
+
+// unixSeconds converts a Unix timestamp filter bound to a time for created_at columns
+func unixSeconds(v int64) any {
+	return time.Unix(v, 0)
+}
+
+// cents passes an amount filter bound through unchanged
+func cents(v int64) any {
+	return v
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+	"github.com/jeffgrover/payment-api/internal/search"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// searchField maps a search query field to a column
+type searchField struct {
+	column string
+	kind   search.Kind
+}
+
+// customerSearchFields are the fields customer searches can use
+var customerSearchFields = map[string]searchField{
+	"email":    {"email", search.Text},
+	"name":     {"name", search.Text},
+	"phone":    {"phone", search.Text},
+	"created":  {"created_at", search.Time},
+	"metadata": {"metadata", search.Metadata},
+}
+
+// paymentSearchFields are the fields payment searches can use
+var paymentSearchFields = map[string]searchField{
+	"amount":      {"amount", search.Number},
+	"status":      {"status", search.Keyword},
+	"currency":    {"currency", search.Keyword},
+	"customer":    {"customer_id", search.Keyword},
+	"description": {"description", search.Text},
+	"created":     {"created_at", search.Time},
+	"metadata":    {"metadata", search.Metadata},
+}
+
+// fullTextIndexes lists the text columns of each table kept in an FTS5 index
+var fullTextIndexes = map[string][]string{
+	"customers": {"email", "name", "phone"},
+	"payments":  {"description"},
+}
+
+// minFullTextLength is the shortest substring the trigram tokenizer can match
+const minFullTextLength = 3
+
+// SearchCustomers retrieves a page of customers matching a search query.
+// Malformed queries are reported as *search.Error.
+func (db *DB) SearchCustomers(query string, page Page) (*List[models.Customer], error) {
+	condition, err := db.searchCondition("customers", query, customerSearchFields)
+	if err != nil {
+		return nil, err
+	}
+	return paginate(db.Model(&models.Customer{}).Where(condition), page, func(c models.Customer) (time.Time, string) {
+		return c.CreatedAt, c.ID
+	})
+}
+
+// SearchPayments retrieves a page of payments matching a search query.
+// Malformed queries are reported as *search.Error.
+func (db *DB) SearchPayments(query string, page Page) (*List[models.Payment], error) {
+	condition, err := db.searchCondition("payments", query, paymentSearchFields)
+	if err != nil {
+		return nil, err
+	}
+	return paginate(db.Model(&models.Payment{}).Where(condition), page, func(p models.Payment) (time.Time, string) {
+		return p.CreatedAt, p.ID
+	})
+}
+
+// searchCondition parses a query and compiles it to a SQL condition on table
+func (db *DB) searchCondition(table, query string, fields map[string]searchField) (clause.Expr, error) {
+	kinds := make(map[string]search.Kind, len(fields))
+	for name, field := range fields {
+		kinds[name] = field.kind
+	}
+	q, err := search.Parse(query, kinds)
+	if err != nil {
+		return clause.Expr{}, err
+	}
+
+	var groups []string
+	var args []any
+	for _, group := range q.Groups {
+		var conditions []string
+		for _, c := range group {
+			condition, conditionArgs := db.compileClause(table, fields[c.Field].column, c)
+			if c.Negate {
+				condition = "NOT COALESCE((" + condition + "), FALSE)"
+			}
+			conditions = append(conditions, "("+condition+")")
+			args = append(args, conditionArgs...)
+		}
+		groups = append(groups, "("+strings.Join(conditions, " AND ")+")")
+	}
+	return clause.Expr{SQL: "(" + strings.Join(groups, " OR ") + ")", Vars: args}, nil
+}
+
+// compileClause compiles one clause to a SQL condition and its arguments
+func (db *DB) compileClause(table, column string, c search.Clause) (string, []any) {
+	qualified := table + "." + column
+	switch c.Kind {
+	case search.Text:
+		value := c.Value.(string)
+		if c.Op == search.OpEqual {
+			return qualified + " = ? COLLATE NOCASE", []any{value}
+		}
+		if db.fullText && utf8.RuneCountInString(value) >= minFullTextLength {
+			return fmt.Sprintf("%s.id IN (SELECT id FROM %s_fts WHERE %s_fts MATCH ?)", table, table, table),
+				[]any{column + `:"` + strings.ReplaceAll(value, `"`, `""`) + `"`}
+		}
+		return qualified + ` LIKE ? ESCAPE '\'`, []any{"%" + escapeLike(value) + "%"}
+	case search.Metadata:
+		return metadataCondition(qualified), []any{c.Key, c.Value}
+	case search.Time:
+		t := c.Value.(time.Time).Local()
+		if c.Day {
+			// A date covers the whole day: created>2025-01-01 starts the next day
+			next := t.AddDate(0, 0, 1)
+			switch c.Op {
+			case search.OpMatch, search.OpEqual:
+				return qualified + " >= ? AND " + qualified + " < ?", []any{t, next}
+			case search.OpGT:
+				return qualified + " >= ?", []any{next}
+			case search.OpLTE:
+				return qualified + " < ?", []any{next}
+			}
+		}
+		return qualified + " " + sqlOperator(c.Op) + " ?", []any{t}
+	default:
+		return qualified + " " + sqlOperator(c.Op) + " ?", []any{c.Value}
+	}
+}
+
+// sqlOperator maps a search operator to SQL
+func sqlOperator(op string) string {
+	if op == search.OpMatch {
+		return "="
+	}
+	return op
+}
+
+// escapeLike escapes LIKE wildcards in a substring
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// setupFullText creates the FTS5 trigram indexes and the triggers that keep
+// them in sync. An index is only rebuilt from its table when it is created,
+// when its definition changed, or when its triggers are missing because rows
+// were written by a build without FTS5. It reports false, after removing any
+// triggers left by an FTS5 build, if SQLite was built without FTS5.
+func setupFullText(db *gorm.DB) (bool, error) {
+	var available bool
+	if err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available).Error; err != nil {
+		return false, err
+	}
+	if !available {
+		return false, dropFullTextTriggers(db)
+	}
+
+	for table, columns := range fullTextIndexes {
+		index := table + "_fts"
+		list := strings.Join(columns, ", ")
+		values := "new." + strings.Join(columns, ", new.")
+		definition := fmt.Sprintf("CREATE VIRTUAL TABLE %s USING fts5(id UNINDEXED, %s, tokenize = 'trigram')", index, list)
+		triggers := map[string]string{
+			index + "_insert": fmt.Sprintf("CREATE TRIGGER %s_insert AFTER INSERT ON %s BEGIN INSERT INTO %s (id, %s) VALUES (new.id, %s); END", index, table, index, list, values),
+			index + "_update": fmt.Sprintf("CREATE TRIGGER %s_update AFTER UPDATE ON %s BEGIN DELETE FROM %s WHERE id = old.id; INSERT INTO %s (id, %s) VALUES (new.id, %s); END", index, table, index, index, list, values),
+			index + "_delete": fmt.Sprintf("CREATE TRIGGER %s_delete AFTER DELETE ON %s BEGIN DELETE FROM %s WHERE id = old.id; END", index, table, index),
+		}
+
+		// SQLite keeps the statement each table and trigger was created with,
+		// which serves as the schema version of the index
+		var existing []struct{ Name, SQL string }
+		if err := db.Raw("SELECT name, sql FROM sqlite_master WHERE name = ? OR (type = 'trigger' AND tbl_name = ?)", index, table).
+			Scan(&existing).Error; err != nil {
+			return false, err
+		}
+		current := make(map[string]string, len(existing))
+		for _, object := range existing {
+			current[object.Name] = object.SQL
+		}
+
+		rebuild := current[index] != definition
+		for name, statement := range triggers {
+			if current[name] != statement {
+				rebuild = true
+			}
+		}
+		if !rebuild {
+			continue
+		}
+
+		statements := []string{fmt.Sprintf("DROP TABLE IF EXISTS %s", index)}
+		for name := range triggers {
+			statements = append(statements, fmt.Sprintf("DROP TRIGGER IF EXISTS %s", name))
+		}
+		statements = append(statements, definition)
+		for _, statement := range triggers {
+			statements = append(statements, statement)
+		}
+		statements = append(statements, fmt.Sprintf("INSERT INTO %s (id, %s) SELECT id, %s FROM %s", index, list, list, table))
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, statement := range statements {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// dropFullTextTriggers removes the index triggers, which would otherwise fail
+// every write once FTS5 is unavailable
+func dropFullTextTriggers(db *gorm.DB) error {
+	for table := range fullTextIndexes {
+		for _, event := range []string{"insert", "update", "delete"} {
+			if err := db.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s_fts_%s", table, event)).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
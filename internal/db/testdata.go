@@ -0,0 +1,76 @@
+package db
+
+import (
+	"github.com/jeffgrover/payment-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// IdempotencyScope returns the prefix of the idempotency keys of requests
+// made with an account's test or live mode keys
+func IdempotencyScope(accountID string, livemode bool) string {
+	if livemode {
+		return accountID + ":live:"
+	}
+	return accountID + ":test:"
+}
+
+// DeleteTestData permanently deletes an account's test mode customers,
+// payment methods, payments, refunds, webhook endpoints and events, along
+// with the payments' history, the endpoints' deliveries and attempts, and the
+// account's test mode idempotency keys. Live mode data is not touched. It
+// returns the vault tokens of the deleted cards so the caller can remove them
+// from the vault.
+func (db *DB) DeleteTestData(accountID string) (*models.DeletedTestData, []string, error) {
+	deleted := &models.DeletedTestData{Deleted: true}
+	var tokens []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		testData := func(model any) *gorm.DB {
+			return tx.Model(model).Unscoped().Where("account_id = ? AND livemode = ?", accountID, false)
+		}
+
+		if err := testData(&models.PaymentMethod{}).Where("vault_token <> ''").Pluck("vault_token", &tokens).Error; err != nil {
+			return err
+		}
+		payments := testData(&models.Payment{}).Select("id")
+		if err := tx.Where("payment_id IN (?)", payments).Delete(&models.PaymentStatusTransition{}).Error; err != nil {
+			return err
+		}
+		endpoints := testData(&models.WebhookEndpoint{}).Select("id")
+		events := testData(&models.Event{}).Select("id")
+		if err := tx.Where("endpoint_id IN (?) OR event_id IN (?)", endpoints, events).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("endpoint_id IN (?) OR event_id IN (?)", endpoints, events).Delete(&models.WebhookAttempt{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted.WebhookAttempts = result.RowsAffected
+		prefix := IdempotencyScope(accountID, false)
+		if err := tx.Where("substr(key, 1, ?) = ?", len(prefix), prefix).Delete(&models.IdempotencyKey{}).Error; err != nil {
+			return err
+		}
+
+		for _, table := range []struct {
+			model any
+			count *int64
+		}{
+			{&models.Refund{}, &deleted.Refunds},
+			{&models.Payment{}, &deleted.Payments},
+			{&models.PaymentMethod{}, &deleted.PaymentMethods},
+			{&models.Customer{}, &deleted.Customers},
+			{&models.WebhookEndpoint{}, &deleted.WebhookEndpoints},
+			{&models.Event{}, &deleted.Events},
+		} {
+			result := testData(table.model).Delete(table.model)
+			if result.Error != nil {
+				return result.Error
+			}
+			*table.count = result.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return deleted, tokens, nil
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jeffgrover/payment-api/internal/ids"
+	"github.com/jeffgrover/payment-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// paymentStatusEvents maps payment statuses to the events sent when a payment
+// moves to them
+var paymentStatusEvents = map[string]string{
+	models.PaymentStatusRequiresCapture:   models.EventPaymentRequiresCapture,
+	models.PaymentStatusSucceeded:         models.EventPaymentSucceeded,
+	models.PaymentStatusFailed:            models.EventPaymentFailed,
+	models.PaymentStatusCanceled:          models.EventPaymentCanceled,
+	models.PaymentStatusPartiallyRefunded: models.EventPaymentRefunded,
+	models.PaymentStatusRefunded:          models.EventPaymentRefunded,
+}
+
+// refundStatusEvents maps refund statuses to the events sent when a refund
+// is completed with them
+var refundStatusEvents = map[string]string{
+	models.RefundStatusSucceeded: models.EventRefundSucceeded,
+	models.RefundStatusFailed:    models.EventRefundFailed,
+}
+
+// recordEvent records an event about an object of an account and mode, and
+// schedules its delivery to each of their webhook endpoints that subscribes
+// to it. Nothing is recorded when no endpoint does.
+func recordEvent(tx *gorm.DB, eventType, accountID string, livemode bool, object any) error {
+	var endpoints []models.WebhookEndpoint
+	if err := tx.Where("account_id = ? AND livemode = ?", accountID, livemode).Find(&endpoints).Error; err != nil {
+		return err
+	}
+	var subscribed []models.WebhookEndpoint
+	for _, endpoint := range endpoints {
+		if endpoint.EnabledEvents.Includes(eventType) {
+			subscribed = append(subscribed, endpoint)
+		}
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(map[string]any{"object": object})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	event := &models.Event{
+		ID:        ids.New(ids.Event),
+		AccountID: accountID,
+		Livemode:  livemode,
+		Type:      eventType,
+		Data:      data,
+		CreatedAt: now,
+	}
+	if err := tx.Create(event).Error; err != nil {
+		return err
+	}
+
+	for _, endpoint := range subscribed {
+		if err := tx.Create(&models.WebhookDelivery{
+			EndpointID:    endpoint.ID,
+			EventID:       event.ID,
+			Status:        models.DeliveryStatusPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordPaymentEvent records the event for a payment's new status, if it has one
+func recordPaymentEvent(tx *gorm.DB, payment *models.Payment) error {
+	eventType, ok := paymentStatusEvents[payment.Status]
+	if !ok {
+		return nil
+	}
+	return recordEvent(tx, eventType, payment.AccountID, payment.Livemode, payment)
+}
+
+// CreateWebhookEndpoint creates a new webhook endpoint
+func (db *DB) CreateWebhookEndpoint(endpoint *models.WebhookEndpoint) error {
+	endpoint.CreatedAt = time.Now()
+	return db.Create(endpoint).Error
+}
+
+// GetWebhookEndpoint retrieves a webhook endpoint by ID
+func (db *DB) GetWebhookEndpoint(id string) (*models.WebhookEndpoint, error) {
+	var endpoint models.WebhookEndpoint
+	if err := db.First(&endpoint, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+// ListWebhookEndpoints retrieves a page of webhook endpoints
+func (db *DB) ListWebhookEndpoints(page Page) (*List[models.WebhookEndpoint], error) {
+	return paginate(db.Model(&models.WebhookEndpoint{}), page, func(e models.WebhookEndpoint) (time.Time, string) {
+		return e.CreatedAt, e.ID
+	})
+}
+
+// DeleteWebhookEndpoint permanently deletes a webhook endpoint along with its
+// pending deliveries and attempt log
+func (db *DB) DeleteWebhookEndpoint(endpoint *models.WebhookEndpoint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("endpoint_id = ?", endpoint.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("endpoint_id = ?", endpoint.ID).Delete(&models.WebhookAttempt{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(endpoint).Error
+	})
+}
+
+// DueDelivery is a pending webhook delivery whose next attempt is due, with
+// the endpoint and event to send
+type DueDelivery struct {
+	models.WebhookDelivery
+	Endpoint models.WebhookEndpoint
+	Event    models.Event
+}
+
+// DueWebhookDeliveries retrieves up to limit pending deliveries whose next
+// attempt is due at the given time, oldest first. At most perEndpoint are
+// taken from each endpoint, so that one endpoint's backlog cannot fill the
+// batch, and the endpoints in skip are left out.
+func (db *DB) DueWebhookDeliveries(now time.Time, limit, perEndpoint int, skip []string) ([]DueDelivery, error) {
+	pending := db.Model(&models.WebhookDelivery{}).
+		Select("*, ROW_NUMBER() OVER (PARTITION BY endpoint_id ORDER BY next_attempt_at, id) AS endpoint_rank").
+		Where("status = ? AND next_attempt_at <= ?", models.DeliveryStatusPending, now)
+	if len(skip) > 0 {
+		pending = pending.Where("endpoint_id NOT IN ?", skip)
+	}
+	var deliveries []models.WebhookDelivery
+	if err := db.Table("(?) AS pending", pending).Where("endpoint_rank <= ?", perEndpoint).
+		Order("next_attempt_at, id").Limit(limit).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+
+	endpointIDs := make([]string, len(deliveries))
+	eventIDs := make([]string, len(deliveries))
+	for i, delivery := range deliveries {
+		endpointIDs[i], eventIDs[i] = delivery.EndpointID, delivery.EventID
+	}
+	var endpoints []models.WebhookEndpoint
+	if err := db.Where("id IN ?", endpointIDs).Find(&endpoints).Error; err != nil {
+		return nil, err
+	}
+	var events []models.Event
+	if err := db.Where("id IN ?", eventIDs).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	endpointsByID := make(map[string]models.WebhookEndpoint, len(endpoints))
+	for _, endpoint := range endpoints {
+		endpointsByID[endpoint.ID] = endpoint
+	}
+	eventsByID := make(map[string]models.Event, len(events))
+	for _, event := range events {
+		eventsByID[event.ID] = event
+	}
+
+	due := make([]DueDelivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		endpoint, ok := endpointsByID[delivery.EndpointID]
+		event, found := eventsByID[delivery.EventID]
+		if !ok || !found {
+			continue
+		}
+		due = append(due, DueDelivery{WebhookDelivery: delivery, Endpoint: endpoint, Event: event})
+	}
+	return due, nil
+}
+
+// RecordWebhookAttempt logs an attempt to send a delivery and updates the
+// delivery: it succeeded if the attempt did, is retried at the attempt's
+// NextAttemptAt if that is set, and has failed otherwise
+func (db *DB) RecordWebhookAttempt(delivery *models.WebhookDelivery, attempt *models.WebhookAttempt) error {
+	delivery.Attempts++
+	delivery.NextAttemptAt = attempt.NextAttemptAt
+	switch {
+	case attempt.Succeeded:
+		delivery.Status = models.DeliveryStatusSucceeded
+		delivery.NextAttemptAt = nil
+	case attempt.NextAttemptAt != nil:
+		delivery.Status = models.DeliveryStatusPending
+	default:
+		delivery.Status = models.DeliveryStatusFailed
+	}
+	attempt.ID = ids.New(ids.WebhookAttempt)
+	attempt.EndpointID = delivery.EndpointID
+	attempt.EventID = delivery.EventID
+	attempt.Attempt = delivery.Attempts
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(attempt).Error; err != nil {
+			return err
+		}
+		return tx.Model(delivery).Select("status", "attempts", "next_attempt_at").Updates(delivery).Error
+	})
+}
+
+// ListWebhookAttempts retrieves a page of the attempts to send events to a
+// webhook endpoint
+func (db *DB) ListWebhookAttempts(endpointID string, page Page) (*List[models.WebhookAttempt], error) {
+	query := db.Model(&models.WebhookAttempt{}).Where("endpoint_id = ?", endpointID)
+	return paginate(query, page, func(a models.WebhookAttempt) (time.Time, string) {
+		return a.CreatedAt, a.ID
+	})
+}
@@ -0,0 +1,141 @@
+// Package ids generates and validates resource IDs. An ID is a type prefix,
+// an underscore and 26 lower-case Crockford base32 characters encoding a
+// 48-bit millisecond timestamp followed by 80 random bits, like a ULID. IDs
+// therefore sort lexicographically by creation time, and IDs created in the
+// same millisecond by this process sort in creation order.
+package ids
+
+import (
+	"crypto/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resource ID prefixes
+const (
+	Customer        = "cus"
+	PaymentMethod   = "pm"
+	Payment         = "pay"
+	Refund          = "ref"
+	APIKey          = "key"
+	Account         = "acct"
+	WebhookEndpoint = "we"
+	Event           = "evt"
+	WebhookAttempt  = "wha"
+)
+
+// encoding is the Crockford base32 alphabet in lower case, which is in ASCII
+// order so that encoded IDs sort like the bytes they encode
+const encoding = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// encodedLength is the length of the part of an ID after the prefix
+const encodedLength = 26
+
+var (
+	mu         sync.Mutex
+	lastMillis uint64
+	lastRandom [10]byte
+)
+
+// New returns a new ID with the given prefix
+func New(prefix string) string {
+	return prefix + "_" + generate(time.Now())
+}
+
+// generate encodes a timestamp and random bits. Within the millisecond of the
+// previous ID the random bits are incremented instead of regenerated so that
+// IDs stay in order.
+func generate(now time.Time) string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	millis := uint64(now.UnixMilli())
+	if millis <= lastMillis && increment(&lastRandom) {
+		millis = lastMillis
+	} else {
+		if millis <= lastMillis {
+			// The random bits overflowed or the clock went backwards
+			millis = lastMillis + 1
+		}
+		if _, err := rand.Read(lastRandom[:]); err != nil {
+			panic(err)
+		}
+	}
+	lastMillis = millis
+
+	var b [16]byte
+	for i := 0; i < 6; i++ {
+		b[i] = byte(millis >> (40 - 8*i))
+	}
+	copy(b[6:], lastRandom[:])
+	return encode(b)
+}
+
+// increment adds one to a big-endian number, reporting false on overflow
+func increment(b *[10]byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encode converts 128 bits to 26 base32 characters, the first of which only
+// carries the top 3 bits
+func encode(b [16]byte) string {
+	out := make([]byte, encodedLength)
+	// Process the bits from least to most significant, 5 at a time
+	var acc uint32
+	bits := 0
+	pos := encodedLength - 1
+	for i := len(b) - 1; i >= 0; i-- {
+		acc |= uint32(b[i]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[pos] = encoding[acc&31]
+			pos--
+			acc >>= 5
+			bits -= 5
+		}
+	}
+	out[pos] = encoding[acc&31]
+	return string(out)
+}
+
+// Valid reports whether id is a well-formed ID with the given prefix. IDs
+// created before this package existed, a prefix followed by a nanosecond
+// timestamp, are also accepted.
+func Valid(prefix, id string) bool {
+	rest, ok := strings.CutPrefix(id, prefix+"_")
+	if !ok {
+		return false
+	}
+	if legacy(rest) {
+		return true
+	}
+	if len(rest) != encodedLength || rest[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(rest); i++ {
+		if strings.IndexByte(encoding, rest[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// legacy reports whether s is a decimal nanosecond timestamp
+func legacy(s string) bool {
+	if len(s) == 0 || len(s) > 19 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package ids
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	id := New(Customer)
+	if !strings.HasPrefix(id, "cus_") || len(id) != len("cus_")+encodedLength {
+		t.Fatalf("Expected a cus_ ID of %d characters, got %q", len("cus_")+encodedLength, id)
+	}
+	if !Valid(Customer, id) {
+		t.Errorf("Expected %q to be valid", id)
+	}
+	if Valid(Payment, id) {
+		t.Errorf("Expected %q not to be a valid payment ID", id)
+	}
+}
+
+func TestSortable(t *testing.T) {
+	// IDs from later milliseconds sort after earlier ones
+	start := time.Now().Add(24 * time.Hour)
+	var times []string
+	for i := 0; i < 5; i++ {
+		times = append(times, generate(start.Add(time.Duration(i)*time.Hour)))
+	}
+	if !slices.IsSorted(times) {
+		t.Errorf("Expected IDs to sort by time, got %v", times)
+	}
+
+	// IDs created in the same millisecond sort in creation order
+	var same []string
+	for i := 0; i < 100; i++ {
+		same = append(same, generate(start.Add(5*time.Hour)))
+	}
+	if !slices.IsSorted(same) || same[0] <= times[len(times)-1] {
+		t.Errorf("Expected IDs in the same millisecond to sort in creation order, got %v", same)
+	}
+
+	// A clock that goes backwards doesn't break the order
+	if earlier := generate(start); earlier <= same[len(same)-1] {
+		t.Errorf("Expected %s to sort after %s", earlier, same[len(same)-1])
+	}
+}
+
+func TestUnique(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				id := New(Payment)
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("Duplicate ID %s", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEncode(t *testing.T) {
+	var max [16]byte
+	for i := range max {
+		max[i] = 0xff
+	}
+	if got := encode(max); got != "7zzzzzzzzzzzzzzzzzzzzzzzzz" {
+		t.Errorf("Expected the largest value to encode as 7zzz..., got %s", got)
+	}
+	if got := encode([16]byte{}); got != strings.Repeat("0", encodedLength) {
+		t.Errorf("Expected zero to encode as 000..., got %s", got)
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"cus_01jh3z6v0q8w2k4m5n6p7r8s9t", true},
+		{"cus_1700000000000000000", true},
+		{"cus_01JH3Z6V0Q8W2K4M5N6P7R8S9T", false},
+		{"cus_81jh3z6v0q8w2k4m5n6p7r8s9t", false},
+		{"cus_01jh3z6v0q8w2k4m5n6p7r8s9", false},
+		{"cus_01jh3z6v0q8w2k4m5n6p7r8s9u", false},
+		{"cus_", false},
+		{"cus_12345678901234567890", false},
+		{"pay_01jh3z6v0q8w2k4m5n6p7r8s9t", false},
+		{"01jh3z6v0q8w2k4m5n6p7r8s9t", false},
+		{"cus_../../etc", false},
+	}
+	for _, tt := range tests {
+		if got := Valid(Customer, tt.id); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+)
+
+// Account represents a merchant. Customers, payment methods, payments,
+// refunds and API keys each belong to one account and are only visible to
+// requests made with that account's API keys.
+type Account struct {
+	ID        string    `json:"id" gorm:"primaryKey" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a" description:"Unique identifier for the account"`
+	Name      string    `json:"name" example:"Acme Corp" description:"Business name of the account"`
+	Email     string    `json:"email,omitempty" example:"billing@acme.example" description:"Contact email address of the account"`
+	CreatedAt time.Time `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the account was created"`
+}
+
+// CreatedAccount represents a newly created account with its first API keys
+type CreatedAccount struct {
+	*Account
+	APIKeys []CreatedAPIKey `json:"api_keys" description:"Test mode secret and publishable keys for the account; they are only returned when the account is created"`
+}
+
+// CreateAccountRequest represents the request to create an account
+type CreateAccountRequest struct {
+	Name  string `json:"name" validate:"required" example:"Acme Corp" description:"Business name of the account"`
+	Email string `json:"email,omitempty" validate:"omitempty,email" example:"billing@acme.example" description:"Contact email address of the account"`
+}
+
+// TableName overrides the table name used by GORM to `accounts`
+func (Account) TableName() string {
+	return "accounts"
+}
+
+// DeletedTestData represents the response to deleting an account's test mode data
+type DeletedTestData struct {
+	Deleted          bool  `json:"deleted" example:"true" description:"Always true"`
+	Customers        int64 `json:"customers" example:"12" description:"Number of test mode customers deleted"`
+	PaymentMethods   int64 `json:"payment_methods" example:"15" description:"Number of test mode payment methods deleted"`
+	Payments         int64 `json:"payments" example:"40" description:"Number of test mode payments deleted"`
+	Refunds          int64 `json:"refunds" example:"3" description:"Number of test mode refunds deleted"`
+	WebhookEndpoints int64 `json:"webhook_endpoints" example:"1" description:"Number of test mode webhook endpoints deleted"`
+	Events           int64 `json:"events" example:"70" description:"Number of test mode events deleted"`
+	WebhookAttempts  int64 `json:"webhook_attempts" example:"70" description:"Number of attempts to send test mode events that were deleted"`
+}
@@ -0,0 +1,26 @@
+package models
+
+// Address represents a postal address
+type Address struct {
+	Line1      string `json:"line1,omitempty" example:"510 Townsend St" description:"Street address, P.O. box or company name"`
+	Line2      string `json:"line2,omitempty" example:"Suite 200" description:"Apartment, suite, unit or building"`
+	City       string `json:"city,omitempty" example:"San Francisco" description:"City, district, suburb, town or village"`
+	State      string `json:"state,omitempty" example:"CA" description:"State, county, province or region"`
+	PostalCode string `json:"postal_code,omitempty" example:"94103" description:"ZIP or postal code"`
+	Country    string `json:"country,omitempty" example:"US" description:"Two-letter ISO country code"`
+}
+
+// BillingDetails represents the billing information associated with a payment method
+type BillingDetails struct {
+	Name    string  `json:"name,omitempty" example:"John Doe" description:"Full name of the account holder"`
+	Email   string  `json:"email,omitempty" example:"user@example.com" description:"Email address of the account holder"`
+	Phone   string  `json:"phone,omitempty" example:"+14155550123" description:"Phone number of the account holder"`
+	Address Address `json:"address" required:"false" gorm:"embedded;embeddedPrefix:address_" description:"Billing address"`
+}
+
+// Shipping represents where and to whom a customer's orders are shipped
+type Shipping struct {
+	Name    string  `json:"name,omitempty" example:"John Doe" description:"Recipient name"`
+	Phone   string  `json:"phone,omitempty" example:"+14155550123" description:"Recipient phone number in E.164 format"`
+	Address Address `json:"address" gorm:"embedded;embeddedPrefix:address_" description:"Shipping address"`
+}
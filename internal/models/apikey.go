@@ -0,0 +1,133 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Resources that restricted API keys can be given permissions on
+const (
+	ResourceCustomers        = "customers"
+	ResourcePaymentMethods   = "payment_methods"
+	ResourcePayments         = "payments"
+	ResourceRefunds          = "refunds"
+	ResourceWebhookEndpoints = "webhook_endpoints"
+)
+
+// Resources lists every resource restricted API keys can be given permissions on
+var Resources = []string{ResourceCustomers, ResourcePaymentMethods, ResourcePayments, ResourceRefunds, ResourceWebhookEndpoints}
+
+// Access levels a restricted API key can have on a resource. Write access
+// includes read access.
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+// Permissions maps resources to the access a restricted API key has on them.
+// Resources that are not listed cannot be accessed. It is stored as JSON.
+type Permissions map[string]string
+
+// APIKey represents a key that authenticates API requests. Only a salted hash
+// of the key is stored; the key itself is returned once, when it is created.
+type APIKey struct {
+	ID          string      `json:"id" gorm:"primaryKey" example:"key_01jh3z9b8c7d6e5f4g3h2j1k0m" description:"Unique identifier for the API key"`
+	AccountID   string      `json:"account_id" gorm:"index" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a" description:"ID of the account the API key belongs to"`
+	Type        string      `json:"type" example:"secret" description:"Type of key: secret keys can use the whole API, restricted keys only what their permissions allow, and publishable keys can only create payment methods"`
+	Livemode    bool        `json:"livemode" example:"false" description:"Whether the key is a live mode key rather than a test mode key"`
+	Permissions Permissions `json:"permissions,omitempty" gorm:"type:text" description:"Access a restricted key has to each resource"`
+	Redacted    string      `json:"redacted" example:"sk_test_...4f2a" description:"The key with all but its prefix and last 4 characters hidden"`
+	Lookup      string      `json:"-" gorm:"uniqueIndex"` // Leading random characters of the key, used to find it
+	Salt        string      `json:"-"`
+	Hash        string      `json:"-"` // SHA-256 of the salt and key
+	CreatedAt   time.Time   `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the key was created"`
+	ExpiresAt   *time.Time  `json:"expires_at,omitempty" example:"2023-01-02T12:00:00Z" description:"Time after which the key stops working, set when the key is rolled"`
+}
+
+// CreatedAPIKey represents a newly created API key, including the key itself
+type CreatedAPIKey struct {
+	*APIKey
+	Secret string `json:"secret" example:"sk_test_4eC39HqLyjWDarjtT1zdp7dc0123abcd" description:"The API key; it is only returned when the key is created"`
+}
+
+// CreateAPIKeyRequest represents the request to create an API key
+type CreateAPIKeyRequest struct {
+	Type        string      `json:"type" validate:"required,oneof=secret restricted publishable" example:"restricted" description:"Type of key: secret, restricted or publishable"`
+	Livemode    bool        `json:"livemode,omitempty" example:"false" description:"Create a live mode key rather than a test mode key"`
+	Permissions Permissions `json:"permissions,omitempty" example:"{\"payments\":\"read\",\"refunds\":\"write\"}" description:"For restricted keys, read or write access to customers, payment_methods, payments, refunds and webhook_endpoints"`
+}
+
+// RollAPIKeyRequest represents the request to replace an API key with a new one
+type RollAPIKeyRequest struct {
+	ExpiresIn *int64 `json:"expires_in,omitempty" validate:"omitempty,min=0,max=604800" example:"86400" description:"Seconds the old key keeps working alongside the new one, up to 7 days (defaults to 24 hours; 0 expires it immediately)"`
+}
+
+// DeletedAPIKey represents the response to deleting an API key
+type DeletedAPIKey struct {
+	ID      string `json:"id" example:"key_01jh3z9b8c7d6e5f4g3h2j1k0m" description:"ID of the deleted API key"`
+	Deleted bool   `json:"deleted" example:"true" description:"Always true"`
+}
+
+// IsExpired reports whether the key has stopped working
+func (k *APIKey) IsExpired(now time.Time) bool {
+	return k.ExpiresAt != nil && !k.ExpiresAt.After(now)
+}
+
+// TableName overrides the table name used by GORM to `api_keys`
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+// Validate checks that permissions only name known resources and access levels
+func (p Permissions) Validate() error {
+	if len(p) == 0 {
+		return fmt.Errorf("restricted keys need at least one permission")
+	}
+	for resource, access := range p {
+		if !slices.Contains(Resources, resource) {
+			return fmt.Errorf("unknown resource %q; use customers, payment_methods, payments, refunds or webhook_endpoints", resource)
+		}
+		if access != AccessRead && access != AccessWrite {
+			return fmt.Errorf("access to %s must be read or write, not %q", resource, access)
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the permissions grant an access level on a resource
+func (p Permissions) Allows(resource, access string) bool {
+	granted := p[resource]
+	return granted == AccessWrite || (granted == AccessRead && access == AccessRead)
+}
+
+// Value implements driver.Valuer
+func (p Permissions) Value() (driver.Value, error) {
+	if p == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (p *Permissions) Scan(value any) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("cannot scan %T into Permissions", value)
+	}
+	return json.Unmarshal(b, p)
+}
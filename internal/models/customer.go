@@ -2,21 +2,53 @@ package models
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 // Customer represents a customer in the payment system
 type Customer struct {
-	ID        string    `json:"id" gorm:"primaryKey" example:"cus_123456789" description:"Unique identifier for the customer"`
-	Email     string    `json:"email" example:"user@example.com" description:"Email address of the customer"`
-	Name      string    `json:"name" example:"John Doe" description:"Customer's full name"`
-	CreatedAt time.Time `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the customer was created"`
-	UpdatedAt time.Time `json:"updated_at" example:"2023-01-01T12:00:00Z" description:"Time at which the customer was last updated"`
+	ID                     string         `json:"id" gorm:"primaryKey" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t" description:"Unique identifier for the customer"`
+	AccountID              string         `json:"account_id" gorm:"index" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a" description:"ID of the account the customer belongs to"`
+	Livemode               bool           `json:"livemode" gorm:"index" example:"false" description:"Whether the customer was created with a live mode key rather than a test mode key"`
+	Email                  string         `json:"email" gorm:"index" example:"user@example.com" description:"Email address of the customer, trimmed and lower-cased"`
+	Name                   string         `json:"name" example:"John Doe" description:"Customer's full name"`
+	Phone                  string         `json:"phone,omitempty" example:"+14155550123" description:"Customer's phone number in E.164 format"`
+	Address                Address        `json:"address" gorm:"embedded;embeddedPrefix:address_" description:"Customer's billing address"`
+	Shipping               Shipping       `json:"shipping" gorm:"embedded;embeddedPrefix:shipping_" description:"Customer's shipping name, phone number and address"`
+	Metadata               Metadata       `json:"metadata" gorm:"type:text" description:"Set of key-value pairs attached to the customer"`
+	DefaultPaymentMethodID string         `json:"default_payment_method_id,omitempty" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g" description:"ID of the payment method used when a payment does not specify one"`
+	CreatedAt              time.Time      `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the customer was created"`
+	UpdatedAt              time.Time      `json:"updated_at" example:"2023-01-01T12:00:00Z" description:"Time at which the customer was last updated"`
+	DeletedAt              gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
 // CreateCustomerRequest represents the request to create a new customer
 type CreateCustomerRequest struct {
-	Email string `json:"email" validate:"required,email" example:"user@example.com" description:"Customer's email address"`
-	Name  string `json:"name" validate:"required" example:"John Doe" description:"Customer's full name"`
+	Email    string    `json:"email" validate:"required,email" example:"user@example.com" description:"Customer's email address"`
+	Name     string    `json:"name" validate:"required" example:"John Doe" description:"Customer's full name"`
+	Phone    string    `json:"phone,omitempty" example:"+14155550123" description:"Customer's phone number in E.164 format"`
+	Address  *Address  `json:"address,omitempty" description:"Customer's billing address"`
+	Shipping *Shipping `json:"shipping,omitempty" description:"Customer's shipping name, phone number and address"`
+	Metadata Metadata  `json:"metadata,omitempty" description:"Set of key-value pairs to attach to the customer"`
+}
+
+// UpdateCustomerRequest represents the request to update a customer. Omitted
+// fields are left unchanged.
+type UpdateCustomerRequest struct {
+	Email                  *string   `json:"email,omitempty" validate:"omitempty,email" example:"user@example.com" description:"Customer's email address"`
+	Name                   *string   `json:"name,omitempty" example:"John Doe" description:"Customer's full name"`
+	Phone                  *string   `json:"phone,omitempty" example:"+14155550123" description:"Customer's phone number in E.164 format"`
+	Address                *Address  `json:"address,omitempty" description:"Replacement billing address"`
+	Shipping               *Shipping `json:"shipping,omitempty" description:"Replacement shipping details"`
+	Metadata               Metadata  `json:"metadata,omitempty" description:"Metadata to merge into the customer's; set a key to an empty string to remove it"`
+	DefaultPaymentMethodID *string   `json:"default_payment_method_id,omitempty" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g" description:"ID of an attached payment method to use by default, or empty to clear it"`
+}
+
+// DeletedCustomer represents the response to deleting a customer
+type DeletedCustomer struct {
+	ID      string `json:"id" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t" description:"ID of the deleted customer"`
+	Deleted bool   `json:"deleted" example:"true" description:"Always true"`
 }
 
 // TableName overrides the table name used by GORM to `customers`
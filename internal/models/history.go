@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+// Actors recorded on status transitions that were not made by an API request
+const (
+	ActorAPI    = "api"
+	ActorSystem = "system"
+)
+
+// PaymentStatusTransition represents a single change to a payment's status
+type PaymentStatusTransition struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	PaymentID  string    `json:"payment_id" gorm:"index" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k" description:"ID of the payment"`
+	FromStatus string    `json:"from_status,omitempty" example:"requires_capture" description:"Status before the transition; empty when the payment was created"`
+	ToStatus   string    `json:"to_status" example:"succeeded" description:"Status after the transition"`
+	Actor      string    `json:"actor" example:"api" description:"Who made the transition"`
+	CreatedAt  time.Time `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the transition happened"`
+}
+
+// TableName overrides the table name used by GORM to `payment_status_history`
+func (PaymentStatusTransition) TableName() string {
+	return "payment_status_history"
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// IdempotencyKey represents a request made with an Idempotency-Key header and
+// the response to replay when the request is retried
+type IdempotencyKey struct {
+	Key             string     `gorm:"primaryKey"`
+	Fingerprint     string     // SHA-256 of the request method, path and body
+	LockedAt        *time.Time // Set while the original request is in flight
+	StatusCode      int
+	ResponseHeaders string // JSON-encoded http.Header
+	ResponseBody    []byte
+	CreatedAt       time.Time
+	ExpiresAt       time.Time `gorm:"index"`
+}
+
+// TableName overrides the table name used by GORM to `idempotency_keys`
+func (IdempotencyKey) TableName() string {
+	return "idempotency_keys"
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Metadata limits
+const (
+	MaxMetadataKeys        = 50
+	MaxMetadataKeyLength   = 40
+	MaxMetadataValueLength = 500
+)
+
+// Metadata is a set of key-value pairs that clients can attach to an object
+// to store their own structured information. It is stored as JSON.
+type Metadata map[string]string
+
+// Validate checks the metadata against the key count and length limits. Keys
+// cannot contain square brackets so that they can be used in list filters
+// such as metadata[order_id]=123.
+func (m Metadata) Validate() error {
+	if len(m) > MaxMetadataKeys {
+		return fmt.Errorf("metadata can have at most %d keys", MaxMetadataKeys)
+	}
+	for key, value := range m {
+		if key == "" {
+			return fmt.Errorf("metadata keys cannot be empty")
+		}
+		if utf8.RuneCountInString(key) > MaxMetadataKeyLength {
+			return fmt.Errorf("metadata key %q is longer than %d characters", key, MaxMetadataKeyLength)
+		}
+		if strings.ContainsAny(key, "[]") {
+			return fmt.Errorf("metadata key %q cannot contain square brackets", key)
+		}
+		if utf8.RuneCountInString(value) > MaxMetadataValueLength {
+			return fmt.Errorf("metadata value for %q is longer than %d characters", key, MaxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// Merge applies updates to the metadata. Keys with an empty value are removed.
+func (m Metadata) Merge(updates Metadata) Metadata {
+	merged := make(Metadata, len(m)+len(updates))
+	for key, value := range m {
+		merged[key] = value
+	}
+	for key, value := range updates {
+		if value == "" {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// Value implements driver.Valuer
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (m *Metadata) Scan(value any) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("cannot scan %T into Metadata", value)
+	}
+	return json.Unmarshal(b, m)
+}
@@ -4,27 +4,76 @@ import (
 	"time"
 )
 
+// Payment method types
+const (
+	PaymentMethodTypeCard        = "card"
+	PaymentMethodTypeBankAccount = "bank_account"
+)
+
 // PaymentMethod represents a payment method in the system
 type PaymentMethod struct {
-	ID         string    `json:"id" gorm:"primaryKey" example:"pm_123456789" description:"Unique identifier for the payment method"`
-	CustomerID string    `json:"customer_id" gorm:"index" example:"cus_123456789" description:"ID of the customer this payment method belongs to"`
-	Type       string    `json:"type" example:"card" description:"Type of payment method (card or bank_account)"`
-	Last4      string    `json:"last4" example:"4242" description:"Last 4 digits of the card or bank account"`
-	ExpMonth   int       `json:"exp_month,omitempty" example:"12" description:"Expiration month (cards only)"`
-	ExpYear    int       `json:"exp_year,omitempty" example:"2025" description:"Expiration year (cards only)"`
-	Brand      string    `json:"brand,omitempty" example:"visa" description:"Card brand (cards only)"`
-	CreatedAt  time.Time `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the payment method was created"`
+	ID                string         `json:"id" gorm:"primaryKey" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g" description:"Unique identifier for the payment method"`
+	AccountID         string         `json:"account_id" gorm:"index" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a" description:"ID of the account the payment method belongs to"`
+	Livemode          bool           `json:"livemode" gorm:"index" example:"false" description:"Whether the payment method was created with a live mode key rather than a test mode key"`
+	CustomerID        string         `json:"customer_id" gorm:"index" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t" description:"ID of the customer this payment method belongs to; empty until it is attached to one"`
+	Type              string         `json:"type" example:"card" description:"Type of payment method (card or bank_account)"`
+	Last4             string         `json:"last4" example:"4242" description:"Last 4 digits of the card or bank account"`
+	ExpMonth          int            `json:"exp_month,omitempty" example:"12" description:"Expiration month (cards only)"`
+	ExpYear           int            `json:"exp_year,omitempty" example:"2025" description:"Expiration year (cards only)"`
+	Brand             string         `json:"brand,omitempty" example:"visa" description:"Card brand: visa, mastercard, amex, discover, jcb, diners or unionpay (cards only)"`
+	Funding           string         `json:"funding,omitempty" example:"credit" description:"Card funding type: credit, debit or prepaid (cards only)"`
+	Fingerprint       string         `json:"fingerprint,omitempty" gorm:"index" example:"3f1c0b7e9a5d2c4e8b6a1f0d9c7e5b3a" description:"Identifies the card number; two payment methods with the same fingerprint are the same card (cards only)"`
+	VaultToken        string         `json:"-"` // Token of the encrypted card number in the vault
+	BankName          string         `json:"bank_name,omitempty" example:"STRIPE TEST BANK" description:"Name of the bank (bank accounts only)"`
+	RoutingNumber     string         `json:"routing_number,omitempty" example:"110000000" description:"ABA routing number (bank accounts only)"`
+	AccountHolderType string         `json:"account_holder_type,omitempty" example:"individual" description:"Account holder type: individual or company (bank accounts only)"`
+	AccountType       string         `json:"account_type,omitempty" example:"checking" description:"Account type: checking or savings (bank accounts only)"`
+	BillingDetails    BillingDetails `json:"billing_details" gorm:"embedded;embeddedPrefix:billing_" description:"Billing information for the payment method"`
+	Metadata          Metadata       `json:"metadata" gorm:"type:text" description:"Set of key-value pairs attached to the payment method"`
+	Expired           bool           `json:"expired" gorm:"-" example:"false" description:"Whether the card's expiry date has passed (cards only)"`
+	CreatedAt         time.Time      `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the payment method was created"`
+	DetachedAt        *time.Time     `json:"detached_at,omitempty" gorm:"index" example:"2023-01-01T12:00:00Z" description:"Time at which the payment method was detached from its customer"`
 }
 
 // CreatePaymentMethodRequest represents the request to create a new payment method
 type CreatePaymentMethodRequest struct {
-	CustomerID string `json:"customer_id" validate:"required" example:"cus_123456789" description:"ID of the customer"`
+	CustomerID string `json:"customer_id,omitempty" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t" description:"ID of the customer to attach the payment method to. Publishable keys cannot set it; their payment methods are attached later with a secret key."`
 	Type       string `json:"type" validate:"required,oneof=card bank_account" example:"card" description:"Type of payment method"`
-	// For a real implementation, you'd have additional fields like card number, exp date, etc.
-	CardNumber string `json:"card_number,omitempty" validate:"omitempty,len=16" example:"4242424242424242" description:"Credit card number"`
+	// Card details, required when type is card
+	CardNumber string `json:"card_number,omitempty" validate:"omitempty,min=12,max=19" example:"4242424242424242" description:"Card number; must pass the Luhn check and match the brand's length"`
 	ExpMonth   int    `json:"exp_month,omitempty" validate:"omitempty,min=1,max=12" example:"12" description:"Expiration month"`
 	ExpYear    int    `json:"exp_year,omitempty" validate:"omitempty,min=2023" example:"2025" description:"Expiration year"`
-	Cvc        string `json:"cvc,omitempty" validate:"omitempty,len=3" example:"123" description:"Card security code"`
+	Cvc        string `json:"cvc,omitempty" validate:"omitempty,min=3,max=4" example:"123" description:"Card security code (4 digits for amex, 3 otherwise)"`
+	// Bank account details, required when type is bank_account
+	RoutingNumber     string `json:"routing_number,omitempty" validate:"omitempty,len=9" example:"110000000" description:"ABA routing number"`
+	AccountNumber     string `json:"account_number,omitempty" validate:"omitempty,min=4,max=17" example:"000123456789" description:"Bank account number"`
+	AccountHolderType string `json:"account_holder_type,omitempty" validate:"omitempty,oneof=individual company" example:"individual" description:"Account holder type: individual (default) or company"`
+	AccountType       string `json:"account_type,omitempty" validate:"omitempty,oneof=checking savings" example:"checking" description:"Account type: checking (default) or savings"`
+	// Billing information, optional for all types
+	BillingDetails BillingDetails `json:"billing_details,omitempty" description:"Billing information for the payment method"`
+	Metadata       Metadata       `json:"metadata,omitempty" description:"Set of key-value pairs to attach to the payment method"`
+}
+
+// AttachPaymentMethodRequest represents the request to attach a payment method to a customer
+type AttachPaymentMethodRequest struct {
+	CustomerID string `json:"customer_id" validate:"required" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t" description:"ID of the customer"`
+}
+
+// UpdatePaymentMethodRequest represents the request to update a payment method.
+// Omitted fields are left unchanged.
+type UpdatePaymentMethodRequest struct {
+	ExpMonth       *int            `json:"exp_month,omitempty" validate:"omitempty,min=1,max=12" example:"12" description:"New expiration month (cards only)"`
+	ExpYear        *int            `json:"exp_year,omitempty" example:"2030" description:"New expiration year (cards only)"`
+	BillingDetails *BillingDetails `json:"billing_details,omitempty" description:"Replacement billing information"`
+	Metadata       Metadata        `json:"metadata,omitempty" description:"Metadata to merge into the payment method's; set a key to an empty string to remove it"`
+}
+
+// IsExpired reports whether a card is past the end of its expiry month
+func (m *PaymentMethod) IsExpired(now time.Time) bool {
+	if m.Type != PaymentMethodTypeCard || m.ExpYear == 0 {
+		return false
+	}
+	return m.ExpYear < now.Year() || (m.ExpYear == now.Year() && m.ExpMonth < int(now.Month()))
 }
 
 // TableName overrides the table name used by GORM to `payment_methods`
@@ -4,26 +4,85 @@ import (
 	"time"
 )
 
+// Payment statuses
+const (
+	PaymentStatusPending           = "pending"
+	PaymentStatusRequiresCapture   = "requires_capture"
+	PaymentStatusSucceeded         = "succeeded"
+	PaymentStatusFailed            = "failed"
+	PaymentStatusCanceled          = "canceled"
+	PaymentStatusPartiallyRefunded = "partially_refunded"
+	PaymentStatusRefunded          = "refunded"
+)
+
+// Cancellation reasons
+const (
+	CancellationReasonDuplicate           = "duplicate"
+	CancellationReasonFraudulent          = "fraudulent"
+	CancellationReasonRequestedByCustomer = "requested_by_customer"
+	CancellationReasonAbandoned           = "abandoned"
+	CancellationReasonAutomatic           = "automatic"
+)
+
+// Capture methods
+const (
+	CaptureMethodAutomatic = "automatic"
+	CaptureMethodManual    = "manual"
+)
+
 // Payment represents a payment transaction in the system
 type Payment struct {
-	ID              string    `json:"id" gorm:"primaryKey" example:"pay_123456789" description:"Unique identifier for the payment"`
-	Amount          int64     `json:"amount" example:"2000" description:"Amount in cents"`
-	Currency        string    `json:"currency" example:"usd" description:"Three-letter ISO currency code"`
-	CustomerID      string    `json:"customer_id" gorm:"index" example:"cus_123456789" description:"ID of the customer making the payment"`
-	PaymentMethodID string    `json:"payment_method_id" example:"pm_123456789" description:"ID of the payment method used"`
-	Status          string    `json:"status" example:"succeeded" description:"Status of the payment (pending, succeeded, failed)"`
-	Description     string    `json:"description,omitempty" example:"Payment for order #1234" description:"Description of what the payment is for"`
-	CreatedAt       time.Time `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the payment was created"`
-	UpdatedAt       time.Time `json:"updated_at" example:"2023-01-01T12:00:00Z" description:"Time at which the payment was last updated"`
+	ID                 string     `json:"id" gorm:"primaryKey" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k" description:"Unique identifier for the payment"`
+	AccountID          string     `json:"account_id" gorm:"index" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a" description:"ID of the account the payment belongs to"`
+	Livemode           bool       `json:"livemode" gorm:"index" example:"false" description:"Whether the payment was created with a live mode key rather than a test mode key"`
+	Amount             int64      `json:"amount" example:"2000" description:"Amount in cents"`
+	AmountCaptured     int64      `json:"amount_captured" example:"2000" description:"Amount in cents that has been captured"`
+	AmountRefunded     int64      `json:"amount_refunded" example:"500" description:"Amount in cents that has been refunded"`
+	Refunded           bool       `json:"refunded" example:"false" description:"Whether the captured amount has been fully refunded"`
+	Currency           string     `json:"currency" example:"usd" description:"Three-letter ISO currency code"`
+	CustomerID         string     `json:"customer_id" gorm:"index" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t" description:"ID of the customer making the payment"`
+	PaymentMethodID    string     `json:"payment_method_id" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g" description:"ID of the payment method used"`
+	Status             string     `json:"status" gorm:"index" example:"succeeded" description:"Status of the payment (pending, requires_capture, succeeded, failed, canceled, partially_refunded, refunded)"`
+	CaptureMethod      string     `json:"capture_method" example:"automatic" description:"How the payment is captured (automatic or manual)"`
+	CaptureBefore      *time.Time `json:"capture_before,omitempty" example:"2023-01-08T12:00:00Z" description:"Time after which an uncaptured authorization expires (manual capture only)"`
+	CapturedAt         *time.Time `json:"captured_at,omitempty" example:"2023-01-01T12:00:00Z" description:"Time at which the payment was captured"`
+	CanceledAt         *time.Time `json:"canceled_at,omitempty" example:"2023-01-01T12:00:00Z" description:"Time at which the payment was canceled"`
+	CancellationReason string     `json:"cancellation_reason,omitempty" example:"requested_by_customer" description:"Reason the payment was canceled (duplicate, fraudulent, requested_by_customer, abandoned, automatic)"`
+	Description        string     `json:"description,omitempty" example:"Payment for order #1234" description:"Description of what the payment is for"`
+	FailureCode        string     `json:"failure_code,omitempty" example:"card_declined" description:"Processor decline code if the payment failed"`
+	FailureMessage     string     `json:"failure_message,omitempty" example:"Your card was declined." description:"Human-readable explanation of the failure"`
+	Metadata           Metadata   `json:"metadata" gorm:"type:text" description:"Set of key-value pairs attached to the payment"`
+	ProcessorReference string     `json:"-"`
+	CreatedAt          time.Time  `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the payment was created"`
+	UpdatedAt          time.Time  `json:"updated_at" example:"2023-01-01T12:00:00Z" description:"Time at which the payment was last updated"`
 }
 
 // CreatePaymentRequest represents the request to create a new payment
 type CreatePaymentRequest struct {
-	Amount          int64  `json:"amount" validate:"required,min=1" example:"2000" description:"Amount in cents"`
-	Currency        string `json:"currency" validate:"required,len=3" example:"usd" description:"Three-letter ISO currency code"`
-	CustomerID      string `json:"customer_id" validate:"required" example:"cus_123456789" description:"ID of the customer making the payment"`
-	PaymentMethodID string `json:"payment_method_id" validate:"required" example:"pm_123456789" description:"ID of the payment method to use"`
-	Description     string `json:"description,omitempty" example:"Payment for order #1234" description:"Description of what the payment is for"`
+	Amount          int64    `json:"amount" validate:"required,min=1" minimum:"1" example:"2000" description:"Amount in cents"`
+	Currency        string   `json:"currency" validate:"required,len=3" example:"usd" description:"Three-letter ISO currency code"`
+	CustomerID      string   `json:"customer_id" validate:"required" example:"cus_01jh3z6v0q8w2k4m5n6p7r8s9t" description:"ID of the customer making the payment"`
+	PaymentMethodID string   `json:"payment_method_id,omitempty" example:"pm_01jh3z6x1y2z3a4b5c6d7e8f9g" description:"ID of the payment method to use; defaults to the customer's default payment method"`
+	Description     string   `json:"description,omitempty" example:"Payment for order #1234" description:"Description of what the payment is for"`
+	CaptureMethod   string   `json:"capture_method,omitempty" validate:"omitempty,oneof=automatic manual" example:"manual" description:"Set to manual to place an authorization hold and capture it later (defaults to automatic)"`
+	Metadata        Metadata `json:"metadata,omitempty" description:"Set of key-value pairs to attach to the payment"`
+}
+
+// UpdatePaymentRequest represents the request to update a payment. Omitted
+// fields are left unchanged.
+type UpdatePaymentRequest struct {
+	Description *string  `json:"description,omitempty" example:"Payment for order #1234" description:"Description of what the payment is for"`
+	Metadata    Metadata `json:"metadata,omitempty" description:"Metadata to merge into the payment's; set a key to an empty string to remove it"`
+}
+
+// CapturePaymentRequest represents the request to capture an authorized payment
+type CapturePaymentRequest struct {
+	AmountToCapture int64 `json:"amount_to_capture,omitempty" validate:"omitempty,min=1" example:"1500" description:"Amount in cents to capture; defaults to the full authorized amount"`
+}
+
+// CancelPaymentRequest represents the request to cancel a payment
+type CancelPaymentRequest struct {
+	CancellationReason string `json:"cancellation_reason,omitempty" validate:"omitempty,oneof=duplicate fraudulent requested_by_customer abandoned" example:"requested_by_customer" description:"Reason for canceling the payment"`
 }
 
 // TableName overrides the table name used by GORM to `payments`
@@ -4,22 +4,40 @@ import (
 	"time"
 )
 
+// Refund statuses
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusSucceeded = "succeeded"
+	RefundStatusFailed    = "failed"
+)
+
 // Refund represents a refund transaction in the system
 type Refund struct {
-	ID        string    `json:"id" gorm:"primaryKey" example:"ref_123456789" description:"Unique identifier for the refund"`
-	PaymentID string    `json:"payment_id" gorm:"index" example:"pay_123456789" description:"ID of the payment being refunded"`
-	Amount    int64     `json:"amount" example:"2000" description:"Amount to refund in cents"`
-	Status    string    `json:"status" example:"succeeded" description:"Status of the refund (pending, succeeded, failed)"`
-	Reason    string    `json:"reason,omitempty" example:"requested_by_customer" description:"Reason for the refund"`
-	CreatedAt time.Time `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the refund was created"`
-	UpdatedAt time.Time `json:"updated_at" example:"2023-01-01T12:00:00Z" description:"Time at which the refund was last updated"`
+	ID                 string    `json:"id" gorm:"primaryKey" example:"ref_01jh3z8m9n0p1q2r3s4t5v6w7x" description:"Unique identifier for the refund"`
+	AccountID          string    `json:"account_id" gorm:"index" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a" description:"ID of the account the refund belongs to"`
+	Livemode           bool      `json:"livemode" gorm:"index" example:"false" description:"Whether the refund was created with a live mode key rather than a test mode key"`
+	PaymentID          string    `json:"payment_id" gorm:"index" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k" description:"ID of the payment being refunded"`
+	Amount             int64     `json:"amount" example:"2000" description:"Amount to refund in cents"`
+	Status             string    `json:"status" example:"succeeded" description:"Status of the refund (pending, succeeded, failed)"`
+	Reason             string    `json:"reason,omitempty" example:"requested_by_customer" description:"Reason for the refund"`
+	FailureReason      string    `json:"failure_reason,omitempty" example:"refund_failed" description:"Processor failure code if the refund failed"`
+	Metadata           Metadata  `json:"metadata" gorm:"type:text" description:"Set of key-value pairs attached to the refund"`
+	ProcessorReference string    `json:"-"`
+	CreatedAt          time.Time `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the refund was created"`
+	UpdatedAt          time.Time `json:"updated_at" example:"2023-01-01T12:00:00Z" description:"Time at which the refund was last updated"`
 }
 
 // CreateRefundRequest represents the request to create a new refund
 type CreateRefundRequest struct {
-	PaymentID string `json:"payment_id" validate:"required" example:"pay_123456789" description:"ID of the payment to refund"`
-	Amount    int64  `json:"amount" validate:"required,min=1" example:"2000" description:"Amount to refund in cents"`
-	Reason    string `json:"reason,omitempty" example:"requested_by_customer" description:"Reason for the refund"`
+	PaymentID string   `json:"payment_id" validate:"required" example:"pay_01jh3z7a2b3c4d5e6f7g8h9j0k" description:"ID of the payment to refund"`
+	Amount    int64    `json:"amount" validate:"required,min=1" minimum:"1" example:"2000" description:"Amount to refund in cents"`
+	Reason    string   `json:"reason,omitempty" example:"requested_by_customer" description:"Reason for the refund"`
+	Metadata  Metadata `json:"metadata,omitempty" description:"Set of key-value pairs to attach to the refund"`
+}
+
+// UpdateRefundRequest represents the request to update a refund
+type UpdateRefundRequest struct {
+	Metadata Metadata `json:"metadata,omitempty" description:"Metadata to merge into the refund's; set a key to an empty string to remove it"`
 }
 
 // TableName overrides the table name used by GORM to `refunds`
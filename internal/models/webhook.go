@@ -0,0 +1,214 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Event types sent to webhook endpoints
+const (
+	EventCustomerCreated        = "customer.created"
+	EventCustomerUpdated        = "customer.updated"
+	EventCustomerDeleted        = "customer.deleted"
+	EventPaymentMethodAttached  = "payment_method.attached"
+	EventPaymentMethodUpdated   = "payment_method.updated"
+	EventPaymentMethodDetached  = "payment_method.detached"
+	EventPaymentCreated         = "payment.created"
+	EventPaymentRequiresCapture = "payment.requires_capture"
+	EventPaymentSucceeded       = "payment.succeeded"
+	EventPaymentFailed          = "payment.failed"
+	EventPaymentCanceled        = "payment.canceled"
+	EventPaymentRefunded        = "payment.refunded"
+	EventRefundCreated          = "refund.created"
+	EventRefundSucceeded        = "refund.succeeded"
+	EventRefundFailed           = "refund.failed"
+	EventAll                    = "*"
+)
+
+// EventTypes lists every event type webhook endpoints can subscribe to
+var EventTypes = []string{
+	EventCustomerCreated, EventCustomerUpdated, EventCustomerDeleted,
+	EventPaymentMethodAttached, EventPaymentMethodUpdated, EventPaymentMethodDetached,
+	EventPaymentCreated, EventPaymentRequiresCapture, EventPaymentSucceeded,
+	EventPaymentFailed, EventPaymentCanceled, EventPaymentRefunded,
+	EventRefundCreated, EventRefundSucceeded, EventRefundFailed,
+}
+
+// eventResources maps the prefix of each event type to the resource whose
+// objects its events carry
+var eventResources = map[string]string{
+	"customer":       ResourceCustomers,
+	"payment_method": ResourcePaymentMethods,
+	"payment":        ResourcePayments,
+	"refund":         ResourceRefunds,
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusSucceeded = "succeeded"
+	DeliveryStatusFailed    = "failed"
+)
+
+// EnabledEvents lists the event types a webhook endpoint subscribes to; "*"
+// subscribes to all of them. It is stored as JSON.
+type EnabledEvents []string
+
+// Validate checks that every entry is a known event type or "*"
+func (e EnabledEvents) Validate() error {
+	if len(e) == 0 {
+		return fmt.Errorf("enabled_events needs at least one event type, or * for all of them")
+	}
+	for _, eventType := range e {
+		if eventType != EventAll && !slices.Contains(EventTypes, eventType) {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	return nil
+}
+
+// Includes reports whether events of a type are sent to the endpoint
+func (e EnabledEvents) Includes(eventType string) bool {
+	return slices.Contains(e, EventAll) || slices.Contains(e, eventType)
+}
+
+// Resources lists the resources whose objects are sent to the endpoint, in
+// the order of Resources
+func (e EnabledEvents) Resources() []string {
+	var resources []string
+	for _, resource := range Resources {
+		for _, eventType := range EventTypes {
+			prefix, _, _ := strings.Cut(eventType, ".")
+			if eventResources[prefix] == resource && e.Includes(eventType) {
+				resources = append(resources, resource)
+				break
+			}
+		}
+	}
+	return resources
+}
+
+// Value implements driver.Valuer
+func (e EnabledEvents) Value() (driver.Value, error) {
+	if e == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (e *EnabledEvents) Scan(value any) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*e = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("cannot scan %T into EnabledEvents", value)
+	}
+	return json.Unmarshal(b, e)
+}
+
+// WebhookEndpoint represents a URL that events are POSTed to. An endpoint
+// only receives events of its account and mode.
+type WebhookEndpoint struct {
+	ID            string        `json:"id" gorm:"primaryKey" example:"we_01jh3zb2c3d4e5f6g7h8j9k0m1" description:"Unique identifier for the webhook endpoint"`
+	AccountID     string        `json:"account_id" gorm:"index" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a" description:"ID of the account the endpoint belongs to"`
+	Livemode      bool          `json:"livemode" gorm:"index" example:"false" description:"Whether the endpoint receives live mode events rather than test mode events"`
+	URL           string        `json:"url" example:"https://example.com/webhooks" description:"URL events are POSTed to"`
+	Description   string        `json:"description,omitempty" example:"Order fulfillment" description:"Description of the endpoint"`
+	EnabledEvents EnabledEvents `json:"enabled_events" gorm:"type:text" description:"Event types sent to the endpoint; * for all of them"`
+	Secret        string        `json:"-"` // Key of the HMAC-SHA256 signatures of events sent to the endpoint
+	CreatedAt     time.Time     `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the endpoint was created"`
+}
+
+// CreatedWebhookEndpoint represents a newly created webhook endpoint,
+// including its signing secret
+type CreatedWebhookEndpoint struct {
+	*WebhookEndpoint
+	Secret string `json:"secret" example:"whsec_5f0c8a3e2b1d4f6a8c9e0b2d4f6a8c9e0b2d4f6a8c9e0b2d" description:"Secret used to sign events sent to the endpoint; it is only returned when the endpoint is created"`
+}
+
+// CreateWebhookEndpointRequest represents the request to create a webhook endpoint
+type CreateWebhookEndpointRequest struct {
+	URL           string        `json:"url" validate:"required,url" example:"https://example.com/webhooks" description:"URL to POST events to; live mode endpoints must use https"`
+	Description   string        `json:"description,omitempty" example:"Order fulfillment" description:"Description of the endpoint"`
+	EnabledEvents EnabledEvents `json:"enabled_events" validate:"required" example:"[\"payment.succeeded\",\"refund.created\"]" description:"Event types to send to the endpoint; * for all of them"`
+}
+
+// DeletedWebhookEndpoint represents the response to deleting a webhook endpoint
+type DeletedWebhookEndpoint struct {
+	ID      string `json:"id" example:"we_01jh3zb2c3d4e5f6g7h8j9k0m1" description:"ID of the deleted webhook endpoint"`
+	Deleted bool   `json:"deleted" example:"true" description:"Always true"`
+}
+
+// Event represents something that happened to an object, as sent to webhook
+// endpoints. Data holds the object as it was right after the change.
+type Event struct {
+	ID        string          `json:"id" gorm:"primaryKey" example:"evt_01jh3zc3d4e5f6g7h8j9k0m1n2" description:"Unique identifier for the event"`
+	AccountID string          `json:"account_id" gorm:"index" example:"acct_01jh3z5q4r3s2t1v0w9x8y7z6a" description:"ID of the account the event belongs to"`
+	Livemode  bool            `json:"livemode" example:"false" description:"Whether the event happened in live mode rather than test mode"`
+	Type      string          `json:"type" example:"payment.succeeded" description:"Type of the event"`
+	Data      json.RawMessage `json:"data" gorm:"type:text" description:"The object the event is about, under the key object"`
+	CreatedAt time.Time       `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the event happened"`
+}
+
+// WebhookDelivery tracks sending an event to one endpoint until it succeeds
+// or is given up on
+type WebhookDelivery struct {
+	ID            uint       `gorm:"primaryKey"`
+	EndpointID    string     `gorm:"index"`
+	EventID       string     `gorm:"index"`
+	Status        string     `gorm:"index"`
+	Attempts      int        // Number of attempts made so far
+	NextAttemptAt *time.Time `gorm:"index"` // Set while the delivery is pending
+	CreatedAt     time.Time
+}
+
+// WebhookAttempt represents one attempt to send an event to an endpoint
+type WebhookAttempt struct {
+	ID            string     `json:"id" gorm:"primaryKey" example:"wha_01jh3zd4e5f6g7h8j9k0m1n2p3" description:"Unique identifier for the attempt"`
+	EndpointID    string     `json:"endpoint_id" gorm:"index" example:"we_01jh3zb2c3d4e5f6g7h8j9k0m1" description:"ID of the webhook endpoint"`
+	EventID       string     `json:"event_id" example:"evt_01jh3zc3d4e5f6g7h8j9k0m1n2" description:"ID of the event sent"`
+	EventType     string     `json:"event_type" example:"payment.succeeded" description:"Type of the event sent"`
+	Attempt       int        `json:"attempt" example:"1" description:"Number of the attempt, starting at 1"`
+	Succeeded     bool       `json:"succeeded" example:"true" description:"Whether the endpoint accepted the event with a 2xx status"`
+	StatusCode    int        `json:"status_code,omitempty" example:"200" description:"HTTP status the endpoint responded with"`
+	ResponseBody  string     `json:"response_body,omitempty" example:"ok" description:"Start of the endpoint's response body"`
+	Error         string     `json:"error,omitempty" example:"connection refused" description:"Why no response was received"`
+	DurationMS    int64      `json:"duration_ms" example:"85" description:"Milliseconds the attempt took"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty" example:"2023-01-01T12:02:00Z" description:"When the event will be sent again, if the attempt failed and it is still being retried"`
+	CreatedAt     time.Time  `json:"created_at" example:"2023-01-01T12:00:00Z" description:"Time at which the attempt was made"`
+}
+
+// TableName overrides the table name used by GORM to `webhook_endpoints`
+func (WebhookEndpoint) TableName() string {
+	return "webhook_endpoints"
+}
+
+// TableName overrides the table name used by GORM to `events`
+func (Event) TableName() string {
+	return "events"
+}
+
+// TableName overrides the table name used by GORM to `webhook_deliveries`
+func (WebhookDelivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// TableName overrides the table name used by GORM to `webhook_attempts`
+func (WebhookAttempt) TableName() string {
+	return "webhook_attempts"
+}
@@ -0,0 +1,93 @@
+// Package processor defines the interface between the API and the payment
+// gateway that moves money, along with a deterministic simulated gateway.
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+)
+
+// Decline codes returned by processors
+const (
+	CodeCardDeclined      = "card_declined"
+	CodeInsufficientFunds = "insufficient_funds"
+	CodeLostCard          = "lost_card"
+	CodeStolenCard        = "stolen_card"
+	CodeExpiredCard       = "expired_card"
+	CodeIncorrectCVC      = "incorrect_cvc"
+	CodeProcessingError   = "processing_error"
+	CodeRefundFailed      = "refund_failed"
+)
+
+// Processor is a payment gateway that can place, settle and reverse charges.
+// A non-nil error means the operation did not take place; declines are
+// reported as *DeclineError.
+type Processor interface {
+	// Authorize places a hold for the amount on the payment method and,
+	// if req.Capture is set, captures it immediately
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error)
+	// Capture settles all or part of an authorization
+	Capture(ctx context.Context, reference string, amount int64) (*Result, error)
+	// Void releases an uncaptured authorization
+	Void(ctx context.Context, reference string) error
+	// Refund returns all or part of a captured amount
+	Refund(ctx context.Context, reference string, amount int64) (*Result, error)
+}
+
+// AuthorizeRequest represents a request to authorize a payment. Card payment
+// methods carry a vault token that gateway implementations exchange for the
+// card number with vault.Vault.Reveal.
+type AuthorizeRequest struct {
+	Amount        int64
+	Currency      string
+	PaymentMethod *models.PaymentMethod
+	Capture       bool
+}
+
+// Result represents a successful processor operation
+type Result struct {
+	// Reference identifies the authorization or refund at the processor
+	Reference string
+}
+
+// DeclineError reports that the processor declined an operation
+type DeclineError struct {
+	Code    string
+	Message string
+}
+
+// Error implements the error interface
+func (e *DeclineError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ErrNotConfigured is returned by Unconfigured for every operation
+var ErrNotConfigured = errors.New("no payment processor is configured")
+
+// Unconfigured is a processor that refuses every operation. It stands in for
+// the live mode processor when none is configured, so live payments are never
+// sent to the simulator by accident.
+type Unconfigured struct{}
+
+// Authorize implements Processor
+func (Unconfigured) Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error) {
+	return nil, ErrNotConfigured
+}
+
+// Capture implements Processor
+func (Unconfigured) Capture(ctx context.Context, reference string, amount int64) (*Result, error) {
+	return nil, ErrNotConfigured
+}
+
+// Void implements Processor
+func (Unconfigured) Void(ctx context.Context, reference string) error {
+	return ErrNotConfigured
+}
+
+// Refund implements Processor
+func (Unconfigured) Refund(ctx context.Context, reference string, amount int64) (*Result, error) {
+	return nil, ErrNotConfigured
+}
@@ -0,0 +1,156 @@
+package processor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+)
+
+// TestCards maps magic card numbers to the decline the simulator returns for
+// them. Any other card number succeeds.
+var TestCards = map[string]*DeclineError{
+	"4000000000000002": {Code: CodeCardDeclined, Message: "Your card was declined."},
+	"4000000000009995": {Code: CodeInsufficientFunds, Message: "Your card has insufficient funds."},
+	"4000000000009987": {Code: CodeLostCard, Message: "Your card was declined."},
+	"4000000000009979": {Code: CodeStolenCard, Message: "Your card was declined."},
+	"4000000000000069": {Code: CodeExpiredCard, Message: "Your card has expired."},
+	"4000000000000127": {Code: CodeIncorrectCVC, Message: "Your card's security code is incorrect."},
+	"4000000000000119": {Code: CodeProcessingError, Message: "An error occurred while processing your card. Try again in a little bit."},
+}
+
+// RefundFailureCard authorizes and captures normally but every refund against
+// it fails
+const RefundFailureCard = "4000000000005126"
+
+// CardNumbers looks up the full number of a vaulted card. *vault.Vault
+// implements it.
+type CardNumbers interface {
+	Reveal(token string) (string, error)
+}
+
+// Simulator is an in-memory processor that behaves deterministically based on
+// the card used, so failure paths can be exercised without a real gateway
+type Simulator struct {
+	cards          CardNumbers
+	mu             sync.Mutex
+	authorizations map[string]*authorization
+}
+
+// authorization tracks the state of a simulated authorization
+type authorization struct {
+	amount     int64
+	captured   int64
+	refunded   int64
+	voided     bool
+	failRefund bool
+}
+
+// NewSimulator creates a new simulated processor that reads card numbers
+// from cards to recognize the test cards
+func NewSimulator(cards CardNumbers) *Simulator {
+	return &Simulator{cards: cards, authorizations: make(map[string]*authorization)}
+}
+
+// Authorize implements Processor
+func (s *Simulator) Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error) {
+	number, err := s.cardNumber(req.PaymentMethod)
+	if err != nil {
+		return nil, err
+	}
+	if decline, ok := TestCards[number]; ok {
+		return nil, decline
+	}
+
+	auth := &authorization{
+		amount:     req.Amount,
+		failRefund: number == RefundFailureCard,
+	}
+	if req.Capture {
+		auth.captured = req.Amount
+	}
+
+	reference := "sim_" + randomHex()
+	s.mu.Lock()
+	s.authorizations[reference] = auth
+	s.mu.Unlock()
+	return &Result{Reference: reference}, nil
+}
+
+// Capture implements Processor
+func (s *Simulator) Capture(ctx context.Context, reference string, amount int64) (*Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Authorizations from before a restart are unknown and always succeed
+	auth, ok := s.authorizations[reference]
+	if !ok {
+		return &Result{Reference: reference}, nil
+	}
+	if auth.voided || auth.captured > 0 || amount > auth.amount {
+		return nil, &DeclineError{Code: CodeProcessingError, Message: "The authorization cannot be captured."}
+	}
+	auth.captured = amount
+	return &Result{Reference: reference}, nil
+}
+
+// Void implements Processor
+func (s *Simulator) Void(ctx context.Context, reference string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	auth, ok := s.authorizations[reference]
+	if !ok {
+		return nil
+	}
+	if auth.captured > 0 {
+		return &DeclineError{Code: CodeProcessingError, Message: "A captured authorization cannot be voided."}
+	}
+	auth.voided = true
+	return nil
+}
+
+// Refund implements Processor
+func (s *Simulator) Refund(ctx context.Context, reference string, amount int64) (*Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	auth, ok := s.authorizations[reference]
+	if !ok {
+		return &Result{Reference: "sim_re_" + randomHex()}, nil
+	}
+	if auth.failRefund {
+		return nil, &DeclineError{Code: CodeRefundFailed, Message: "The refund could not be processed."}
+	}
+	if auth.refunded+amount > auth.captured {
+		return nil, &DeclineError{Code: CodeProcessingError, Message: "The refund exceeds the captured amount."}
+	}
+	auth.refunded += amount
+	return &Result{Reference: "sim_re_" + randomHex()}, nil
+}
+
+// cardNumber returns the full number of a vaulted card, so only the test
+// cards themselves and not every card sharing their last four digits are
+// declined. It returns "" for other payment methods.
+func (s *Simulator) cardNumber(method *models.PaymentMethod) (string, error) {
+	if method.Type != models.PaymentMethodTypeCard || method.VaultToken == "" || s.cards == nil {
+		return "", nil
+	}
+	number, err := s.cards.Reveal(method.VaultToken)
+	if err != nil {
+		return "", fmt.Errorf("revealing card number: %w", err)
+	}
+	return number, nil
+}
+
+// randomHex returns 16 random hex characters for simulated references
+func randomHex() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
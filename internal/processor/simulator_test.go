@@ -0,0 +1,112 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+)
+
+// cardNumbers is a vault of card numbers keyed by token
+type cardNumbers map[string]string
+
+func (c cardNumbers) Reveal(token string) (string, error) {
+	number, ok := c[token]
+	if !ok {
+		return "", errors.New("token not found")
+	}
+	return number, nil
+}
+
+// card returns a card payment method for a number stored in cards
+func (c cardNumbers) card(number string) *models.PaymentMethod {
+	token := "tok_" + number
+	c[token] = number
+	return &models.PaymentMethod{Type: "card", Last4: number[len(number)-4:], VaultToken: token}
+}
+
+func TestSimulatorDeclines(t *testing.T) {
+	cards := cardNumbers{}
+	simulator := NewSimulator(cards)
+
+	tests := []struct {
+		number string
+		code   string
+	}{
+		{"4242424242424242", ""},
+		{"4000000000000002", CodeCardDeclined},
+		{"4000000000009995", CodeInsufficientFunds},
+		{"4000000000000069", CodeExpiredCard},
+		{"4000000000000127", CodeIncorrectCVC},
+		// Real cards that only share a test card's last four digits
+		{"5555555555550002", ""},
+		{"4111111111119995", ""},
+	}
+
+	for _, tt := range tests {
+		method := cards.card(tt.number)
+		result, err := simulator.Authorize(context.Background(), AuthorizeRequest{Amount: 1000, Currency: "usd", PaymentMethod: method, Capture: true})
+
+		if tt.code == "" {
+			if err != nil || result.Reference == "" {
+				t.Errorf("Expected %s to be approved, got %v", tt.number, err)
+			}
+			continue
+		}
+		var decline *DeclineError
+		if !errors.As(err, &decline) || decline.Code != tt.code {
+			t.Errorf("Expected %s to be declined with '%s', got %v", tt.number, tt.code, err)
+		}
+	}
+}
+
+func TestSimulatorCaptureAndRefund(t *testing.T) {
+	cards := cardNumbers{}
+	simulator := NewSimulator(cards)
+	ctx := context.Background()
+
+	// Authorize and partially capture
+	result, err := simulator.Authorize(ctx, AuthorizeRequest{Amount: 1000, Currency: "usd", PaymentMethod: &models.PaymentMethod{Last4: "4242"}})
+	if err != nil {
+		t.Fatalf("Failed to authorize: %v", err)
+	}
+	if _, err := simulator.Capture(ctx, result.Reference, 1500); err == nil {
+		t.Error("Expected error when capturing more than authorized")
+	}
+	if _, err := simulator.Capture(ctx, result.Reference, 600); err != nil {
+		t.Fatalf("Failed to capture: %v", err)
+	}
+
+	// Captured authorizations cannot be voided
+	if err := simulator.Void(ctx, result.Reference); err == nil {
+		t.Error("Expected error when voiding a captured authorization")
+	}
+
+	// Refunds are limited to the captured amount
+	if _, err := simulator.Refund(ctx, result.Reference, 600); err != nil {
+		t.Fatalf("Failed to refund: %v", err)
+	}
+	if _, err := simulator.Refund(ctx, result.Reference, 1); err == nil {
+		t.Error("Expected error when refunding more than captured")
+	}
+
+	// Refunds against the refund failure card always fail
+	result, err = simulator.Authorize(ctx, AuthorizeRequest{Amount: 1000, Currency: "usd", PaymentMethod: cards.card(RefundFailureCard), Capture: true})
+	if err != nil {
+		t.Fatalf("Failed to authorize: %v", err)
+	}
+	var decline *DeclineError
+	if _, err := simulator.Refund(ctx, result.Reference, 100); !errors.As(err, &decline) || decline.Code != CodeRefundFailed {
+		t.Errorf("Expected '%s', got %v", CodeRefundFailed, err)
+	}
+
+	// Other cards ending in the same digits refund normally
+	result, err = simulator.Authorize(ctx, AuthorizeRequest{Amount: 1000, Currency: "usd", PaymentMethod: cards.card("4111111111115126"), Capture: true})
+	if err != nil {
+		t.Fatalf("Failed to authorize: %v", err)
+	}
+	if _, err := simulator.Refund(ctx, result.Reference, 100); err != nil {
+		t.Errorf("Expected the refund to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+// Package search parses the query language used by the search endpoints, e.g.
+//
+//	email:"jane@" AND created>2025-01-01
+//	status:"succeeded" amount>=1000 OR -currency:"usd"
+//
+// A query is a list of clauses joined by AND (or whitespace) and OR, with AND
+// binding tighter. Each clause is a field, an operator and a value, and may be
+// negated with a leading '-'. The ':' operator matches a substring for text
+// fields and an exact value otherwise; numbers and dates also accept '=',
+// '>', '>=', '<' and '<='. Metadata is matched with metadata["key"]:"value".
+package search
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind determines which operators and values a field accepts
+type Kind int
+
+const (
+	// Text fields match substrings with ':' and whole values with '='
+	Text Kind = iota
+	// Keyword fields match whole values
+	Keyword
+	// Number fields hold integers and can be compared
+	Number
+	// Time fields hold dates or Unix timestamps and can be compared
+	Time
+	// Metadata fields match the value stored under a key
+	Metadata
+)
+
+// Operators
+const (
+	OpMatch = ":"
+	OpEqual = "="
+	OpGT    = ">"
+	OpGTE   = ">="
+	OpLT    = "<"
+	OpLTE   = "<="
+)
+
+// maxClauses bounds the size of a query
+const maxClauses = 10
+
+// metadataKey restricts metadata keys in queries to safe characters
+var metadataKey = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,40}$`)
+
+// Clause is a single condition on a field
+type Clause struct {
+	Field  string
+	Key    string // Metadata key, for Metadata fields
+	Kind   Kind
+	Op     string
+	Negate bool
+	// Value is a string for Text, Keyword and Metadata fields, an int64 for
+	// Number fields and a time.Time for Time fields
+	Value any
+	// Day is set when a Time value was given as a date, so ':' and '=' match
+	// the whole day
+	Day bool
+}
+
+// Query is a disjunction of conjunctions: it matches records that satisfy
+// every clause in at least one group
+type Query struct {
+	Groups [][]Clause
+}
+
+// Error reports a malformed query
+type Error struct {
+	Pos     int
+	Message string
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid search query at position %d: %s", e.Pos, e.Message)
+}
+
+// Parse parses a query, checking it against the searchable fields
+func Parse(query string, fields map[string]Kind) (*Query, error) {
+	p := &parser{input: query, fields: fields}
+	return p.parse()
+}
+
+// parser is a hand-written recursive descent parser over the query string
+type parser struct {
+	input   string
+	pos     int
+	fields  map[string]Kind
+	clauses int
+}
+
+// parse parses the whole input
+func (p *parser) parse() (*Query, error) {
+	p.skipSpace()
+	if p.pos == len(p.input) {
+		return nil, p.errorf("query is empty")
+	}
+
+	q := &Query{}
+	group := []Clause{}
+	for {
+		clause, err := p.clause()
+		if err != nil {
+			return nil, err
+		}
+		group = append(group, *clause)
+
+		p.skipSpace()
+		if p.pos == len(p.input) {
+			break
+		}
+		switch {
+		case p.keyword("OR"):
+			q.Groups = append(q.Groups, group)
+			group = []Clause{}
+		case p.keyword("AND"):
+		}
+		p.skipSpace()
+		if p.pos == len(p.input) {
+			return nil, p.errorf("expected a clause after the operator")
+		}
+	}
+	q.Groups = append(q.Groups, group)
+	return q, nil
+}
+
+// clause parses [-]field[["key"]]op value
+func (p *parser) clause() (*Clause, error) {
+	p.clauses++
+	if p.clauses > maxClauses {
+		return nil, p.errorf("query has more than %d clauses", maxClauses)
+	}
+
+	c := &Clause{}
+	if p.peek() == '-' {
+		c.Negate = true
+		p.pos++
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && isFieldChar(p.input[p.pos]) {
+		p.pos++
+	}
+	c.Field = p.input[start:p.pos]
+	kind, ok := p.fields[c.Field]
+	if !ok {
+		p.pos = start
+		return nil, p.errorf("unknown field %q", c.Field)
+	}
+	c.Kind = kind
+
+	if kind == Metadata {
+		if p.peek() != '[' {
+			return nil, p.errorf(`expected ["key"] after %s`, c.Field)
+		}
+		p.pos++
+		key, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		if !metadataKey.MatchString(key) {
+			return nil, p.errorf("invalid metadata key %q", key)
+		}
+		if p.peek() != ']' {
+			return nil, p.errorf("expected ]")
+		}
+		p.pos++
+		c.Key = key
+	}
+
+	c.Op = p.operator()
+	if c.Op == "" {
+		return nil, p.errorf("expected an operator after %s", c.Field)
+	}
+	if c.Op != OpMatch && c.Op != OpEqual && kind != Number && kind != Time {
+		return nil, p.errorf("%s only supports the : operator", c.Field)
+	}
+
+	valuePos := p.pos
+	raw, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.convert(raw); err != nil {
+		p.pos = valuePos
+		return nil, p.errorf("%v", err)
+	}
+	return c, nil
+}
+
+// convert sets the clause's typed value from its raw text
+func (c *Clause) convert(raw string) error {
+	switch c.Kind {
+	case Number:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", c.Field)
+		}
+		c.Value = n
+	case Time:
+		t, day, err := parseTime(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be a date (YYYY-MM-DD), RFC 3339 time or Unix timestamp", c.Field)
+		}
+		c.Value, c.Day = t, day
+	default:
+		if raw == "" {
+			return fmt.Errorf("%s needs a value", c.Field)
+		}
+		c.Value = raw
+	}
+	return nil
+}
+
+// parseTime parses a date, RFC 3339 time or Unix timestamp, reporting whether
+// it was a date
+func parseTime(raw string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, false, nil
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(n, 0), false, nil
+}
+
+// operator consumes a comparison operator
+func (p *parser) operator() string {
+	for _, op := range []string{OpGTE, OpLTE, OpMatch, OpEqual, OpGT, OpLT} {
+		if strings.HasPrefix(p.input[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+// value consumes a quoted string or a bare token
+func (p *parser) value() (string, error) {
+	if p.peek() == '"' {
+		return p.quoted()
+	}
+	start := p.pos
+	for p.pos < len(p.input) && !isSpace(p.input[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a value")
+	}
+	return p.input[start:p.pos], nil
+}
+
+// quoted consumes a double-quoted string; \" and \\ are escapes
+func (p *parser) quoted() (string, error) {
+	if p.peek() != '"' {
+		return "", p.errorf(`expected "`)
+	}
+	start := p.pos
+	p.pos++
+
+	var b strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		switch {
+		case c == '\\' && p.pos+1 < len(p.input):
+			b.WriteByte(p.input[p.pos+1])
+			p.pos += 2
+		case c == '"':
+			p.pos++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+// keyword consumes a case-sensitive keyword followed by whitespace
+func (p *parser) keyword(word string) bool {
+	end := p.pos + len(word)
+	if end < len(p.input) && p.input[p.pos:end] == word && isSpace(p.input[end]) {
+		p.pos = end
+		return true
+	}
+	return false
+}
+
+// peek returns the next byte without consuming it, or 0 at the end
+func (p *parser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+// skipSpace consumes whitespace
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && isSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// errorf returns an *Error at the current position
+func (p *parser) errorf(format string, args ...any) error {
+	return &Error{Pos: p.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+// isSpace reports whether c separates tokens
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isFieldChar reports whether c can appear in a field name
+func isFieldChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,72 @@
+package search
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var testFields = map[string]Kind{
+	"email":    Text,
+	"status":   Keyword,
+	"amount":   Number,
+	"created":  Time,
+	"metadata": Metadata,
+}
+
+func TestParse(t *testing.T) {
+	q, err := Parse(`email:"jane@" AND created>2025-01-01 amount>=1000 OR -status:failed metadata["order_id"]:"12 3"`, testFields)
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+	if len(q.Groups) != 2 || len(q.Groups[0]) != 3 || len(q.Groups[1]) != 2 {
+		t.Fatalf("Expected groups of 3 and 2 clauses, got %+v", q.Groups)
+	}
+
+	email := q.Groups[0][0]
+	if email.Field != "email" || email.Op != OpMatch || email.Value != "jane@" {
+		t.Errorf("Unexpected email clause: %+v", email)
+	}
+	created := q.Groups[0][1]
+	if created.Op != OpGT || !created.Day || !created.Value.(time.Time).Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected created clause: %+v", created)
+	}
+	amount := q.Groups[0][2]
+	if amount.Op != OpGTE || amount.Value != int64(1000) {
+		t.Errorf("Unexpected amount clause: %+v", amount)
+	}
+	status := q.Groups[1][0]
+	if !status.Negate || status.Value != "failed" {
+		t.Errorf("Unexpected status clause: %+v", status)
+	}
+	metadata := q.Groups[1][1]
+	if metadata.Key != "order_id" || metadata.Value != "12 3" {
+		t.Errorf("Unexpected metadata clause: %+v", metadata)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	queries := []string{
+		``,
+		`   `,
+		`phone:"123"`,
+		`email`,
+		`email:`,
+		`email:"unterminated`,
+		`email>"a"`,
+		`amount>lots`,
+		`created:yesterday`,
+		`metadata:"x"`,
+		`metadata["bad key"]:"x"`,
+		`email:"a" AND`,
+		`email:"a" OR `,
+		`status:a status:b status:c status:d status:e status:f status:g status:h status:i status:j status:k`,
+	}
+	for _, query := range queries {
+		_, err := Parse(query, testFields)
+		var searchErr *Error
+		if !errors.As(err, &searchErr) {
+			t.Errorf("Parse(%q): expected *Error, got %v", query, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package statemachine defines the legal status transitions for payments and refunds.
+package statemachine
+
+import (
+	"fmt"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+)
+
+// Machine describes the statuses a resource can be created in and the
+// statuses each status can move to
+type Machine struct {
+	resource    string
+	initial     map[string]bool
+	transitions map[string]map[string]bool
+}
+
+// TransitionError reports an attempt to move a resource to a status that is
+// not reachable from its current one
+type TransitionError struct {
+	Resource string
+	From     string
+	To       string
+}
+
+// Error implements the error interface
+func (e *TransitionError) Error() string {
+	if e.From == "" {
+		return fmt.Sprintf("%s cannot be created with status %q", e.Resource, e.To)
+	}
+	return fmt.Sprintf("%s cannot transition from %q to %q", e.Resource, e.From, e.To)
+}
+
+// Payment is the payment status machine:
+//
+//	pending → requires_capture → succeeded → partially_refunded → refunded
+//	pending → succeeded, failed or canceled
+//	requires_capture → canceled
+var Payment = New("payment",
+	[]string{
+		models.PaymentStatusPending,
+		models.PaymentStatusRequiresCapture,
+		models.PaymentStatusSucceeded,
+		models.PaymentStatusFailed,
+	},
+	map[string][]string{
+		models.PaymentStatusPending: {
+			models.PaymentStatusRequiresCapture,
+			models.PaymentStatusSucceeded,
+			models.PaymentStatusFailed,
+			models.PaymentStatusCanceled,
+		},
+		models.PaymentStatusRequiresCapture: {
+			models.PaymentStatusSucceeded,
+			models.PaymentStatusCanceled,
+		},
+		models.PaymentStatusSucceeded: {
+			models.PaymentStatusPartiallyRefunded,
+			models.PaymentStatusRefunded,
+		},
+		models.PaymentStatusPartiallyRefunded: {
+			models.PaymentStatusRefunded,
+		},
+	},
+)
+
+// Refund is the refund status machine: pending → succeeded or failed
+var Refund = New("refund",
+	[]string{
+		models.RefundStatusPending,
+		models.RefundStatusSucceeded,
+		models.RefundStatusFailed,
+	},
+	map[string][]string{
+		models.RefundStatusPending: {
+			models.RefundStatusSucceeded,
+			models.RefundStatusFailed,
+		},
+	},
+)
+
+// New creates a status machine from its initial statuses and transitions
+func New(resource string, initial []string, transitions map[string][]string) *Machine {
+	m := &Machine{
+		resource:    resource,
+		initial:     make(map[string]bool, len(initial)),
+		transitions: make(map[string]map[string]bool, len(transitions)),
+	}
+	for _, status := range initial {
+		m.initial[status] = true
+	}
+	for from, targets := range transitions {
+		m.transitions[from] = make(map[string]bool, len(targets))
+		for _, to := range targets {
+			m.transitions[from][to] = true
+		}
+	}
+	return m
+}
+
+// CanTransition reports whether a resource may move from one status to
+// another. An empty from status checks whether the resource may be created
+// with the to status.
+func (m *Machine) CanTransition(from, to string) bool {
+	if from == "" {
+		return m.initial[to]
+	}
+	return m.transitions[from][to]
+}
+
+// Validate returns a *TransitionError if the transition is not allowed
+func (m *Machine) Validate(from, to string) error {
+	if !m.CanTransition(from, to) {
+		return &TransitionError{Resource: m.resource, From: from, To: to}
+	}
+	return nil
+}
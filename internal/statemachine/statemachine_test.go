@@ -0,0 +1,53 @@
+package statemachine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jeffgrover/payment-api/internal/models"
+)
+
+func TestPaymentTransitions(t *testing.T) {
+	tests := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{"", models.PaymentStatusPending, true},
+		{"", models.PaymentStatusRequiresCapture, true},
+		{"", models.PaymentStatusRefunded, false},
+		{models.PaymentStatusPending, models.PaymentStatusRequiresCapture, true},
+		{models.PaymentStatusPending, models.PaymentStatusFailed, true},
+		{models.PaymentStatusRequiresCapture, models.PaymentStatusSucceeded, true},
+		{models.PaymentStatusRequiresCapture, models.PaymentStatusCanceled, true},
+		{models.PaymentStatusRequiresCapture, models.PaymentStatusFailed, false},
+		{models.PaymentStatusSucceeded, models.PaymentStatusPartiallyRefunded, true},
+		{models.PaymentStatusSucceeded, models.PaymentStatusCanceled, false},
+		{models.PaymentStatusPartiallyRefunded, models.PaymentStatusRefunded, true},
+		{models.PaymentStatusRefunded, models.PaymentStatusSucceeded, false},
+		{models.PaymentStatusCanceled, models.PaymentStatusSucceeded, false},
+		{models.PaymentStatusFailed, models.PaymentStatusPending, false},
+	}
+
+	for _, tt := range tests {
+		if got := Payment.CanTransition(tt.from, tt.to); got != tt.allowed {
+			t.Errorf("CanTransition(%q, %q) = %v, expected %v", tt.from, tt.to, got, tt.allowed)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// Legal transitions return no error
+	if err := Refund.Validate(models.RefundStatusPending, models.RefundStatusSucceeded); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	// Illegal transitions return a TransitionError
+	err := Refund.Validate(models.RefundStatusSucceeded, models.RefundStatusPending)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Fatalf("Expected TransitionError, got %v", err)
+	}
+	if transitionErr.Resource != "refund" || transitionErr.From != models.RefundStatusSucceeded || transitionErr.To != models.RefundStatusPending {
+		t.Errorf("Unexpected TransitionError fields: %+v", transitionErr)
+	}
+}
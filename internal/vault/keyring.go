@@ -0,0 +1,102 @@
+package vault
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the size in bytes of key-encryption and fingerprint keys (AES-256)
+const KeySize = 32
+
+// Keyring holds the key-encryption keys (KEKs) that protect stored card
+// numbers and the key used to fingerprint them. New cards are encrypted under
+// the primary KEK; older KEKs are kept so existing cards can be decrypted
+// until they are rotated.
+type Keyring struct {
+	primary        string
+	keys           map[string][]byte
+	fingerprintKey []byte
+}
+
+// NewKeyring creates a keyring. The primary key ID must be present in keys.
+func NewKeyring(primary string, keys map[string][]byte, fingerprintKey []byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q not found", primary)
+	}
+	for id, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key %q must be %d bytes, got %d", id, KeySize, len(key))
+		}
+	}
+	if len(fingerprintKey) != KeySize {
+		return nil, fmt.Errorf("fingerprint key must be %d bytes, got %d", KeySize, len(fingerprintKey))
+	}
+	return &Keyring{primary: primary, keys: keys, fingerprintKey: fingerprintKey}, nil
+}
+
+// ParseKeyring creates a keyring from configuration strings. keys is a
+// comma-separated list of id:base64 pairs with the primary key first, e.g.
+// "2024-06:<base64>,2023-01:<base64>"; fingerprintKey is base64.
+func ParseKeyring(keys, fingerprintKey string) (*Keyring, error) {
+	if keys == "" {
+		return nil, errors.New("no keys configured")
+	}
+
+	var primary string
+	parsed := make(map[string][]byte)
+	for _, entry := range strings.Split(keys, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key entry %q must be id:base64", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if _, ok := parsed[id]; ok {
+			return nil, fmt.Errorf("duplicate key %q", id)
+		}
+		if primary == "" {
+			primary = id
+		}
+		parsed[id] = key
+	}
+
+	fingerprint, err := base64.StdEncoding.DecodeString(fingerprintKey)
+	if err != nil {
+		return nil, fmt.Errorf("fingerprint key: %w", err)
+	}
+	return NewKeyring(primary, parsed, fingerprint)
+}
+
+// GenerateKeyring creates a keyring with random keys. Cards stored under it
+// cannot be decrypted once the keyring is lost, so it is only suitable for
+// tests and local development.
+func GenerateKeyring() (*Keyring, error) {
+	kek, err := randomBytes(KeySize)
+	if err != nil {
+		return nil, err
+	}
+	fingerprintKey, err := randomBytes(KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring("generated", map[string][]byte{"generated": kek}, fingerprintKey)
+}
+
+// Primary returns the ID of the key new cards are encrypted under
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// randomBytes returns n bytes from the system's secure random source
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
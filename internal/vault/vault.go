@@ -0,0 +1,214 @@
+// Package vault stores card numbers encrypted at rest and hands out opaque
+// tokens in their place, so the rest of the API never holds a raw PAN.
+//
+// Each card is encrypted with AES-256-GCM under its own random data key, and
+// the data key is in turn encrypted under a key-encryption key (KEK) from the
+// Keyring. Security codes are never stored.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrTokenNotFound is returned when no card is stored under a token
+	ErrTokenNotFound = errors.New("vault token not found")
+
+	// ErrUnknownKey is returned when a card is encrypted under a KEK that is
+	// not in the keyring
+	ErrUnknownKey = errors.New("card is encrypted under an unknown key")
+)
+
+// Card is a stored card as seen by the rest of the API
+type Card struct {
+	// Token identifies the card in the vault
+	Token string
+	// Fingerprint is the same for every copy of a card number, so duplicates
+	// can be detected without decrypting
+	Fingerprint string
+}
+
+// record is a vaulted card number
+type record struct {
+	Token       string `gorm:"primaryKey"`
+	KeyID       string `gorm:"index"`
+	WrappedKey  []byte // Data key encrypted under the KEK, prefixed by its nonce
+	Ciphertext  []byte // Card number encrypted under the data key, prefixed by its nonce
+	Fingerprint string `gorm:"index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// TableName overrides the table name used by GORM to `vault_cards`
+func (record) TableName() string {
+	return "vault_cards"
+}
+
+// Vault encrypts and stores card numbers
+type Vault struct {
+	db   *gorm.DB
+	keys *Keyring
+}
+
+// New creates a vault backed by the given database, creating its table if needed
+func New(db *gorm.DB, keys *Keyring) (*Vault, error) {
+	if err := db.AutoMigrate(&record{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate vault: %w", err)
+	}
+	return &Vault{db: db, keys: keys}, nil
+}
+
+// Store encrypts and saves a card number and returns its token and fingerprint
+func (v *Vault) Store(number string) (*Card, error) {
+	token, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	rec := &record{
+		Token:       "tok_" + hex.EncodeToString(token),
+		Fingerprint: v.Fingerprint(number),
+	}
+	if err := v.seal(rec, number); err != nil {
+		return nil, err
+	}
+	if err := v.db.Create(rec).Error; err != nil {
+		return nil, err
+	}
+	return &Card{Token: rec.Token, Fingerprint: rec.Fingerprint}, nil
+}
+
+// Reveal decrypts the card number stored under a token. It should only be
+// called by processors that need to send the number to a gateway.
+func (v *Vault) Reveal(token string) (string, error) {
+	var rec record
+	if err := v.db.First(&rec, "token = ?", token).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return "", ErrTokenNotFound
+		}
+		return "", err
+	}
+	return v.open(&rec)
+}
+
+// Delete removes a stored card
+func (v *Vault) Delete(token string) error {
+	return v.db.Delete(&record{}, "token = ?", token).Error
+}
+
+// Fingerprint returns a keyed hash of a card number that identifies the card
+// without revealing it
+func (v *Vault) Fingerprint(number string) string {
+	mac := hmac.New(sha256.New, v.keys.fingerprintKey)
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Rotate re-encrypts every card that is not under the primary KEK with a new
+// data key under the primary KEK, and returns the number of cards rotated.
+// Once it completes the old KEKs can be removed from the keyring.
+func (v *Vault) Rotate() (int, error) {
+	var stale []record
+	if err := v.db.Where("key_id <> ?", v.keys.primary).Find(&stale).Error; err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for i := range stale {
+		rec := &stale[i]
+		number, err := v.open(rec)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to decrypt %s: %w", rec.Token, err)
+		}
+		if err := v.seal(rec, number); err != nil {
+			return rotated, err
+		}
+		if err := v.db.Model(rec).Select("key_id", "wrapped_key", "ciphertext").Updates(rec).Error; err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+// seal encrypts a card number into a record under a new data key wrapped by
+// the primary KEK. The token is bound to the ciphertext as additional data so
+// ciphertexts cannot be swapped between records.
+func (v *Vault) seal(rec *record, number string) error {
+	dataKey, err := randomBytes(KeySize)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := encrypt(dataKey, []byte(number), []byte(rec.Token))
+	if err != nil {
+		return err
+	}
+	wrapped, err := encrypt(v.keys.keys[v.keys.primary], dataKey, []byte(rec.Token))
+	if err != nil {
+		return err
+	}
+	rec.KeyID = v.keys.primary
+	rec.WrappedKey = wrapped
+	rec.Ciphertext = ciphertext
+	return nil
+}
+
+// open decrypts the card number in a record
+func (v *Vault) open(rec *record) (string, error) {
+	kek, ok := v.keys.keys[rec.KeyID]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	dataKey, err := decrypt(kek, rec.WrappedKey, []byte(rec.Token))
+	if err != nil {
+		return "", err
+	}
+	number, err := decrypt(dataKey, rec.Ciphertext, []byte(rec.Token))
+	if err != nil {
+		return "", err
+	}
+	return string(number), nil
+}
+
+// encrypt seals plaintext with AES-GCM and prefixes the random nonce
+func encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// decrypt opens a nonce-prefixed AES-GCM ciphertext
+func decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, additionalData)
+}
+
+// newGCM creates an AES-GCM cipher for a key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,150 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/jeffgrover/payment-api/internal/db"
+)
+
+// Setup test vault
+func setupTestVault(t *testing.T, keys *Keyring) *Vault {
+	t.Helper()
+
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	v, err := New(database.DB, keys)
+	if err != nil {
+		t.Fatalf("Failed to create vault: %v", err)
+	}
+	return v
+}
+
+// testKey returns a deterministic key filled with b
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestStoreAndReveal(t *testing.T) {
+	keys, err := GenerateKeyring()
+	if err != nil {
+		t.Fatalf("Failed to generate keyring: %v", err)
+	}
+	v := setupTestVault(t, keys)
+
+	card, err := v.Store("4242424242424242")
+	if err != nil {
+		t.Fatalf("Failed to store card: %v", err)
+	}
+	if card.Token == "" || card.Fingerprint == "" {
+		t.Fatalf("Expected token and fingerprint, got %+v", card)
+	}
+
+	// The card number is not stored in the clear
+	var rec record
+	if err := v.db.First(&rec, "token = ?", card.Token).Error; err != nil {
+		t.Fatalf("Failed to load record: %v", err)
+	}
+	if bytes.Contains(rec.Ciphertext, []byte("4242424242424242")) {
+		t.Error("Expected card number to be encrypted")
+	}
+
+	number, err := v.Reveal(card.Token)
+	if err != nil {
+		t.Fatalf("Failed to reveal card: %v", err)
+	}
+	if number != "4242424242424242" {
+		t.Errorf("Expected revealed number to match, got %s", number)
+	}
+
+	// Fingerprints are stable for the same number and differ between numbers
+	if v.Fingerprint("4242424242424242") != card.Fingerprint {
+		t.Error("Expected fingerprint to be stable")
+	}
+	if v.Fingerprint("5555555555554444") == card.Fingerprint {
+		t.Error("Expected different cards to have different fingerprints")
+	}
+
+	// Deleted cards cannot be revealed
+	if err := v.Delete(card.Token); err != nil {
+		t.Fatalf("Failed to delete card: %v", err)
+	}
+	if _, err := v.Reveal(card.Token); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	oldKeys, err := NewKeyring("old", map[string][]byte{"old": testKey(1)}, testKey(9))
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	v := setupTestVault(t, oldKeys)
+	card, err := v.Store("378282246310005")
+	if err != nil {
+		t.Fatalf("Failed to store card: %v", err)
+	}
+
+	// Add a new primary key and rotate
+	v.keys, err = NewKeyring("new", map[string][]byte{"new": testKey(2), "old": testKey(1)}, testKey(9))
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	rotated, err := v.Rotate()
+	if err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+	if rotated != 1 {
+		t.Errorf("Expected 1 card rotated, got %d", rotated)
+	}
+
+	// The old key is no longer needed
+	v.keys, err = NewKeyring("new", map[string][]byte{"new": testKey(2)}, testKey(9))
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	number, err := v.Reveal(card.Token)
+	if err != nil {
+		t.Fatalf("Failed to reveal rotated card: %v", err)
+	}
+	if number != "378282246310005" {
+		t.Errorf("Expected revealed number to match, got %s", number)
+	}
+	if rotated, _ := v.Rotate(); rotated != 0 {
+		t.Errorf("Expected nothing left to rotate, got %d", rotated)
+	}
+
+	// Cards under a key that was removed before rotation cannot be read
+	v.keys, _ = NewKeyring("other", map[string][]byte{"other": testKey(3)}, testKey(9))
+	if _, err := v.Reveal(card.Token); err != ErrUnknownKey {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	encode := func(b byte) string { return base64.StdEncoding.EncodeToString(testKey(b)) }
+
+	keys, err := ParseKeyring("new:"+encode(2)+", old:"+encode(1), encode(9))
+	if err != nil {
+		t.Fatalf("Failed to parse keyring: %v", err)
+	}
+	if keys.Primary() != "new" || len(keys.keys) != 2 {
+		t.Errorf("Expected primary new with 2 keys, got %s with %d", keys.Primary(), len(keys.keys))
+	}
+
+	invalid := []struct{ keys, fingerprint string }{
+		{"", encode(9)},
+		{"new", encode(9)},
+		{"new:" + base64.StdEncoding.EncodeToString([]byte("short")), encode(9)},
+		{"new:" + encode(2) + ",new:" + encode(1), encode(9)},
+		{"new:" + encode(2), ""},
+	}
+	for _, tt := range invalid {
+		if _, err := ParseKeyring(tt.keys, tt.fingerprint); err == nil {
+			t.Errorf("Expected error for keys %q", tt.keys)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Package webhooks signs, sends and schedules retries of webhook events.
+// Every request carries a Signature header of the form t=<unix time>,v1=<hex>
+// where the hex value is the HMAC-SHA256 of "<unix time>.<body>" keyed with
+// the endpoint's secret. Receivers recompute it with Verify and reject
+// requests whose timestamp is too old, so captured requests cannot be
+// replayed.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// SignatureHeader is the header carrying an event's signature
+	SignatureHeader = "Signature"
+
+	// SecretPrefix is the prefix of endpoint signing secrets
+	SecretPrefix = "whsec_"
+
+	// DefaultTolerance is how old a signature's timestamp may be before
+	// Verify rejects it as a possible replay
+	DefaultTolerance = 5 * time.Minute
+
+	// RetryPeriod is how long after an event is created its delivery is
+	// retried before it is given up on
+	RetryPeriod = 3 * 24 * time.Hour
+
+	// firstRetryDelay is the wait after the first failed attempt; each
+	// following wait is twice as long, up to maxRetryDelay
+	firstRetryDelay = time.Minute
+	maxRetryDelay   = 12 * time.Hour
+
+	// maxResponseBody is how much of an endpoint's response is kept
+	maxResponseBody = 1024
+)
+
+// Errors returned by Verify
+var (
+	ErrInvalidSignature = errors.New("webhook signature does not match")
+	ErrMalformedHeader  = errors.New("malformed webhook signature header")
+	ErrTimestampTooOld  = errors.New("webhook timestamp is outside the tolerance")
+)
+
+// ErrPrivateAddress is returned when a webhook URL resolves to an address
+// that is not publicly routable
+var ErrPrivateAddress = errors.New("webhook URL resolves to a private, loopback or link-local address")
+
+// reservedPrefixes are ranges that are not publicly routable but that the
+// netip predicates do not cover
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space (CGNAT)
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, which can reach IPv4 private ranges
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+}
+
+// NewSecret returns a new random endpoint signing secret
+func NewSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return SecretPrefix + hex.EncodeToString(b), nil
+}
+
+// Sign returns the Signature header value for a payload sent at a time
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac(secret, t, payload))
+}
+
+// Verify checks a Signature header against a payload. It fails if no v1
+// signature matches or the timestamp is more than tolerance away from now.
+func Verify(header, secret string, payload []byte, tolerance time.Duration, now time.Time) error {
+	var t string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrMalformedHeader
+		}
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			signature, err := hex.DecodeString(value)
+			if err != nil {
+				return ErrMalformedHeader
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrMalformedHeader
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return ErrTimestampTooOld
+	}
+
+	expected := mac(secret, t, payload)
+	for _, signature := range signatures {
+		if hmac.Equal(signature, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// mac computes the HMAC-SHA256 of a timestamp and payload
+func mac(secret, timestamp string, payload []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// NextAttempt returns when to retry an event created at created after its
+// attempts-th failed delivery, waiting twice as long after each failure. It
+// returns false once the retry would fall outside RetryPeriod.
+func NextAttempt(created time.Time, attempts int, now time.Time) (time.Time, bool) {
+	delay := maxRetryDelay
+	if attempts < 32 {
+		delay = min(firstRetryDelay<<(attempts-1), maxRetryDelay)
+	}
+	next := now.Add(delay)
+	if next.After(created.Add(RetryPeriod)) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// Response is the outcome of sending an event to an endpoint
+type Response struct {
+	StatusCode int
+	// Body is the start of the endpoint's response body
+	Body string
+}
+
+// Succeeded reports whether the endpoint accepted the event with a 2xx status
+func (r *Response) Succeeded() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// PrivateAddress reports whether events must not be sent to an address
+// because it is not publicly routable: loopback, private, link-local (which
+// includes cloud metadata services such as 169.254.169.254), unspecified,
+// multicast, shared (CGNAT) or otherwise reserved
+func PrivateAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || !ip.IsGlobalUnicast() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckHost resolves a URL's host and returns ErrPrivateAddress if any of its
+// addresses is private. Sender checks the address it connects to as well,
+// since DNS can change between the two.
+func CheckHost(ctx context.Context, host string) error {
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		if PrivateAddress(ip) {
+			return ErrPrivateAddress
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", host, err)
+	}
+	for _, ip := range addrs {
+		if PrivateAddress(ip) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// Sender POSTs signed events to endpoints
+type Sender struct {
+	Client *http.Client
+}
+
+// NewSender returns a sender that gives up on endpoints after 10 seconds.
+// Unless allowPrivate is set, it refuses to connect to private addresses,
+// including after redirects, so that endpoints cannot be used to reach
+// internal services.
+func NewSender(allowPrivate bool) *Sender {
+	if allowPrivate {
+		return &Sender{Client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if PrivateAddress(addr.Addr()) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+	// No proxy, since the dialer would then only check the proxy's address
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Sender{Client: &http.Client{Timeout: 10 * time.Second, Transport: transport}}
+}
+
+// Send POSTs a JSON payload to a URL, signed with the endpoint's secret. An
+// error is only returned if no response was received.
+func (s *Sender) Send(ctx context.Context, url, secret string, payload []byte, now time.Time) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PaymentsAPI-Webhooks/1.0")
+	req.Header.Set(SignatureHeader, Sign(secret, now, payload))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	return &Response{StatusCode: resp.StatusCode, Body: string(body)}, nil
+}
@@ -0,0 +1,179 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	if !strings.HasPrefix(secret, SecretPrefix) {
+		t.Errorf("Expected secret to start with %s, got %q", SecretPrefix, secret)
+	}
+
+	now := time.Unix(1700000000, 0)
+	payload := []byte(`{"id":"evt_1","type":"payment.succeeded"}`)
+	header := Sign(secret, now, payload)
+	if !strings.HasPrefix(header, "t=1700000000,v1=") {
+		t.Errorf("Unexpected header %q", header)
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		secret  string
+		payload []byte
+		now     time.Time
+		want    error
+	}{
+		{"valid", header, secret, payload, now, nil},
+		{"within tolerance", header, secret, payload, now.Add(DefaultTolerance), nil},
+		{"replayed later", header, secret, payload, now.Add(DefaultTolerance + time.Second), ErrTimestampTooOld},
+		{"from the future", header, secret, payload, now.Add(-DefaultTolerance - time.Second), ErrTimestampTooOld},
+		{"other secret", header, "whsec_other", payload, now, ErrInvalidSignature},
+		{"tampered payload", header, secret, []byte(`{"id":"evt_2"}`), now, ErrInvalidSignature},
+		{"tampered timestamp", strings.Replace(header, "t=1700000000", "t=1700000001", 1), secret, payload, now, ErrInvalidSignature},
+		{"second signature matches", "t=1700000000,v1=00," + strings.TrimPrefix(header, "t=1700000000,"), secret, payload, now, nil},
+		{"no signature", "t=1700000000", secret, payload, now, ErrMalformedHeader},
+		{"no timestamp", "v1=00", secret, payload, now, ErrMalformedHeader},
+		{"garbage", "nonsense", secret, payload, now, ErrMalformedHeader},
+	}
+	for _, tt := range tests {
+		if err := Verify(tt.header, tt.secret, tt.payload, DefaultTolerance, tt.now); err != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestNextAttempt(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+
+	// Waits double after each failure
+	now := created
+	var waits []time.Duration
+	for attempts := 1; ; attempts++ {
+		next, ok := NextAttempt(created, attempts, now)
+		if !ok {
+			break
+		}
+		waits = append(waits, next.Sub(now))
+		now = next
+	}
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute} {
+		if waits[i] != want {
+			t.Errorf("Retry %d: expected to wait %v, got %v", i+1, want, waits[i])
+		}
+	}
+	if last := waits[len(waits)-1]; last != maxRetryDelay {
+		t.Errorf("Expected waits to be capped at %v, got %v", maxRetryDelay, last)
+	}
+
+	// Retries stop after the retry period
+	if now.After(created.Add(RetryPeriod)) || now.Add(maxRetryDelay).Before(created.Add(RetryPeriod)) {
+		t.Errorf("Expected the last retry within %v of the end of the retry period, got %v", maxRetryDelay, now.Sub(created))
+	}
+	if _, ok := NextAttempt(created, 1000, created.Add(RetryPeriod)); ok {
+		t.Error("Expected no retry after the retry period")
+	}
+}
+
+func TestSend(t *testing.T) {
+	var signature, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, signature = string(b), r.Header.Get(SignatureHeader)
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(strings.Repeat("x", 2*maxResponseBody)))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	payload := []byte(`{"id":"evt_1"}`)
+	resp, err := NewSender(true).Send(context.Background(), server.URL, "whsec_test", payload, now)
+	if err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError || resp.Succeeded() {
+		t.Errorf("Expected a failed 500 response, got %d", resp.StatusCode)
+	}
+	if len(resp.Body) != maxResponseBody {
+		t.Errorf("Expected the response body truncated to %d bytes, got %d", maxResponseBody, len(resp.Body))
+	}
+	if body != string(payload) {
+		t.Errorf("Expected payload %s, got %s", payload, body)
+	}
+	if err := Verify(signature, "whsec_test", []byte(body), DefaultTolerance, now); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+
+	// Senders that block private addresses never connect to the loopback
+	// server, whatever the URL's host
+	body = ""
+	for _, url := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)} {
+		if _, err := NewSender(false).Send(context.Background(), url, "whsec_test", payload, now); !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("%s: expected ErrPrivateAddress, got %v", url, err)
+		}
+	}
+	if body != "" {
+		t.Errorf("Expected nothing sent to a private address, got %s", body)
+	}
+
+	// Unreachable endpoints return an error
+	server.Close()
+	if _, err := NewSender(true).Send(context.Background(), server.URL, "whsec_test", payload, now); err == nil {
+		t.Error("Expected an error sending to a closed server")
+	}
+}
+
+func TestPrivateAddress(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":          false,
+		"2606:2800:220:1::1":     false,
+		"127.0.0.1":              true,
+		"::1":                    true,
+		"10.1.2.3":               true,
+		"172.16.0.1":             true,
+		"192.168.1.1":            true,
+		"169.254.169.254":        true,
+		"fe80::1":                true,
+		"fd00:ec2::254":          true,
+		"0.0.0.0":                true,
+		"::":                     true,
+		"100.64.0.1":             true,
+		"224.0.0.1":              true,
+		"255.255.255.255":        true,
+		"::ffff:127.0.0.1":       true,
+		"::ffff:169.254.169.254": true,
+		"64:ff9b::a00:1":         true,
+	} {
+		if got := PrivateAddress(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: expected %v, got %v", addr, want, got)
+		}
+	}
+
+	for host, want := range map[string]error{
+		"93.184.216.34":     nil,
+		"169.254.169.254":   ErrPrivateAddress,
+		"[::1]":             ErrPrivateAddress,
+		"localhost":         ErrPrivateAddress,
+		"[::ffff:10.0.0.1]": ErrPrivateAddress,
+	} {
+		if err := CheckHost(context.Background(), host); err != want {
+			t.Errorf("%s: expected %v, got %v", host, want, err)
+		}
+	}
+}
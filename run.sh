@@ -10,7 +10,7 @@ function show_help {
     echo "  server    Run the application without building a binary"
     echo "  build     Build the application"
     echo "  test      Run unit tests"
-    echo "  e2e       Run end-to-end tests (handles setup/teardown automatically)"
+    echo "  e2e       Run end-to-end tests against a running server (needs API_KEY)"
     echo "  clean     Clean build artifacts"
     echo "  reset-db  Reset the database (delete payments.db)"
     echo "  dev       Run with hot reload using air (for development)"
@@ -28,25 +28,23 @@ fi
 case "$1" in
     server)
         echo "Running the application..."
-        go run cmd/server/main.go
+        go run -tags sqlite_fts5 cmd/server/main.go
         ;;
     run) # Keep 'run' for backward compatibility
         echo "Running the application... (Note: 'run' is deprecated, please use 'server' instead)"
-        go run cmd/server/main.go
+        go run -tags sqlite_fts5 cmd/server/main.go
         ;;
     build)
         echo "Building the application..."
-        go build -o payment-api ./cmd/server
+        go build -tags sqlite_fts5 -o payment-api ./cmd/server
         echo "Build complete. Run with ./payment-api"
         ;;
     test)
         echo "Running unit tests..."
-        go test ./...
+        go test -tags sqlite_fts5 ./...
         ;;
     e2e)
         echo "Running end-to-end tests..."
-        echo "Note: This will reset the database and restart the server automatically."
-        echo ""
         ./e2e_test.sh
         ;;
     clean)